@@ -0,0 +1,92 @@
+// Package acl implements client address and destination host matching and
+// scheduled access rules
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL allows or denies clients by address. Deny entries win; an empty allow
+// list admits every client that isn't denied.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// New parses CIDR or single-address entries
+func New(allow, deny []string) (*ACL, error) {
+	acl := &ACL{}
+	var err error
+	if acl.allow, err = ParseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = ParseNetworks(deny); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Allowed reports whether ip may use the proxy
+func (a *ACL) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	if ContainsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || ContainsIP(a.allow, ip)
+}
+
+// ParseNetworks converts "10.0.0.0/8", "fd00::/8", "192.168.1.5" or
+// "fe80::1%eth0" entries to networks
+func ParseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			entry, _, _ = strings.Cut(entry, "%") // Zones don't affect matching
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ContainsIP reports whether any network contains ip
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHost reports whether host equals or is a subdomain of any pattern.
+// Patterns may be written as "example.com", ".example.com" or "*.example.com",
+// and both sides are compared in canonical form (see CanonicalHost).
+func MatchHost(host string, patterns []string) bool {
+	host = CanonicalHost(host)
+	for _, pattern := range patterns {
+		pattern = CanonicalHost(strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), "."))
+		if host == pattern || strings.HasSuffix(host, "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
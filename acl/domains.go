@@ -0,0 +1,72 @@
+package acl
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// CanonicalHost returns host as rules match and logs show it: in lower case,
+// without a trailing dot and with internationalized labels in their ASCII
+// (punycode) form. "Bücher.example.", "xn--bcher-kva.example" and full-width
+// spellings compare equal once canonical. Hosts that are not valid names
+// are only lowered.
+func CanonicalHost(host string) string {
+	if !isASCII(host) {
+		if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+			host = ascii
+		}
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// UnicodeHost returns the Unicode form of a canonical host, for people to
+// spot lookalike names. Hosts without punycode labels come back as they are.
+func UnicodeHost(host string) string {
+	if !strings.Contains(host, "xn--") {
+		return host
+	}
+	if unicode, err := idna.Display.ToUnicode(host); err == nil {
+		return unicode
+	}
+	return host
+}
+
+// isASCII reports whether s needs no IDNA processing
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// DomainSet matches hosts against a large set of domains, including their
+// subdomains, in time proportional to the number of labels in the host
+type DomainSet map[string]struct{}
+
+// Add inserts domain, accepting the same spellings as MatchHost patterns
+func (s DomainSet) Add(domain string) {
+	domain = CanonicalHost(strings.TrimPrefix(strings.TrimPrefix(domain, "*"), "."))
+	if domain != "" {
+		s[domain] = struct{}{}
+	}
+}
+
+// Match reports whether host or one of its parent domains is in the set
+func (s DomainSet) Match(host string) bool {
+	host = CanonicalHost(host)
+	for host != "" {
+		if _, ok := s[host]; ok {
+			return true
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+	return false
+}
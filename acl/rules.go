@@ -0,0 +1,124 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Rule actions
+const (
+	ActionAllow = "allow"
+	ActionBlock = "block"
+)
+
+// Rule matches requests by client network, MAC address or host name, device
+// class, destination domain and schedule
+type Rule struct {
+	Name     string
+	Action   string
+	clients  []*net.IPNet
+	macs     []string // Canonical form, as net.HardwareAddr.String
+	hosts    []string // Lowercased glob patterns
+	domains  []string
+	groups   []string
+	devices  []string
+	schedule *Schedule
+}
+
+// NewRule creates a rule. Clients are addresses, networks or MAC addresses,
+// hosts are client host names with * wildcards. Empty clients and hosts,
+// domains, groups or devices match everything, and a nil schedule is always
+// active.
+func NewRule(name, action string, clients, hosts, domains, groups, devices []string, schedule *Schedule) (*Rule, error) {
+	if action != ActionAllow && action != ActionBlock {
+		return nil, fmt.Errorf("rule %s: invalid action %q", name, action)
+	}
+	var addresses, macs []string
+	for _, client := range clients {
+		if mac, err := net.ParseMAC(client); err == nil {
+			macs = append(macs, mac.String())
+		} else {
+			addresses = append(addresses, client)
+		}
+	}
+	networks, err := ParseNetworks(addresses)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", name, err)
+	}
+	var patterns []string
+	for _, host := range hosts {
+		pattern := strings.ToLower(host)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("rule %s: invalid host %q: %w", name, host, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return &Rule{Name: name, Action: action, clients: networks, macs: macs, hosts: patterns, domains: domains, groups: groups, devices: devices, schedule: schedule}, nil
+}
+
+// Match reports whether the rule applies to a request from client, known by
+// MAC address mac and host name clientName when not empty, a member of
+// groups using a device of class device, to host at t
+func (r *Rule) Match(client net.IP, mac, clientName string, groups []string, device, host string, t time.Time) bool {
+	if len(r.clients) > 0 || len(r.macs) > 0 || len(r.hosts) > 0 {
+		byIP := client != nil && ContainsIP(r.clients, client)
+		byMAC := mac != "" && slices.Contains(r.macs, mac)
+		if !byIP && !byMAC && !matchClientName(clientName, r.hosts) {
+			return false
+		}
+	}
+	if len(r.groups) > 0 && !inAnyGroup(groups, r.groups) {
+		return false
+	}
+	if len(r.devices) > 0 && !inAnyGroup([]string{device}, r.devices) {
+		return false
+	}
+	if len(r.domains) > 0 && !MatchHost(host, r.domains) {
+		return false
+	}
+	return r.schedule == nil || r.schedule.Active(t)
+}
+
+// Rules is an ordered rule list where the first match decides
+type Rules []*Rule
+
+// Evaluate returns the first rule matching the request, or nil
+func (rs Rules) Evaluate(client net.IP, mac, clientName string, groups []string, device, host string, t time.Time) *Rule {
+	for _, rule := range rs {
+		if rule.Match(client, mac, clientName, groups, device, host, t) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchClientName reports whether name matches any of patterns, ignoring
+// case. An unknown client matches none.
+func matchClientName(name string, patterns []string) bool {
+	if name == "" {
+		return false
+	}
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// inAnyGroup reports whether any of groups is in wanted, ignoring case
+func inAnyGroup(groups, wanted []string) bool {
+	for _, group := range groups {
+		for _, w := range wanted {
+			if strings.EqualFold(group, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package acl
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is a weekly time window, e.g. weekdays 09:00-17:00. A window whose
+// end is before its start runs overnight into the following day.
+type Schedule struct {
+	days     [7]bool
+	from, to int // Minutes since midnight
+	location *time.Location
+}
+
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// ParseSchedule builds a schedule from day names ("mon", "weekdays", ...; all
+// days when empty) and "HH:MM" bounds (all day when both are empty),
+// evaluated in location
+func ParseSchedule(days []string, from, to string, location *time.Location) (*Schedule, error) {
+	s := &Schedule{location: location}
+	if len(days) == 0 {
+		days = []string{"weekdays", "weekends"}
+	}
+	for _, name := range days {
+		weekdays, ok := dayNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("invalid day %q", name)
+		}
+		for _, day := range weekdays {
+			s.days[day] = true
+		}
+	}
+
+	if from == "" && to == "" {
+		s.from, s.to = 0, 24*60
+		return s, nil
+	}
+	var err error
+	if s.from, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if s.to, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseClock converts "HH:MM" to minutes since midnight; "24:00" is allowed
+func parseClock(value string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hour, &minute); err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return hour*60 + minute, nil
+}
+
+// Active reports whether t falls inside the window
+func (s *Schedule) Active(t time.Time) bool {
+	if s.location != nil {
+		t = t.In(s.location)
+	}
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+
+	if s.from <= s.to {
+		return s.days[day] && minute >= s.from && minute < s.to
+	}
+	// Overnight: the part after midnight belongs to the previous day's window
+	previous := (day + 6) % 7
+	return (s.days[day] && minute >= s.from) || (s.days[previous] && minute < s.to)
+}
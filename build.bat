@@ -47,7 +47,7 @@ if exist WinDivert64.sys (
 
 echo.
 echo Building for Windows...
-go build -o build\windivert-gateway.exe .
+go build -o build\windivert-gateway.exe .\cmd\gatelan
 
 if %ERRORLEVEL% EQU 0 (
     echo.
@@ -44,7 +44,7 @@ fi
 
 echo ""
 echo "Building for current platform..."
-go build -o build/windivert-gateway .
+go build -o build/windivert-gateway ./cmd/gatelan
 
 if [ $? -eq 0 ]; then
     echo ""
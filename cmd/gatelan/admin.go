@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// errNoAdminAPI is returned when neither the config nor -admin name an admin
+// API
+var errNoAdminAPI = errors.New("no admin API configured, set admin.addr or pass -admin")
+
+// adminAPI is the admin API of the running forwarder as reached from this
+// host, over HTTPS when admin.tls is set and with the credentials the config
+// sets for it
+type adminAPI struct {
+	base   string // Scheme and address
+	config config.AdminConfig
+	client *http.Client
+}
+
+// newAdminAPI reaches the admin API at addr, or at admin.addr of the config
+// when addr is empty. The config is still read for the credentials when addr
+// is given, but need not load then.
+func newAdminAPI(addr, configPath string) (*adminAPI, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil && addr == "" {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	return adminAPIOf(cfg, addr)
+}
+
+// adminAPIOf reaches the admin API of cfg at addr, or at admin.addr when addr
+// is empty
+func adminAPIOf(cfg *config.Config, addr string) (*adminAPI, error) {
+	api := &adminAPI{config: cfg.Admin, client: http.DefaultClient}
+	if addr == "" {
+		if api.config.Addr == "" {
+			return nil, errNoAdminAPI
+		}
+		addr = localAddr(api.config.Addr)
+	}
+	if !api.config.TLS.Enabled() {
+		api.base = "http://" + addr
+		return api, nil
+	}
+	tlsConfig, err := adminTLS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	api.base = "https://" + addr
+	api.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return api, nil
+}
+
+// adminTLS verifies the admin certificate as served to a loopback dial: for
+// the first ACME host, or for the name in the certificate file, which is
+// trusted along with the system roots so that self-signed ones work
+func adminTLS(cfg *config.Config) (*tls.Config, error) {
+	if cfg.Admin.TLS.ACME {
+		if len(cfg.ACME.Hosts) == 0 {
+			return nil, errors.New("admin.tls.acme needs acme.hosts")
+		}
+		return &tls.Config{ServerName: cfg.ACME.Hosts[0]}, nil
+	}
+	data, err := os.ReadFile(cfg.Admin.TLS.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin certificate: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	tlsConfig := &tls.Config{RootCAs: roots}
+	leaf := true
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse admin certificate: %w", err)
+		}
+		if leaf && len(cert.DNSNames) > 0 {
+			// Without a name the dialed address is verified, for
+			// certificates issued to IP addresses
+			tlsConfig.ServerName = cert.DNSNames[0]
+		}
+		leaf = false
+		roots.AddCert(cert)
+	}
+	return tlsConfig, nil
+}
+
+// get sends a GET for path with the admin credentials
+func (a *adminAPI) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case a.config.Token != "":
+		req.Header.Set("Authorization", "Bearer "+a.config.Token)
+	case a.config.Username != "":
+		req.SetBasicAuth(a.config.Username, a.config.Password)
+	}
+	return a.client.Do(req)
+}
+
+// getJSON decodes the JSON answer at path into v
+func (a *adminAPI) getJSON(ctx context.Context, path string, v any) error {
+	resp, err := a.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s%s answered %s", a.base, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
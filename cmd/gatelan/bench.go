@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// benchResult is the outcome of one benchmark request or tunnel
+type benchResult struct {
+	status  int
+	bytes   int64
+	elapsed time.Duration
+	err     error
+}
+
+// runBench drives load through the running forwarder: GET requests over
+// keep-alive connections, or with -tunnels one CONNECT tunnel per round. It
+// prints request rate, throughput and latency percentiles.
+func runBench(args []string, configPath string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	proxyAddr := flags.String("proxy", "", "forwarder address, the first TCP listener of the config when empty")
+	proxyUser := flags.String("user", "", "user:password for listeners with proxy authentication")
+	concurrency := flags.Int("concurrency", 10, "number of requests or tunnels in flight")
+	duration := flags.Duration("duration", 10*time.Second, "how long to run")
+	limit := flags.Int("requests", 0, "stop after this many requests or tunnels, run for the duration when 0")
+	tunnels := flags.Bool("tunnels", false, "open and close a CONNECT tunnel per round instead of sending GET requests")
+	timeout := flags.Duration("timeout", 30*time.Second, "time allowed for each request or tunnel")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gatelan [-config file] bench [flags] url")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one target URL")
+	}
+	target, err := url.Parse(flags.Arg(0))
+	if err != nil || target.Host == "" {
+		return fmt.Errorf("invalid target URL %q", flags.Arg(0))
+	}
+
+	if *proxyAddr == "" {
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			return err
+		}
+		for _, l := range cfg.Listeners {
+			if l.Socket == "" && !strings.HasPrefix(l.Addr, "systemd") {
+				*proxyAddr = localAddr(l.Addr)
+				break
+			}
+		}
+		if *proxyAddr == "" {
+			return fmt.Errorf("no TCP listener to benchmark, pass -proxy")
+		}
+	}
+	proxy := &url.URL{Scheme: "http", Host: *proxyAddr}
+	if user, password, ok := strings.Cut(*proxyUser, ":"); ok {
+		proxy.User = url.UserPassword(user, password)
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyURL(proxy),
+		MaxIdleConnsPerHost: max(*concurrency, 1),
+	}
+	defer transport.CloseIdleConnections()
+	run := func(ctx context.Context) benchResult {
+		return benchRequest(ctx, transport, target)
+	}
+	if *tunnels {
+		run = func(ctx context.Context) benchResult {
+			return benchTunnel(ctx, proxy, target)
+		}
+	}
+
+	fmt.Printf("Benchmarking %s through %s with %d workers for %v\n", target, *proxyAddr, *concurrency, *duration)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	var (
+		mu      sync.Mutex
+		results []benchResult
+		started int
+		wg      sync.WaitGroup
+	)
+	// take claims the next round, false once the limit is reached
+	take := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if *limit > 0 && started >= *limit {
+			return false
+		}
+		started++
+		return true
+	}
+	start := time.Now()
+	for i := 0; i < max(*concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil && take() {
+				roundCtx, cancelRound := context.WithTimeout(ctx, *timeout)
+				result := run(roundCtx)
+				cancelRound()
+				if ctx.Err() != nil && result.err != nil {
+					return // Cut off by the end of the run
+				}
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	printBenchSummary(results, time.Since(start))
+	return nil
+}
+
+// benchRequest sends one GET to target and reads the whole response
+func benchRequest(ctx context.Context, transport *http.Transport, target *url.URL) benchResult {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return benchResult{err: err}
+	}
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return benchResult{elapsed: time.Since(start), err: err}
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return benchResult{status: resp.StatusCode, bytes: n, elapsed: time.Since(start), err: err}
+}
+
+// benchTunnel opens a CONNECT tunnel to target's host through proxy and
+// closes it as soon as it is established
+func benchTunnel(ctx context.Context, proxy, target *url.URL) benchResult {
+	host := target.Host
+	if target.Port() == "" {
+		port := "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(target.Hostname(), port)
+	}
+
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return benchResult{elapsed: time.Since(start), err: err}
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: host}, Host: host, Header: make(http.Header)}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := &http.Request{Header: make(http.Header)}
+		auth.SetBasicAuth(proxy.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", auth.Header.Get("Authorization"))
+	}
+	if err := req.Write(conn); err != nil {
+		return benchResult{elapsed: time.Since(start), err: err}
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return benchResult{elapsed: time.Since(start), err: err}
+	}
+	resp.Body.Close()
+	return benchResult{status: resp.StatusCode, elapsed: time.Since(start)}
+}
+
+// printBenchSummary prints rates, statuses and latency percentiles of a run
+// that took elapsed
+func printBenchSummary(results []benchResult, elapsed time.Duration) {
+	if len(results) == 0 {
+		fmt.Println("No requests completed")
+		return
+	}
+
+	statuses := make(map[int]int)
+	failures := 0
+	var total int64
+	latencies := make([]time.Duration, 0, len(results))
+	for _, r := range results {
+		if r.err != nil {
+			failures++
+		} else {
+			statuses[r.status]++
+		}
+		total += r.bytes
+		latencies = append(latencies, r.elapsed)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	seconds := elapsed.Seconds()
+
+	fmt.Println()
+	fmt.Printf("Completed: %d in %v, errors: %d\n", len(results), elapsed.Round(time.Millisecond), failures)
+	fmt.Printf("Rate: %.1f/s\n", float64(len(results))/seconds)
+	if total > 0 {
+		fmt.Printf("Throughput: %.2f MiB/s (%d bytes)\n", float64(total)/seconds/(1<<20), total)
+	}
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("  %d: %d\n", code, statuses[code])
+	}
+	fmt.Printf("Latency: min %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		latencies[0].Round(time.Microsecond), percentile(0.5), percentile(0.9), percentile(0.99),
+		latencies[len(latencies)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/forwarder"
+)
+
+// daemonEnv marks the re-executed child so it doesn't detach again
+const daemonEnv = "GATELAN_DAEMON"
+
+// daemonize re-executes the binary detached from the terminal with output
+// redirected to logFile, and returns once the child has started
+func daemonize(pidFile, logFile string) error {
+	if pid, err := readPidFile(pidFile); err == nil && processAlive(pid) {
+		return fmt.Errorf("already running with pid %d", pid)
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	if logFile == "" {
+		logFile = os.DevNull
+	}
+	output, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer output.Close()
+
+	cmd := exec.Command(exePath, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = detachedProcAttr()
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start daemon: %w", err)
+	}
+
+	fmt.Printf("Started in background with pid %d\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// isDaemonChild reports whether this process is the detached daemon
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) == "1"
+}
+
+// writePidFile records the current pid, refusing to overwrite a live instance
+// unless this process is taking over from it
+func writePidFile(pidFile string) error {
+	if pid, err := readPidFile(pidFile); err == nil && pid != os.Getpid() && processAlive(pid) && !forwarder.IsUpgrade() {
+		return fmt.Errorf("already running with pid %d", pid)
+	}
+	return os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// removePidFile deletes pidFile unless a newer instance has taken it over
+func removePidFile(pidFile string) {
+	if pid, err := readPidFile(pidFile); err == nil && pid == os.Getpid() {
+		os.Remove(pidFile)
+	}
+}
+
+// readPidFile returns the pid stored in pidFile
+func readPidFile(pidFile string) (int, error) {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %w", pidFile, err)
+	}
+	return pid, nil
+}
+
+// stopDaemon terminates the instance recorded in pidFile and waits for it to exit
+func stopDaemon(pidFile string) error {
+	pid, err := readPidFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("not running: %w", err)
+	}
+	if !processAlive(pid) {
+		os.Remove(pidFile)
+		return fmt.Errorf("not running (stale pid file for %d removed)", pid)
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find process %d: %w", pid, err)
+	}
+	if err := terminateProcess(process); err != nil {
+		return fmt.Errorf("failed to stop process %d: %w", pid, err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for process %d to exit", pid)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	os.Remove(pidFile)
+	fmt.Printf("Stopped process %d\n", pid)
+	return nil
+}
+
+// upgradeDaemon asks the instance recorded in pidFile to hand over to a new
+// instance of the binary and waits for the new one to record its pid
+func upgradeDaemon(pidFile string) error {
+	pid, err := readPidFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("not running: %w", err)
+	}
+	if !processAlive(pid) {
+		return fmt.Errorf("not running (stale pid file for %d)", pid)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find process %d: %w", pid, err)
+	}
+	if err := signalUpgrade(process); err != nil {
+		return fmt.Errorf("failed to signal process %d: %w", pid, err)
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	for {
+		if newPid, err := readPidFile(pidFile); err == nil && newPid != pid && processAlive(newPid) {
+			fmt.Printf("Upgraded: process %d took over from %d\n", newPid, pid)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for a new instance to replace process %d", pid)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// daemonStatus reports whether the instance recorded in pidFile is running
+func daemonStatus(pidFile string) error {
+	pid, err := readPidFile(pidFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("not running")
+	}
+	if err != nil {
+		return err
+	}
+	if !processAlive(pid) {
+		return fmt.Errorf("not running (stale pid file for %d)", pid)
+	}
+
+	fmt.Printf("Running with pid %d\n", pid)
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachedProcAttr starts the daemon in its own session, away from the terminal
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// processAlive reports whether a process with the given pid exists
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// terminateProcess asks the process to shut down gracefully
+func terminateProcess(process *os.Process) error {
+	return process.Signal(syscall.SIGTERM)
+}
+
+// upgradeSignal asks a running instance to hand over to a fresh copy of the binary
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// profileSignal asks a running instance to switch to its next config profile
+var profileSignal os.Signal = syscall.SIGUSR1
+
+// reloadSignal asks a running instance to load its TLS certificates again
+var reloadSignal os.Signal = syscall.SIGHUP
+
+// signalUpgrade sends upgradeSignal to the process
+func signalUpgrade(process *os.Process) error {
+	return process.Signal(upgradeSignal)
+}
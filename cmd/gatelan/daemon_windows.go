@@ -0,0 +1,53 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// detachedProcAttr starts the daemon without a console window
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: windows.DETACHED_PROCESS | windows.CREATE_NEW_PROCESS_GROUP,
+		HideWindow:    true,
+	}
+}
+
+// processAlive reports whether a process with the given pid is still running
+func processAlive(pid int) bool {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(handle, &code); err != nil {
+		return false
+	}
+	return code == 259 // STILL_ACTIVE
+}
+
+// terminateProcess kills the process; Windows has no SIGTERM equivalent for detached processes
+func terminateProcess(process *os.Process) error {
+	return process.Kill()
+}
+
+// upgradeSignal is nil since Windows cannot hand sockets over to a new process
+var upgradeSignal os.Signal
+
+// profileSignal is nil since Windows has no signal to switch profiles with
+var profileSignal os.Signal
+
+// reloadSignal is nil since Windows has no signal to reload certificates with
+var reloadSignal os.Signal
+
+// signalUpgrade fails since Windows does not support upgrades
+func signalUpgrade(process *os.Process) error {
+	return errors.New("upgrades are not supported on Windows")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// runHealthcheck probes the forwarder running with the config file, for
+// container health checks in images without curl. It asks the admin API's
+// /readyz when an admin address is configured and otherwise sends a request
+// to the first listener, failing unless an answer arrives within the timeout.
+func runHealthcheck(args []string, configPath string) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 5*time.Second, "time allowed for the probe")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gatelan [-config file] healthcheck [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if cfg.Admin.Addr != "" {
+		api, err := adminAPIOf(cfg, "")
+		if err != nil {
+			return err
+		}
+		return probeReadiness(ctx, api)
+	}
+	for _, l := range cfg.Listeners {
+		switch {
+		case l.Socket != "":
+			return probeListener(ctx, "unix", l.Socket)
+		case !strings.HasPrefix(l.Addr, "systemd"):
+			return probeListener(ctx, "tcp", localAddr(l.Addr))
+		}
+	}
+	return fmt.Errorf("nothing to probe: configure admin.addr or a listener")
+}
+
+// probeReadiness requires a 200 from /readyz on the admin API
+func probeReadiness(ctx context.Context, api *adminAPI) error {
+	resp, err := api.get(ctx, "/readyz")
+	if err != nil {
+		return fmt.Errorf("readiness probe failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("not ready: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Printf("Ready: %s/readyz\n", api.base)
+	return nil
+}
+
+// probeListener checks that the listener at addr answers HTTP. Any response
+// will do, since access control may legitimately refuse the probe.
+func probeListener(ctx context.Context, network, addr string) error {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+		DisableKeepAlives: true,
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://gatelan-healthcheck/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("listener probe failed: %w", err)
+	}
+	resp.Body.Close()
+	fmt.Printf("Listener %s is serving\n", addr)
+	return nil
+}
+
+// localAddr turns a listen address into one to connect to on this host,
+// mapping unspecified and empty hosts to loopback
+func localAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	switch ip := net.ParseIP(host); {
+	case host == "" || ip != nil && ip.To4() != nil && ip.IsUnspecified():
+		host = "127.0.0.1"
+	case ip != nil && ip.IsUnspecified():
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}
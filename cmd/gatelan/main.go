@@ -0,0 +1,265 @@
+// Command gatelan runs the GateLAN forwarder as a foreground process, a
+// daemon or a Windows service
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	_ "time/tzdata" // Access rule timezones on systems without a zone database
+
+	"github.com/n0z0/GateLAN/config"
+	"github.com/n0z0/GateLAN/forwarder"
+)
+
+func main() {
+	configPath := flag.String("config", "config.json", "path to the config file")
+	profile := flag.String("profile", "", "config profile to start with, overriding the file's")
+	daemon := flag.Bool("daemon", false, "run in the background")
+	pidFile := flag.String("pidfile", "gatelan.pid", "pid file used by -daemon, stop and status")
+	logFile := flag.String("logfile", "", "log file used by -daemon (discarded when empty)")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println("gatelan", forwarder.GetVersion())
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "service":
+		if err := runServiceCommand(flag.Args()[1:], *configPath); err != nil {
+			log.Fatalf("Service command failed: %v", err)
+		}
+		return
+	case "replay":
+		if err := runReplay(flag.Args()[1:], *configPath); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	case "bench":
+		if err := runBench(flag.Args()[1:], *configPath); err != nil {
+			log.Fatalf("Bench failed: %v", err)
+		}
+		return
+	case "top":
+		if err := runTop(flag.Args()[1:], *configPath); err != nil {
+			log.Fatalf("Top failed: %v", err)
+		}
+		return
+	case "selftest":
+		if err := runSelftest(flag.Args()[1:], *configPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	case "healthcheck":
+		if err := runHealthcheck(flag.Args()[1:], *configPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	case "stop":
+		if err := stopDaemon(*pidFile); err != nil {
+			log.Fatalf("Stop failed: %v", err)
+		}
+		return
+	case "upgrade":
+		if err := upgradeDaemon(*pidFile); err != nil {
+			log.Fatalf("Upgrade failed: %v", err)
+		}
+		return
+	case "status":
+		if err := runStatus(flag.Args()[1:], *configPath, *pidFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	case "":
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	// Hand control to the service manager when started by it
+	if isWindowsService() {
+		if err := runService(*configPath); err != nil {
+			log.Fatalf("Service failed: %v", err)
+		}
+		return
+	}
+
+	if *daemon {
+		if !isDaemonChild() {
+			if err := daemonize(*pidFile, *logFile); err != nil {
+				log.Fatalf("Failed to daemonize: %v", err)
+			}
+			return
+		}
+		if err := writePidFile(*pidFile); err != nil {
+			log.Fatalf("Failed to write pid file: %v", err)
+		}
+		defer removePidFile(*pidFile)
+	}
+
+	// Keep the application running until asked to stop
+	stop := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		close(stop)
+	}()
+
+	if err := runForwarder(*configPath, *profile, stop); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// runForwarder creates the forwarder, starting with profile unless empty,
+// and keeps it ready until stop is closed
+func runForwarder(configPath, profile string, stop <-chan struct{}) error {
+	// Check if config file exists
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return fmt.Errorf("config file not found: %s", configPath)
+	}
+
+	// Create forwarder
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if profile != "" {
+		cfg.Profile = profile
+	}
+	fwd, err := forwarder.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create forwarder: %w", err)
+	}
+	if fwd.GetConfig().Log.File != "" {
+		log.SetOutput(fwd.LogOutput())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log.Printf("HTTP Forwarder Client - Ready")
+	log.Printf("Version: %s", forwarder.GetVersion())
+	if fwd.Profile() != "" {
+		log.Printf("Profile: %s", fwd.Profile())
+	}
+	log.Printf("Upstream proxy: %s", fwd.GetConfig().ProxyAddr)
+	log.Printf("Buffer size: %d bytes", fwd.GetConfig().BufferSize)
+	log.Println("")
+
+	if len(fwd.GetConfig().Listeners) > 0 || fwd.GetConfig().Admin.Addr != "" {
+		if err := fwd.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start listeners: %w", err)
+		}
+		log.Println("Forwarder is serving proxy requests on the configured listeners.")
+		log.Println("Press Ctrl+C to exit.")
+	} else {
+		log.Println("This is a client-side HTTP forwarder tool.")
+		log.Println("It provides an HTTP client that forwards requests through the upstream proxy.")
+		log.Println("No server is listening - this is a library/tool for your applications.")
+		log.Println("")
+		log.Printf("Usage examples:")
+		log.Printf("- Use GetHTTPClient() to get the configured HTTP client")
+		log.Printf("- Use ForwardHTTPRequest() for simple request forwarding")
+		log.Printf("- Use ForwardRequest() for full control over requests")
+		log.Println("")
+
+		// Test the connection
+		testURL := "http://httpbin.org/ip"
+		if resp, err := fwd.ForwardHTTPRequest("GET", testURL, nil); err != nil {
+			log.Printf("Test request failed: %v", err)
+		} else {
+			if resp.StatusCode == http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				log.Printf("Test successful! Response: %s", string(body))
+			} else {
+				log.Printf("Test request returned status: %d", resp.StatusCode)
+			}
+			resp.Body.Close()
+		}
+
+		log.Println("")
+		log.Println("Forwarder is ready for use. Configure your applications to use this as a proxy client.")
+		log.Println("Press Ctrl+C to exit.")
+	}
+
+	// Tell systemd we are up, as its main process after an upgrade (which
+	// needs NotifyAccess=all), and keep the watchdog fed
+	sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+	stopWatchdog := startWatchdog()
+
+	// Hand the sockets to a new instance of the binary on request, keeping
+	// this one serving if that fails
+	upgrade := make(chan os.Signal, 1)
+	if upgradeSignal != nil {
+		signal.Notify(upgrade, upgradeSignal)
+		defer signal.Stop(upgrade)
+	}
+
+	// Move on to the next profile on request
+	cycle := make(chan os.Signal, 1)
+	if profileSignal != nil {
+		signal.Notify(cycle, profileSignal)
+		defer signal.Stop(cycle)
+	}
+
+	// Load renewed TLS certificates on request
+	reload := make(chan os.Signal, 1)
+	if reloadSignal != nil {
+		signal.Notify(reload, reloadSignal)
+		defer signal.Stop(reload)
+	}
+	upgraded := false
+wait:
+	for {
+		select {
+		case <-stop:
+			break wait
+		case <-cycle:
+			if name, err := fwd.CycleProfile(); err != nil {
+				log.Printf("Failed to switch profile: %v", err)
+			} else {
+				log.Printf("Switched to profile %s", name)
+			}
+		case <-reload:
+			if err := fwd.ReloadCertificates(); err != nil {
+				log.Printf("Failed to reload certificates: %v", err)
+			} else {
+				log.Printf("Reloaded certificates")
+			}
+		case <-upgrade:
+			log.Printf("Upgrading to a new instance")
+			if err := fwd.Upgrade(ctx); err != nil {
+				log.Printf("Upgrade failed, still serving: %v", err)
+			}
+		case <-fwd.HandedOver():
+			log.Printf("New instance is serving, draining open connections")
+			upgraded = true
+			break wait
+		}
+	}
+
+	if !upgraded {
+		sdNotify("STOPPING=1")
+	}
+	stopWatchdog()
+
+	shutdownCtx := context.Background()
+	if drain := fwd.GetConfig().Timeouts.ShutdownDrain.Timeout(); drain > 0 {
+		var shutdownCancel context.CancelFunc
+		shutdownCtx, shutdownCancel = context.WithTimeout(shutdownCtx, drain)
+		defer shutdownCancel()
+	}
+	return fwd.Shutdown(shutdownCtx)
+}
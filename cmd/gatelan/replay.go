@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/forwarder"
+)
+
+// replayResult is the outcome of one replayed request
+type replayResult struct {
+	status  int
+	elapsed time.Duration
+	err     error
+}
+
+// runReplay sends the requests recorded in a HAR file through the configured
+// upstream and prints a summary of statuses and latencies
+func runReplay(args []string, configPath string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	concurrency := flags.Int("concurrency", 1, "number of requests in flight")
+	repeat := flags.Int("repeat", 1, "times to replay the whole capture")
+	quiet := flags.Bool("quiet", false, "only print the summary")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gatelan [-config file] replay [flags] capture.har")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one HAR file")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open capture: %w", err)
+	}
+	requests, err := forwarder.ReadHAR(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	fwd, err := forwarder.NewFromFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to create forwarder: %w", err)
+	}
+
+	jobs := make(chan *http.Request)
+	results := make(chan replayResult)
+	var wg sync.WaitGroup
+	for i := 0; i < max(*concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range jobs {
+				result := replayOne(fwd, req)
+				if !*quiet {
+					if result.err != nil {
+						fmt.Printf("ERR %s %s %v: %v\n", req.Method, req.URL, result.elapsed.Round(time.Millisecond), result.err)
+					} else {
+						fmt.Printf("%d %s %s %v\n", result.status, req.Method, req.URL, result.elapsed.Round(time.Millisecond))
+					}
+				}
+				results <- result
+			}
+		}()
+	}
+
+	go func() {
+		for round := 0; round < *repeat; round++ {
+			for _, req := range requests {
+				jobs <- req
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var all []replayResult
+	for result := range results {
+		all = append(all, result)
+	}
+	printReplaySummary(all)
+	return nil
+}
+
+// replayOne forwards a fresh copy of req and drains the response
+func replayOne(fwd *forwarder.Forwarder, req *http.Request) replayResult {
+	clone := req.Clone(context.Background())
+	if req.GetBody != nil {
+		clone.Body, _ = req.GetBody()
+	}
+
+	start := time.Now()
+	resp, err := fwd.ForwardRequest(clone)
+	if err != nil {
+		return replayResult{elapsed: time.Since(start), err: err}
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return replayResult{status: resp.StatusCode, elapsed: time.Since(start), err: err}
+}
+
+// printReplaySummary prints counts per status and latency percentiles
+func printReplaySummary(results []replayResult) {
+	if len(results) == 0 {
+		fmt.Println("No requests replayed")
+		return
+	}
+
+	statuses := make(map[int]int)
+	failures := 0
+	latencies := make([]time.Duration, 0, len(results))
+	for _, r := range results {
+		if r.err != nil {
+			failures++
+		} else {
+			statuses[r.status]++
+		}
+		latencies = append(latencies, r.elapsed)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Millisecond)
+	}
+
+	fmt.Println()
+	fmt.Printf("Requests: %d, errors: %d\n", len(results), failures)
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("  %d: %d\n", code, statuses[code])
+	}
+	fmt.Printf("Latency: min %v, p50 %v, p95 %v, max %v\n",
+		latencies[0].Round(time.Millisecond), percentile(0.5), percentile(0.95), latencies[len(latencies)-1].Round(time.Millisecond))
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+	"github.com/n0z0/GateLAN/forwarder"
+)
+
+const (
+	selftestHost      = "selftest.gatelan.invalid" // Never resolves, so only the mock upstream can reach it
+	selftestUser      = "gatelan"
+	selftestPassword  = "selftest"
+	selftestUpstream  = "X-Gatelan-Selftest-Upstream" // Set by the mock upstream on what it forwarded
+	selftestLargeBody = 8 << 20
+)
+
+// selftestCheck is one end-to-end check run by selftest
+type selftestCheck struct {
+	name string
+	run  func(ctx context.Context, proxyAddr string) error
+}
+
+// runSelftest runs the forwarder with the config file against an in-process
+// mock upstream proxy and origin, and prints a pass/fail line per check.
+// Listeners, the admin API and state files are left alone, so it is safe to
+// run next to the live instance.
+func runSelftest(args []string, configPath string) error {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 10*time.Second, "time allowed for each check")
+	verbose := flags.Bool("verbose", false, "also print the forwarder's log")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gatelan [-config file] selftest [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	isolateSelftest(cfg)
+
+	origin, err := serveSelftest(selftestOrigin())
+	if err != nil {
+		return fmt.Errorf("failed to start mock origin: %w", err)
+	}
+	defer origin.Close()
+	upstream, err := serveSelftest(selftestProxy(origin.Addr().String()))
+	if err != nil {
+		return fmt.Errorf("failed to start mock upstream: %w", err)
+	}
+	defer upstream.Close()
+
+	// Keep the forwarder's request log out of the report
+	stdout := os.Stdout
+	if !*verbose {
+		if os.Stdout, err = os.Open(os.DevNull); err != nil {
+			os.Stdout = stdout
+		}
+	}
+	fwd, err := forwarder.New(cfg)
+	if err == nil {
+		err = fwd.SetUpstreams([]string{"http://" + selftestUser + ":" + selftestPassword + "@" + upstream.Addr().String()})
+	}
+	os.Stdout = stdout
+	if err != nil {
+		return fmt.Errorf("failed to create forwarder: %w", err)
+	}
+	proxy, err := serveSelftest(fwd.Handler())
+	if err != nil {
+		return fmt.Errorf("failed to start forwarder: %w", err)
+	}
+	defer proxy.Close()
+
+	checks := []selftestCheck{
+		{"HTTP request", checkSelftestHTTP},
+		{"CONNECT tunnel", checkSelftestConnect},
+		{"upstream authentication", checkSelftestAuth},
+		{"chunked body", checkSelftestChunked},
+		{"large body", checkSelftestLargeBody},
+	}
+	failed := 0
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		start := time.Now()
+		err := check.run(ctx, proxy.Addr().String())
+		cancel()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s (%v): %v\n", check.name, elapsed, err)
+		} else {
+			fmt.Printf("PASS %s (%v)\n", check.name, elapsed)
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("Checks: %d, passed: %d, failed: %d\n", len(checks), len(checks)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("selftest failed")
+	}
+	return nil
+}
+
+// isolateSelftest keeps a selftest forwarder from writing the live
+// instance's state, logs and captures
+func isolateSelftest(cfg *config.Config) {
+	cfg.State.Dir = ""
+	cfg.Quota.File = ""
+	cfg.Stats.File = ""
+	cfg.Portal.File = ""
+	cfg.Lists.File = ""
+	cfg.Cache.Dir = ""
+	cfg.HAR.File = ""
+	cfg.Capture.Enabled = false
+	cfg.Log.File = ""
+}
+
+// serveSelftest serves handler on a loopback port until the listener is closed
+func serveSelftest(handler http.Handler) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go (&http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}).Serve(listener)
+	return listener, nil
+}
+
+// selftestOrigin answers /hello and echoes the body of /echo, streaming it
+// back chunked
+func selftestOrigin() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("POST /echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, r.Body)
+	})
+	return mux
+}
+
+// selftestProxy is the mock upstream proxy: it requires the selftest
+// credentials and sends everything, CONNECT tunnels included, to origin
+func selftestProxy(origin string) http.Handler {
+	reverse := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = origin
+			r.Out.Host = r.In.Host
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Set(selftestUpstream, "1")
+			return nil
+		},
+		FlushInterval: -1,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+		if !ok || user != selftestUser || password != selftestPassword {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="selftest"`)
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			reverse.ServeHTTP(w, r)
+			return
+		}
+
+		target, err := net.Dial("tcp", origin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		client, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(target, buffered)
+		io.Copy(client, target)
+	})
+}
+
+// parseProxyAuth decodes Basic Proxy-Authorization credentials
+func parseProxyAuth(header string) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return r.BasicAuth()
+}
+
+// selftestClient sends requests through the forwarder at proxyAddr
+func selftestClient(proxyAddr string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr}),
+		DisableKeepAlives: true,
+	}}
+}
+
+// viaUpstream fails unless resp was forwarded by the mock upstream
+func viaUpstream(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	if resp.Header.Get(selftestUpstream) == "" {
+		return errors.New("response did not come through the upstream")
+	}
+	return nil
+}
+
+// checkSelftestHTTP fetches a page through the upstream
+func checkSelftestHTTP(ctx context.Context, proxyAddr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+selftestHost+"/hello", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := selftestClient(proxyAddr).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := viaUpstream(resp); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	if string(body) != "hello" {
+		return fmt.Errorf("unexpected body %q", body)
+	}
+	return nil
+}
+
+// checkSelftestConnect opens a tunnel and sends a request through it
+func checkSelftestConnect(ctx context.Context, proxyAddr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	target := selftestHost + ":443"
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT answered %s", resp.Status)
+	}
+
+	fmt.Fprintf(conn, "GET /hello HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", selftestHost)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read response through the tunnel: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tunneled request answered %s", resp.Status)
+	}
+	return nil
+}
+
+// checkSelftestAuth makes sure the upstream gets the configured credentials
+// and not the ones the client sent to the forwarder
+func checkSelftestAuth(ctx context.Context, proxyAddr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+selftestHost+"/hello", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("client", "secret")
+	req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+	req.Header.Del("Authorization")
+	resp, err := selftestClient(proxyAddr).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return errors.New("upstream refused the configured credentials")
+	}
+	return viaUpstream(resp)
+}
+
+// checkSelftestChunked posts a body of unknown length and reads it back
+func checkSelftestChunked(ctx context.Context, proxyAddr string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 16; i++ {
+			fmt.Fprintf(pw, "chunk %02d\n", i)
+		}
+		pw.Close()
+	}()
+	var want bytes.Buffer
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&want, "chunk %02d\n", i)
+	}
+	return echoSelftest(ctx, proxyAddr, pr, -1, want.Bytes())
+}
+
+// checkSelftestLargeBody posts a large random body and reads it back
+func checkSelftestLargeBody(ctx context.Context, proxyAddr string) error {
+	data := make([]byte, selftestLargeBody)
+	rand.Read(data)
+	return echoSelftest(ctx, proxyAddr, bytes.NewReader(data), int64(len(data)), data)
+}
+
+// echoSelftest posts body to the echo endpoint and compares the answer to want
+func echoSelftest(ctx context.Context, proxyAddr string, body io.Reader, size int64, want []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+selftestHost+"/echo", body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := selftestClient(proxyAddr).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := viaUpstream(resp); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read body after %d bytes: %w", n, err)
+	}
+	if n != int64(len(want)) {
+		return fmt.Errorf("got %d bytes back, sent %d", n, len(want))
+	}
+	if sum := sha256.Sum256(want); !bytes.Equal(hash.Sum(nil), sum[:]) {
+		return errors.New("body changed on the way")
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+var errServiceUnsupported = errors.New("service commands are only supported on Windows")
+
+// isWindowsService is always false outside Windows
+func isWindowsService() bool {
+	return false
+}
+
+// runService is only available on Windows
+func runService(configPath string) error {
+	return errServiceUnsupported
+}
+
+// runServiceCommand is only available on Windows
+func runServiceCommand(args []string, configPath string) error {
+	return errServiceUnsupported
+}
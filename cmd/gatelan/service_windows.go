@@ -0,0 +1,187 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceName        = "GateLAN"
+	serviceDisplayName = "GateLAN HTTP Forwarder"
+	serviceDescription = "Forwards LAN HTTP traffic through the configured upstream proxy."
+)
+
+// isWindowsService reports whether the process was started by the service control manager
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// gatelanService adapts runForwarder to the Windows service API
+type gatelanService struct {
+	configPath string
+}
+
+// Execute runs the forwarder until the service control manager asks it to stop
+func (s *gatelanService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- runForwarder(s.configPath, "", stop)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				close(stop)
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// runService serves the forwarder as a Windows service
+func runService(configPath string) error {
+	return svc.Run(serviceName, &gatelanService{configPath: configPath})
+}
+
+// runServiceCommand implements "service install|uninstall|start|stop"
+func runServiceCommand(args []string, configPath string) error {
+	if len(args) == 0 {
+		return errors.New("usage: service install|uninstall|start|stop")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		return installService(m, configPath)
+	case "uninstall":
+		return uninstallService(m)
+	case "start":
+		return startService(m)
+	case "stop":
+		return stopService(m)
+	default:
+		return fmt.Errorf("unknown service command: %s", args[0])
+	}
+}
+
+// installService registers the current executable as an auto-start service
+func installService(m *mgr.Mgr, configPath string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	// The service starts in System32, so the config path must be absolute
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path: %w", err)
+	}
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exePath, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, "-config", absConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer s.Close()
+
+	fmt.Printf("Service %s installed (config: %s)\n", serviceName, absConfig)
+	return nil
+}
+
+// uninstallService removes the service registration
+func uninstallService(m *mgr.Mgr) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+
+	fmt.Printf("Service %s removed\n", serviceName)
+	return nil
+}
+
+// startService asks the service manager to start the service
+func startService(m *mgr.Mgr) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("failed to start service: %w", err)
+	}
+
+	fmt.Printf("Service %s started\n", serviceName)
+	return nil
+}
+
+// stopService sends a stop request and waits for the service to stop
+func stopService(m *mgr.Mgr) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("failed to stop service: %w", err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service %s to stop", serviceName)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return fmt.Errorf("failed to query service: %w", err)
+		}
+	}
+
+	fmt.Printf("Service %s stopped\n", serviceName)
+	return nil
+}
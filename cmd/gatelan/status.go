@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/forwarder"
+)
+
+// runStatus prints the status document of the forwarder running with the
+// config file, as text or, with -json, as the admin API serves it. Without
+// an admin API it only reports whether the instance recorded in pidFile is
+// running.
+func runStatus(args []string, configPath, pidFile string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	adminAddr := flags.String("admin", "", "admin API address, admin.addr of the config when empty")
+	asJSON := flags.Bool("json", false, "print the status document as JSON")
+	timeout := flags.Duration("timeout", 5*time.Second, "time allowed for the admin API to answer")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gatelan [-config file] [-pidfile file] status [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	api, err := newAdminAPI(*adminAddr, configPath)
+	if err != nil {
+		if *asJSON {
+			return err
+		}
+		return daemonStatus(pidFile)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var document json.RawMessage
+	if err := api.getJSON(ctx, "/status", &document); err != nil {
+		if daemonErr := daemonStatus(pidFile); daemonErr != nil {
+			return daemonErr
+		}
+		return fmt.Errorf("failed to get status: %w", err)
+	}
+	if *asJSON {
+		var out bytes.Buffer
+		if err := json.Indent(&out, document, "", "  "); err != nil {
+			return err
+		}
+		out.WriteByte('\n')
+		_, err := out.WriteTo(os.Stdout)
+		return err
+	}
+
+	var status forwarder.Status
+	if err := json.Unmarshal(document, &status); err != nil {
+		return fmt.Errorf("failed to decode status: %w", err)
+	}
+	if status.StatusVersion != forwarder.StatusVersion {
+		return fmt.Errorf("status document version %d is not supported, expected %d; use -json", status.StatusVersion, forwarder.StatusVersion)
+	}
+	var out strings.Builder
+	drawStatus(&out, status)
+	fmt.Print(out.String())
+	if !status.Readiness.Ready {
+		return fmt.Errorf("not ready: %s", strings.Join(status.Readiness.Problems, ", "))
+	}
+	return nil
+}
+
+// drawStatus renders the status document as text
+func drawStatus(out *strings.Builder, status forwarder.Status) {
+	fmt.Fprintf(out, "GateLAN %s\n", status.Version)
+	if status.Started.IsZero() {
+		fmt.Fprintln(out, "Not serving")
+	} else {
+		fmt.Fprintf(out, "Up %s since %s\n", status.Uptime(), status.Started.Local().Format(time.DateTime))
+	}
+	if status.Profile != "" {
+		fmt.Fprintf(out, "Profile %s\n", status.Profile)
+	}
+	c := status.Connections
+	fmt.Fprintf(out, "Connections: %d open (%d requests, %d tunnels, %d stalled), %d handled\n", c.Open, c.Requests, c.Tunnels, c.Stalled, c.Handled)
+	fmt.Fprintf(out, "Traffic: %s up, %s down\n", formatTopBytes(float64(status.BytesSent)), formatTopBytes(float64(status.BytesReceived)))
+
+	if len(status.Listeners) > 0 {
+		fmt.Fprintf(out, "\n%-20s %-32s %-5s %-6s %s\n", "LISTENER", "ADDR", "TLS", "AUTH", "PROFILE")
+		for _, l := range status.Listeners {
+			tls := "no"
+			if l.TLS {
+				tls = "yes"
+			}
+			auth := l.Auth
+			if auth == "" {
+				auth = "none"
+			}
+			fmt.Fprintf(out, "%-20s %-32s %-5s %-6s %s\n", truncateTop(l.Name, 20), truncateTop(l.Addr, 32), tls, auth, l.Profile)
+		}
+	}
+	drawTopUpstreams(out, status.Upstreams)
+}
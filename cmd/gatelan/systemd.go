@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/n0z0/GateLAN/forwarder"
+)
+
+// sdNotify sends a state update to systemd when running under a Type=notify
+// unit. It is a no-op when NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// Abstract namespace sockets are advertised with a leading '@'
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// startWatchdog pings the systemd watchdog at half the configured interval
+// and returns a function that stops pinging. It does nothing unless
+// WatchdogSec= is set on the unit.
+func startWatchdog() func() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return func() {}
+	}
+	// After an upgrade WATCHDOG_PID still names the previous instance
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) && !forwarder.IsUpgrade() {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sdNotify("WATCHDOG=1")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
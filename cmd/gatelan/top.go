@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/forwarder"
+)
+
+// Columns top sorts connections by
+var topSortKeys = []string{"rate", "age", "bytes", "client", "target"}
+
+// topView is what top shows, changed by the commands typed while it runs
+type topView struct {
+	sort    string
+	reverse bool
+	filter  string
+	rows    int
+}
+
+// topSnapshot is one poll of the admin API, with transfer rates in bytes per
+// second computed against the previous poll
+type topSnapshot struct {
+	taken       time.Time
+	status      forwarder.Status
+	connections []forwarder.Connection
+	rates       map[uint64][2]float64 // Sent and received, by connection ID
+	err         error
+}
+
+// topClient sums the open connections of one client
+type topClient struct {
+	client      string
+	connections int
+	sent        float64
+	received    float64
+}
+
+// runTop shows live connections, per-client rates and upstream health from
+// the admin API, redrawn every refresh interval. Commands are typed as a
+// line followed by Enter, so it works over any SSH session.
+func runTop(args []string, configPath string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	adminAddr := flags.String("admin", "", "admin API address, admin.addr of the config when empty")
+	refresh := flags.Duration("refresh", 2*time.Second, "time between updates")
+	view := topView{}
+	flags.StringVar(&view.sort, "sort", "rate", "connection column to sort by: "+strings.Join(topSortKeys, ", "))
+	flags.StringVar(&view.filter, "filter", "", "only show connections whose client, target or upstream contains this")
+	flags.IntVar(&view.rows, "rows", 20, "connections shown")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gatelan [-config file] top [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if !validTopSort(view.sort) {
+		return fmt.Errorf("invalid sort %q", view.sort)
+	}
+
+	api, err := newAdminAPI(*adminAddr, configPath)
+	if err != nil {
+		return err
+	}
+
+	commands := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			commands <- strings.TrimSpace(scanner.Text())
+		}
+	}()
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+	var last topSnapshot
+	message := ""
+	poll := true
+	for {
+		if poll {
+			last = pollTop(api, last)
+		}
+		drawTop(os.Stdout, last, view, message)
+		message = ""
+		select {
+		case <-interrupted:
+			fmt.Println()
+			return nil
+		case <-ticker.C:
+			poll = true
+		case command := <-commands:
+			// Redraw the last poll right away instead of polling again early
+			var quit bool
+			if quit, message = view.apply(command); quit {
+				return nil
+			}
+			poll = false
+		}
+	}
+}
+
+// apply runs a command typed into top, reporting whether to quit and a
+// message for the status line
+func (v *topView) apply(command string) (bool, string) {
+	name, arg, _ := strings.Cut(command, " ")
+	switch {
+	case command == "":
+		return false, ""
+	case name == "q":
+		return true, ""
+	case name == "s":
+		arg = strings.TrimSpace(arg)
+		if !validTopSort(arg) {
+			return false, "Sort by one of: " + strings.Join(topSortKeys, ", ")
+		}
+		v.sort = arg
+	case name == "r":
+		v.reverse = !v.reverse
+	case strings.HasPrefix(command, "/"):
+		v.filter = strings.TrimPrefix(command, "/")
+	default:
+		return false, "Unknown command " + command
+	}
+	return false, ""
+}
+
+// validTopSort reports whether key is a column top sorts by
+func validTopSort(key string) bool {
+	for _, k := range topSortKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// pollTop fetches the status and connections, computing rates against last
+func pollTop(api *adminAPI, last topSnapshot) topSnapshot {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	snap := topSnapshot{taken: time.Now(), rates: make(map[uint64][2]float64)}
+	if snap.err = api.getJSON(ctx, "/status", &snap.status); snap.err != nil {
+		return snap
+	}
+	if snap.err = api.getJSON(ctx, "/connections", &snap.connections); snap.err != nil {
+		return snap
+	}
+
+	previous := make(map[uint64]forwarder.Connection, len(last.connections))
+	for _, c := range last.connections {
+		previous[c.ID] = c
+	}
+	seconds := snap.taken.Sub(last.taken).Seconds()
+	for _, c := range snap.connections {
+		before, ok := previous[c.ID]
+		if !ok || seconds <= 0 {
+			continue
+		}
+		snap.rates[c.ID] = [2]float64{
+			float64(c.BytesSent-before.BytesSent) / seconds,
+			float64(c.BytesReceived-before.BytesReceived) / seconds,
+		}
+	}
+	return snap
+}
+
+// drawTop clears the terminal and renders snap as view shows it
+func drawTop(w io.Writer, snap topSnapshot, view topView, message string) {
+	var out strings.Builder
+	out.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&out, "GateLAN %s", snap.status.Version.Version)
+	if snap.status.Profile != "" {
+		fmt.Fprintf(&out, "  profile %s", snap.status.Profile)
+	}
+	fmt.Fprintf(&out, "  %s\n", snap.taken.Format(time.TimeOnly))
+	if snap.err != nil {
+		fmt.Fprintf(&out, "\nFailed to poll the admin API: %v\n", snap.err)
+	} else {
+		drawTopUpstreams(&out, snap.status.Upstreams)
+		connections := filterTopConnections(snap.connections, view.filter)
+		drawTopClients(&out, connections, snap.rates)
+		drawTopConnections(&out, connections, snap.rates, view)
+	}
+
+	fmt.Fprintln(&out)
+	if message != "" {
+		fmt.Fprintln(&out, message)
+	}
+	fmt.Fprint(&out, "s <column> sort, r reverse, /text filter, / clear, q quit, then Enter: ")
+	io.WriteString(w, out.String())
+}
+
+// drawTopUpstreams renders the upstream health table
+func drawTopUpstreams(out *strings.Builder, upstreams []forwarder.UpstreamStatus) {
+	fmt.Fprintf(out, "\n%-32s %-9s %9s %9s %9s %9s  %s\n", "UPSTREAM", "BREAKER", "REQUESTS", "FAILURES", "CONN MS", "TTFB MS", "LAST ERROR")
+	for _, u := range upstreams {
+		fmt.Fprintf(out, "%-32s %-9s %9d %9d %9.1f %9.1f  %s\n",
+			truncateTop(u.Addr, 32), u.Breaker, u.Requests, u.Failures, u.ConnectMS, u.TTFBMS, u.LastError)
+	}
+}
+
+// drawTopClients renders the rates of connections per client name or
+// address, busiest first
+func drawTopClients(out *strings.Builder, connections []forwarder.Connection, rates map[uint64][2]float64) {
+	byClient := make(map[string]*topClient)
+	for _, c := range connections {
+		host := c.ClientName
+		if host == "" {
+			host = c.Client
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+		}
+		client := byClient[host]
+		if client == nil {
+			client = &topClient{client: host}
+			byClient[host] = client
+		}
+		client.connections++
+		client.sent += rates[c.ID][0]
+		client.received += rates[c.ID][1]
+	}
+	clients := make([]*topClient, 0, len(byClient))
+	for _, client := range byClient {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if a, b := clients[i].sent+clients[i].received, clients[j].sent+clients[j].received; a != b {
+			return a > b
+		}
+		return clients[i].client < clients[j].client
+	})
+
+	fmt.Fprintf(out, "\n%-32s %6s %12s %12s\n", "CLIENT", "CONNS", "SENT/S", "RECEIVED/S")
+	for _, client := range clients[:min(len(clients), 10)] {
+		fmt.Fprintf(out, "%-32s %6d %12s %12s\n", truncateTop(client.client, 32), client.connections, formatTopBytes(client.sent), formatTopBytes(client.received))
+	}
+}
+
+// drawTopConnections renders the connection table sorted as view asks
+func drawTopConnections(out *strings.Builder, connections []forwarder.Connection, rates map[uint64][2]float64, view topView) {
+	rate := func(c forwarder.Connection) float64 { return rates[c.ID][0] + rates[c.ID][1] }
+	less := map[string]func(a, b forwarder.Connection) bool{
+		"rate":   func(a, b forwarder.Connection) bool { return rate(a) > rate(b) },
+		"age":    func(a, b forwarder.Connection) bool { return a.Age > b.Age },
+		"bytes":  func(a, b forwarder.Connection) bool { return a.BytesSent+a.BytesReceived > b.BytesSent+b.BytesReceived },
+		"client": func(a, b forwarder.Connection) bool { return a.Client < b.Client },
+		"target": func(a, b forwarder.Connection) bool { return a.Target < b.Target },
+	}[view.sort]
+	sort.SliceStable(connections, func(i, j int) bool {
+		if view.reverse {
+			return less(connections[j], connections[i])
+		}
+		return less(connections[i], connections[j])
+	})
+
+	order := "desc"
+	if view.reverse {
+		order = "reversed"
+	}
+	fmt.Fprintf(out, "\nCONNECTIONS %d, sorted by %s (%s)", len(connections), view.sort, order)
+	if view.filter != "" {
+		fmt.Fprintf(out, ", filter %q", view.filter)
+	}
+	fmt.Fprintf(out, "\n%-8s %-7s %-22s %-36s %9s %12s %12s\n", "ID", "KIND", "CLIENT", "TARGET", "AGE", "BYTES", "RATE/S")
+	for _, c := range connections[:min(len(connections), max(view.rows, 0))] {
+		client := c.Client
+		if c.ClientName != "" {
+			client = c.ClientName
+		}
+		fmt.Fprintf(out, "%-8d %-7s %-22s %-36s %9s %12s %12s\n", c.ID, c.Kind, truncateTop(client, 22), truncateTop(c.Target, 36),
+			c.Age.Round(time.Second), formatTopBytes(float64(c.BytesSent+c.BytesReceived)), formatTopBytes(rate(c)))
+	}
+}
+
+// filterTopConnections keeps the connections whose client address or name,
+// target or upstream contains filter
+func filterTopConnections(connections []forwarder.Connection, filter string) []forwarder.Connection {
+	if filter == "" {
+		return append([]forwarder.Connection(nil), connections...)
+	}
+	var kept []forwarder.Connection
+	for _, c := range connections {
+		if strings.Contains(c.Client, filter) || strings.Contains(c.ClientName, filter) || strings.Contains(c.Target, filter) || strings.Contains(c.Upstream, filter) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// formatTopBytes renders a byte count with a binary unit
+func formatTopBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// truncateTop shortens s to width characters for a table column
+func truncateTop(s string, width int) string {
+	if len(s) <= width {
+		return s
+	}
+	return s[:width-1] + "~"
+}
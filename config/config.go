@@ -0,0 +1,2503 @@
+// Package config defines the GateLAN configuration file format
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config represents the forwarder configuration
+type Config struct {
+	ProxyAddr     string            `json:"proxy_addr"`     // See ParseUpstream; detected from the environment or system when empty
+	Upstreams     []string          `json:"upstreams"`      // Additional upstream proxies after proxy_addr
+	ProxyChain    []string          `json:"proxy_chain"`    // Hops traversed, in order, to reach each upstream
+	NoProxy       []string          `json:"no_proxy"`       // Destinations reached directly, in NO_PROXY syntax with optional ports, globs and "~" regular expressions
+	Balance       string            `json:"balance"`        // "failover" (default) or "fastest"
+	IPFamily      string            `json:"ip_family"`      // Address family of outgoing connections, both in resolver order when empty
+	FallbackDelay Duration          `json:"fallback_delay"` // Head start of each address when dialing directly (RFC 8305), 250ms when unset, negative for one at a time
+	DNSRefresh    Duration          `json:"dns_refresh"`    // How often upstream host names are resolved again to follow DNS changes, 30s when unset, negative disables
+	BufferSize    int               `json:"buffer_size"`
+	Pool          PoolConfig        `json:"pool"`
+	Prewarm       PrewarmConfig     `json:"prewarm"`
+	Timeouts      TimeoutsConfig    `json:"timeouts"`
+	TCP           TCPConfig         `json:"tcp"`
+	SSH           SSHConfig         `json:"ssh"`
+	FTP           FTPConfig         `json:"ftp"`
+	UpstreamTLS   UpstreamTLSConfig `json:"upstream_tls"`
+	BodyFilter    BodyFilterConfig  `json:"body_filter"`
+	Cache         CacheConfig       `json:"cache"`
+	Compression   CompressionConfig `json:"compression"`
+	Limits        LimitsConfig      `json:"limits"`
+	SlowClients   SlowClientsConfig `json:"slow_clients"`
+	Admission     AdmissionConfig   `json:"admission"`
+	Shaping       ShapingConfig     `json:"shaping"`
+
+	Headers          HeadersConfig          `json:"headers"`
+	ForwardedHeaders ForwardedHeadersConfig `json:"forwarded_headers"`
+	LoopDetection    LoopDetectionConfig    `json:"loop_detection"`
+	RequestID        RequestIDConfig        `json:"request_id"`
+	RequestTimeout   RequestTimeoutConfig   `json:"request_timeout"`
+	Retry            RetryConfig            `json:"retry"`
+	FailureCache     FailureCacheConfig     `json:"failure_cache"`
+	CircuitBreaker   CircuitBreakerConfig   `json:"circuit_breaker"`
+	Affinity         AffinityConfig         `json:"affinity"`
+	GeoIP            GeoIPConfig            `json:"geoip"`
+	AccessRules      AccessRulesConfig      `json:"access_rules"`
+	Devices          DevicesConfig          `json:"devices"`
+	Lists            ListsConfig            `json:"lists"`
+	SSRF             SSRFConfig             `json:"ssrf"`
+	Pauses           PausesConfig           `json:"pauses"`
+	Rewrites         []RewriteRule          `json:"rewrites"`  // Applied in order, each to the result of the previous
+	Redirects        []RedirectRule         `json:"redirects"` // The first match answers the request
+	Stubs            []StubRule             `json:"stubs"`     // The first match answers the request without contacting upstream
+	Routes           []RouteRule            `json:"routes"`    // The first rule matching the destination applies
+	Mirrors          []MirrorRule           `json:"mirrors"`   // The first rule matching the request copies it
+	DSCP             []DSCPRule             `json:"dscp"`      // The first rule matching the destination marks its upstream connections
+	Credentials      []CredentialRule       `json:"credentials"`
+	UpstreamAuth     UpstreamAuthConfig     `json:"upstream_auth"`
+	Quota            QuotaConfig            `json:"quota"`
+	Portal           PortalConfig           `json:"portal"`
+	ICAP             ICAPConfig             `json:"icap"`
+	Blocklist        BlocklistConfig        `json:"blocklist"`
+	Adblock          AdblockConfig          `json:"adblock"`
+	Categories       CategoriesConfig       `json:"categories"`
+	Downloads        DownloadsConfig        `json:"downloads"`
+	Policy           PolicyConfig           `json:"policy"`
+	HAR              HARConfig              `json:"har"`
+	BodyLog          BodyLogConfig          `json:"body_log"`
+	Capture          CaptureConfig          `json:"capture"`
+	Stats            StatsConfig            `json:"stats"`
+	Reports          ReportsConfig          `json:"reports"`
+	MetricsPush      []MetricsPushConfig    `json:"metrics_push"` // Time-series databases the metrics are sent to
+	Webhooks         []WebhookConfig        `json:"webhooks"`     // Receivers of operational events
+	Notifiers        []NotifierConfig       `json:"notifiers"`    // Chat channels operational events are posted to
+	ClientNames      ClientNamesConfig      `json:"client_names"`
+	Neighbors        NeighborsConfig        `json:"neighbors"`
+	DHCP             DHCPConfig             `json:"dhcp"`
+	ErrorPages       ErrorPagesConfig       `json:"error_pages"`
+	State            StateConfig            `json:"state"`
+	Cluster          ClusterConfig          `json:"cluster"`
+	ACME             ACMEConfig             `json:"acme"`
+
+	Profile  string                   `json:"profile"`  // Active entry of profiles, none when empty
+	Profiles map[string]ProfileConfig `json:"profiles"` // Named upstreams and rules to switch between while running
+	Tenants  []TenantConfig           `json:"tenants"`  // Namespaces of their own for groups of clients, the first one a client belongs to applies
+
+	Listeners []ListenerConfig `json:"listeners"`
+	Admin     AdminConfig      `json:"admin"`
+	WPAD      WPADConfig       `json:"wpad"`
+	MDNS      MDNSConfig       `json:"mdns"`
+	LDAP      LDAPConfig       `json:"ldap"`
+	JWT       JWTConfig        `json:"jwt"`
+	Syslog    SyslogConfig     `json:"syslog"`
+	Log       LogConfig        `json:"log"`
+
+	UDPForwarders []UDPForwarderConfig `json:"udp_forwarders"` // Ports relaying datagrams to fixed destinations
+}
+
+// Upstream balancing strategies
+const (
+	BalanceFailover = "failover" // The first healthy upstream in configured order
+	BalanceFastest  = "fastest"  // The healthy upstream with the lowest recent latency
+)
+
+// PoolConfig sizes the connection pool of each upstream. Zero values keep
+// the net/http defaults.
+type PoolConfig struct {
+	MaxIdleConns        int      `json:"max_idle_conns"`          // Idle connections kept in total, unlimited when 0
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"` // Idle connections kept per destination, 2 when 0
+	MaxConnsPerHost     int      `json:"max_conns_per_host"`      // Connections per destination including active ones, unlimited when 0
+	IdleConnTimeout     Duration `json:"idle_conn_timeout"`       // How long an idle connection is kept, forever when 0
+	DisableKeepAlives   bool     `json:"disable_keep_alives"`     // Use each connection for a single request
+	ReapInterval        Duration `json:"reap_interval"`           // How often the idle connections of upstreams unused since the last sweep are closed, never when 0
+}
+
+// validate rejects negative sizes
+func (c *PoolConfig) validate() error {
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 || c.IdleConnTimeout < 0 || c.ReapInterval < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+const (
+	defaultPrewarmTop      = 20
+	defaultPrewarmHalfLife = 24 * time.Hour
+	defaultPrewarmInterval = 30 * time.Second
+	defaultPrewarmMaxIdle  = 45 * time.Second
+)
+
+// PrewarmConfig prepares for the destinations requested most, ranked by
+// requests that count less the older they are, so that their next requests
+// skip DNS and connection setup
+type PrewarmConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Top      int      `json:"top"`       // Destinations prepared, 20 by default
+	HalfLife Duration `json:"half_life"` // Age at which a request counts half toward a destination's rank, 24h by default
+	Interval Duration `json:"interval"`  // How often the destinations are prepared, 30s by default
+	Resolve  bool     `json:"resolve"`   // Look up the names of those reached directly, refreshing the resolver's cache
+	Connect  bool     `json:"connect"`   // Keep a connection open toward each, to the destination or its upstream proxy
+	MaxIdle  Duration `json:"max_idle"`  // Prepared connections unused for this long are closed, 45s by default
+}
+
+// validate requires something to prepare when enabled and fills in defaults
+func (c *PrewarmConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if !c.Resolve && !c.Connect {
+		return errors.New("resolve or connect is required")
+	}
+	if c.Top < 0 || c.HalfLife < 0 || c.Interval < 0 || c.MaxIdle < 0 {
+		return errors.New("top, half_life, interval and max_idle must not be negative")
+	}
+	if c.Top == 0 {
+		c.Top = defaultPrewarmTop
+	}
+	if c.HalfLife == 0 {
+		c.HalfLife = Duration(defaultPrewarmHalfLife)
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(defaultPrewarmInterval)
+	}
+	if c.MaxIdle == 0 {
+		c.MaxIdle = Duration(defaultPrewarmMaxIdle)
+	}
+	return nil
+}
+
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = time.Minute
+	defaultExpectContinueTimeout = time.Second
+	defaultUpstreamIdleTimeout   = 2 * time.Minute
+	defaultReadHeaderTimeout     = 30 * time.Second
+	defaultHandshakeTimeout      = 30 * time.Second
+	defaultIdleTimeout           = 2 * time.Minute
+	defaultShutdownDrain         = 30 * time.Second
+)
+
+// TimeoutsConfig bounds the phases of client and upstream connections. Zero
+// values take the defaults, negative ones disable the timeout.
+type TimeoutsConfig struct {
+	Dial           Duration `json:"dial"`            // Connecting to an upstream or destination, including tunnel setup, 30s
+	TLSHandshake   Duration `json:"tls_handshake"`   // TLS handshake with a destination, 10s
+	ResponseHeader Duration `json:"response_header"` // From a request being sent to its response headers, 1m
+	ExpectContinue Duration `json:"expect_continue"` // Waiting for 100 Continue before sending a body the client asked about anyway, 1s
+	UpstreamIdle   Duration `json:"upstream_idle"`   // Between reads of a response body that is not streamed, 2m
+	Handshake      Duration `json:"handshake"`       // From accepting a client connection to its first request headers, PROXY header and TLS handshake included, 30s
+	ReadHeader     Duration `json:"read_header"`     // Reading a client's request headers, 30s
+	Read           Duration `json:"read"`            // Reading a whole client request including its body, unlimited by default
+	Write          Duration `json:"write"`           // From reading a client request to finishing its response, unlimited by default
+	Idle           Duration `json:"idle"`            // Keep-alive client connections between requests, 2m
+	TunnelIdle     Duration `json:"tunnel_idle"`     // Tunnels without traffic in either direction, unlimited by default
+	ShutdownDrain  Duration `json:"shutdown_drain"`  // Waiting for in-flight requests on shutdown, 30s
+}
+
+// setDefaults fills in the unset timeouts
+func (c *TimeoutsConfig) setDefaults() {
+	if c.Dial == 0 {
+		c.Dial = Duration(defaultDialTimeout)
+	}
+	if c.TLSHandshake == 0 {
+		c.TLSHandshake = Duration(defaultTLSHandshakeTimeout)
+	}
+	if c.ResponseHeader == 0 {
+		c.ResponseHeader = Duration(defaultResponseHeaderTimeout)
+	}
+	if c.ExpectContinue == 0 {
+		c.ExpectContinue = Duration(defaultExpectContinueTimeout)
+	}
+	if c.UpstreamIdle == 0 {
+		c.UpstreamIdle = Duration(defaultUpstreamIdleTimeout)
+	}
+	if c.Handshake == 0 {
+		c.Handshake = Duration(defaultHandshakeTimeout)
+	}
+	if c.ReadHeader == 0 {
+		c.ReadHeader = Duration(defaultReadHeaderTimeout)
+	}
+	if c.Idle == 0 {
+		c.Idle = Duration(defaultIdleTimeout)
+	}
+	if c.ShutdownDrain == 0 {
+		c.ShutdownDrain = Duration(defaultShutdownDrain)
+	}
+}
+
+// UpstreamDirect as an upstream address connects to destinations without a proxy
+const UpstreamDirect = "direct"
+
+// ParseUpstream parses an upstream proxy address: host:port for an HTTP
+// proxy, or an http://, https://, socks5:// or socks4(a):// URL with optional
+// credentials (a SOCKS4 user ID as the username), an ssh://user@host jump
+// host, or an ss://method:password@host Shadowsocks server.
+// The scheme's default port is added when missing. UpstreamDirect yields nil.
+func ParseUpstream(addr string) (*url.URL, error) {
+	if addr == UpstreamDirect {
+		return nil, nil
+	}
+	raw := addr
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %w", addr, err)
+	}
+	ports := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080", "socks4": "1080", "socks4a": "1080", "ssh": "22", "ss": "8388"}
+	port, ok := ports[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("invalid upstream %q: unsupported scheme %q", addr, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid upstream %q: missing host", addr)
+	}
+	if u.Scheme == "ssh" && u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid upstream %q: missing user", addr)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// Address families for outgoing connections
+const (
+	IPv4Only   = "ipv4"
+	IPv6Only   = "ipv6"
+	PreferIPv4 = "prefer_ipv4"
+	PreferIPv6 = "prefer_ipv6"
+)
+
+const (
+	defaultFallbackDelay = 250 * time.Millisecond
+	defaultDNSRefresh    = 30 * time.Second
+)
+
+// Load loads configuration from file
+func Load(configPath string) (*Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Validate fills in defaults and checks option values. It is safe to call
+// more than once.
+func (c *Config) Validate() error {
+	// Set defaults
+	if c.BufferSize == 0 {
+		c.BufferSize = 8192
+	}
+	switch c.IPFamily {
+	case "", IPv4Only, IPv6Only, PreferIPv4, PreferIPv6:
+	default:
+		return fmt.Errorf("invalid ip_family %q", c.IPFamily)
+	}
+	if c.FallbackDelay == 0 {
+		c.FallbackDelay = Duration(defaultFallbackDelay)
+	}
+	if c.DNSRefresh == 0 {
+		c.DNSRefresh = Duration(defaultDNSRefresh)
+	}
+	switch c.Balance {
+	case "":
+		c.Balance = BalanceFailover
+	case BalanceFailover, BalanceFastest:
+	default:
+		return fmt.Errorf("invalid balance %q", c.Balance)
+	}
+
+	for _, addr := range append([]string{c.ProxyAddr}, c.Upstreams...) {
+		if addr == "" {
+			continue
+		}
+		if _, err := ParseUpstream(addr); err != nil {
+			return err
+		}
+	}
+	if err := c.Pool.validate(); err != nil {
+		return fmt.Errorf("invalid pool: %w", err)
+	}
+	if err := c.Prewarm.validate(); err != nil {
+		return fmt.Errorf("invalid prewarm: %w", err)
+	}
+	c.Timeouts.setDefaults()
+	c.SSH.setDefaults()
+	c.FTP.setDefaults()
+	if err := c.UpstreamTLS.validate(); err != nil {
+		return fmt.Errorf("invalid upstream_tls: %w", err)
+	}
+	if err := c.TCP.Client.validate(); err != nil {
+		return fmt.Errorf("invalid tcp.client: %w", err)
+	}
+	if err := c.TCP.Upstream.validate(); err != nil {
+		return fmt.Errorf("invalid tcp.upstream: %w", err)
+	}
+	if err := c.Limits.validate(); err != nil {
+		return fmt.Errorf("invalid limits: %w", err)
+	}
+	if err := c.SlowClients.validate(); err != nil {
+		return fmt.Errorf("invalid slow_clients: %w", err)
+	}
+	if err := c.Admission.validate(); err != nil {
+		return fmt.Errorf("invalid admission: %w", err)
+	}
+	if err := c.Shaping.validate(); err != nil {
+		return fmt.Errorf("invalid shaping: %w", err)
+	}
+	for i := range c.Redirects {
+		if err := c.Redirects[i].validate(); err != nil {
+			return fmt.Errorf("invalid redirect %d: %w", i+1, err)
+		}
+	}
+	for i := range c.Stubs {
+		if err := c.Stubs[i].validate(); err != nil {
+			return fmt.Errorf("invalid stub %d: %w", i+1, err)
+		}
+	}
+	for i := range c.Routes {
+		if err := c.Routes[i].validate(); err != nil {
+			return fmt.Errorf("invalid route %d: %w", i+1, err)
+		}
+	}
+	for i := range c.DSCP {
+		if err := c.DSCP[i].validate(); err != nil {
+			return fmt.Errorf("invalid dscp rule %d: %w", i+1, err)
+		}
+	}
+	for i := range c.Mirrors {
+		if err := c.Mirrors[i].validate(); err != nil {
+			return fmt.Errorf("invalid mirror rule %d: %w", i+1, err)
+		}
+	}
+	for i := range c.Credentials {
+		if err := c.Credentials[i].validate(); err != nil {
+			return fmt.Errorf("invalid credential rule %d: %w", i+1, err)
+		}
+	}
+	if _, ok := c.Profiles[c.Profile]; c.Profile != "" && !ok {
+		return fmt.Errorf("unknown profile %q", c.Profile)
+	}
+	for name, profile := range c.Profiles {
+		if err := profile.validate(name); err != nil {
+			return fmt.Errorf("invalid profile %s: %w", name, err)
+		}
+	}
+	if err := c.ForwardedHeaders.validate(); err != nil {
+		return fmt.Errorf("invalid forwarded_headers: %w", err)
+	}
+	c.LoopDetection.setDefaults()
+	c.RequestID.setDefaults()
+	if err := c.RequestTimeout.validate(); err != nil {
+		return fmt.Errorf("invalid request_timeout: %w", err)
+	}
+	c.Retry.setDefaults()
+	c.FailureCache.setDefaults()
+	c.CircuitBreaker.setDefaults()
+	if err := c.Affinity.validate(); err != nil {
+		return fmt.Errorf("invalid affinity: %w", err)
+	}
+	if err := c.Quota.validate(); err != nil {
+		return fmt.Errorf("invalid quota: %w", err)
+	}
+	tenants := make(map[string]bool)
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		if err := t.validate(c); err != nil {
+			return fmt.Errorf("invalid tenant %d: %w", i+1, err)
+		}
+		if tenants[t.Name] {
+			return fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		tenants[t.Name] = true
+	}
+	c.Portal.setDefaults()
+	c.State.apply(c)
+	if err := c.Admin.validate(); err != nil {
+		return fmt.Errorf("invalid admin: %w", err)
+	}
+	if err := c.Admin.TLS.validate(); err != nil {
+		return fmt.Errorf("invalid admin.tls: %w", err)
+	}
+	for i := range c.Listeners {
+		if err := c.Listeners[i].TLS.validate(); err != nil {
+			return fmt.Errorf("invalid tls of listener %d: %w", i+1, err)
+		}
+	}
+	for i := range c.UDPForwarders {
+		if err := c.UDPForwarders[i].validate(); err != nil {
+			return fmt.Errorf("invalid UDP forwarder %d: %w", i+1, err)
+		}
+	}
+	if err := c.ACME.validate(c.UsesACME()); err != nil {
+		return fmt.Errorf("invalid acme: %w", err)
+	}
+	if err := c.Blocklist.validate(); err != nil {
+		return fmt.Errorf("invalid blocklist: %w", err)
+	}
+	if err := c.Adblock.validate(); err != nil {
+		return fmt.Errorf("invalid adblock: %w", err)
+	}
+	if err := c.ICAP.validate(); err != nil {
+		return fmt.Errorf("invalid icap: %w", err)
+	}
+	c.Policy.setDefaults()
+	c.HAR.setDefaults()
+	c.BodyLog.setDefaults()
+	c.Capture.setDefaults()
+	c.Stats.setDefaults()
+	if err := c.Reports.validate(c.Stats); err != nil {
+		return fmt.Errorf("invalid reports: %w", err)
+	}
+	for i := range c.MetricsPush {
+		if err := c.MetricsPush[i].validate(); err != nil {
+			return fmt.Errorf("invalid metrics_push %d: %w", i+1, err)
+		}
+	}
+	for i := range c.Webhooks {
+		if err := c.Webhooks[i].validate(); err != nil {
+			return fmt.Errorf("invalid webhook %d: %w", i+1, err)
+		}
+	}
+	for i := range c.Notifiers {
+		if err := c.Notifiers[i].validate(); err != nil {
+			return fmt.Errorf("invalid notifier %d: %w", i+1, err)
+		}
+	}
+	if err := c.Cluster.validate(); err != nil {
+		return fmt.Errorf("invalid cluster: %w", err)
+	}
+	c.ClientNames.setDefaults()
+	c.Neighbors.setDefaults()
+	if err := c.DHCP.validate(); err != nil {
+		return fmt.Errorf("invalid dhcp: %w", err)
+	}
+	if !c.knowsMACs() && (c.Quota.Key == IdentityMAC || c.Affinity.Key == IdentityMAC) {
+		return errors.New("identity key \"mac\" needs neighbors.enabled or dhcp.server")
+	}
+	if err := c.Devices.validate(); err != nil {
+		return fmt.Errorf("invalid devices: %w", err)
+	}
+	c.LDAP.setDefaults()
+	c.JWT.setDefaults()
+	c.Log.setDefaults()
+	if err := c.Syslog.validate(); err != nil {
+		return fmt.Errorf("invalid syslog: %w", err)
+	}
+
+	return nil
+}
+
+// Duration is a time.Duration that unmarshals from strings like "500ms" or "2m"
+type Duration time.Duration
+
+// UnmarshalJSON accepts a Go duration string or a number of seconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	return nil
+}
+
+// MarshalJSON writes the duration as a Go duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// TCPConfig tunes the sockets on both sides of the proxy
+type TCPConfig struct {
+	Client   TCPOptions `json:"client"`   // Connections accepted on the listeners
+	Upstream TCPOptions `json:"upstream"` // Connections to upstreams and, when direct, destinations
+}
+
+// TCPOptions are socket options of TCP connections. Zero values keep the Go
+// and system defaults.
+type TCPOptions struct {
+	Nagle          bool     `json:"nagle"`            // Coalesce small writes by clearing TCP_NODELAY, which Go sets
+	KeepAlive      Duration `json:"keep_alive"`       // Idle time before keep-alive probes and between them, 15s (30s upstream) when unset, negative disables
+	KeepAliveCount int      `json:"keep_alive_count"` // Unanswered probes before the connection is dropped
+	ReadBuffer     int      `json:"read_buffer"`      // SO_RCVBUF in bytes
+	WriteBuffer    int      `json:"write_buffer"`     // SO_SNDBUF in bytes
+}
+
+// validate rejects negative counts and sizes
+func (c *TCPOptions) validate() error {
+	if c.KeepAliveCount < 0 || c.ReadBuffer < 0 || c.WriteBuffer < 0 {
+		return errors.New("keep_alive_count and buffer sizes must not be negative")
+	}
+	return nil
+}
+
+// UpstreamTLSConfig secures connections to https:// upstream proxies
+type UpstreamTLSConfig struct {
+	CAFile             string `json:"ca_file"`              // PEM certificates verifying the proxies instead of the system roots
+	CertFile           string `json:"cert_file"`            // PEM client certificate presented to the proxies
+	KeyFile            string `json:"key_file"`             // Private key of cert_file
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Accept any proxy certificate
+}
+
+// validate checks the client certificate comes with its key
+func (c *UpstreamTLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+const defaultSSHKeepAlive = 30 * time.Second
+
+// SSHConfig authenticates to ssh:// upstreams, jump hosts whose direct-tcpip
+// channels carry the traffic. Keys from the SSH agent at SSH_AUTH_SOCK are
+// offered too, and a password in the upstream URL.
+type SSHConfig struct {
+	KeyFile               string   `json:"key_file"`                 // Private key file
+	Passphrase            string   `json:"passphrase"`               // Of an encrypted key file
+	KnownHosts            string   `json:"known_hosts"`              // Verifies host keys, ~/.ssh/known_hosts when empty
+	InsecureIgnoreHostKey bool     `json:"insecure_ignore_host_key"` // Accept any host key
+	KeepAlive             Duration `json:"keep_alive"`               // Interval of keepalive requests detecting dead connections, 30s when unset, negative disables
+}
+
+// setDefaults fills in the keepalive interval
+func (c *SSHConfig) setDefaults() {
+	if c.KeepAlive == 0 {
+		c.KeepAlive = Duration(defaultSSHKeepAlive)
+	}
+}
+
+const defaultFTPPassword = "gatelan@"
+
+// FTPConfig lets clients fetch ftp:// URLs through the proxy, which logs in
+// to the server and answers with the file or an HTML directory listing
+type FTPConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Password string `json:"password"` // Sent for anonymous logins, gatelan@ by default
+}
+
+// setDefaults fills in the anonymous password
+func (c *FTPConfig) setDefaults() {
+	if c.Password == "" {
+		c.Password = defaultFTPPassword
+	}
+}
+
+// Timeout returns d for net and net/http, where zero rather than a negative
+// value means no timeout
+func (d Duration) Timeout() time.Duration {
+	return max(time.Duration(d), 0)
+}
+
+// BodyFilterConfig configures the response body filter pipeline
+type BodyFilterConfig struct {
+	Enabled         bool              `json:"enabled"`
+	MaxSize         int64             `json:"max_size"`
+	BlockKeywords   []string          `json:"block_keywords"`
+	Replacements    []ReplacementRule `json:"replacements"`
+	StripScripts    bool              `json:"strip_scripts"`
+	Domains         []string          `json:"domains"`
+	DisabledDomains []string          `json:"disabled_domains"`
+	SendDecoded     bool              `json:"send_decoded"` // Send gzip and brotli bodies uncompressed once filtered instead of encoding them again
+}
+
+// ReplacementRule replaces every match of Pattern with Replace
+type ReplacementRule struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+// CacheConfig configures the RFC 7234 response cache
+type CacheConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Dir           string `json:"dir"`             // Store bodies on disk when set, in memory otherwise
+	MaxSize       int64  `json:"max_size"`        // Total bytes kept before LRU eviction
+	MaxObjectSize int64  `json:"max_object_size"` // Largest single response that is stored
+}
+
+// CompressionConfig configures on-the-fly compression of responses toward clients
+type CompressionConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Encodings []string `json:"encodings"` // Preference order, "br" and/or "gzip"
+	Level     int      `json:"level"`     // 0 selects each encoder's default
+	MinSize   int64    `json:"min_size"`
+	Types     []string `json:"types"`
+}
+
+// Actions taken when a response exceeds MaxResponseBody
+const (
+	LimitActionReject   = "reject"
+	LimitActionTruncate = "truncate"
+)
+
+// LimitsConfig configures maximum header and body sizes; zero body sizes
+// mean unlimited
+type LimitsConfig struct {
+	MaxHeaderBytes  int    `json:"max_header_bytes"` // Request line and headers of a client request, 1 MB by default
+	MaxRequestBody  int64  `json:"max_request_body"`
+	MaxResponseBody int64  `json:"max_response_body"`
+	ResponseAction  string `json:"response_action"` // "reject" (default) or "truncate"
+}
+
+// validate checks the header limit and the configured action
+func (c *LimitsConfig) validate() error {
+	if c.MaxHeaderBytes < 0 {
+		return errors.New("max_header_bytes must be positive")
+	}
+	switch c.ResponseAction {
+	case "":
+		c.ResponseAction = LimitActionReject
+	case LimitActionReject, LimitActionTruncate:
+	default:
+		return fmt.Errorf("invalid response_action %q", c.ResponseAction)
+	}
+	return nil
+}
+
+const defaultSlowClientStall = 30 * time.Second
+
+// SlowClientsConfig detects clients that stop reading a response or tunnel
+// data while the proxy holds an upstream connection for them, such as
+// slow-read attacks and broken devices
+type SlowClientsConfig struct {
+	Enabled bool     `json:"enabled"`
+	Stall   Duration `json:"stall"` // A write to the client blocked this long marks it slow, 30s
+	Abort   bool     `json:"abort"` // Close the transfers of slow clients instead of only reporting them
+}
+
+// validate fills in the stall threshold
+func (c *SlowClientsConfig) validate() error {
+	if c.Stall == 0 {
+		c.Stall = Duration(defaultSlowClientStall)
+	}
+	if c.Stall < 0 {
+		return errors.New("stall must be positive")
+	}
+	return nil
+}
+
+const defaultAdmissionMaxWait = 5 * time.Second
+
+// AdmissionConfig bounds the proxy requests and tunnel setups in progress.
+// Beyond the limit they wait in a queue served round robin across clients,
+// so that a burst from one client does not hold back the others.
+type AdmissionConfig struct {
+	MaxConcurrent int      `json:"max_concurrent"` // Requests and tunnel setups in progress, unlimited when 0
+	QueueSize     int      `json:"queue_size"`     // Requests waiting for a slot, beyond which they are refused at once
+	MaxWait       Duration `json:"max_wait"`       // Longest wait in the queue before a 503, 5s
+}
+
+// validate fills in the longest wait
+func (c *AdmissionConfig) validate() error {
+	if c.MaxConcurrent < 0 || c.QueueSize < 0 {
+		return errors.New("max_concurrent and queue_size must not be negative")
+	}
+	if c.MaxWait == 0 {
+		c.MaxWait = Duration(defaultAdmissionMaxWait)
+	}
+	if c.MaxWait < 0 {
+		return errors.New("max_wait must be positive")
+	}
+	return nil
+}
+
+// ShapingConfig divides the bandwidth of the uplink between classes of
+// clients while they contend for it, each class getting a share in
+// proportion to its weight. A class alone on the link may use all of it.
+type ShapingConfig struct {
+	Enabled  bool           `json:"enabled"`
+	Download int64          `json:"download"` // Bytes per second relayed to clients, not shaped when 0
+	Upload   int64          `json:"upload"`   // Bytes per second relayed from clients, not shaped when 0
+	Classes  []ShapingClass `json:"classes"`  // The first class matching the client applies; other clients are not shaped
+}
+
+// ShapingClass is a class of clients sharing the shaped bandwidth
+type ShapingClass struct {
+	Name    string   `json:"name"`
+	Clients []string `json:"clients"` // Client addresses or CIDRs, all clients when empty
+	Weight  int      `json:"weight"`  // Share relative to the other classes, 1 by default
+}
+
+// validate requires a rate and classes when enabled and fills in weights
+func (c *ShapingConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Download < 0 || c.Upload < 0 {
+		return errors.New("download and upload must not be negative")
+	}
+	if c.Download == 0 && c.Upload == 0 {
+		return errors.New("download or upload is required")
+	}
+	if len(c.Classes) == 0 {
+		return errors.New("classes are required")
+	}
+	for i := range c.Classes {
+		class := &c.Classes[i]
+		if class.Weight < 0 {
+			return fmt.Errorf("invalid class %d: weight must not be negative", i+1)
+		}
+		if class.Weight == 0 {
+			class.Weight = 1
+		}
+	}
+	return nil
+}
+
+// X-Forwarded-For handling modes
+const (
+	ForwardedForPreserve = "preserve"
+	ForwardedForAppend   = "append"
+	ForwardedForStrip    = "strip"
+)
+
+// HeadersConfig overrides headers on requests sent upstream. Client headers
+// are forwarded unchanged by default.
+type HeadersConfig struct {
+	UserAgent string            `json:"user_agent"` // Replaces the client's User-Agent when set
+	Set       map[string]string `json:"set"`        // Set on every request, e.g. "Connection": "close"
+	Remove    []string          `json:"remove"`     // Dropped from every request
+}
+
+const defaultViaPseudonym = "gatelan"
+
+// ForwardedHeadersConfig controls X-Forwarded-For, X-Real-IP and Via headers
+type ForwardedHeadersConfig struct {
+	ForwardedFor string `json:"forwarded_for"` // "preserve" (default), "append" or "strip"
+	RealIP       bool   `json:"real_ip"`       // Set X-Real-IP when appending
+	Via          bool   `json:"via"`
+	ViaPseudonym string `json:"via_pseudonym"`
+}
+
+// validate checks the mode and fills in defaults
+func (c *ForwardedHeadersConfig) validate() error {
+	switch c.ForwardedFor {
+	case "":
+		c.ForwardedFor = ForwardedForPreserve
+	case ForwardedForPreserve, ForwardedForAppend, ForwardedForStrip:
+	default:
+		return fmt.Errorf("invalid forwarded_for %q", c.ForwardedFor)
+	}
+	if c.ViaPseudonym == "" {
+		c.ViaPseudonym = defaultViaPseudonym
+	}
+	return nil
+}
+
+const defaultLoopHeader = "X-GateLAN-Loop"
+
+// LoopDetectionConfig controls detection of requests that already passed this instance
+type LoopDetectionConfig struct {
+	Disabled   bool   `json:"disabled"`
+	Header     string `json:"header"`      // Private marker header carrying instance IDs
+	InstanceID string `json:"instance_id"` // Random per process when empty
+	CheckVia   bool   `json:"check_via"`   // Also treat our own Via pseudonym as a loop
+}
+
+// setDefaults fills in the marker header and instance ID
+func (c *LoopDetectionConfig) setDefaults() {
+	if c.Header == "" {
+		c.Header = defaultLoopHeader
+	}
+	if c.InstanceID == "" {
+		var id [8]byte
+		rand.Read(id[:])
+		c.InstanceID = hex.EncodeToString(id[:])
+	}
+}
+
+const defaultRequestIDHeader = "X-Request-ID"
+
+// RequestIDConfig controls the IDs that tag the log lines of each request and tunnel
+type RequestIDConfig struct {
+	Inject bool   `json:"inject"` // Send the ID upstream with each request
+	Header string `json:"header"` // Header carrying the ID upstream, X-Request-ID by default
+}
+
+// setDefaults fills in the header
+func (c *RequestIDConfig) setDefaults() {
+	if c.Header == "" {
+		c.Header = defaultRequestIDHeader
+	}
+}
+
+const (
+	defaultRequestTimeoutHeader = "X-Gatelan-Timeout"
+	defaultRequestTimeoutMax    = 10 * time.Minute
+)
+
+// RequestTimeoutConfig lets trusted clients set the timeouts of a single
+// request with a header holding a duration such as "5m". It replaces the
+// response_header and upstream_idle timeouts for that request, so known
+// long-running internal APIs can run longer and others fail sooner.
+type RequestTimeoutConfig struct {
+	Clients []string `json:"clients"` // Addresses or CIDRs trusted with the header, none when empty
+	Header  string   `json:"header"`  // X-Gatelan-Timeout by default, never sent upstream
+	Max     Duration `json:"max"`     // Longer requested timeouts are capped, 10m by default
+}
+
+// validate fills in the header and the cap
+func (c *RequestTimeoutConfig) validate() error {
+	if c.Header == "" {
+		c.Header = defaultRequestTimeoutHeader
+	}
+	if c.Max == 0 {
+		c.Max = Duration(defaultRequestTimeoutMax)
+	}
+	if c.Max < 0 {
+		return errors.New("max must be positive")
+	}
+	return nil
+}
+
+const (
+	defaultRetryInitialBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 2 * time.Second
+)
+
+// RetryConfig controls retries of idempotent requests on upstream connection errors
+type RetryConfig struct {
+	MaxAttempts    int      `json:"max_attempts"` // Retries after the first attempt, 0 disables
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+	SwitchUpstream bool     `json:"switch_upstream"` // Rotate through upstreams between attempts
+}
+
+// setDefaults fills in the backoff bounds
+func (c *RetryConfig) setDefaults() {
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = Duration(defaultRetryInitialBackoff)
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = Duration(defaultRetryMaxBackoff)
+	}
+}
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// CircuitBreakerConfig controls per-upstream circuit breaking
+type CircuitBreakerConfig struct {
+	Enabled          bool     `json:"enabled"`
+	FailureThreshold int      `json:"failure_threshold"` // Consecutive failures before opening
+	Cooldown         Duration `json:"cooldown"`          // Time spent open before probing again
+	FallbackDirect   bool     `json:"fallback_direct"`   // Connect to destinations directly while every upstream's breaker is open
+}
+
+// setDefaults fills in threshold and cool-down
+func (c *CircuitBreakerConfig) setDefaults() {
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = defaultBreakerThreshold
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = Duration(defaultBreakerCooldown)
+	}
+}
+
+// ListenerConfig declares one inbound proxy listener
+type ListenerConfig struct {
+	Name          string            `json:"name"`
+	Addr          string            `json:"addr"`           // host:port, or "systemd[:name]" for socket activation
+	Socket        string            `json:"socket"`         // Unix domain socket path, used instead of addr
+	Mode          string            `json:"mode"`           // Octal permissions for the socket file, e.g. "0660"
+	Allow         []string          `json:"allow"`          // Client addresses/CIDRs admitted, all when empty
+	Deny          []string          `json:"deny"`           // Client addresses/CIDRs rejected
+	Users         map[string]string `json:"users"`          // Basic proxy auth credentials, no auth when empty
+	Realm         string            `json:"realm"`          // Proxy-Authenticate realm
+	Upstream      string            `json:"upstream"`       // Default upstream proxy, proxy_addr when empty
+	Auth          string            `json:"auth"`           // "ldap" checks credentials against the LDAP backend instead of users, "jwt" accepts only bearer tokens
+	Profile       string            `json:"profile"`        // Entry of profiles whose upstreams and rules apply here, the active one when empty
+	TLS           ServerTLSConfig   `json:"tls"`            // Serves the proxy over TLS, for clients supporting HTTPS proxies
+	ProxyProtocol []string          `json:"proxy_protocol"` // Load balancer addresses/CIDRs whose connections start with a PROXY protocol v1 or v2 header, every peer of a socket then
+}
+
+// Identities per-client features key on: the client IP, the proxy auth user
+// or the MAC address of the client, the latter two with the client IP as
+// fallback
+const (
+	IdentityClient = "client"
+	IdentityUser   = "user"
+	IdentityMAC    = "mac" // Needs neighbors.enabled or dhcp.server
+)
+
+// validateIdentity checks an identity key, defaulting to the client IP
+func validateIdentity(key *string) error {
+	switch *key {
+	case "":
+		*key = IdentityClient
+	case IdentityClient, IdentityUser, IdentityMAC:
+	default:
+		return fmt.Errorf("invalid key %q", *key)
+	}
+	return nil
+}
+
+const defaultAffinityTTL = 30 * time.Minute
+
+// AffinityConfig pins clients to the upstream that served them last
+type AffinityConfig struct {
+	Enabled bool     `json:"enabled"`
+	Key     string   `json:"key"` // "client" (default), "user" or "mac", falling back to the client IP
+	TTL     Duration `json:"ttl"` // Idle time after which a pin is forgotten
+}
+
+// validate checks the key and fills in defaults
+func (c *AffinityConfig) validate() error {
+	if err := validateIdentity(&c.Key); err != nil {
+		return err
+	}
+	if c.TTL == 0 {
+		c.TTL = Duration(defaultAffinityTTL)
+	}
+	return nil
+}
+
+// AccessRulesConfig lists scheduled allow/block rules; the first match decides
+type AccessRulesConfig struct {
+	Timezone string             `json:"timezone"` // IANA zone schedules are evaluated in, local time when empty
+	Rules    []AccessRuleConfig `json:"rules"`
+}
+
+// AccessRuleConfig matches requests by client, destination and time of day
+type AccessRuleConfig struct {
+	Name    string   `json:"name"`
+	Action  string   `json:"action"`  // "block" or "allow"
+	Clients []string `json:"clients"` // Client addresses/CIDRs or MAC addresses, all when empty
+	Hosts   []string `json:"hosts"`   // Client host names, as client_names or dhcp know them, with * wildcards; a client matching clients or hosts is matched
+	Domains []string `json:"domains"` // Destination domains, all when empty
+	Groups  []string `json:"groups"`  // Proxy auth groups, all users when empty
+	Devices []string `json:"devices"` // Device classes, see DevicesConfig, all devices when empty
+	Days    []string `json:"days"`    // "mon".."sun", "weekdays" or "weekends", every day when empty
+	From    string   `json:"from"`    // "HH:MM", all day when from and to are empty
+	To      string   `json:"to"`
+}
+
+const defaultDeviceTTL = 24 * time.Hour
+
+// DevicesConfig classifies clients into device classes that access rules
+// match on. A client keeps the class last recognized from its User-Agent or
+// TLS fingerprint, so that requests without either, such as tunnels of IoT
+// devices, are classified too.
+type DevicesConfig struct {
+	Enabled bool          `json:"enabled"`
+	Classes []DeviceClass `json:"classes"` // Tried in order before the built-in phone, console, iot and desktop classes
+	TTL     Duration      `json:"ttl"`     // How long a client keeps its class, 24h
+}
+
+// DeviceClass recognizes one kind of device
+type DeviceClass struct {
+	Name            string   `json:"name"`
+	UserAgents      []string `json:"user_agents"`      // Case-insensitive substrings of the User-Agent
+	TLSFingerprints []string `json:"tls_fingerprints"` // JA3 hashes of the ClientHello sent through tunnels
+}
+
+// validate checks the class names and fills in the TTL
+func (c *DevicesConfig) validate() error {
+	for i, class := range c.Classes {
+		if class.Name == "" {
+			return fmt.Errorf("class %d: name is required", i+1)
+		}
+		if len(class.UserAgents) == 0 && len(class.TLSFingerprints) == 0 {
+			return fmt.Errorf("class %s: user_agents or tls_fingerprints is required", class.Name)
+		}
+	}
+	if c.TTL == 0 {
+		c.TTL = Duration(defaultDeviceTTL)
+	}
+	if c.TTL < 0 {
+		return errors.New("ttl must be positive")
+	}
+	return nil
+}
+
+const defaultFailureCacheTTL = 10 * time.Second
+
+// FailureCacheConfig remembers destinations that could not be reached for a
+// while, answering further requests to them with an error page right away
+// instead of waiting out another timeout for every reload
+type FailureCacheConfig struct {
+	Enabled bool     `json:"enabled"`
+	TTL     Duration `json:"ttl"` // How long a failure is remembered, 10s by default
+}
+
+// setDefaults fills in the TTL
+func (c *FailureCacheConfig) setDefaults() {
+	if c.TTL <= 0 {
+		c.TTL = Duration(defaultFailureCacheTTL)
+	}
+}
+
+// PausesConfig suspends forwarding during scheduled windows
+type PausesConfig struct {
+	Timezone string        `json:"timezone"` // IANA zone windows are evaluated in, local time when empty
+	Windows  []PauseWindow `json:"windows"`
+}
+
+// PauseWindow answers every request of the matching clients with a block page
+// while it is active
+type PauseWindow struct {
+	Name     string   `json:"name"`
+	Profiles []string `json:"profiles"` // Paused while one of these profiles applies, always when empty
+	Clients  []string `json:"clients"`  // Client addresses/CIDRs, all when empty
+	Days     []string `json:"days"`     // "mon".."sun", "weekdays" or "weekends", every day when empty
+	From     string   `json:"from"`     // "HH:MM", all day when from and to are empty
+	To       string   `json:"to"`
+	Message  string   `json:"message"` // Shown on the block page
+}
+
+// RewriteRule transforms the URLs of requests matching a regular expression
+// before they are forwarded
+type RewriteRule struct {
+	Name    string `json:"name"`
+	Match   string `json:"match"`   // Regular expression matched against the whole URL, such as "^https?://repo\\.maven\\.org/"
+	Replace string `json:"replace"` // Replacement, expanding $1 or ${name} to submatches, such as "https://mirror.corp.lan/"
+}
+
+// ProfileConfig is a named set of upstreams and rules that replaces the
+// top-level one while active. Unset fields keep the top-level settings, except
+// that a proxy_addr replaces the top-level upstreams along with it.
+type ProfileConfig struct {
+	ProxyAddr   string             `json:"proxy_addr"`
+	Upstreams   []string           `json:"upstreams"`
+	NoProxy     []string           `json:"no_proxy"`
+	AccessRules *AccessRulesConfig `json:"access_rules"`
+	Rewrites    []RewriteRule      `json:"rewrites"`
+	Redirects   []RedirectRule     `json:"redirects"`
+	Routes      []RouteRule        `json:"routes"`
+}
+
+// validate checks the profile's upstreams and rules
+func (p *ProfileConfig) validate(name string) error {
+	if name == "" {
+		return errors.New("name must not be empty")
+	}
+	for _, addr := range append([]string{p.ProxyAddr}, p.Upstreams...) {
+		if addr == "" {
+			continue
+		}
+		if _, err := ParseUpstream(addr); err != nil {
+			return err
+		}
+	}
+	for i := range p.Redirects {
+		if err := p.Redirects[i].validate(); err != nil {
+			return fmt.Errorf("invalid redirect %d: %w", i+1, err)
+		}
+	}
+	for i := range p.Routes {
+		if err := p.Routes[i].validate(); err != nil {
+			return fmt.Errorf("invalid route %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// ProfileNames returns the names of the configured profiles in sorted order
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithProfile returns a copy of c with the settings of the named profile
+// applied, or c itself for the empty name
+func (c *Config) WithProfile(name string) (*Config, error) {
+	if name == "" {
+		return c, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+
+	copied := *c
+	copied.Profile = name
+	if p.ProxyAddr != "" {
+		copied.ProxyAddr, copied.Upstreams = p.ProxyAddr, p.Upstreams
+	} else if p.Upstreams != nil {
+		copied.Upstreams = p.Upstreams
+	}
+	if p.NoProxy != nil {
+		copied.NoProxy = p.NoProxy
+	}
+	if p.AccessRules != nil {
+		copied.AccessRules = *p.AccessRules
+	}
+	if p.Rewrites != nil {
+		copied.Rewrites = p.Rewrites
+	}
+	if p.Redirects != nil {
+		copied.Redirects = p.Redirects
+	}
+	if p.Routes != nil {
+		copied.Routes = p.Routes
+	}
+	return &copied, nil
+}
+
+// TenantConfig is a namespace of its own inside the gateway, such as a
+// department: its clients get its rules and are charged to its quota,
+// counted in its stats and logged to its log, apart from other tenants
+type TenantConfig struct {
+	Name      string      `json:"name"`       // Letters, digits, "-", "_" and ".", naming it in metrics, the admin API and file names
+	Networks  []string    `json:"networks"`   // Client addresses/CIDRs belonging to it, such as the subnet of a VLAN
+	Realms    []string    `json:"realms"`     // Realms of the listeners whose authenticated users belong to it
+	Profile   string      `json:"profile"`    // Entry of profiles whose upstreams and rules replace those of the listener, its upstream included
+	Quota     QuotaConfig `json:"quota"`      // Caps of its own, replacing the top-level quota for its clients
+	StatsFile string      `json:"stats_file"` // Its usage statistics, kept when stats are enabled, are persisted here when set
+	Log       LogConfig   `json:"log"`        // File receiving the log lines of its requests, besides the main log
+}
+
+// validate checks the name, profile and quota
+func (t *TenantConfig) validate(c *Config) error {
+	if t.Name == "" {
+		return errors.New("name must not be empty")
+	}
+	for _, r := range t.Name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid name %q", t.Name)
+		}
+	}
+	if len(t.Networks) == 0 && len(t.Realms) == 0 {
+		return errors.New("networks or realms are required")
+	}
+	if _, ok := c.Profiles[t.Profile]; t.Profile != "" && !ok {
+		return fmt.Errorf("unknown profile %q", t.Profile)
+	}
+	if err := t.Quota.validate(); err != nil {
+		return fmt.Errorf("invalid quota: %w", err)
+	}
+	if t.Quota.Key == IdentityMAC && !c.knowsMACs() {
+		return errors.New("identity key \"mac\" needs neighbors.enabled or dhcp.server")
+	}
+	if t.Log.File != "" {
+		t.Log.setDefaults()
+	}
+	return nil
+}
+
+// RedirectRule answers requests whose URL matches a regular expression with a
+// redirect instead of forwarding them
+type RedirectRule struct {
+	Name     string `json:"name"`
+	Match    string `json:"match"`    // Regular expression matched against the whole URL, such as "^http://(intranet\\.corp\\.lan/.*)"
+	Location string `json:"location"` // Target, expanding $1 or ${name} to submatches, such as "https://$1"
+	Status   int    `json:"status"`   // 301, 302 (default), 303, 307 or 308
+}
+
+// validate fills in the status and checks the rule
+func (r *RedirectRule) validate() error {
+	if r.Location == "" {
+		return errors.New("location is required")
+	}
+	switch r.Status {
+	case 0:
+		r.Status = 302
+	case 301, 302, 303, 307, 308:
+	default:
+		return fmt.Errorf("invalid status %d", r.Status)
+	}
+	return nil
+}
+
+// StubRule answers requests whose URL matches a regular expression itself,
+// from a fixed response or a local directory, for lab networks and for
+// resources that must stay available while the WAN is down
+type StubRule struct {
+	Name     string            `json:"name"`
+	Match    string            `json:"match"`     // Regular expression matched against the whole URL, such as "^http://status\\.corp\\.lan/"
+	Methods  []string          `json:"methods"`   // Methods answered, all when empty
+	Status   int               `json:"status"`    // Status of the fixed response, 200 by default
+	Headers  map[string]string `json:"headers"`   // Set on the response
+	Body     string            `json:"body"`      // Body of the fixed response
+	BodyFile string            `json:"body_file"` // File read for the body of the fixed response in place of body
+	Dir      string            `json:"dir"`       // Directory serving GET and HEAD by URL path, in place of a fixed response
+	Offline  bool              `json:"offline"`   // Only answer while the circuit breakers of every upstream are open
+}
+
+// validate fills in the status and checks the rule answers somehow
+func (r *StubRule) validate() error {
+	if r.Match == "" {
+		return errors.New("match is required")
+	}
+	if r.Dir != "" && (r.Body != "" || r.BodyFile != "") {
+		return errors.New("dir excludes body and body_file")
+	}
+	if r.Body != "" && r.BodyFile != "" {
+		return errors.New("body and body_file are exclusive")
+	}
+	if r.Status == 0 {
+		r.Status = 200
+	}
+	if r.Status < 100 || r.Status > 599 {
+		return fmt.Errorf("invalid status %d", r.Status)
+	}
+	return nil
+}
+
+// RouteRule changes how requests to matching destinations are sent upstream,
+// for example to front a service or reach one behind a shared anycast address
+type RouteRule struct {
+	Name     string   `json:"name"`
+	Domains  []string `json:"domains"`  // Destination domains, matching subdomains too
+	Upstream string   `json:"upstream"` // Upstream proxy for requests and tunnels, see ParseUpstream
+	Host     string   `json:"host"`     // Host header sent in place of the destination's
+	SNI      string   `json:"sni"`      // TLS server name presented to https destinations in place of theirs
+}
+
+// validate checks the rule overrides something for some destination
+func (r *RouteRule) validate() error {
+	if len(r.Domains) == 0 {
+		return errors.New("domains are required")
+	}
+	if r.Upstream == "" && r.Host == "" && r.SNI == "" {
+		return errors.New("one of upstream, host or sni is required")
+	}
+	if r.Upstream != "" {
+		if _, err := ParseUpstream(r.Upstream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MirrorRule sends a copy of matching requests through a secondary upstream
+// and discards the responses, so that a new egress proxy or filter can be
+// tried on real traffic before switching to it. Tunnels are not mirrored.
+type MirrorRule struct {
+	Name     string   `json:"name"`
+	Domains  []string `json:"domains"`  // Destination domains, matching subdomains too, all when empty
+	Clients  []string `json:"clients"`  // Client addresses or CIDRs, all clients when empty
+	Upstream string   `json:"upstream"` // Upstream proxy the copies go through, see ParseUpstream
+	Percent  int      `json:"percent"`  // Share of matching requests copied, 100 by default
+	MaxBody  int64    `json:"max_body"` // Largest request body copied, 1 MiB by default; larger and chunked bodies are not
+	Timeout  Duration `json:"timeout"`  // Time allowed for each copy, 30s by default
+}
+
+const (
+	defaultMirrorMaxBody = 1 << 20
+	defaultMirrorTimeout = 30 * time.Second
+)
+
+// validate requires an upstream and sets defaults
+func (r *MirrorRule) validate() error {
+	if r.Upstream == "" {
+		return errors.New("upstream is required")
+	}
+	if _, err := ParseUpstream(r.Upstream); err != nil {
+		return err
+	}
+	if r.Percent < 0 || r.Percent > 100 {
+		return fmt.Errorf("invalid percent %d", r.Percent)
+	}
+	if r.Percent == 0 {
+		r.Percent = 100
+	}
+	if r.MaxBody < 0 || r.Timeout < 0 {
+		return errors.New("max_body and timeout must not be negative")
+	}
+	if r.MaxBody == 0 {
+		r.MaxBody = defaultMirrorMaxBody
+	}
+	if r.Timeout == 0 {
+		r.Timeout = Duration(defaultMirrorTimeout)
+	}
+	return nil
+}
+
+// DSCPRule marks the upstream connections opened for matching destinations
+// with a DSCP code point, so that the router's QoS can prioritize flows that
+// all leave from the gateway's address. Plain HTTP requests sent through an
+// HTTP proxy share its connections, which keep the mark of the request that
+// opened them. Windows ignores the marks unless a QoS policy allows them.
+type DSCPRule struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"` // Destination domains, matching subdomains too
+	Class   string   `json:"class"`   // "ef", "afXY", "csN", "va", "le", "be" or a number from 0 to 63
+}
+
+// validate requires destinations and a known class
+func (r *DSCPRule) validate() error {
+	if len(r.Domains) == 0 {
+		return errors.New("domains are required")
+	}
+	_, err := ParseDSCP(r.Class)
+	return err
+}
+
+// ParseDSCP returns the code point of a DSCPRule class
+func ParseDSCP(class string) (int, error) {
+	name := strings.ToLower(class)
+	switch name {
+	case "be", "df":
+		return 0, nil
+	case "le":
+		return 1, nil
+	case "va":
+		return 44, nil
+	case "ef":
+		return 46, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n >= 0 && n <= 63 {
+		return n, nil
+	}
+	if len(name) == 3 && name[:2] == "cs" && name[2] >= '0' && name[2] <= '7' {
+		return int(name[2]-'0') * 8, nil
+	}
+	if len(name) == 4 && name[:2] == "af" && name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3' {
+		return int(name[2]-'0')*8 + int(name[3]-'0')*2, nil
+	}
+	return 0, fmt.Errorf("invalid DSCP class %q", class)
+}
+
+// CredentialRule attaches stored credentials to the requests for internal
+// services, so that clients reach them without holding the secrets. The first
+// rule matching the destination and client applies. Tunnels are left alone,
+// as their requests are encrypted end to end.
+type CredentialRule struct {
+	Name         string   `json:"name"`
+	Domains      []string `json:"domains"` // Destination hosts, matching subdomains too
+	Clients      []string `json:"clients"` // Addresses or CIDRs, all clients when empty
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	PasswordFile string   `json:"password_file"` // Holds the password instead of password
+	TokenFile    string   `json:"token_file"`    // Holds a bearer token sent instead of Basic credentials
+}
+
+// validate requires destinations and either Basic credentials or a token
+func (r *CredentialRule) validate() error {
+	if len(r.Domains) == 0 {
+		return errors.New("domains are required")
+	}
+	if (r.Username == "") == (r.TokenFile == "") {
+		return errors.New("one of username or token_file is required")
+	}
+	if r.Password != "" && r.PasswordFile != "" {
+		return errors.New("password and password_file are mutually exclusive")
+	}
+	if r.TokenFile != "" && (r.Password != "" || r.PasswordFile != "") {
+		return errors.New("a password cannot be used with token_file")
+	}
+	return nil
+}
+
+// Quota periods
+const (
+	QuotaDaily   = "daily"
+	QuotaMonthly = "monthly"
+)
+
+const (
+	defaultPortalHost   = "portal.gatelan"
+	defaultPortalExpiry = 24 * time.Hour
+)
+
+// ListsConfig keeps the block and allow lists of destination domains and
+// addresses that the admin API edits at runtime
+type ListsConfig struct {
+	File string `json:"file"` // Entries are persisted across restarts when set
+}
+
+// SSRFConfig keeps clients from reaching, through the gateway, the networks
+// it sits in. Unless disabled, requests and tunnels to private, loopback,
+// link-local (cloud metadata included) and unspecified addresses are refused.
+type SSRFConfig struct {
+	Disabled bool     `json:"disabled"`
+	Allow    []string `json:"allow"` // Domains, addresses and CIDRs still reachable, such as intranet servers
+}
+
+// PortalConfig holds back clients until they accept the network's terms on a
+// page the forwarder serves itself
+type PortalConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Host     string   `json:"host"`     // Host name the page is served under, portal.gatelan when empty
+	Page     string   `json:"page"`     // Go template file for the page, which receives a forwarder.PortalPage; built in when empty
+	Password string   `json:"password"` // Shared passphrase clients must enter, none when empty
+	Expiry   Duration `json:"expiry"`   // How long an acceptance lasts, 24h when unset
+	Exempt   []string `json:"exempt"`   // Client addresses/CIDRs never held back
+	File     string   `json:"file"`     // Acceptances are persisted across restarts when set
+}
+
+// setDefaults fills in the host and expiry
+func (c *PortalConfig) setDefaults() {
+	if c.Host == "" {
+		c.Host = defaultPortalHost
+	}
+	if c.Expiry == 0 {
+		c.Expiry = Duration(defaultPortalExpiry)
+	}
+}
+
+// UpstreamAuthConfig lets clients authenticate with the upstream proxy
+// themselves, so that it accounts for each user. Their 407 challenges are
+// otherwise answered with a 502.
+type UpstreamAuthConfig struct {
+	PassThrough bool     `json:"pass_through"` // Relay the upstream's challenges and the clients' Proxy-Authorization
+	Clients     []string `json:"clients"`      // Client addresses or CIDRs able to authenticate, all when empty
+}
+
+// QuotaConfig caps the data each user or client may transfer per period
+type QuotaConfig struct {
+	Enabled   bool             `json:"enabled"`
+	Key       string           `json:"key"`       // "client" (default), "user" or "mac"
+	Period    string           `json:"period"`    // "daily" or "monthly" (default)
+	Limit     int64            `json:"limit"`     // Bytes per period, 0 for no default cap
+	Overrides map[string]int64 `json:"overrides"` // Per user, client IP or MAC address limits
+	File      string           `json:"file"`      // Usage is persisted across restarts when set
+}
+
+// validate checks the key and period
+func (c *QuotaConfig) validate() error {
+	if err := validateIdentity(&c.Key); err != nil {
+		return err
+	}
+	switch c.Period {
+	case "":
+		c.Period = QuotaMonthly
+	case QuotaDaily, QuotaMonthly:
+	default:
+		return fmt.Errorf("invalid period %q", c.Period)
+	}
+	return nil
+}
+
+// GeoIPConfig routes or blocks requests by the country of the destination
+type GeoIPConfig struct {
+	Database string            `json:"database"` // MaxMind .mmdb country or city database, disabled when empty
+	Block    []string          `json:"block"`    // ISO country codes of destinations to refuse
+	Routes   map[string]string `json:"routes"`   // ISO country code to upstream proxy address
+}
+
+// Blocklist feed formats
+const (
+	FeedPlain = "plain" // One domain, IP, CIDR or URL per line
+	FeedHosts = "hosts" // hosts file entries such as "0.0.0.0 ads.example.com"
+	FeedABP   = "abp"   // AdBlock Plus "||example.com^" rules
+)
+
+const defaultBlocklistRefresh = 6 * time.Hour
+
+// BlocklistConfig refuses destinations listed in downloaded threat feeds
+type BlocklistConfig struct {
+	Feeds   []FeedConfig `json:"feeds"`
+	Refresh Duration     `json:"refresh"` // How often feeds are downloaded again
+}
+
+// FeedConfig is one subscribed blocklist
+type FeedConfig struct {
+	Name   string `json:"name"` // Shown in logs and the admin API, the URL when empty
+	URL    string `json:"url"`
+	Format string `json:"format"` // plain (default), hosts or abp
+}
+
+// validate fills in defaults and checks every feed
+func (c *BlocklistConfig) validate() error {
+	if c.Refresh == 0 {
+		c.Refresh = Duration(defaultBlocklistRefresh)
+	}
+	for i := range c.Feeds {
+		feed := &c.Feeds[i]
+		if feed.URL == "" {
+			return fmt.Errorf("feed %d has no url", i+1)
+		}
+		if feed.Name == "" {
+			feed.Name = feed.URL
+		}
+		switch feed.Format {
+		case "":
+			feed.Format = FeedPlain
+		case FeedPlain, FeedHosts, FeedABP:
+		default:
+			return fmt.Errorf("feed %s: invalid format %q", feed.Name, feed.Format)
+		}
+	}
+	return nil
+}
+
+// CategoriesConfig refuses destination categories per group of clients,
+// e.g. adult and gambling sites for the kids' VLAN
+type CategoriesConfig struct {
+	// Categorized domain database: a directory with one subdirectory per
+	// category holding a "domains" file (UT1/Shalla layout), or a file of
+	// "domain category[,category...]" lines
+	Database string            `json:"database"`
+	Profiles []CategoryProfile `json:"profiles"` // The first profile containing the client applies
+}
+
+// CategoryProfile blocks categories for the clients in its networks
+type CategoryProfile struct {
+	Name    string   `json:"name"`
+	Clients []string `json:"clients"` // Addresses or CIDRs, such as a VLAN's subnet
+	Block   []string `json:"block"`   // Category names as used in the database
+}
+
+// DownloadsConfig refuses responses by content type or file extension once
+// their headers arrive, before any of the body reaches the client
+type DownloadsConfig struct {
+	Rules []DownloadRule `json:"rules"` // Every rule containing the client applies
+}
+
+// DownloadRule blocks downloads for the clients in its networks
+type DownloadRule struct {
+	Name         string   `json:"name"`
+	Clients      []string `json:"clients"`       // Addresses or CIDRs, all clients when empty
+	ContentTypes []string `json:"content_types"` // Media types such as "application/vnd.android.package-archive", or "video/*"
+	Extensions   []string `json:"extensions"`    // Of the URL path or the Content-Disposition file name, such as ".exe"
+}
+
+const defaultAdblockRefresh = 24 * time.Hour
+
+// AdblockConfig answers requests matching AdBlock Plus style rules locally
+// instead of forwarding them
+type AdblockConfig struct {
+	Profiles []AdblockProfile `json:"profiles"`
+	Response int              `json:"response"` // Status returned for blocked requests, 204 by default
+	Refresh  Duration         `json:"refresh"`  // How often list URLs are downloaded again
+}
+
+// AdblockProfile is a named set of filter lists, such as "ads" or "trackers"
+type AdblockProfile struct {
+	Name   string   `json:"name"`
+	Lists  []string `json:"lists"`   // Files or http(s) URLs of filter lists
+	Rules  []string `json:"rules"`   // Inline rules
+	OptOut []string `json:"opt_out"` // Clients (addresses or CIDRs) the profile doesn't apply to
+}
+
+// validate fills in defaults and checks the response status
+func (c *AdblockConfig) validate() error {
+	if c.Response == 0 {
+		c.Response = 204
+	}
+	if c.Response < 200 || c.Response > 599 {
+		return fmt.Errorf("invalid response status %d", c.Response)
+	}
+	if c.Refresh == 0 {
+		c.Refresh = Duration(defaultAdblockRefresh)
+	}
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == "" {
+			c.Profiles[i].Name = fmt.Sprintf("#%d", i+1)
+		}
+	}
+	return nil
+}
+
+const (
+	defaultICAPTimeout     = 10 * time.Second
+	defaultICAPMaxBodySize = 10 << 20
+)
+
+// ICAPConfig hands requests and responses to an external ICAP scanner
+type ICAPConfig struct {
+	ReqMod      string   `json:"reqmod"`        // REQMOD service URL, e.g. icap://scanner:1344/reqmod
+	RespMod     string   `json:"respmod"`       // RESPMOD service URL
+	Timeout     Duration `json:"timeout"`       // Longest a single scan may take
+	MaxBodySize int64    `json:"max_body_size"` // Larger bodies are forwarded unscanned
+	FailOpen    bool     `json:"fail_open"`     // Forward unscanned when the scanner fails instead of refusing
+}
+
+// validate fills in defaults and checks the service URLs
+func (c *ICAPConfig) validate() error {
+	for _, service := range []string{c.ReqMod, c.RespMod} {
+		if service == "" {
+			continue
+		}
+		u, err := url.Parse(service)
+		if err != nil || u.Scheme != "icap" || u.Host == "" {
+			return fmt.Errorf("invalid service URL %q", service)
+		}
+	}
+	if c.Timeout == 0 {
+		c.Timeout = Duration(defaultICAPTimeout)
+	}
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = defaultICAPMaxBodySize
+	}
+	return nil
+}
+
+const defaultPolicyTimeout = 100 * time.Millisecond
+
+// PolicyConfig loads a Lua script that can rewrite, reroute or reject requests
+type PolicyConfig struct {
+	Script  string   `json:"script"`  // Path to the Lua script, disabled when empty
+	Timeout Duration `json:"timeout"` // Longest a single script call may run
+}
+
+// setDefaults fills in the call timeout
+func (c *PolicyConfig) setDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = Duration(defaultPolicyTimeout)
+	}
+}
+
+const defaultHARMaxEntries = 1000
+
+// HARConfig records forwarded exchanges for export as an HTTP Archive
+type HARConfig struct {
+	Enabled     bool   `json:"enabled"`
+	File        string `json:"file"`          // Written on shutdown when set
+	MaxEntries  int    `json:"max_entries"`   // Most recent exchanges kept
+	MaxBodySize int64  `json:"max_body_size"` // Bytes of each body captured, 0 records no bodies
+}
+
+// setDefaults fills in the entry limit
+func (c *HARConfig) setDefaults() {
+	if c.MaxEntries == 0 {
+		c.MaxEntries = defaultHARMaxEntries
+	}
+}
+
+const defaultBodyLogMaxSize = 1 << 10
+
+// BodyLogConfig logs the headers and the beginning of the bodies of plain
+// requests and their responses, to diagnose misbehaving clients without a
+// full capture
+type BodyLogConfig struct {
+	Enabled bool     `json:"enabled"`
+	MaxSize int      `json:"max_size"` // Bytes logged of each body, 1 KiB by default
+	Hosts   []string `json:"hosts"`    // Only log requests to these domains, all when empty
+	Clients []string `json:"clients"`  // Only log requests of these client addresses or CIDRs, all when empty
+	Redact  []string `json:"redact"`   // Headers logged without their values besides Authorization, Proxy-Authorization, Cookie and Set-Cookie
+}
+
+// setDefaults fills in the logged size
+func (c *BodyLogConfig) setDefaults() {
+	if c.MaxSize <= 0 {
+		c.MaxSize = defaultBodyLogMaxSize
+	}
+}
+
+const (
+	defaultCaptureMaxFileSize = 64 << 20
+	defaultCaptureMaxFiles    = 10
+)
+
+// CaptureConfig writes the bytes of CONNECT tunnels to pcap files
+type CaptureConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Dir         string   `json:"dir"`           // Directory for .pcap files, the working directory when empty
+	Hosts       []string `json:"hosts"`         // Only capture tunnels to these domains, all when empty
+	PerTunnel   bool     `json:"per_tunnel"`    // One file per tunnel instead of a shared one
+	MaxFileSize int64    `json:"max_file_size"` // Rotate once a file reaches this size
+	MaxFiles    int      `json:"max_files"`     // Oldest capture files are removed beyond this count
+}
+
+// setDefaults fills in the rotation limits
+func (c *CaptureConfig) setDefaults() {
+	if c.MaxFileSize == 0 {
+		c.MaxFileSize = defaultCaptureMaxFileSize
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = defaultCaptureMaxFiles
+	}
+}
+
+const (
+	defaultStatsWindow  = 24 * time.Hour
+	defaultStatsBuckets = 24
+)
+
+// StateConfig keeps the persisted state together in one directory
+type StateConfig struct {
+	Dir string `json:"dir"` // Holds the quota, stats, portal, lists and cache files that have no path of their own
+}
+
+// apply points the persisted files that have no path of their own into Dir
+func (c *StateConfig) apply(cfg *Config) {
+	if c.Dir == "" {
+		return
+	}
+	for name, path := range map[string]*string{
+		"quota.json":  &cfg.Quota.File,
+		"stats.json":  &cfg.Stats.File,
+		"portal.json": &cfg.Portal.File,
+		"lists.json":  &cfg.Lists.File,
+		"cache":       &cfg.Cache.Dir,
+		"acme":        &cfg.ACME.CacheDir,
+	} {
+		if *path == "" {
+			*path = filepath.Join(c.Dir, name)
+		}
+	}
+	for i := range cfg.Tenants {
+		t := &cfg.Tenants[i]
+		if t.Quota.File == "" {
+			t.Quota.File = filepath.Join(c.Dir, "quota-"+t.Name+".json")
+		}
+		if t.StatsFile == "" {
+			t.StatsFile = filepath.Join(c.Dir, "stats-"+t.Name+".json")
+		}
+	}
+}
+
+const (
+	defaultClusterInterval     = 5 * time.Second
+	defaultClusterCacheTimeout = 300 * time.Millisecond
+)
+
+// ClusterConfig shares the block and allow lists, quota usage and portal
+// acceptances with the other instances of a site, so clients keep their
+// state when failing over between them. With PeerCache the instances also
+// answer each other's cache misses.
+type ClusterConfig struct {
+	Node     string   `json:"node"`     // Name of this instance among its peers, the host name when empty
+	Addr     string   `json:"addr"`     // host:port peers send their state to, disabled when empty
+	Peers    []string `json:"peers"`    // Cluster addresses of the other instances
+	Secret   string   `json:"secret"`   // Shared key peers authenticate with
+	Interval Duration `json:"interval"` // Between state exchanges with each peer, 5s
+
+	PeerCache    bool     `json:"peer_cache"`    // Ask the peers' caches on a miss before going upstream
+	CacheTimeout Duration `json:"cache_timeout"` // Wait for a peer's cache answer, 300ms
+}
+
+// validate requires the secret once clustering is enabled and fills in the
+// interval
+func (c *ClusterConfig) validate() error {
+	if c.Addr == "" && len(c.Peers) == 0 {
+		return nil
+	}
+	if c.Secret == "" {
+		return errors.New("secret is required")
+	}
+	for _, peer := range c.Peers {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return fmt.Errorf("invalid peer %q: %w", peer, err)
+		}
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(defaultClusterInterval)
+	}
+	if c.Interval < 0 {
+		return errors.New("interval must be positive")
+	}
+	if c.CacheTimeout == 0 {
+		c.CacheTimeout = Duration(defaultClusterCacheTimeout)
+	}
+	if c.CacheTimeout < 0 {
+		return errors.New("cache_timeout must be positive")
+	}
+	return nil
+}
+
+// StatsConfig tracks per-domain and per-client usage over a rolling window
+type StatsConfig struct {
+	Enabled bool     `json:"enabled"`
+	Window  Duration `json:"window"`  // Span covered by the reports
+	Buckets int      `json:"buckets"` // Window granularity, one bucket expires at a time
+	File    string   `json:"file"`    // Persisted across restarts when set
+}
+
+// setDefaults fills in the window
+func (c *StatsConfig) setDefaults() {
+	if c.Window == 0 {
+		c.Window = Duration(defaultStatsWindow)
+	}
+	if c.Buckets == 0 {
+		c.Buckets = defaultStatsBuckets
+	}
+}
+
+// Report schedules
+const (
+	ReportDaily  = "daily"
+	ReportWeekly = "weekly"
+)
+
+const defaultReportTop = 10
+
+// ReportsConfig sends usage summaries built from the stats window on a
+// schedule
+type ReportsConfig struct {
+	Schedule string      `json:"schedule"` // "daily" or "weekly" (up to Monday), disabled when empty
+	At       string      `json:"at"`       // Local time of day periods end at, "15:04" format, midnight when empty
+	Top      int         `json:"top"`      // Entries in each top list, 10 when unset
+	Dir      string      `json:"dir"`      // Directory each report is written to as a JSON file
+	Webhook  string      `json:"webhook"`  // URL each report is POSTed to as JSON
+	Email    EmailConfig `json:"email"`
+}
+
+// Period returns the span one report covers
+func (c *ReportsConfig) Period() time.Duration {
+	if c.Schedule == ReportWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// validate checks the schedule and destinations against the stats window
+// reports are built from
+func (c *ReportsConfig) validate(stats StatsConfig) error {
+	switch c.Schedule {
+	case "":
+		return nil
+	case ReportDaily, ReportWeekly:
+	default:
+		return fmt.Errorf("invalid schedule %q", c.Schedule)
+	}
+	if c.At == "" {
+		c.At = "00:00"
+	}
+	if _, err := time.Parse("15:04", c.At); err != nil {
+		return fmt.Errorf("invalid at %q", c.At)
+	}
+	if c.Top == 0 {
+		c.Top = defaultReportTop
+	}
+	if c.Dir == "" && c.Webhook == "" && c.Email.Addr == "" {
+		return errors.New("dir, webhook or email.addr is required")
+	}
+	if c.Email.Addr != "" && (c.Email.From == "" || len(c.Email.To) == 0) {
+		return errors.New("email requires from and to")
+	}
+	if !stats.Enabled {
+		return errors.New("reports require stats to be enabled")
+	}
+	if time.Duration(stats.Window) < c.Period() {
+		return fmt.Errorf("stats window %v is shorter than the %s period", time.Duration(stats.Window), c.Schedule)
+	}
+	return nil
+}
+
+// Metrics push formats
+const (
+	MetricsInflux   = "influx"   // InfluxDB line protocol POSTed to a write URL
+	MetricsGraphite = "graphite" // Graphite plaintext protocol over TCP
+)
+
+const defaultMetricsPushInterval = 30 * time.Second
+
+// MetricsPushConfig sends the metrics to a time-series database on an interval
+type MetricsPushConfig struct {
+	Format   string            `json:"format"`   // "influx" or "graphite"
+	Addr     string            `json:"addr"`     // InfluxDB write URL including database or org and bucket, or Graphite host:port
+	Token    string            `json:"token"`    // InfluxDB API token, none when empty
+	Prefix   string            `json:"prefix"`   // Graphite path prefix, e.g. the site, none when empty
+	Tags     map[string]string `json:"tags"`     // Added to every point, e.g. the site or host
+	Interval Duration          `json:"interval"` // 30s when unset
+}
+
+// validate checks the format and address and fills in the interval
+func (c *MetricsPushConfig) validate() error {
+	switch c.Format {
+	case MetricsInflux:
+		u, err := url.Parse(c.Addr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid influx write URL %q", c.Addr)
+		}
+	case MetricsGraphite:
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			return fmt.Errorf("invalid graphite address %q: %w", c.Addr, err)
+		}
+	default:
+		return fmt.Errorf("invalid format %q", c.Format)
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(defaultMetricsPushInterval)
+	}
+	return nil
+}
+
+// Operational events
+const (
+	EventUpstreamDown      = "upstream_down"      // The circuit breaker of an upstream opened
+	EventUpstreamRecovered = "upstream_recovered" // It closed again
+	EventQuotaExceeded     = "quota_exceeded"     // A user or client used up its quota, sent once per period
+	EventReloadFailed      = "reload_failed"      // A new instance failed to take over, e.g. over invalid config
+)
+
+// WebhookConfig POSTs operational events as JSON
+type WebhookConfig struct {
+	URL     string            `json:"url"`
+	Events  []string          `json:"events"`  // Event types sent, all when empty
+	Headers map[string]string `json:"headers"` // Added to every request, e.g. Authorization
+}
+
+// validate checks the URL and event types
+func (c *WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", c.URL)
+	}
+	return validateEvents(c.Events)
+}
+
+// Wants reports whether the webhook receives events of type event
+func (c *WebhookConfig) Wants(event string) bool {
+	return wantsEvent(c.Events, event)
+}
+
+// validateEvents checks a list of event types
+func validateEvents(events []string) error {
+	for _, event := range events {
+		switch event {
+		case EventUpstreamDown, EventUpstreamRecovered, EventQuotaExceeded, EventReloadFailed:
+		default:
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// wantsEvent reports whether event is listed in events, an empty list
+// taking all of them
+func wantsEvent(events []string, event string) bool {
+	if len(events) == 0 {
+		return true
+	}
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Chat platforms for notifiers
+const (
+	ChatSlack    = "slack"
+	ChatDiscord  = "discord"
+	ChatTelegram = "telegram"
+)
+
+const (
+	defaultNotifierRateLimit = 5 * time.Minute
+	defaultTelegramAPI       = "https://api.telegram.org"
+)
+
+// NotifierConfig posts operational events to a chat channel
+type NotifierConfig struct {
+	Type      string   `json:"type"`       // "slack", "discord" or "telegram"
+	URL       string   `json:"url"`        // Slack or Discord incoming webhook URL; Telegram Bot API server, the public one when empty
+	Token     string   `json:"token"`      // Telegram bot token
+	ChatID    string   `json:"chat_id"`    // Telegram chat the bot posts to
+	Events    []string `json:"events"`     // Event types posted, all when empty
+	Template  string   `json:"template"`   // Go template for the message text, receiving a forwarder.Notification; built in when empty
+	RateLimit Duration `json:"rate_limit"` // Least time between messages about the same event type and subject, 5m when unset
+}
+
+// validate checks the platform settings and event types and fills in the
+// rate limit
+func (c *NotifierConfig) validate() error {
+	switch c.Type {
+	case ChatSlack, ChatDiscord:
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q", c.URL)
+		}
+	case ChatTelegram:
+		if c.Token == "" || c.ChatID == "" {
+			return errors.New("telegram requires token and chat_id")
+		}
+		if c.URL == "" {
+			c.URL = defaultTelegramAPI
+		}
+	default:
+		return fmt.Errorf("invalid type %q", c.Type)
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = Duration(defaultNotifierRateLimit)
+	}
+	return validateEvents(c.Events)
+}
+
+// Wants reports whether the notifier posts events of type event
+func (c *NotifierConfig) Wants(event string) bool {
+	return wantsEvent(c.Events, event)
+}
+
+// EmailConfig delivers reports over SMTP
+type EmailConfig struct {
+	Addr     string   `json:"addr"` // SMTP server host:port, disabled when empty
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Username string   `json:"username"` // PLAIN authentication, none when empty
+	Password string   `json:"password"`
+}
+
+const defaultClientNameTTL = 10 * time.Minute
+
+// ClientNamesConfig labels clients with host names instead of IPs in logs,
+// usage reports and the dashboard. Sources are tried in field order.
+type ClientNamesConfig struct {
+	File       string   `json:"file"`        // Static mapping with one "IP name" or "MAC name" pair per line, in hosts file syntax
+	ReverseDNS bool     `json:"reverse_dns"` // Look up PTR records
+	NetBIOS    bool     `json:"netbios"`     // Ask clients for their NetBIOS name, for Windows machines missing from DNS
+	TTL        Duration `json:"ttl"`         // How long looked up names are kept, 10m when unset
+}
+
+// Enabled reports whether any name source is configured
+func (c *ClientNamesConfig) Enabled() bool {
+	return c.File != "" || c.ReverseDNS || c.NetBIOS
+}
+
+// setDefaults fills in the TTL
+func (c *ClientNamesConfig) setDefaults() {
+	if c.TTL == 0 {
+		c.TTL = Duration(defaultClientNameTTL)
+	}
+}
+
+const defaultNeighborRefresh = 30 * time.Second
+
+// NeighborsConfig reads the gateway's neighbor table (ARP and, on Linux, NDP)
+// to learn the MAC address behind each client IP. Quotas, affinity, stats,
+// client names and access rules can then follow devices across DHCP lease
+// changes.
+type NeighborsConfig struct {
+	Enabled bool     `json:"enabled"`
+	Refresh Duration `json:"refresh"` // How often the table is read again, 30s by default; unknown clients trigger a read sooner
+}
+
+// setDefaults fills in the refresh interval
+func (c *NeighborsConfig) setDefaults() {
+	if c.Refresh <= 0 {
+		c.Refresh = Duration(defaultNeighborRefresh)
+	}
+}
+
+// knowsMACs reports whether clients can be known by their MAC address
+func (c *Config) knowsMACs() bool {
+	return c.Neighbors.Enabled || c.DHCP.Server != ""
+}
+
+// DHCP servers whose leases can be read
+const (
+	DHCPDnsmasq = "dnsmasq"
+	DHCPKea     = "kea"
+)
+
+const defaultDHCPRefresh = 30 * time.Second
+
+// DHCPConfig reads the leases and static assignments of the LAN's DHCP
+// server. Clients are then known by the host name they were given and by
+// their MAC address, in logs, usage reports, the dashboard and access rules,
+// without a neighbor table. Names from client_names.file come first, those
+// looked up over DNS or NetBIOS last.
+type DHCPConfig struct {
+	Server   string   `json:"server"`   // "dnsmasq" or "kea", disabled when empty
+	Leases   []string `json:"leases"`   // Lease files, the server's default one unless api is set
+	Hosts    []string `json:"hosts"`    // dnsmasq configuration or dhcp-hostsfile files with dhcp-host static assignments
+	API      string   `json:"api"`      // Kea control agent URL, queried for leases and reservations; credentials go in its user info
+	Services []string `json:"services"` // Kea servers the control agent asks, "dhcp4" by default
+	Refresh  Duration `json:"refresh"`  // How often the leases are checked for changes, 30s by default
+}
+
+// validate checks the server and fills in the defaults
+func (c *DHCPConfig) validate() error {
+	switch c.Server {
+	case "":
+		return nil
+	case DHCPDnsmasq:
+		if c.API != "" {
+			return errors.New("api is only supported with kea")
+		}
+		if len(c.Leases) == 0 {
+			c.Leases = []string{"/var/lib/misc/dnsmasq.leases"}
+		}
+	case DHCPKea:
+		if len(c.Hosts) > 0 {
+			return errors.New("hosts is only supported with dnsmasq, kea reservations are read over the api")
+		}
+		if c.API != "" {
+			if u, err := url.Parse(c.API); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid api %q: expected an http or https URL", c.API)
+			}
+			if len(c.Services) == 0 {
+				c.Services = []string{"dhcp4"}
+			}
+			for _, service := range c.Services {
+				if service != "dhcp4" && service != "dhcp6" {
+					return fmt.Errorf("unknown service %q, expected \"dhcp4\" or \"dhcp6\"", service)
+				}
+			}
+		} else if len(c.Leases) == 0 {
+			c.Leases = []string{"/var/lib/kea/kea-leases4.csv"}
+		}
+	default:
+		return fmt.Errorf("unknown server %q, expected %q or %q", c.Server, DHCPDnsmasq, DHCPKea)
+	}
+	if c.Refresh == 0 {
+		c.Refresh = Duration(defaultDHCPRefresh)
+	}
+	if c.Refresh < 0 {
+		return errors.New("refresh must be positive")
+	}
+	return nil
+}
+
+// ErrorPagesConfig replaces the plain text answers to refused and failed
+// requests with HTML pages rendered from Go template files. Templates receive
+// a forwarder.ErrorPage.
+type ErrorPagesConfig struct {
+	Blocked       string `json:"blocked"`        // 403 Forbidden
+	AuthRequired  string `json:"auth_required"`  // 407 Proxy Authentication Required
+	RateLimited   string `json:"rate_limited"`   // 429 Too Many Requests
+	UpstreamError string `json:"upstream_error"` // 502 Bad Gateway, 503 Service Unavailable and 504 Gateway Timeout
+}
+
+// AdminConfig serves the admin API and dashboard. Every route but the
+// health probes, and the gRPC control API, require the token or the
+// username and password once either is set, and an address beyond loopback
+// requires one of them.
+type AdminConfig struct {
+	Addr     string          `json:"addr"`      // host:port, disabled when empty; keep it off the LAN-facing interface
+	GRPCAddr string          `json:"grpc_addr"` // host:port of the gRPC control API over plaintext HTTP/2, disabled when empty
+	TLS      ServerTLSConfig `json:"tls"`       // Serves the admin API and dashboard over HTTPS
+	Token    string          `json:"token"`     // Accepted as "Authorization: Bearer <token>"
+	Username string          `json:"username"`  // Accepted with password over basic authentication, as browsers send it
+	Password string          `json:"password"`
+}
+
+// AuthEnabled reports whether the admin API requires credentials
+func (c *AdminConfig) AuthEnabled() bool {
+	return c.Token != "" || c.Username != ""
+}
+
+// validate requires credentials for admin addresses reachable beyond
+// loopback and for a public certificate obtained through ACME
+func (c *AdminConfig) validate() error {
+	if (c.Username == "") != (c.Password == "") {
+		return errors.New("username and password must be set together")
+	}
+	if c.TLS.ACME && !c.AuthEnabled() {
+		return errors.New("tls.acme serves the admin API on a public host name, set token or username and password")
+	}
+	if c.AuthEnabled() {
+		return nil
+	}
+	for _, addr := range []string{c.Addr, c.GRPCAddr} {
+		if addr != "" && !isLoopbackAddr(addr) {
+			return fmt.Errorf("%s is reachable beyond loopback, set token or username and password", addr)
+		}
+	}
+	return nil
+}
+
+// isLoopbackAddr reports whether the host:port addr only accepts
+// connections from this host
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ServerTLSConfig serves a listener over TLS with a certificate from files
+// or one obtained through ACME
+type ServerTLSConfig struct {
+	CertFile string `json:"cert_file"` // PEM certificate chain
+	KeyFile  string `json:"key_file"`
+	ACME     bool   `json:"acme"` // Obtain and renew the certificate as configured in acme instead
+}
+
+// Enabled reports whether the listener serves TLS
+func (c *ServerTLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.ACME
+}
+
+// validate requires a certificate and key, or ACME alone
+func (c *ServerTLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if c.ACME && c.CertFile != "" {
+		return errors.New("acme and cert_file are mutually exclusive")
+	}
+	return nil
+}
+
+// ACMEConfig obtains certificates from an ACME CA such as Let's Encrypt for
+// the TLS listeners setting tls.acme, renewing them before they expire.
+// Challenges are answered over TLS-ALPN-01 on those listeners, which must
+// then be reachable on port 443, or over HTTP-01 on http_addr.
+type ACMEConfig struct {
+	Hosts     []string `json:"hosts"`      // Public host names the certificates are for
+	Email     string   `json:"email"`      // Contact for notices from the CA
+	Directory string   `json:"directory"`  // ACME directory URL, Let's Encrypt production when empty
+	CacheDir  string   `json:"cache_dir"`  // Account key and certificates, "acme" in state.dir when empty
+	HTTPAddr  string   `json:"http_addr"`  // host:port answering HTTP-01 challenges, usually ":80"; may be wpad.addr
+	AcceptTOS bool     `json:"accept_tos"` // Agree to the terms of service of the CA, required
+}
+
+// UsesACME reports whether the admin API or any listener obtains its
+// certificate through ACME
+func (c *Config) UsesACME() bool {
+	if c.Admin.TLS.ACME {
+		return true
+	}
+	for _, l := range c.Listeners {
+		if l.TLS.ACME {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the settings once a listener asks for ACME
+func (c *ACMEConfig) validate(used bool) error {
+	if !used {
+		return nil
+	}
+	if len(c.Hosts) == 0 {
+		return errors.New("hosts is required")
+	}
+	if !c.AcceptTOS {
+		return errors.New("accept_tos must be set to agree to the terms of service of the CA")
+	}
+	if c.CacheDir == "" {
+		return errors.New("cache_dir or state.dir is required to keep the certificates")
+	}
+	return nil
+}
+
+// WPADConfig publishes a proxy auto-config file so clients set to detect
+// proxy settings automatically find the forwarder
+type WPADConfig struct {
+	Addr    string   `json:"addr"`     // HTTP host:port serving /wpad.dat, usually ":80"; disabled when empty
+	Proxy   string   `json:"proxy"`    // host:port clients connect to, this host's LAN address and the first listener's port when empty
+	Direct  []string `json:"direct"`   // Host names, domains and IPv4 networks clients reach without the proxy
+	DNSAddr string   `json:"dns_addr"` // UDP host:port answering "wpad" name lookups, e.g. ":53"; disabled when empty
+}
+
+// UDPForwarderConfig relays the datagrams clients send to a local port to a
+// fixed destination, such as a DNS resolver or a QUIC server. Each client
+// gets an upstream socket of its own so replies find their way back.
+type UDPForwarderConfig struct {
+	Name        string   `json:"name"`
+	Listen      string   `json:"listen"`       // UDP host:port clients send to
+	Target      string   `json:"target"`       // host:port datagrams are relayed to
+	Allow       []string `json:"allow"`        // Client addresses and networks served, all when empty
+	Idle        Duration `json:"idle"`         // Sessions without traffic either way end after this, 2m by default
+	MaxSessions int      `json:"max_sessions"` // Clients relayed at once, 1024 by default
+}
+
+const (
+	defaultUDPIdle        = 2 * time.Minute
+	defaultUDPMaxSessions = 1024
+)
+
+// validate checks the addresses and sets defaults
+func (c *UDPForwarderConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen %q: %w", c.Listen, err)
+	}
+	if _, _, err := net.SplitHostPort(c.Target); err != nil {
+		return fmt.Errorf("invalid target %q: %w", c.Target, err)
+	}
+	if c.Idle < 0 || c.MaxSessions < 0 {
+		return errors.New("idle and max_sessions must not be negative")
+	}
+	if c.Idle == 0 {
+		c.Idle = Duration(defaultUDPIdle)
+	}
+	if c.MaxSessions == 0 {
+		c.MaxSessions = defaultUDPMaxSessions
+	}
+	return nil
+}
+
+// MDNSConfig advertises the proxy as a _http-proxy._tcp service over
+// multicast DNS
+type MDNSConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Instance  string   `json:"instance"`  // Service instance name, "GateLAN on <hostname>" when empty
+	Proxy     string   `json:"proxy"`     // host:port advertised, chosen as for WPAD when empty
+	Interface string   `json:"interface"` // Network interface to advertise on, the system default when empty
+	TXT       []string `json:"txt"`       // Extra "key=value" entries of the TXT record
+}
+
+const (
+	defaultLDAPUserFilter     = "(uid=%s)"
+	defaultLDAPGroupAttribute = "memberOf"
+	defaultLDAPPoolSize       = 4
+	defaultLDAPCacheTTL       = 5 * time.Minute
+)
+
+// LDAPConfig validates proxy credentials against an LDAP or Active Directory server
+type LDAPConfig struct {
+	URL                string            `json:"url"` // ldap://host:389 or ldaps://host:636
+	StartTLS           bool              `json:"start_tls"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+	BindDN             string            `json:"bind_dn"` // Service account used to look users up
+	BindPassword       string            `json:"bind_password"`
+	BaseDN             string            `json:"base_dn"`
+	UserFilter         string            `json:"user_filter"`     // %s is replaced by the escaped user name; "(sAMAccountName=%s)" for AD
+	GroupAttribute     string            `json:"group_attribute"` // User attribute listing group DNs
+	PoolSize           int               `json:"pool_size"`
+	CacheTTL           Duration          `json:"cache_ttl"`       // How long successful logins are cached
+	GroupUpstreams     map[string]string `json:"group_upstreams"` // Group name to upstream proxy
+}
+
+// setDefaults fills in the lookup and pooling options
+func (c *LDAPConfig) setDefaults() {
+	if c.UserFilter == "" {
+		c.UserFilter = defaultLDAPUserFilter
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = defaultLDAPGroupAttribute
+	}
+	if c.PoolSize == 0 {
+		c.PoolSize = defaultLDAPPoolSize
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = Duration(defaultLDAPCacheTTL)
+	}
+}
+
+const (
+	defaultJWTUserClaim   = "sub"
+	defaultJWTGroupsClaim = "groups"
+	defaultJWKSRefresh    = time.Hour
+)
+
+// JWTConfig lets clients authenticate with a bearer token instead of Basic auth
+type JWTConfig struct {
+	Secret      string   `json:"secret"`   // HMAC key for HS256/384/512 tokens
+	JWKSURL     string   `json:"jwks_url"` // Key set for RS and ES tokens
+	Issuer      string   `json:"issuer"`   // Required iss claim when set
+	Audience    string   `json:"audience"` // Required aud entry when set
+	UserClaim   string   `json:"user_claim"`
+	GroupsClaim string   `json:"groups_claim"`
+	JWKSRefresh Duration `json:"jwks_refresh"`
+}
+
+// Enabled reports whether bearer tokens are accepted
+func (c *JWTConfig) Enabled() bool {
+	return c.Secret != "" || c.JWKSURL != ""
+}
+
+// setDefaults fills in claim names and the key refresh interval
+func (c *JWTConfig) setDefaults() {
+	if c.UserClaim == "" {
+		c.UserClaim = defaultJWTUserClaim
+	}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = defaultJWTGroupsClaim
+	}
+	if c.JWKSRefresh == 0 {
+		c.JWKSRefresh = Duration(defaultJWKSRefresh)
+	}
+}
+
+// Syslog transports
+const (
+	SyslogUDP = "udp"
+	SyslogTCP = "tcp"
+	SyslogTLS = "tls"
+)
+
+const (
+	defaultSyslogFacility = "local0"
+	defaultSyslogAppName  = "gatelan"
+)
+
+// SyslogFacilities maps facility names to RFC 5424 facility codes
+var SyslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5, "authpriv": 10,
+	"security": 13, "local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig sends access and security audit events to a syslog collector
+type SyslogConfig struct {
+	Addr               string `json:"addr"`     // host:port of the collector, disabled when empty
+	Network            string `json:"network"`  // udp (default), tcp or tls
+	Facility           string `json:"facility"` // Facility name, local0 by default
+	AppName            string `json:"app_name"`
+	Hostname           string `json:"hostname"` // HOSTNAME field, the system hostname when empty
+	CAFile             string `json:"ca_file"`  // PEM roots for verifying the collector over tls
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// validate fills in defaults and checks the transport and facility
+func (c *SyslogConfig) validate() error {
+	switch c.Network {
+	case "":
+		c.Network = SyslogUDP
+	case SyslogUDP, SyslogTCP, SyslogTLS:
+	default:
+		return fmt.Errorf("invalid network %q", c.Network)
+	}
+	if c.Facility == "" {
+		c.Facility = defaultSyslogFacility
+	}
+	if _, ok := SyslogFacilities[c.Facility]; !ok {
+		return fmt.Errorf("invalid facility %q", c.Facility)
+	}
+	if c.AppName == "" {
+		c.AppName = defaultSyslogAppName
+	}
+	return nil
+}
+
+const (
+	defaultLogMaxSize    = 100 << 20
+	defaultLogMaxBackups = 7
+)
+
+// LogConfig writes the log to a file that rotates by size and age
+type LogConfig struct {
+	File       string   `json:"file"`        // Log file, stdout when empty
+	MaxSize    int64    `json:"max_size"`    // Rotate once the file reaches this size
+	MaxAge     Duration `json:"max_age"`     // Rotate once the file is this old, size only when zero
+	MaxBackups int      `json:"max_backups"` // Oldest rotated files are removed beyond this count
+	Retention  Duration `json:"retention"`   // Rotated files older than this are removed, kept when zero
+	Compress   bool     `json:"compress"`    // Gzip rotated files
+}
+
+// setDefaults fills in the rotation limits
+func (c *LogConfig) setDefaults() {
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultLogMaxSize
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = defaultLogMaxBackups
+	}
+}
@@ -0,0 +1,32 @@
+-- Example GateLAN policy script, enabled with "policy": {"script": "policy.lua"}
+--
+-- on_request(req) runs for plain HTTP requests and on_connect(req) for CONNECT
+-- tunnels. req has method, url, host, path, client and headers (lower-case
+-- names). Return nothing to forward unchanged, or a table with any of:
+--   reject         status code to answer with instead of forwarding
+--   body           body sent with the rejection
+--   upstream       "host:port" of the upstream proxy to use
+--   set_headers    headers to set on the forwarded request
+--   remove_headers list of headers to drop from the forwarded request
+
+local blocked = {
+  ["ads.example.com"] = true,
+  ["tracker.example.net"] = true,
+}
+
+function on_request(req)
+  if blocked[req.host] then
+    return {reject = 403, body = "Blocked by policy\n"}
+  end
+  if string.find(req.host, "%.internal$") then
+    return {upstream = "10.0.0.2:3128"}
+  end
+  return {remove_headers = {"Referer"}}
+end
+
+function on_connect(req)
+  local host = string.match(req.host, "^([^:]+)")
+  if blocked[host] then
+    return {reject = 403}
+  end
+end
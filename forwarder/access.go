@@ -0,0 +1,59 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// newAccessRules builds the scheduled access rules in the configured timezone
+func newAccessRules(cfg config.AccessRulesConfig) (acl.Rules, error) {
+	location := time.Local
+	if cfg.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid access_rules timezone: %w", err)
+		}
+	}
+
+	rules := make(acl.Rules, 0, len(cfg.Rules))
+	for i, rc := range cfg.Rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		var schedule *acl.Schedule
+		if len(rc.Days) > 0 || rc.From != "" || rc.To != "" {
+			var err error
+			if schedule, err = acl.ParseSchedule(rc.Days, rc.From, rc.To, location); err != nil {
+				return nil, fmt.Errorf("rule %s: %w", name, err)
+			}
+		}
+		rule, err := acl.NewRule(name, rc.Action, rc.Clients, rc.Hosts, rc.Domains, rc.Groups, rc.Devices, schedule)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// blockingRule returns the access rule refusing req to host right now, if any
+func (f *Forwarder) blockingRule(req *http.Request, host string) *acl.Rule {
+	// Classify every request so clients are known before a rule needs them
+	device := f.devices.classify(req)
+	rules := f.profileFor(req.Context()).rules
+	if len(rules) == 0 || f.lists.allows(host) {
+		return nil
+	}
+	name, mac := f.clientIdentity(req)
+	rule := rules.Evaluate(net.ParseIP(remoteIP(req)), mac, name, requestGroups(req), device, host, time.Now())
+	if rule != nil && rule.Action == acl.ActionBlock {
+		return rule
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// newACMEManager creates the certificate manager shared by the listeners
+// using ACME
+func newACMEManager(cfg config.ACMEConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Hosts...),
+		Email:      cfg.Email,
+	}
+	if cfg.Directory != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.Directory}
+	}
+	return m
+}
+
+// serverTLS returns the TLS configuration a listener serves with, offering
+// protos through ALPN
+func (f *Forwarder) serverTLS(cfg config.ServerTLSConfig, protos ...string) (*tls.Config, error) {
+	if cfg.ACME {
+		tlsConfig := f.acme.TLSConfig()
+		tlsConfig.NextProtos = append(protos, acme.ALPNProto)
+		return tlsConfig, nil
+	}
+	reloader, err := f.certReloader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: reloader.getCertificate, NextProtos: protos}, nil
+}
+
+// startACME answers HTTP-01 challenges on acme.http_addr, unless the WPAD
+// server shares that address and answers them
+func (f *Forwarder) startACME(ctx context.Context) error {
+	addr := f.config.ACME.HTTPAddr
+	if f.acme == nil || addr == "" || addr == f.config.WPAD.Addr {
+		return nil
+	}
+	listener, err := f.listenTCP(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on ACME HTTP address: %w", err)
+	}
+
+	f.acmeHTTP = &http.Server{
+		// Other requests are redirected to HTTPS
+		Handler:           f.acme.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	f.logger.Printf("ACME HTTP-01 challenges on %s", listener.Addr())
+	go func() {
+		if err := f.acmeHTTP.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			f.logger.Printf("ACME HTTP server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// obtainCertificates requests the certificates of every ACME host once the
+// listeners serve, so problems show up in the log right away rather than at
+// the first client handshake. The manager renews them when they near expiry.
+func (f *Forwarder) obtainCertificates(ctx context.Context) {
+	if f.acme == nil {
+		return
+	}
+	for _, host := range f.config.ACME.Hosts {
+		// Ask as a modern client would, for the ECDSA certificate they get
+		hello := &tls.ClientHelloInfo{
+			ServerName:   host,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+		cert, err := f.acme.GetCertificate(hello)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			f.logger.Printf("Failed to obtain certificate for %s: %v", host, err)
+			continue
+		}
+		if cert.Leaf != nil {
+			f.logger.Printf("Certificate for %s valid until %s", host, cert.Leaf.NotAfter.Format(time.DateOnly))
+		}
+	}
+}
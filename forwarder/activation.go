@@ -0,0 +1,50 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdListenFdsStart is the first file descriptor passed by socket activation
+const systemdListenFdsStart = 3
+
+// systemdListeners returns the sockets passed via LISTEN_FDS, grouped by their
+// FileDescriptorName= (sockets without a name are grouped under "")
+func systemdListeners() (map[string][]net.Listener, error) {
+	listeners := make(map[string][]net.Listener)
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return listeners, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Don't let child processes inherit the activation environment
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) && names[i] != "unknown" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(systemdListenFdsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("fd %d is not a listening socket: %w", systemdListenFdsStart+i, err)
+		}
+		listeners[name] = append(listeners[name], listener)
+	}
+
+	return listeners, nil
+}
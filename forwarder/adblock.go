@@ -0,0 +1,399 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// adblocker answers requests matching AdBlock Plus style filter rules
+type adblocker struct {
+	client   *http.Client
+	profiles []*adblockProfile
+}
+
+// adblockProfile is one named set of filter lists and the clients it skips
+type adblockProfile struct {
+	config config.AdblockProfile
+	optOut []*net.IPNet
+	inline *abpFilter
+
+	mu    sync.RWMutex
+	lists map[string]*abpFilter // By list source, kept when a reload fails
+}
+
+// abpFilter is a compiled filter list. Plain "||domain^" rules, the bulk of
+// most lists, are matched by a domain set; the rest by regular expression.
+type abpFilter struct {
+	blockDomains acl.DomainSet
+	allowDomains acl.DomainSet
+	block        []*abpRule
+	allow        []*abpRule
+}
+
+// abpRule is a URL pattern rule with its options
+type abpRule struct {
+	literal    string // Lower-case text every match contains, for a cheap pre-check
+	pattern    *regexp.Regexp
+	thirdParty int      // 1 for third-party requests only, -1 for first-party only
+	domains    []string // Page domains the rule applies on, all when empty
+	notDomains []string // Page domains the rule doesn't apply on
+}
+
+// abpRequest is the part of a request filter rules look at
+type abpRequest struct {
+	url        string
+	host       string
+	pageHost   string
+	thirdParty bool
+	hostOnly   bool // CONNECT tunnels, where only the host is known
+}
+
+func newAdblocker(cfg config.AdblockConfig) (*adblocker, error) {
+	a := &adblocker{client: &http.Client{Timeout: time.Minute}}
+	for _, pc := range cfg.Profiles {
+		optOut, err := acl.ParseNetworks(pc.OptOut)
+		if err != nil {
+			return nil, fmt.Errorf("adblock profile %s: %w", pc.Name, err)
+		}
+		a.profiles = append(a.profiles, &adblockProfile{
+			config: pc,
+			optOut: optOut,
+			inline: parseABP(strings.NewReader(strings.Join(pc.Rules, "\n"))),
+			lists:  make(map[string]*abpFilter),
+		})
+	}
+	return a, nil
+}
+
+// refreshAdblock loads every filter list now and then once per refresh
+// interval until ctx is cancelled
+func (f *Forwarder) refreshAdblock(ctx context.Context) {
+	if f.adblock == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(f.config.Adblock.Refresh))
+	defer ticker.Stop()
+	for {
+		for _, profile := range f.adblock.profiles {
+			for _, source := range profile.config.Lists {
+				filter, err := f.adblock.load(ctx, source)
+				if err != nil {
+					f.logger.Printf("Failed to load adblock list %s: %v", source, err)
+					continue
+				}
+				profile.mu.Lock()
+				profile.lists[source] = filter
+				profile.mu.Unlock()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// load reads a filter list from a file or an http(s) URL
+func (a *adblocker) load(ctx context.Context, source string) (*abpFilter, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return parseABP(file), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	return parseABP(resp.Body), nil
+}
+
+// blocked returns the first profile blocking the request from client, or ""
+func (a *adblocker) blocked(client net.IP, r abpRequest) string {
+	if a == nil {
+		return ""
+	}
+	for _, profile := range a.profiles {
+		if client != nil && acl.ContainsIP(profile.optOut, client) {
+			continue
+		}
+		if profile.blocks(r) {
+			return profile.config.Name
+		}
+	}
+	return ""
+}
+
+// blocks reports whether a rule in the profile blocks r and no exception
+// rule allows it
+func (p *adblockProfile) blocks(r abpRequest) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	filters := make([]*abpFilter, 0, len(p.lists)+1)
+	filters = append(filters, p.inline)
+	for _, filter := range p.lists {
+		filters = append(filters, filter)
+	}
+
+	blocked := false
+	for _, filter := range filters {
+		if filter.allows(r) {
+			return false
+		}
+		blocked = blocked || filter.blocks(r)
+	}
+	return blocked
+}
+
+// blocks reports whether a blocking rule of the filter matches r
+func (f *abpFilter) blocks(r abpRequest) bool {
+	return f.blockDomains.Match(r.host) || !r.hostOnly && matchAny(f.block, r)
+}
+
+// allows reports whether an exception rule of the filter matches r
+func (f *abpFilter) allows(r abpRequest) bool {
+	return f.allowDomains.Match(r.host) || !r.hostOnly && matchAny(f.allow, r)
+}
+
+// matchAny reports whether any of rules matches r
+func matchAny(rules []*abpRule, r abpRequest) bool {
+	lower := strings.ToLower(r.url)
+	for _, rule := range rules {
+		if rule.matches(r, lower) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks the rule's options and pattern against r
+func (rule *abpRule) matches(r abpRequest, lowerURL string) bool {
+	if !strings.Contains(lowerURL, rule.literal) {
+		return false
+	}
+	if rule.thirdParty == 1 && !r.thirdParty || rule.thirdParty == -1 && r.thirdParty {
+		return false
+	}
+	if len(rule.domains) > 0 && !acl.MatchHost(r.pageHost, rule.domains) {
+		return false
+	}
+	if len(rule.notDomains) > 0 && acl.MatchHost(r.pageHost, rule.notDomains) {
+		return false
+	}
+	return rule.pattern.MatchString(r.url)
+}
+
+// abpIgnoredOptions are resource type options. The proxy can't tell resource
+// types apart, so rules carrying them apply to every request.
+var abpIgnoredOptions = map[string]bool{
+	"script": true, "image": true, "stylesheet": true, "object": true, "xmlhttprequest": true,
+	"subdocument": true, "media": true, "font": true, "websocket": true, "ping": true,
+	"other": true, "match-case": true, "all": true,
+}
+
+// abpDomainRule matches rules that only name a domain
+var abpDomainRule = regexp.MustCompile(`^\|\|[a-z0-9.-]+\^?$`)
+
+// parseABP compiles an AdBlock Plus filter list, skipping cosmetic rules and
+// rules with options the proxy can't evaluate
+func parseABP(r io.Reader) *abpFilter {
+	filter := &abpFilter{blockDomains: acl.DomainSet{}, allowDomains: acl.DomainSet{}}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '[' || isCosmeticRule(line) {
+			continue
+		}
+
+		exception := strings.HasPrefix(line, "@@")
+		line = strings.TrimPrefix(line, "@@")
+
+		pattern, options := line, ""
+		if i := strings.LastIndex(line, "$"); i >= 0 {
+			pattern, options = line[:i], line[i+1:]
+		}
+
+		rule, ok := parseABPOptions(options)
+		if !ok || pattern == "" || pattern == "*" || pattern == "|" || pattern == "||" {
+			continue
+		}
+
+		lowerPattern := strings.ToLower(pattern)
+		if options == "" && abpDomainRule.MatchString(lowerPattern) {
+			domain := strings.TrimSuffix(strings.TrimPrefix(lowerPattern, "||"), "^")
+			if exception {
+				filter.allowDomains.Add(domain)
+			} else {
+				filter.blockDomains.Add(domain)
+			}
+			continue
+		}
+
+		compiled, err := regexp.Compile(abpRegexp(pattern))
+		if err != nil {
+			continue
+		}
+		rule.pattern = compiled
+		rule.literal = abpLiteral(lowerPattern)
+		if exception {
+			filter.allow = append(filter.allow, rule)
+		} else {
+			filter.block = append(filter.block, rule)
+		}
+	}
+	return filter
+}
+
+// isCosmeticRule reports whether line is an element hiding or scriptlet rule
+func isCosmeticRule(line string) bool {
+	for _, separator := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(line, separator) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseABPOptions reads the comma-separated options after "$"
+func parseABPOptions(options string) (*abpRule, bool) {
+	rule := &abpRule{}
+	if options == "" {
+		return rule, true
+	}
+	for _, option := range strings.Split(strings.ToLower(options), ",") {
+		switch {
+		case option == "third-party" || option == "3p" || option == "~first-party" || option == "~1p":
+			rule.thirdParty = 1
+		case option == "~third-party" || option == "~3p" || option == "first-party" || option == "1p":
+			rule.thirdParty = -1
+		case strings.HasPrefix(option, "domain="):
+			for _, domain := range strings.Split(strings.TrimPrefix(option, "domain="), "|") {
+				if negated, ok := strings.CutPrefix(domain, "~"); ok {
+					rule.notDomains = append(rule.notDomains, negated)
+				} else if domain != "" {
+					rule.domains = append(rule.domains, domain)
+				}
+			}
+		case abpIgnoredOptions[option]:
+		default:
+			// Negated types, $popup, $redirect and friends
+			return nil, false
+		}
+	}
+	return rule, true
+}
+
+// abpRegexp translates a filter pattern to a regular expression
+func abpRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("(?i)")
+	if rest, ok := strings.CutPrefix(pattern, "||"); ok {
+		b.WriteString(`^[a-z][a-z0-9+.-]*://([^/?#]*\.)?`)
+		pattern = rest
+	} else if rest, ok := strings.CutPrefix(pattern, "|"); ok {
+		b.WriteString("^")
+		pattern = rest
+	}
+	anchorEnd := false
+	if rest, ok := strings.CutSuffix(pattern, "|"); ok {
+		anchorEnd = true
+		pattern = rest
+	}
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '^':
+			b.WriteString(`(?:[^\w\-.%]|$)`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if anchorEnd {
+		b.WriteString("$")
+	}
+	return b.String()
+}
+
+// abpLiteral returns the longest run of pattern every match must contain
+func abpLiteral(pattern string) string {
+	longest := ""
+	for _, part := range strings.FieldsFunc(pattern, func(c rune) bool { return c == '*' || c == '^' || c == '|' }) {
+		if len(part) > len(longest) {
+			longest = part
+		}
+	}
+	return longest
+}
+
+// adblockRequest describes req for rule matching. Requests are third-party
+// when the page that made them, from Referer or Origin, is on another site.
+func adblockRequest(req *http.Request, host string, hostOnly bool) abpRequest {
+	r := abpRequest{host: host, hostOnly: hostOnly}
+	if !hostOnly {
+		r.url = req.URL.String()
+	}
+	page := req.Header.Get("Referer")
+	if page == "" {
+		page = req.Header.Get("Origin")
+	}
+	if u, err := url.Parse(page); err == nil && u.Hostname() != "" {
+		r.pageHost = u.Hostname()
+		r.thirdParty = siteOf(r.pageHost) != siteOf(host)
+	}
+	return r
+}
+
+// siteOf approximates the registrable domain of host by its last two labels
+func siteOf(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) <= 2 {
+		return host
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// blockedByAdblock returns the profile blocking req to host, counting it
+func (f *Forwarder) blockedByAdblock(req *http.Request, host string, hostOnly bool) string {
+	if f.adblock == nil || f.lists.allows(host) {
+		return ""
+	}
+	name := f.adblock.blocked(net.ParseIP(remoteIP(req)), adblockRequest(req, host, hostOnly))
+	if name != "" {
+		f.metrics.inc("gatelan_adblock_blocked_total", "profile", name)
+		f.countBlocked(req, host)
+	}
+	return name
+}
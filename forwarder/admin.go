@@ -0,0 +1,491 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTopN = 10
+
+// AdminHandler returns the admin API and dashboard, for mounting in another
+// server instead of the configured admin address. It requires the admin
+// credentials on every route but the health probes.
+func (f *Forwarder) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", f.handleDashboard)
+	mux.HandleFunc("GET /metrics", f.handleMetrics)
+	mux.HandleFunc("GET /har", f.handleHAR)
+	mux.HandleFunc("GET /stats/domains", f.handleTopUsage(false))
+	mux.HandleFunc("GET /stats/clients", f.handleTopUsage(true))
+	mux.HandleFunc("GET /connections", f.handleConnections)
+	mux.HandleFunc("DELETE /connections/{id}", f.handleKillConnection)
+	mux.HandleFunc("GET /blocklists", f.handleBlocklists)
+	mux.HandleFunc("GET /status", f.handleStatus)
+	mux.HandleFunc("GET /profiles", f.handleProfiles)
+	mux.HandleFunc("GET /portal/clients", f.handlePortalClients)
+	mux.HandleFunc("DELETE /portal/clients/{client}", f.handleRevokePortalClient)
+	mux.HandleFunc("POST /profiles/{name}/activate", f.handleActivateProfile)
+	mux.HandleFunc("GET /lists", f.handleLists)
+	mux.HandleFunc("PUT /lists/{list}/{entry...}", f.handleAddListEntry)
+	mux.HandleFunc("DELETE /lists/{list}/{entry...}", f.handleRemoveListEntry)
+	mux.HandleFunc("GET /cache", f.handleCacheStats)
+	mux.HandleFunc("DELETE /cache", f.handlePurgeAllCache)
+	mux.HandleFunc("DELETE /cache/entry", f.handlePurgeCache)
+	mux.HandleFunc("GET /state/backup", f.handleStateBackup)
+	mux.HandleFunc("POST /state/compact", f.handleCompactState)
+	mux.HandleFunc("GET /cluster/peers", f.handleClusterPeers)
+	mux.HandleFunc("GET /devices", f.handleDevices)
+	mux.HandleFunc("GET /dhcp/leases", f.handleDHCPLeases)
+	mux.HandleFunc("POST /drain", f.handleDrain)
+	mux.HandleFunc("DELETE /drain", f.handleResume)
+	mux.HandleFunc("GET /healthz", f.handleHealthz)
+	mux.HandleFunc("GET /readyz", f.handleReadyz)
+	mux.HandleFunc("GET /api/v1/version", f.handleVersion)
+	mux.HandleFunc("GET /api/v1/upstreams", f.handleUpstreams)
+	mux.HandleFunc("PUT /api/v1/upstreams", f.handleSetUpstreams)
+	return f.adminGuard(mux)
+}
+
+// adminGuard refuses state changes sent from another origin, which browsers
+// would otherwise let any page make with the user's credentials, and
+// requests lacking the admin credentials
+func (f *Forwarder) adminGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+			http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/healthz" && r.URL.Path != "/readyz" && !f.adminAuthorized(r) {
+			if f.config.Admin.Username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="GateLAN admin", charset="UTF-8"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorized reports whether r carries the admin token or username and
+// password, or whether none are configured
+func (f *Forwarder) adminAuthorized(r *http.Request) bool {
+	cfg := f.config.Admin
+	if !cfg.AuthEnabled() {
+		return true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && cfg.Token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) == 1
+	}
+	if username, password, ok := r.BasicAuth(); ok && cfg.Username != "" {
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(cfg.Username)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Password)) == 1
+		return userOK && passwordOK
+	}
+	return false
+}
+
+// sameOrigin reports whether r comes from a page of the admin API itself, or
+// from a client other than a browser, which sends no Origin
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// startAdmin serves the admin API when an address is configured
+func (f *Forwarder) startAdmin(ctx context.Context) error {
+	if f.config.Admin.Addr == "" {
+		return nil
+	}
+	var tlsConfig *tls.Config
+	if f.config.Admin.TLS.Enabled() {
+		var err error
+		if tlsConfig, err = f.serverTLS(f.config.Admin.TLS, "h2", "http/1.1"); err != nil {
+			return fmt.Errorf("invalid admin TLS: %w", err)
+		}
+	}
+	listener, err := f.listenTCP(f.config.Admin.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address: %w", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	f.admin = &http.Server{
+		Handler:           f.AdminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	f.logger.Printf("Admin API on %s", listener.Addr())
+	go func() {
+		if err := f.admin.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			f.logger.Printf("Admin API stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// handleMetrics serves the counters in the Prometheus text format
+func (f *Forwarder) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	f.WriteMetrics(w)
+}
+
+// handleHAR serves the recorded exchanges
+func (f *Forwarder) handleHAR(w http.ResponseWriter, r *http.Request) {
+	if f.har == nil {
+		http.Error(w, "HAR recording is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="gatelan.har"`)
+	f.WriteHAR(w)
+}
+
+// handleTopUsage serves a top-N report of the clients or domains; ?n= sets
+// the size, 0 for all, and ?tenant= reports on that tenant alone
+func (f *Forwarder) handleTopUsage(clients bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := f.stats
+		if name := r.URL.Query().Get("tenant"); name != "" {
+			t := f.tenantNamed(name)
+			if t == nil {
+				http.Error(w, "Unknown tenant", http.StatusNotFound)
+				return
+			}
+			stats = t.stats
+		}
+		if stats == nil {
+			http.Error(w, "Usage statistics are not enabled", http.StatusNotFound)
+			return
+		}
+		n := defaultTopN
+		if raw := r.URL.Query().Get("n"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 0 {
+				http.Error(w, "Invalid n", http.StatusBadRequest)
+				return
+			}
+			n = parsed
+		}
+		writeJSON(w, stats.top(clients, n))
+	}
+}
+
+// handleConnections lists in-flight requests and open tunnels
+func (f *Forwarder) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, f.Connections())
+}
+
+// handleBlocklists reports when each threat feed was last updated
+func (f *Forwarder) handleBlocklists(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, f.Blocklists())
+}
+
+// handleStatus reports upstream health and latency
+func (f *Forwarder) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, f.GetStatus())
+}
+
+// handleProfiles lists the configured profiles and the active one
+func (f *Forwarder) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{"active": f.Profile(), "profiles": f.Profiles()})
+}
+
+// handleActivateProfile switches to the profile named in the path
+func (f *Forwarder) handleActivateProfile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := f.config.Profiles[name]; !ok {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	}
+	if err := f.SwitchProfile(name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.logger.Printf("Activated profile %s via admin API", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePortalClients lists the clients that accepted the portal terms
+func (f *Forwarder) handlePortalClients(w http.ResponseWriter, r *http.Request) {
+	if f.portal == nil {
+		http.Error(w, "Captive portal is not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, f.PortalClients())
+}
+
+// handleRevokePortalClient sends the client named in the path back to the portal
+func (f *Forwarder) handleRevokePortalClient(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("client"))
+	if ip == nil {
+		http.Error(w, "Invalid client address", http.StatusBadRequest)
+		return
+	}
+	revoked, err := f.RevokePortalClient(ip.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	f.logger.Printf("Revoked portal acceptance of %s via admin API", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLists serves the entries of the block and allow lists
+func (f *Forwarder) handleLists(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, f.Lists())
+}
+
+// handleAddListEntry puts the domain, address or CIDR in the path on a list
+func (f *Forwarder) handleAddListEntry(w http.ResponseWriter, r *http.Request) {
+	list, entry, ok := listEntry(w, r)
+	if !ok {
+		return
+	}
+	if err := f.AddListEntry(list, entry); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.logger.Printf("Added %s to the %s list via admin API", entry, list)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRemoveListEntry takes the domain, address or CIDR in the path off a list
+func (f *Forwarder) handleRemoveListEntry(w http.ResponseWriter, r *http.Request) {
+	list, entry, ok := listEntry(w, r)
+	if !ok {
+		return
+	}
+	removed, err := f.RemoveListEntry(list, entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	f.logger.Printf("Removed %s from the %s list via admin API", entry, list)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listEntry reads the list name and normalized entry from the path,
+// answering the request when either is invalid
+func listEntry(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	list := r.PathValue("list")
+	if list != ListBlock && list != ListAllow {
+		http.Error(w, "List not found", http.StatusNotFound)
+		return "", "", false
+	}
+	entry, err := normalizeListEntry(r.PathValue("entry"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return list, entry, true
+}
+
+// handleStateBackup serves an archive of the persisted state
+func (f *Forwarder) handleStateBackup(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("gatelan-state-%s.tar.gz", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := f.WriteStateBackup(w); err != nil {
+		// Headers are gone once the archive started, so the truncated
+		// download is all the client learns
+		f.logger.Printf("Failed to back up state: %v", err)
+	}
+}
+
+// handleCompactState drops expired state and orphaned cache files
+func (f *Forwarder) handleCompactState(w http.ResponseWriter, r *http.Request) {
+	result, err := f.CompactState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.logger.Printf("Compacted state via admin API, removed %d cache files", result.CacheFiles)
+	writeJSON(w, result)
+}
+
+// handleCacheStats reports the response cache occupancy
+func (f *Forwarder) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, f.GetCacheStats())
+}
+
+// handlePurgeAllCache empties the response cache
+func (f *Forwarder) handlePurgeAllCache(w http.ResponseWriter, r *http.Request) {
+	removed := f.PurgeAllCache()
+	f.logger.Printf("Purged %d cached responses via admin API", removed)
+	writeJSON(w, map[string]int{"removed": removed})
+}
+
+// handlePurgeCache removes the cached response for the url query parameter
+func (f *Forwarder) handlePurgeCache(w http.ResponseWriter, r *http.Request) {
+	rawURL := r.URL.Query().Get("url")
+	if rawURL == "" {
+		http.Error(w, "Missing url parameter", http.StatusBadRequest)
+		return
+	}
+	if !f.PurgeCache(rawURL) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	f.logger.Printf("Purged the cached response for %s via admin API", rawURL)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upstreamsBody is the body of the upstreams endpoints
+type upstreamsBody struct {
+	Upstreams []string `json:"upstreams"` // proxy_addr first, then the rest of the pool
+}
+
+// handleUpstreams lists the pool of the active profile
+func (f *Forwarder) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, upstreamsBody{Upstreams: f.Upstreams()})
+}
+
+// handleSetUpstreams replaces the pool of the active profile
+func (f *Forwarder) handleSetUpstreams(w http.ResponseWriter, r *http.Request) {
+	var body upstreamsBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := f.SetUpstreams(body.Upstreams); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.logger.Printf("Replaced upstreams via admin API")
+	writeJSON(w, upstreamsBody{Upstreams: f.Upstreams()})
+}
+
+// handleVersion reports the running build
+func (f *Forwarder) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, GetVersion())
+}
+
+// handleKillConnection terminates the connection named in the path
+func (f *Forwarder) handleKillConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid connection ID", http.StatusBadRequest)
+		return
+	}
+	if !f.KillConnection(id) {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	f.logger.Printf("Killed connection %d via admin API", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus writes v as indented JSON with the given status
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GateLAN</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>GateLAN</h1>
+{{with .Status}}
+<p>Version {{.Version}}{{if .Profile}}, profile {{.Profile}}{{end}}{{if .Started.IsZero}}, not serving{{else}}, up {{.Uptime}}{{end}}{{if not .Readiness.Ready}}, not ready: {{range $i, $p := .Readiness.Problems}}{{if $i}}, {{end}}{{$p}}{{end}}{{end}}</p>
+<p>{{.Connections.Open}} open ({{.Connections.Requests}} requests, {{.Connections.Tunnels}} tunnels, {{.Connections.Stalled}} stalled), {{.Connections.Handled}} handled, {{bytes .BytesSent}} sent, {{bytes .BytesReceived}} received</p>
+<h2>Listeners</h2>
+<table>
+<tr><th>Listener</th><th>Address</th><th>TLS</th><th>Auth</th><th>Profile</th></tr>
+{{range .Listeners}}<tr><td>{{.Name}}</td><td>{{.Addr}}</td><td>{{if .TLS}}yes{{else}}no{{end}}</td><td>{{or .Auth "none"}}</td><td>{{.Profile}}</td></tr>
+{{end}}</table>
+<h2>Upstreams</h2>
+<table>
+<tr><th>Upstream</th><th>Breaker</th><th>Requests</th><th>Failures</th><th>Connect ms</th><th>TTFB ms</th><th>Last error</th></tr>
+{{range .Upstreams}}<tr><td>{{.Addr}}</td><td>{{.Breaker}}</td><td>{{.Requests}}</td><td>{{.Failures}}</td><td>{{printf "%.1f" .ConnectMS}}</td><td>{{printf "%.1f" .TTFBMS}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Enabled}}
+{{range .Tables}}
+<h2>{{.Title}}</h2>
+<table>
+<tr><th>{{.Column}}</th><th>Requests</th><th>Sent</th><th>Received</th></tr>
+{{range .Rows}}<tr><td>{{.Key}}</td><td>{{.Requests}}</td><td>{{.BytesSent}}</td><td>{{.BytesReceived}}</td></tr>
+{{end}}</table>
+{{end}}
+{{else}}
+<p>Usage statistics are not enabled.</p>
+{{end}}
+<p><a href="status">Status</a> <a href="metrics">Metrics</a></p>
+</body>
+</html>
+`))
+
+// handleDashboard renders the status document and the top domains and
+// clients as an HTML page
+func (f *Forwarder) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	type table struct {
+		Title, Column string
+		Rows          []Usage
+	}
+	data := struct {
+		Status  Status
+		Enabled bool
+		Tables  []table
+	}{
+		Status:  f.GetStatus(),
+		Enabled: f.stats != nil,
+		Tables: []table{
+			{"Top domains", "Domain", f.TopDomains(defaultTopN)},
+			{"Top clients", "Client", f.TopClients(defaultTopN)},
+		},
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		f.logger.Printf("Failed to render dashboard: %v", err)
+	}
+}
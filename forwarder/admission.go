@@ -0,0 +1,186 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+var (
+	errQueueFull    = errors.New("admission queue full")
+	errQueueTimeout = errors.New("timed out in the admission queue")
+)
+
+// admissionBuckets are the histogram buckets of queue waits, in seconds
+var admissionBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// admission bounds the requests in progress, queueing the ones beyond the
+// limit per client and granting freed slots to the clients in turn. A nil
+// admission admits everything.
+type admission struct {
+	config  config.AdmissionConfig
+	metrics *metrics
+
+	mu      sync.Mutex
+	active  int
+	queued  int
+	waiting map[string][]chan struct{} // Waiters of each client, oldest first
+	turns   []string                   // Clients with waiters, the next one to be served first
+}
+
+// newAdmission returns nil when concurrency is unlimited
+func newAdmission(cfg config.AdmissionConfig, m *metrics) *admission {
+	if cfg.MaxConcurrent == 0 {
+		return nil
+	}
+	return &admission{config: cfg, metrics: m, waiting: make(map[string][]chan struct{})}
+}
+
+// acquire takes a slot for client, waiting in the queue when all are taken
+// until ctx ends or the wait exceeds max_wait
+func (a *admission) acquire(ctx context.Context, client string) (*admissionSlot, error) {
+	if a == nil {
+		return nil, nil
+	}
+	a.mu.Lock()
+	if a.active < a.config.MaxConcurrent && a.queued == 0 {
+		a.active++
+		a.mu.Unlock()
+		return &admissionSlot{admission: a}, nil
+	}
+	if a.queued >= a.config.QueueSize {
+		a.mu.Unlock()
+		a.metrics.inc("gatelan_admission_rejected_total", "reason", "queue_full")
+		return nil, errQueueFull
+	}
+	granted := make(chan struct{})
+	if len(a.waiting[client]) == 0 {
+		a.turns = append(a.turns, client)
+	}
+	a.waiting[client] = append(a.waiting[client], granted)
+	a.queued++
+	a.mu.Unlock()
+
+	started := time.Now()
+	timer := time.NewTimer(time.Duration(a.config.MaxWait))
+	defer timer.Stop()
+	var err error
+	select {
+	case <-granted:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil && a.dequeue(client, granted) {
+		if err == errQueueTimeout {
+			a.metrics.inc("gatelan_admission_rejected_total", "reason", "timeout")
+		}
+		return nil, err
+	}
+	// Granted, possibly while giving up
+	a.metrics.observe("gatelan_admission_wait_seconds", admissionBuckets, time.Since(started).Seconds())
+	return &admissionSlot{admission: a}, nil
+}
+
+// dequeue removes a waiter giving up, reporting false when it was granted a
+// slot in the meantime
+func (a *admission) dequeue(client string, granted chan struct{}) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	waiters := a.waiting[client]
+	for i, ch := range waiters {
+		if ch != granted {
+			continue
+		}
+		a.queued--
+		if len(waiters) == 1 {
+			delete(a.waiting, client)
+			a.removeTurn(client)
+		} else {
+			a.waiting[client] = append(waiters[:i:i], waiters[i+1:]...)
+		}
+		return true
+	}
+	return false
+}
+
+// removeTurn drops client from the turns; a.mu must be held
+func (a *admission) removeTurn(client string) {
+	for i, c := range a.turns {
+		if c == client {
+			a.turns = append(a.turns[:i], a.turns[i+1:]...)
+			return
+		}
+	}
+}
+
+// release hands the slot to the oldest waiter of the next client in turn,
+// or frees it
+func (a *admission) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.turns) == 0 {
+		a.active--
+		return
+	}
+	client := a.turns[0]
+	a.turns = a.turns[1:]
+	waiters := a.waiting[client]
+	close(waiters[0])
+	a.queued--
+	if len(waiters) == 1 {
+		delete(a.waiting, client)
+	} else {
+		a.waiting[client] = waiters[1:]
+		a.turns = append(a.turns, client)
+	}
+}
+
+// admissionSlot is a slot taken by a request, released once
+type admissionSlot struct {
+	admission *admission
+	once      sync.Once
+}
+
+// release frees the slot, a nil slot being a no-op
+func (s *admissionSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(s.admission.release)
+}
+
+// admissionContextKey carries the slot of a request
+type admissionContextKey struct{}
+
+// releaseAdmission frees the slot of req before it ends, as tunnels do once
+// established
+func releaseAdmission(req *http.Request) {
+	slot, _ := req.Context().Value(admissionContextKey{}).(*admissionSlot)
+	slot.release()
+}
+
+// admit takes a slot for r, refusing it with a 503 when the queue is full or
+// the wait too long. The returned request carries the slot.
+func (f *Forwarder) admit(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if f.admission == nil {
+		return r, true
+	}
+	slot, err := f.admission.acquire(r.Context(), remoteIP(r))
+	if err != nil {
+		if r.Context().Err() == nil {
+			f.logf(r, "Overloaded, refused %s %s for %s: %v", r.Method, r.Host, f.clientLabel(r), err)
+			retry := int(time.Duration(f.config.Admission.MaxWait).Seconds())
+			w.Header().Set("Retry-After", strconv.Itoa(max(retry, 1)))
+			f.writeError(w, r, http.StatusServiceUnavailable, "Proxy overloaded, try again later", "")
+		}
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), admissionContextKey{}, slot)), true
+}
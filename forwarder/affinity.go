@@ -0,0 +1,88 @@
+package forwarder
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// affinityTable remembers which upstream served each client so sites with
+// IP-based sessions keep seeing the same egress address
+type affinityTable struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	pins      map[string]affinityPin
+	lastSweep time.Time
+}
+
+// affinityPin is an upstream a client is pinned to until expires
+type affinityPin struct {
+	upstream *upstream
+	expires  time.Time
+}
+
+func newAffinityTable(cfg config.AffinityConfig) *affinityTable {
+	return &affinityTable{ttl: time.Duration(cfg.TTL), pins: make(map[string]affinityPin)}
+}
+
+// lookup returns the upstream key is pinned to, if the pin is still live
+func (t *affinityTable) lookup(key string) *upstream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pin, ok := t.pins[key]
+	if !ok || time.Now().After(pin.expires) {
+		return nil
+	}
+	return pin.upstream
+}
+
+// pin binds key to up, refreshing the expiry on every use
+func (t *affinityTable) pin(key string, up *upstream) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pins[key] = affinityPin{upstream: up, expires: now.Add(t.ttl)}
+
+	// Forget idle clients once per TTL
+	if now.Sub(t.lastSweep) > t.ttl {
+		for k, p := range t.pins {
+			if now.After(p.expires) {
+				delete(t.pins, k)
+			}
+		}
+		t.lastSweep = now
+	}
+}
+
+// affinityContextKey carries the affinity key of a request
+type affinityContextKey struct{}
+
+// withAffinity tags ctx with the client's affinity key
+func withAffinity(ctx context.Context, key string) context.Context {
+	if key == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, affinityContextKey{}, key)
+}
+
+// affinityKey returns the key requests from client (and user, when
+// authenticated) are pinned by, or "" when affinity is disabled
+func (f *Forwarder) affinityKey(client, user string) string {
+	if f.affinity == nil {
+		return ""
+	}
+	switch f.config.Affinity.Key {
+	case config.IdentityUser:
+		if user != "" {
+			return "user:" + user
+		}
+	case config.IdentityMAC:
+		if mac := f.neighbors.lookup(client); mac != "" {
+			return "mac:" + mac
+		}
+	}
+	return "client:" + client
+}
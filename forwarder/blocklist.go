@@ -0,0 +1,260 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// BlocklistStatus describes the freshness of one subscribed feed
+type BlocklistStatus struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Format  string    `json:"format"`
+	Entries int       `json:"entries"`
+	Updated time.Time `json:"updated"` // Last successful download, zero before the first
+	Checked time.Time `json:"checked"` // Last download attempt
+	Error   string    `json:"error,omitempty"`
+}
+
+// blocklist refuses destinations found in periodically downloaded feeds
+type blocklist struct {
+	client *http.Client
+
+	mu    sync.RWMutex
+	feeds []*feed
+}
+
+// feed is one subscribed list and its last successfully parsed entries
+type feed struct {
+	config       config.FeedConfig
+	domains      acl.DomainSet
+	networks     []*net.IPNet
+	etag         string
+	lastModified string
+	updated      time.Time
+	checked      time.Time
+	err          error
+}
+
+func newBlocklist(cfg config.BlocklistConfig) *blocklist {
+	b := &blocklist{client: &http.Client{Timeout: time.Minute}}
+	for _, fc := range cfg.Feeds {
+		b.feeds = append(b.feeds, &feed{config: fc, domains: acl.DomainSet{}})
+	}
+	return b
+}
+
+// match returns the name of the first feed listing host, or ""
+func (b *blocklist) match(host string) string {
+	if b == nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, feed := range b.feeds {
+		if ip != nil {
+			if acl.ContainsIP(feed.networks, ip) {
+				return feed.config.Name
+			}
+		} else if feed.domains.Match(host) {
+			return feed.config.Name
+		}
+	}
+	return ""
+}
+
+// refreshBlocklists downloads every feed now and then once per refresh
+// interval until ctx is cancelled
+func (f *Forwarder) refreshBlocklists(ctx context.Context) {
+	if f.blocklist == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(f.config.Blocklist.Refresh))
+	defer ticker.Stop()
+	for {
+		for _, feed := range f.blocklist.feeds {
+			if err := f.blocklist.update(ctx, feed); err != nil {
+				f.logger.Printf("Failed to update blocklist %s: %v", feed.config.Name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update downloads feed, keeping the previous entries when that fails or the
+// list hasn't changed
+func (b *blocklist) update(ctx context.Context, feed *feed) error {
+	b.mu.RLock()
+	etag, lastModified := feed.etag, feed.lastModified
+	b.mu.RUnlock()
+
+	domains, networks, resp, err := b.fetch(ctx, feed.config, etag, lastModified)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	feed.checked = time.Now()
+	feed.err = err
+	if err != nil {
+		return err
+	}
+	feed.updated = feed.checked
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	feed.domains, feed.networks = domains, networks
+	feed.etag, feed.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return nil
+}
+
+// fetch downloads and parses a feed, revalidating with the given validators
+func (b *blocklist) fetch(ctx context.Context, fc config.FeedConfig, etag, lastModified string) (acl.DomainSet, []*net.IPNet, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fc.URL, nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil, resp, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	domains, networks, err := parseFeed(resp.Body, fc.Format)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read list: %w", err)
+	}
+	return domains, networks, resp, nil
+}
+
+// parseFeed reads a list in the given format, skipping lines it doesn't understand
+func parseFeed(r io.Reader, format string) (acl.DomainSet, []*net.IPNet, error) {
+	domains := acl.DomainSet{}
+	var networks []*net.IPNet
+	add := func(entry string) {
+		if nets, err := acl.ParseNetworks([]string{entry}); err == nil {
+			networks = append(networks, nets...)
+		} else if strings.Contains(entry, ".") {
+			domains.Add(entry)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		switch format {
+		case config.FeedHosts:
+			line, _, _ = strings.Cut(line, "#")
+			fields := strings.Fields(line)
+			if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			for _, host := range fields[1:] {
+				switch host {
+				case "localhost", "localhost.localdomain", "local", "broadcasthost", "0.0.0.0":
+					continue
+				}
+				domains.Add(host)
+			}
+		case config.FeedABP:
+			rule, ok := strings.CutPrefix(line, "||")
+			if !ok {
+				continue
+			}
+			domain, rest, _ := strings.Cut(rule, "^")
+			if rest != "" && rest[0] != '$' || strings.ContainsAny(domain, "/*") {
+				continue
+			}
+			domains.Add(domain)
+		default:
+			if strings.Contains(line, "://") {
+				if u, err := url.Parse(line); err == nil {
+					add(u.Hostname())
+				}
+				continue
+			}
+			entry, _, _ := strings.Cut(strings.Fields(line)[0], "#")
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				entry, _, _ = strings.Cut(entry, "/")
+			}
+			add(entry)
+		}
+	}
+	return domains, networks, scanner.Err()
+}
+
+// Blocklists reports the freshness of every subscribed feed
+func (f *Forwarder) Blocklists() []BlocklistStatus {
+	if f.blocklist == nil {
+		return []BlocklistStatus{}
+	}
+	b := f.blocklist
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	statuses := make([]BlocklistStatus, 0, len(b.feeds))
+	for _, feed := range b.feeds {
+		status := BlocklistStatus{
+			Name:    feed.config.Name,
+			URL:     feed.config.URL,
+			Format:  feed.config.Format,
+			Entries: len(feed.domains) + len(feed.networks),
+			Updated: feed.updated,
+			Checked: feed.checked,
+		}
+		if feed.err != nil {
+			status.Error = feed.err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// blockedByFeed returns the feed listing host, logging and counting the
+// refusal of r
+func (f *Forwarder) blockedByFeed(r *http.Request, host string) string {
+	if f.lists.allows(host) {
+		return ""
+	}
+	name := f.blocklist.match(host)
+	if name != "" {
+		f.logf(r, "Blocklist %s blocked %s for %s", name, host, f.clientLabel(r))
+		f.metrics.inc("gatelan_blocklist_hits_total", "feed", name)
+		f.logBlocked(r, host, "listed in blocklist "+name)
+	}
+	return name
+}
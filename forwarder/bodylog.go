@@ -0,0 +1,199 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// bodyLogRedacted are the headers never logged with their values
+var bodyLogRedacted = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// bodyLogger logs the headers and beginning of the bodies of requests
+type bodyLogger struct {
+	config  config.BodyLogConfig
+	clients []*net.IPNet
+	redact  map[string]bool // Canonical header names
+}
+
+// newBodyLogger returns nil when body logging is disabled
+func newBodyLogger(cfg config.BodyLogConfig) (*bodyLogger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	clients, err := acl.ParseNetworks(cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body_log clients: %w", err)
+	}
+	l := &bodyLogger{config: cfg, clients: clients, redact: make(map[string]bool)}
+	for _, name := range append(bodyLogRedacted, cfg.Redact...) {
+		l.redact[http.CanonicalHeaderKey(name)] = true
+	}
+	return l, nil
+}
+
+// matches reports whether the exchange of req is logged
+func (l *bodyLogger) matches(req *http.Request) bool {
+	if l == nil {
+		return false
+	}
+	if len(l.config.Hosts) > 0 && !acl.MatchHost(req.URL.Hostname(), l.config.Hosts) {
+		return false
+	}
+	return len(l.clients) == 0 || acl.ContainsIP(l.clients, net.ParseIP(remoteIP(req)))
+}
+
+// headers formats header on one line, sorted by name and redacted
+func (l *bodyLogger) headers(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range header[name] {
+			if l.redact[http.CanonicalHeaderKey(name)] {
+				value = "[redacted]"
+			}
+			if b.Len() > 0 {
+				b.WriteString("; ")
+			}
+			fmt.Fprintf(&b, "%s: %s", name, value)
+		}
+	}
+	return b.String()
+}
+
+// body describes the beginning of a body of size bytes in total captured,
+// decoding gzip and brotli content and summarizing binary content
+func (l *bodyLogger) body(encoding string, captured []byte, size int64) string {
+	if size == 0 {
+		return "empty"
+	}
+	note := ""
+	if encoding != "" && decodable(encoding) {
+		if r, err := decodeBody(encoding, bytes.NewReader(captured)); err == nil {
+			decoded, _ := io.ReadAll(io.LimitReader(r, int64(l.config.MaxSize)))
+			if len(decoded) > 0 {
+				captured = decoded
+				note = ", decoded from " + encoding
+			}
+		}
+	}
+	summary := fmt.Sprintf("%d bytes", size)
+	if int64(len(captured)) < size || note != "" {
+		summary += fmt.Sprintf(", first %d shown%s", len(captured), note)
+	}
+	if !printable(captured) {
+		return fmt.Sprintf("%s, binary: % x", summary, captured[:min(len(captured), 32)])
+	}
+	return fmt.Sprintf("%s: %q", summary, captured)
+}
+
+// printable reports whether text is UTF-8 without control characters other
+// than whitespace. A multibyte character cut off at the end is allowed.
+func printable(text []byte) bool {
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		if r == utf8.RuneError && size == 1 {
+			return len(text) < utf8.UTFMax && !utf8.FullRune(text)
+		}
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+		text = text[size:]
+	}
+	return true
+}
+
+// loggedBody keeps the first max bytes read through it. Unlike a
+// captureBody it may be looked at while the transport still reads it.
+type loggedBody struct {
+	io.ReadCloser
+	max     int
+	onClose func()
+
+	mu   sync.Mutex
+	size int64
+	buf  bytes.Buffer
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	b.size += int64(n)
+	if room := b.max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(n, room)])
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.onClose()
+	return err
+}
+
+// captured returns what was kept and the bytes read so far
+func (b *loggedBody) captured() ([]byte, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes()), b.size
+}
+
+// logBodies forwards req with next, logging the request body once it has been
+// sent and the response body once it has been relayed
+func (f *Forwarder) logBodies(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	l := f.bodyLog
+	target := req.Method + " " + req.URL.String()
+	f.logf(req, "Request headers of %s: %s", target, l.headers(req.Header))
+
+	// Requests answered without their body being sent, such as blocked ones,
+	// are logged as the exchange ends
+	var logRequest sync.Once
+	logRequestBody := func() {}
+	if req.Body != nil && req.Body != http.NoBody {
+		body := &loggedBody{ReadCloser: req.Body, max: l.config.MaxSize}
+		encoding := contentEncoding(req.Header)
+		logRequestBody = func() {
+			logRequest.Do(func() {
+				captured, size := body.captured()
+				f.logf(req, "Request body of %s: %s", target, l.body(encoding, captured, size))
+			})
+		}
+		body.onClose = logRequestBody
+		req = req.WithContext(req.Context())
+		req.Body = body
+	}
+
+	resp, err := next(req)
+	if err != nil {
+		logRequestBody()
+		return nil, err
+	}
+	f.logf(req, "Response headers of %s: %d, %s", target, resp.StatusCode, l.headers(resp.Header))
+	body := &loggedBody{ReadCloser: resp.Body, max: l.config.MaxSize}
+	encoding := contentEncoding(resp.Header)
+	var logResponse sync.Once
+	body.onClose = func() {
+		logResponse.Do(func() {
+			logRequestBody()
+			captured, size := body.captured()
+			f.logf(req, "Response body of %s: %s", target, l.body(encoding, captured, size))
+		})
+	}
+	resp.Body = body
+	return resp, nil
+}
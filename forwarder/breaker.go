@@ -0,0 +1,158 @@
+package forwarder
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// ErrUpstreamUnavailable is returned when every upstream's circuit breaker is open
+var ErrUpstreamUnavailable = errors.New("all upstream proxies are unavailable")
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker tracks consecutive failures of one upstream. A nil breaker
+// always allows requests.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(state string)
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(cfg config.CircuitBreakerConfig, onChange func(state string)) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: cfg.FailureThreshold,
+		cooldown:  time.Duration(cfg.Cooldown),
+		onChange:  onChange,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether a request may be sent, admitting a single probe
+// once the cool-down has elapsed
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// success records a completed exchange and closes the breaker
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+// failure records a connection failure, opening the breaker when the
+// threshold is reached or a half-open probe fails
+func (b *circuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// release gives up a probe that allow admitted without a verdict on the
+// upstream, as when the client went away first, so that the next request
+// probes instead
+func (b *circuitBreaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// currentState returns the breaker state for reporting
+func (b *circuitBreaker) currentState() string {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState transitions and notifies; b.mu must be held
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
+
+// newBreaker creates the breaker for the upstream at addr, or nil when disabled.
+// Its closing ends a fallback to direct connections. Opening after having
+// been closed and closing again are announced as events, while failed
+// half-open probes are not.
+func (f *Forwarder) newBreaker(addr string) *circuitBreaker {
+	if !f.config.CircuitBreaker.Enabled {
+		return nil
+	}
+	down := false // Guarded by the breaker's mutex
+	return newCircuitBreaker(f.config.CircuitBreaker, func(state string) {
+		f.logger.Printf("Circuit breaker for upstream %s is now %s", addr, state)
+		f.metrics.inc("gatelan_circuit_breaker_transitions_total", "upstream", addr, "state", state)
+		if state == breakerClosed && f.fallback.CompareAndSwap(true, false) {
+			f.logger.Printf("Upstream %s recovered, no longer connecting directly", addr)
+		}
+		switch {
+		case state == breakerOpen && !down:
+			down = true
+			f.emit(Event{Type: config.EventUpstreamDown, Upstream: addr, Message: "Upstream " + addr + " is down"})
+		case state == breakerClosed && down:
+			down = false
+			f.emit(Event{Type: config.EventUpstreamRecovered, Upstream: addr, Message: "Upstream " + addr + " recovered"})
+		}
+	})
+}
@@ -0,0 +1,644 @@
+package forwarder
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+const (
+	cacheOrphanAge            = time.Hour // Unindexed files younger than this may still be in use
+	defaultCacheMaxSize       = 256 << 20
+	defaultCacheMaxObjectSize = 64 << 20
+)
+
+// CacheStats reports the current cache occupancy
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"max_size"`
+}
+
+// cacheEntry is a stored response together with its freshness metadata
+type cacheEntry struct {
+	Key          string            `json:"key"`
+	URL          string            `json:"url"`
+	StatusCode   int               `json:"status_code"`
+	Header       http.Header       `json:"header"`
+	Vary         map[string]string `json:"vary"`
+	RequestTime  time.Time         `json:"request_time"`
+	ResponseTime time.Time         `json:"response_time"`
+	Size         int64             `json:"size"`
+
+	body []byte // Only populated for in-memory caches
+}
+
+// httpCache is a shared HTTP cache with LRU eviction
+type httpCache struct {
+	config config.CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+// newHTTPCache creates the cache and loads any entries persisted in cfg.Dir
+func newHTTPCache(cfg config.CacheConfig) (*httpCache, error) {
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = defaultCacheMaxSize
+	}
+	if cfg.MaxObjectSize == 0 {
+		cfg.MaxObjectSize = defaultCacheMaxObjectSize
+	}
+
+	c := &httpCache{
+		config:  cfg,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache dir: %w", err)
+		}
+		if err := c.loadDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// loadDir rebuilds the index from metadata files left by a previous run
+func (c *httpCache) loadDir() error {
+	metaFiles, err := filepath.Glob(filepath.Join(c.config.Dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to scan cache dir: %w", err)
+	}
+
+	var loaded []*cacheEntry
+	for _, metaFile := range metaFiles {
+		data, err := os.ReadFile(metaFile)
+		if err != nil {
+			continue
+		}
+		var entry cacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			os.Remove(metaFile)
+			continue
+		}
+		if _, err := os.Stat(c.bodyPath(entry.Key)); err != nil {
+			os.Remove(metaFile)
+			continue
+		}
+		loaded = append(loaded, &entry)
+	}
+
+	// Oldest entries go to the back of the LRU list
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].ResponseTime.After(loaded[j].ResponseTime)
+	})
+	for _, entry := range loaded {
+		c.entries[entry.Key] = c.lru.PushBack(entry)
+		c.size += entry.Size
+	}
+	c.evict()
+
+	return nil
+}
+
+// cacheKey identifies a stored response
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+// lookable reports whether the request may be answered from the cache
+func (c *httpCache) lookable(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	cc := parseCacheControl(req.Header.Get("Cache-Control"))
+	_, noStore := cc["no-store"]
+	return !noStore
+}
+
+// lookup returns the entry stored for req, if its Vary headers match
+func (c *httpCache) lookup(req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[cacheKey(req)]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	for name, value := range entry.Vary {
+		if req.Header.Get(name) != value {
+			return nil
+		}
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+// fresh reports whether entry can be served to req without revalidation
+func (e *cacheEntry) fresh(req *http.Request, now time.Time) bool {
+	respCC := parseCacheControl(e.Header.Get("Cache-Control"))
+	reqCC := parseCacheControl(req.Header.Get("Cache-Control"))
+
+	if _, ok := respCC["no-cache"]; ok {
+		return false
+	}
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	if strings.Contains(req.Header.Get("Pragma"), "no-cache") {
+		return false
+	}
+
+	age := e.age(now)
+	if maxAge, ok := reqCC["max-age"]; ok {
+		if secs, err := strconv.Atoi(maxAge); err == nil && age > time.Duration(secs)*time.Second {
+			return false
+		}
+	}
+
+	return e.lifetime() > age
+}
+
+// lifetime computes the freshness lifetime (RFC 7234 section 4.2.1)
+func (e *cacheEntry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cc[directive]; ok {
+			if secs, err := strconv.Atoi(value); err == nil {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+
+	date := e.date()
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	// Heuristic freshness: 10% of the time since last modification
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		return date.Sub(lastModified) / 10
+	}
+
+	return 0
+}
+
+// age computes the current age of the entry (RFC 7234 section 4.2.3)
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	date := e.date()
+	apparentAge := e.ResponseTime.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+
+	var ageValue time.Duration
+	if secs, err := strconv.Atoi(e.Header.Get("Age")); err == nil {
+		ageValue = time.Duration(secs) * time.Second
+	}
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+
+	initialAge := apparentAge
+	if correctedAge > initialAge {
+		initialAge = correctedAge
+	}
+	return initialAge + now.Sub(e.ResponseTime)
+}
+
+// date returns the Date header, falling back to the response time
+func (e *cacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// addValidators turns the outgoing request into a conditional one for entry
+func (c *httpCache) addValidators(header http.Header, entry *cacheEntry) {
+	if header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != "" {
+		return
+	}
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// response builds a client response from a stored entry
+func (c *httpCache) response(req *http.Request, entry *cacheEntry) (*http.Response, error) {
+	header := entry.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(entry.age(time.Now()).Seconds())))
+	header.Set("X-Cache", "HIT")
+
+	// Answer the client's own conditional request when the validator matches
+	if etag := header.Get("ETag"); etag != "" && strings.Contains(req.Header.Get("If-None-Match"), etag) {
+		resp := newResponse(req, http.StatusNotModified, "")
+		resp.Header = header
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = 0
+		return resp, nil
+	}
+
+	var body io.ReadCloser
+	if c.config.Dir != "" {
+		file, err := os.Open(c.bodyPath(entry.Key))
+		if err != nil {
+			c.remove(entry.Key)
+			return nil, fmt.Errorf("failed to open cached body: %w", err)
+		}
+		body = file
+	} else {
+		body = io.NopCloser(bytes.NewReader(entry.body))
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: entry.Size,
+		Request:       req,
+	}, nil
+}
+
+// handleResponse processes an upstream response: it refreshes a revalidated
+// entry on 304, invalidates on unsafe methods and tees storable bodies into the cache
+func (c *httpCache) handleResponse(req *http.Request, cached *cacheEntry, requestTime time.Time, resp *http.Response) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return resp, nil
+	default:
+		// Unsafe methods invalidate the stored response (RFC 7234 section 4.4)
+		if resp.StatusCode < 400 {
+			c.remove(http.MethodGet + " " + req.URL.String())
+		}
+		return resp, nil
+	}
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return c.response(req, c.refresh(cached, resp.Header, requestTime))
+	}
+
+	if !c.storable(req, resp) {
+		return resp, nil
+	}
+
+	entry := &cacheEntry{
+		Key:          cacheKey(req),
+		URL:          req.URL.String(),
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Vary:         make(map[string]string),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	}
+	entry.Header.Del("X-Cache")
+	// Cookies set for the first client are never replayed to the others
+	entry.Header.Del("Set-Cookie")
+	for _, name := range strings.Split(resp.Header.Get("Vary"), ",") {
+		if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+			entry.Vary[name] = req.Header.Get(name)
+		}
+	}
+
+	sink, err := c.newSink(entry)
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body = &cachingBody{ReadCloser: resp.Body, cache: c, entry: entry, sink: sink, limit: c.config.MaxObjectSize}
+	return resp, nil
+}
+
+// storable reports whether resp may be stored by a shared cache (RFC 7234 section 3)
+func (c *httpCache) storable(req *http.Request, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return false
+	}
+	if resp.ContentLength > c.config.MaxObjectSize || isEventStream(resp) {
+		return false
+	}
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+
+	reqCC := parseCacheControl(req.Header.Get("Cache-Control"))
+	respCC := parseCacheControl(resp.Header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "private"} {
+		if _, ok := respCC[directive]; ok {
+			return false
+		}
+	}
+	if _, ok := reqCC["no-store"]; ok {
+		return false
+	}
+
+	_, public := respCC["public"]
+	_, sMaxAge := respCC["s-maxage"]
+	if req.Header.Get("Authorization") != "" && !public && !sMaxAge {
+		return false
+	}
+	// A response setting a cookie is the client's own unless marked public
+	if !public && resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	// Something must let us decide freshness or revalidate later
+	_, maxAge := respCC["max-age"]
+	return public || maxAge || sMaxAge ||
+		resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("Last-Modified") != "" ||
+		resp.Header.Get("ETag") != ""
+}
+
+// refresh stores a copy of entry updated with the headers of a 304 response
+// and returns it; stored entries are never changed in place, as requests are
+// answered from them without holding c.mu
+func (c *httpCache) refresh(entry *cacheEntry, header http.Header, requestTime time.Time) *cacheEntry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" || name == "Set-Cookie" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The entry may have been evicted or replaced meanwhile
+	if elem, ok := c.entries[entry.Key]; ok && elem.Value == entry {
+		elem.Value = &updated
+		c.writeMeta(&updated)
+	}
+	return &updated
+}
+
+// cacheSink receives a response body while it is relayed to the client
+type cacheSink interface {
+	io.Writer
+	commit() error
+	abort()
+}
+
+// memorySink buffers a body for the in-memory cache
+type memorySink struct {
+	bytes.Buffer
+	entry *cacheEntry
+}
+
+func (s *memorySink) commit() error { s.entry.body = s.Bytes(); return nil }
+func (s *memorySink) abort()        {}
+
+// fileSink streams a body into a temporary file inside the cache dir
+type fileSink struct {
+	*os.File
+	final string
+}
+
+func (s *fileSink) commit() error {
+	if err := s.Close(); err != nil {
+		os.Remove(s.Name())
+		return err
+	}
+	return os.Rename(s.Name(), s.final)
+}
+
+func (s *fileSink) abort() {
+	s.Close()
+	os.Remove(s.Name())
+}
+
+// newSink creates the body destination for entry
+func (c *httpCache) newSink(entry *cacheEntry) (cacheSink, error) {
+	if c.config.Dir == "" {
+		return &memorySink{entry: entry}, nil
+	}
+	file, err := os.CreateTemp(c.config.Dir, "tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{File: file, final: c.bodyPath(entry.Key)}, nil
+}
+
+// cachingBody copies the body into the cache as the client reads it
+type cachingBody struct {
+	io.ReadCloser
+	cache   *httpCache
+	entry   *cacheEntry
+	sink    cacheSink
+	limit   int64
+	written int64
+	done    bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.done && n > 0 {
+		b.written += int64(n)
+		if b.written > b.limit {
+			b.finish(false)
+		} else if _, werr := b.sink.Write(p[:n]); werr != nil {
+			b.finish(false)
+		}
+	}
+	if err == io.EOF && !b.done {
+		b.finish(true)
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	// A body closed before EOF is incomplete and must not be stored
+	if !b.done {
+		b.finish(false)
+	}
+	return b.ReadCloser.Close()
+}
+
+func (b *cachingBody) finish(complete bool) {
+	b.done = true
+	if !complete {
+		b.sink.abort()
+		return
+	}
+	if err := b.sink.commit(); err != nil {
+		return
+	}
+	b.entry.Size = b.written
+	b.cache.store(b.entry)
+}
+
+// store inserts entry into the index and evicts old entries beyond MaxSize
+func (c *httpCache) store(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.Key]; ok {
+		c.size -= elem.Value.(*cacheEntry).Size
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.Key] = c.lru.PushFront(entry)
+	c.size += entry.Size
+	c.writeMeta(entry)
+	c.evict()
+}
+
+// evict drops least recently used entries until the cache fits; c.mu must be held
+func (c *httpCache) evict() {
+	for c.size > c.config.MaxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// remove deletes the entry stored under key
+func (c *httpCache) remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok {
+		c.removeElement(elem)
+	}
+	return ok
+}
+
+// removeElement unlinks an entry and its files; c.mu must be held
+func (c *httpCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.Key)
+	c.size -= entry.Size
+	if c.config.Dir != "" {
+		os.Remove(c.metaPath(entry.Key))
+		os.Remove(c.bodyPath(entry.Key))
+	}
+}
+
+// purgeAll empties the cache
+func (c *httpCache) purgeAll() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := c.lru.Len()
+	for c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+	return count
+}
+
+// compact deletes files in the cache directory that no entry refers to,
+// left behind by crashes or interrupted downloads, returning how many
+func (c *httpCache) compact() (int, error) {
+	if c == nil || c.config.Dir == "" {
+		return 0, nil
+	}
+	dirEntries, err := os.ReadDir(c.config.Dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan cache dir: %w", err)
+	}
+
+	c.mu.Lock()
+	indexed := make(map[string]bool, 2*len(c.entries))
+	for key := range c.entries {
+		indexed[filepath.Base(c.metaPath(key))] = true
+		indexed[filepath.Base(c.bodyPath(key))] = true
+	}
+	c.mu.Unlock()
+
+	removed := 0
+	cutoff := time.Now().Add(-cacheOrphanAge)
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || indexed[dirEntry.Name()] {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if os.Remove(filepath.Join(c.config.Dir, dirEntry.Name())) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// stats returns the current occupancy
+func (c *httpCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Entries: c.lru.Len(), Size: c.size, MaxSize: c.config.MaxSize}
+}
+
+// writeMeta persists entry metadata for on-disk caches; c.mu must be held
+func (c *httpCache) writeMeta(entry *cacheEntry) {
+	if c.config.Dir == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	os.WriteFile(c.metaPath(entry.Key), data, 0o644)
+}
+
+func (c *httpCache) fileBase(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.config.Dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *httpCache) metaPath(key string) string { return c.fileBase(key) + ".json" }
+func (c *httpCache) bodyPath(key string) string { return c.fileBase(key) + ".body" }
+
+// parseCacheControl splits a Cache-Control header into directives
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+	}
+	return directives
+}
@@ -0,0 +1,195 @@
+package forwarder
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// categoryFilter blocks destination categories per client profile
+type categoryFilter struct {
+	domains  map[string][]string // Domain to its categories
+	profiles []categoryProfile
+}
+
+// categoryProfile is a compiled CategoryProfile
+type categoryProfile struct {
+	name    string
+	clients []*net.IPNet
+	block   map[string]bool
+}
+
+func newCategoryFilter(cfg config.CategoriesConfig) (*categoryFilter, error) {
+	c := &categoryFilter{}
+	for i, pc := range cfg.Profiles {
+		name := pc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		clients, err := acl.ParseNetworks(pc.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("category profile %s: %w", name, err)
+		}
+		profile := categoryProfile{name: name, clients: clients, block: make(map[string]bool)}
+		for _, category := range pc.Block {
+			profile.block[strings.ToLower(category)] = true
+		}
+		c.profiles = append(c.profiles, profile)
+	}
+
+	var err error
+	if c.domains, err = loadCategoryDatabase(cfg.Database); err != nil {
+		return nil, fmt.Errorf("failed to load category database: %w", err)
+	}
+	return c, nil
+}
+
+// loadCategoryDatabase reads a category directory tree or a domain list file
+func loadCategoryDatabase(path string) (map[string][]string, error) {
+	domains := make(map[string][]string)
+	add := func(domain, category string) {
+		domain = acl.CanonicalHost(strings.TrimPrefix(domain, "."))
+		category = strings.ToLower(category)
+		if domain != "" && category != "" && !slices.Contains(domains[domain], category) {
+			domains[domain] = append(domains[domain], category)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		err = scanLines(file, func(line string) {
+			fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+			for _, category := range fields[1:] {
+				add(fields[0], category)
+			}
+		})
+		return domains, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		file, err := os.Open(filepath.Join(path, entry.Name(), "domains"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = scanLines(file, func(line string) {
+			add(strings.Fields(line)[0], entry.Name())
+		})
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return domains, nil
+}
+
+// scanLines calls fn for every line that isn't blank or a # comment
+func scanLines(r io.Reader, fn func(line string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && line[0] != '#' {
+			fn(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// categories returns the categories of host and every parent domain
+func (c *categoryFilter) categories(host string) []string {
+	var result []string
+	host = acl.CanonicalHost(host)
+	for host != "" {
+		result = append(result, c.domains[host]...)
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+	return result
+}
+
+// blocked returns the profile of client and the category of host it blocks
+func (c *categoryFilter) blocked(client net.IP, host string) (string, string) {
+	if c == nil || client == nil {
+		return "", ""
+	}
+	for _, profile := range c.profiles {
+		if !acl.ContainsIP(profile.clients, client) {
+			continue
+		}
+		for _, category := range c.categories(host) {
+			if profile.block[category] {
+				return profile.name, category
+			}
+		}
+		return "", ""
+	}
+	return "", ""
+}
+
+// blockedCategory returns the category refusing req to host for the
+// client's profile, logging and counting the refusal
+func (f *Forwarder) blockedCategory(req *http.Request, host string) string {
+	if f.lists.allows(host) {
+		return ""
+	}
+	profile, category := f.categories.blocked(net.ParseIP(remoteIP(req)), host)
+	if category != "" {
+		f.logf(req, "Profile %s blocked %s (%s) for %s", profile, host, category, f.clientLabel(req))
+		f.metrics.inc("gatelan_category_blocked_total", "profile", profile, "category", category)
+		f.logBlocked(req, host, fmt.Sprintf("category %s blocked by profile %s", category, profile))
+	}
+	return category
+}
+
+var categoryPage = template.Must(template.New("category").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Site blocked</title></head>
+<body>
+<h1>Site blocked</h1>
+<p>{{.Host}} is in the <strong>{{.Category}}</strong> category, which is not allowed on this network.</p>
+</body>
+</html>
+`))
+
+// categoryResponse builds the page explaining a category block, the
+// configured blocked page when there is one
+func (f *Forwarder) categoryResponse(req *http.Request, host, category string) *http.Response {
+	if f.errorPages[http.StatusForbidden] != nil {
+		return f.errorResponse(req, http.StatusForbidden, "Blocked category: "+category, category)
+	}
+	var body strings.Builder
+	categoryPage.Execute(&body, struct{ Host, Category string }{host, category})
+	resp := newResponse(req, http.StatusForbidden, body.String())
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return resp
+}
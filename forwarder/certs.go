@@ -0,0 +1,142 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// certCheckInterval is how often handshakes look for renewed certificate files
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate in a pair of files, loading it again
+// once either file changes so that renewed certificates roll over without a
+// restart. A failed load keeps the current certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   func(format string, args ...any)
+
+	cert    atomic.Pointer[tls.Certificate]
+	checked atomic.Int64 // Unix nanoseconds of the last look at the files
+
+	mu       sync.Mutex
+	modified time.Time // Latest modification time of the files loaded
+}
+
+// newCertReloader loads the certificate in certFile and keyFile
+func newCertReloader(certFile, keyFile string, logger func(format string, args ...any)) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	r.checked.Store(time.Now().UnixNano())
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modTime returns the later modification time of the two files
+func (r *certReloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the files; r.mu must be held unless r is not shared yet
+func (r *certReloader) load() error {
+	modified, err := r.modTime()
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	r.cert.Store(&cert)
+	r.modified = modified
+	return nil
+}
+
+// reload loads the files again when they changed since the last load, or
+// regardless when forced
+func (r *certReloader) reload(force bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !force {
+		modified, err := r.modTime()
+		if err != nil {
+			return err
+		}
+		if modified.Equal(r.modified) {
+			return nil
+		}
+	}
+	if err := r.load(); err != nil {
+		return err
+	}
+	if leaf := r.cert.Load().Leaf; leaf != nil {
+		r.logger("Loaded certificate %s, valid until %s", r.certFile, leaf.NotAfter.Format(time.DateOnly))
+	}
+	return nil
+}
+
+// getCertificate is the GetCertificate of the TLS configurations serving
+// r's certificate. Now and then a handshake checks the files first.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := time.Now().UnixNano()
+	last := r.checked.Load()
+	if now-last >= int64(certCheckInterval) && r.checked.CompareAndSwap(last, now) {
+		if err := r.reload(false); err != nil {
+			r.logger("Keeping the current certificate %s: %v", r.certFile, err)
+		}
+	}
+	return r.cert.Load(), nil
+}
+
+// certReloader returns the reloader of the certificate files of cfg, shared
+// by the listeners serving them
+func (f *Forwarder) certReloader(cfg config.ServerTLSConfig) (*certReloader, error) {
+	key := cfg.CertFile + "\x00" + cfg.KeyFile
+	f.certsMu.Lock()
+	defer f.certsMu.Unlock()
+	if r, ok := f.certs[key]; ok {
+		return r, nil
+	}
+	r, err := newCertReloader(cfg.CertFile, cfg.KeyFile, f.logger.Printf)
+	if err != nil {
+		return nil, err
+	}
+	if f.certs == nil {
+		f.certs = make(map[string]*certReloader)
+	}
+	f.certs[key] = r
+	return r, nil
+}
+
+// ReloadCertificates loads the certificate files of the TLS listeners and
+// the admin API again. Those failing to load keep serving their current
+// certificate.
+func (f *Forwarder) ReloadCertificates() error {
+	f.certsMu.Lock()
+	defer f.certsMu.Unlock()
+	var errs []error
+	for _, r := range f.certs {
+		if err := r.reload(true); err != nil {
+			errs = append(errs, fmt.Errorf("certificate %s: %w", r.certFile, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,266 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+const (
+	clientLookupTimeout = 2 * time.Second
+	netbiosPort         = "137"
+)
+
+// clientName is a cached lookup result, empty when no source knew the client
+type clientName struct {
+	name    string
+	expires time.Time
+}
+
+// clientNamer maps client IPs to host names. Lookups run in the background
+// so that requests never wait for them; until one completes the IP stands in.
+// A nil namer knows no names.
+type clientNamer struct {
+	config config.ClientNamesConfig
+	static map[string]string
+	logger func(format string, args ...any)
+
+	mu      sync.Mutex
+	names   map[string]clientName
+	pending map[string]bool
+}
+
+// newClientNamer creates the namer, loading the static mapping if configured
+func newClientNamer(cfg config.ClientNamesConfig, logger func(format string, args ...any)) (*clientNamer, error) {
+	n := &clientNamer{
+		config:  cfg,
+		static:  make(map[string]string),
+		logger:  logger,
+		names:   make(map[string]clientName),
+		pending: make(map[string]bool),
+	}
+	if cfg.File != "" {
+		if err := n.load(cfg.File); err != nil {
+			return nil, fmt.Errorf("failed to load client names: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// load reads "IP name [aliases...]" and "MAC name [aliases...]" lines,
+// skipping blank lines and # comments
+func (n *clientNamer) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expected an IP or MAC address and a name", path, line)
+		}
+		if mac, err := net.ParseMAC(fields[0]); err == nil {
+			n.static[mac.String()] = fields[1]
+		} else if ip := net.ParseIP(fields[0]); ip != nil {
+			n.static[ip.String()] = fields[1]
+		} else {
+			return fmt.Errorf("%s:%d: expected an IP or MAC address and a name", path, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// lookupStatic returns the static name of the client at ip, or ""
+func (n *clientNamer) lookupStatic(ip string) string {
+	if n == nil {
+		return ""
+	}
+	return n.static[ip]
+}
+
+// lookupMAC returns the static name of the client with MAC address mac, or ""
+func (n *clientNamer) lookupMAC(mac string) string {
+	if n == nil || mac == "" {
+		return ""
+	}
+	return n.static[mac]
+}
+
+// lookup returns the name of the client at ip, or "" while it is unknown
+func (n *clientNamer) lookup(ip string) string {
+	if n == nil || ip == "" {
+		return ""
+	}
+	if name, ok := n.static[ip]; ok {
+		return name
+	}
+	if !n.config.ReverseDNS && !n.config.NetBIOS {
+		return ""
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cached, ok := n.names[ip]
+	if (!ok || time.Now().After(cached.expires)) && !n.pending[ip] {
+		n.pending[ip] = true
+		go n.resolve(ip)
+	}
+	return cached.name
+}
+
+// resolve asks the dynamic sources for the name of ip and caches the answer
+func (n *clientNamer) resolve(ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientLookupTimeout)
+	defer cancel()
+
+	var name string
+	if n.config.ReverseDNS {
+		if names, err := net.DefaultResolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+	}
+	if name == "" && n.config.NetBIOS {
+		var err error
+		if name, err = netbiosName(ctx, ip); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			n.logger("NetBIOS lookup of %s failed: %v", ip, err)
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if previous := n.names[ip].name; name != "" && name != previous {
+		n.logger("Client %s is %s", ip, name)
+	}
+	n.names[ip] = clientName{name: name, expires: time.Now().Add(time.Duration(n.config.TTL))}
+	delete(n.pending, ip)
+}
+
+// netbiosName sends a NetBIOS node status request (RFC 1002 4.2.17) to ip
+// and returns the unique workstation name from the answer
+func netbiosName(ctx context.Context, ip string) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(ip, netbiosPort))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Header with one question for the wildcard name "*", first-level encoded
+	request := []byte{0x47, 0x4c, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x20}
+	wildcard := [16]byte{'*'}
+	for _, b := range wildcard {
+		request = append(request, 'A'+b>>4, 'A'+b&0x0f)
+	}
+	request = append(request, 0, 0, 0x21, 0, 1) // NBSTAT, IN
+	if _, err := conn.Write(request); err != nil {
+		return "", err
+	}
+
+	response := make([]byte, 1500)
+	size, err := conn.Read(response)
+	if err != nil {
+		return "", err
+	}
+	return parseNodeStatus(response[:size])
+}
+
+// parseNodeStatus extracts the first unique name with the workstation suffix
+// from a node status response
+func parseNodeStatus(msg []byte) (string, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[6:8]) == 0 {
+		return "", errors.New("no answer in node status response")
+	}
+	i := 12
+	for i < len(msg) && msg[i] != 0 {
+		if msg[i]&0xc0 == 0xc0 {
+			i++
+			break
+		}
+		i += int(msg[i]) + 1
+	}
+	i += 1 + 10 // Name terminator, type, class, TTL and data length
+	if i >= len(msg) {
+		return "", errors.New("truncated node status response")
+	}
+
+	count := int(msg[i])
+	i++
+	for ; count > 0 && i+18 <= len(msg); count, i = count-1, i+18 {
+		entry := msg[i : i+18]
+		group := entry[16]&0x80 != 0
+		if entry[15] == 0x00 && !group {
+			return strings.TrimRight(string(entry[:15]), " \x00"), nil
+		}
+	}
+	return "", errors.New("no workstation name in node status response")
+}
+
+// clientIdentity returns the name of the client of req and its MAC address,
+// each "" when unknown. Static names given to its MAC address or IP come
+// first, then the one its DHCP lease holds, then those looked up.
+func (f *Forwarder) clientIdentity(req *http.Request) (name, mac string) {
+	ip := remoteIP(req)
+	mac = f.clientMAC(req)
+	if name = f.clientNames.lookupMAC(mac); name == "" {
+		name = f.clientNames.lookupStatic(ip)
+	}
+	if name == "" {
+		name = f.leases.hostname(ip, mac)
+	}
+	if name == "" {
+		name = f.clientNames.lookup(ip)
+	}
+	return name, mac
+}
+
+// clientName returns the name of the client of req, or ""
+func (f *Forwarder) clientName(req *http.Request) string {
+	name, _ := f.clientIdentity(req)
+	return name
+}
+
+// clientKey returns the name of the client of req for stats and metrics,
+// its MAC address or else its IP when no name is known
+func (f *Forwarder) clientKey(req *http.Request) string {
+	name, mac := f.clientIdentity(req)
+	switch {
+	case name != "":
+		return name
+	case mac != "":
+		return mac
+	}
+	return remoteIP(req)
+}
+
+// clientLabel describes the client of req for logs: its name or MAC address,
+// when known, followed by its address
+func (f *Forwarder) clientLabel(req *http.Request) string {
+	name, mac := f.clientIdentity(req)
+	if name == "" {
+		name = mac
+	}
+	if name != "" {
+		return name + " (" + req.RemoteAddr + ")"
+	}
+	return req.RemoteAddr
+}
@@ -0,0 +1,234 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+const (
+	clusterTombstoneAge = 7 * 24 * time.Hour // Removals are passed on to peers this long
+	clusterMaxState     = 32 << 20
+)
+
+// clusterState is what an instance sends its peers every interval: its
+// lists and portal table with the time of their latest changes, and the
+// quota usage it counted itself, its tenants' included. Peers apply the
+// newer changes and add up the usage.
+type clusterState struct {
+	Node        string                  `json:"node"`
+	Lists       map[string]listChange   `json:"lists"`
+	Quota       *quotaState             `json:"quota,omitempty"`
+	TenantQuota map[string]quotaState   `json:"tenant_quota,omitempty"` // By tenant name
+	Portal      map[string]portalChange `json:"portal,omitempty"`
+}
+
+// ClusterPeer is an instance this one received state from
+type ClusterPeer struct {
+	Node     string    `json:"node"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// clusterNode is the membership of this instance in a cluster
+type clusterNode struct {
+	config config.ClusterConfig
+	name   string
+
+	mu   sync.Mutex
+	seen map[string]time.Time // Last state received, by peer node
+
+	cacheClient *http.Client // Asks the peers' caches, nil without PeerCache
+}
+
+// newClusterNode returns nil when clustering is not configured
+func newClusterNode(cfg config.ClusterConfig) *clusterNode {
+	if cfg.Addr == "" && len(cfg.Peers) == 0 {
+		return nil
+	}
+	name := cfg.Node
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	node := &clusterNode{config: cfg, name: name, seen: make(map[string]time.Time)}
+	if cfg.PeerCache {
+		node.cacheClient = newPeerCacheClient(time.Duration(cfg.CacheTimeout))
+	}
+	return node
+}
+
+// clusterState collects the state sent to the peers
+func (f *Forwarder) clusterState() clusterState {
+	state := clusterState{
+		Node:   f.cluster.name,
+		Lists:  f.lists.clusterState(),
+		Quota:  f.quota.clusterState(),
+		Portal: f.portal.clusterState(),
+	}
+	for _, t := range f.tenants {
+		if quota := t.quota.clusterState(); quota != nil {
+			if state.TenantQuota == nil {
+				state.TenantQuota = make(map[string]quotaState)
+			}
+			state.TenantQuota[t.config.Name] = *quota
+		}
+	}
+	return state
+}
+
+// mergeClusterState applies the state a peer sent
+func (f *Forwarder) mergeClusterState(state clusterState) {
+	f.cluster.mu.Lock()
+	f.cluster.seen[state.Node] = time.Now()
+	f.cluster.mu.Unlock()
+
+	if changed, err := f.lists.merge(state.Lists); err != nil {
+		f.logger.Printf("Failed to save lists from cluster peer %s: %v", state.Node, err)
+	} else if changed {
+		f.logger.Printf("Applied list changes from cluster peer %s", state.Node)
+	}
+	if state.Quota != nil {
+		f.quota.mergePeer(state.Node, *state.Quota)
+	}
+	for name, quota := range state.TenantQuota {
+		if t := f.tenantNamed(name); t != nil {
+			t.quota.mergePeer(state.Node, quota)
+		}
+	}
+	if changed, err := f.portal.merge(state.Portal); err != nil {
+		f.logger.Printf("Failed to save portal clients from cluster peer %s: %v", state.Node, err)
+	} else if changed {
+		f.logger.Printf("Applied portal changes from cluster peer %s", state.Node)
+	}
+}
+
+// clusterAuthorized reports whether r carries the shared secret
+func (f *Forwarder) clusterAuthorized(r *http.Request) bool {
+	want := "Bearer " + f.cluster.config.Secret
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+// handleClusterState receives the state of a peer holding the shared secret
+func (f *Forwarder) handleClusterState(w http.ResponseWriter, r *http.Request) {
+	if !f.clusterAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var state clusterState
+	if err := json.NewDecoder(io.LimitReader(r.Body, clusterMaxState)).Decode(&state); err != nil || state.Node == "" {
+		http.Error(w, "Invalid cluster state", http.StatusBadRequest)
+		return
+	}
+	if state.Node != f.cluster.name {
+		f.mergeClusterState(state)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startCluster receives peer state on the cluster address when one is
+// configured
+func (f *Forwarder) startCluster(ctx context.Context) error {
+	if f.cluster == nil || f.cluster.config.Addr == "" {
+		return nil
+	}
+	listener, err := f.listenTCP(f.cluster.config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on cluster address: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /cluster/state", f.handleClusterState)
+	mux.HandleFunc("GET /cluster/cache", f.handlePeerCache)
+	f.clusterAPI = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	f.logger.Printf("Cluster node %s on %s", f.cluster.name, listener.Addr())
+	go func() {
+		if err := f.clusterAPI.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			f.logger.Printf("Cluster API stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// syncCluster sends the state to every peer each interval until ctx is
+// cancelled, logging when a peer becomes unreachable and when it is back
+func (f *Forwarder) syncCluster(ctx context.Context) {
+	if f.cluster == nil || len(f.cluster.config.Peers) == 0 {
+		return
+	}
+	headers := map[string]string{"Authorization": "Bearer " + f.cluster.config.Secret}
+	failing := make(map[string]bool)
+	ticker := time.NewTicker(time.Duration(f.cluster.config.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		data, err := json.Marshal(f.clusterState())
+		if err != nil {
+			f.logger.Printf("Failed to encode cluster state: %v", err)
+			continue
+		}
+		for _, peer := range f.cluster.config.Peers {
+			err := postJSON(ctx, "http://"+peer+"/cluster/state", headers, data)
+			switch {
+			case err != nil && !failing[peer]:
+				f.logger.Printf("Failed to send state to cluster peer %s: %v", peer, err)
+			case err == nil && failing[peer]:
+				f.logger.Printf("Cluster peer %s is reachable again", peer)
+			}
+			failing[peer] = err != nil
+			f.metrics.inc("gatelan_cluster_syncs_total", "peer", peer, "result", syncResult(err))
+		}
+	}
+}
+
+// syncResult labels the outcome of a state exchange
+func syncResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// ClusterPeers lists the peers that sent their state, by node name
+func (f *Forwarder) ClusterPeers() []ClusterPeer {
+	if f.cluster == nil {
+		return nil
+	}
+	f.cluster.mu.Lock()
+	peers := make([]ClusterPeer, 0, len(f.cluster.seen))
+	for node, seen := range f.cluster.seen {
+		peers = append(peers, ClusterPeer{Node: node, LastSeen: seen})
+	}
+	f.cluster.mu.Unlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Node < peers[j].Node })
+	return peers
+}
+
+// handleClusterPeers serves the peers this instance heard from
+func (f *Forwarder) handleClusterPeers(w http.ResponseWriter, r *http.Request) {
+	if f.cluster == nil {
+		http.Error(w, "Cluster mode is not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, f.ClusterPeers())
+}
@@ -0,0 +1,229 @@
+package forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+const defaultCompressMinSize = 1024
+
+// defaultCompressTypes lists media types worth compressing when none are configured
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+// compressor decides when and how to compress responses
+type compressor struct {
+	config config.CompressionConfig
+}
+
+// newCompressor applies defaults to the compression config
+func newCompressor(cfg config.CompressionConfig) *compressor {
+	if len(cfg.Encodings) == 0 {
+		cfg.Encodings = []string{"br", "gzip"}
+	}
+	if cfg.MinSize == 0 {
+		cfg.MinSize = defaultCompressMinSize
+	}
+	if len(cfg.Types) == 0 {
+		cfg.Types = defaultCompressTypes
+	}
+	return &compressor{config: cfg}
+}
+
+// negotiate returns the encoding to use for this exchange, or "" to leave it alone
+func (c *compressor) negotiate(req *http.Request, resp *http.Response) string {
+	if !c.config.Enabled {
+		return ""
+	}
+	if req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent {
+		return ""
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		return ""
+	}
+	if strings.Contains(resp.Header.Get("Cache-Control"), "no-transform") {
+		return ""
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < c.config.MinSize {
+		return ""
+	}
+	// Compressors buffer, which would hold events back
+	if isEventStream(resp) {
+		return ""
+	}
+	if !c.compressible(resp.Header.Get("Content-Type")) {
+		return ""
+	}
+
+	accepted := parseAcceptEncoding(req.Header.Get("Accept-Encoding"))
+	for _, encoding := range c.config.Encodings {
+		if q, ok := accepted[encoding]; ok && q > 0 {
+			return encoding
+		}
+		if q, ok := accepted["*"]; ok && q > 0 {
+			if _, explicit := accepted[encoding]; !explicit {
+				return encoding
+			}
+		}
+	}
+	return ""
+}
+
+// compressible reports whether the media type matches one of the configured types
+func (c *compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.config.Types {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// apply replaces the response body with a compressed stream
+func (c *compressor) apply(resp *http.Response, encoding string) {
+	src := resp.Body
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer src.Close()
+
+		enc := newEncoder(pw, encoding, c.config.Level)
+		_, err := io.Copy(enc, src)
+		if closeErr := enc.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = &multiReadCloser{Reader: pr, Closer: pipeCloser{pr, src}}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Add("Vary", "Accept-Encoding")
+
+	// The representation changed, so a strong validator no longer holds
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// newEncoder compresses into w with encoding, "br" or "gzip", at level or
+// the encoder's default when 0
+func newEncoder(w io.Writer, encoding string, level int) io.WriteCloser {
+	if encoding == "br" {
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(w, level)
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		gz = gzip.NewWriter(w)
+	}
+	return gz
+}
+
+// contentEncoding returns the coding of a body, "" when it is not encoded
+func contentEncoding(header http.Header) string {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// decodable reports whether the proxy can decode bodies in encoding for
+// inspection
+func decodable(encoding string) bool {
+	switch encoding {
+	case "gzip", "x-gzip", "br":
+		return true
+	}
+	return false
+}
+
+// decodeBody returns the decoded form of a body in a decodable encoding
+func decodeBody(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// encodeBody compresses a buffered body with encoding at the default level
+func encodeBody(encoding string, body []byte) ([]byte, error) {
+	if encoding == "x-gzip" {
+		encoding = "gzip"
+	}
+	var buf bytes.Buffer
+	enc := newEncoder(&buf, encoding, 0)
+	if _, err := enc.Write(body); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pipeCloser closes both the compressed pipe and the source body
+type pipeCloser struct {
+	pipe *io.PipeReader
+	src  io.Closer
+}
+
+func (p pipeCloser) Close() error {
+	p.pipe.Close()
+	return p.src.Close()
+}
+
+// parseAcceptEncoding maps each advertised coding to its q-value
+func parseAcceptEncoding(value string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(value, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if qValue, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(qValue, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
@@ -0,0 +1,308 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// handleConnect establishes a CONNECT tunnel to r.Host through an upstream proxy
+func (f *Forwarder) handleConnect(w http.ResponseWriter, r *http.Request) {
+	f.logf(r, "Tunneling to %s%s for %s", r.Host, unicodeNote(stripPort(r.Host)), f.clientLabel(r))
+
+	// Refuse tunnels that already passed through this instance
+	if f.detectLoop(r) {
+		f.logf(r, "Loop detected for tunnel to %s", r.Host)
+		f.writeError(w, r, http.StatusLoopDetected, "Proxy loop detected", "")
+		return
+	}
+
+	if !f.portal.admitted(remoteIP(r)) {
+		f.logf(r, "Refused tunnel to %s for %s until it accepts the portal terms", r.Host, f.clientLabel(r))
+		f.writeError(w, r, http.StatusForbidden, "Accept the network terms at "+f.portalURL("")+" first", "")
+		return
+	}
+	if window := f.pausedBy(r); window != nil {
+		f.logf(r, "Pause %s held back tunnel to %s for %s", window.name, r.Host, f.clientLabel(r))
+		f.logBlocked(r, r.Host, "paused by "+window.name)
+		f.writePaused(w, r, window)
+		return
+	}
+
+	quota, quotaKey := f.quotaOf(r), f.quotaKey(r)
+	if quota.exceeded(quotaKey) {
+		f.logf(r, "Quota exceeded for %s, refusing tunnel to %s", quotaKey, r.Host)
+		f.audit.log(severityNotice, auditQuotaExceeded, r, r.Host, "quota exceeded for "+quotaKey)
+		f.announceQuotaExceeded(r, quotaKey)
+		f.writeQuotaExceeded(w, r, quotaKey)
+		return
+	}
+
+	// Register the tunnel; until it is established killing it cancels the dial
+	ctx, cancelTunnel := context.WithCancel(r.Context())
+	defer cancelTunnel()
+	conn := f.connections.add(ConnectionTunnel, r.RemoteAddr, f.clientName(r), r.Host, cancelTunnel)
+	defer f.connections.remove(conn)
+	r = r.WithContext(ctx)
+
+	host := stripPort(r.Host)
+	if f.blockedByList(r, host) {
+		f.writeError(w, r, http.StatusForbidden, "Blocked by administrator", ListBlock)
+		return
+	}
+	if reason := f.blockedBySSRF(r, host); reason != "" {
+		f.writeError(w, r, http.StatusForbidden, "Destination refused: "+reason, "")
+		return
+	}
+	if rule := f.blockingRule(r, host); rule != nil {
+		f.logf(r, "Access rule %s blocked tunnel to %s for %s", rule.Name, r.Host, f.clientLabel(r))
+		f.logBlocked(r, r.Host, "blocked by access rule "+rule.Name)
+		f.writeError(w, r, http.StatusForbidden, "Blocked by access rule", rule.Name)
+		return
+	}
+	if feed := f.blockedByFeed(r, host); feed != "" {
+		f.writeError(w, r, http.StatusForbidden, "Blocked by threat feed", feed)
+		return
+	}
+	if category := f.blockedCategory(r, host); category != "" {
+		f.writeError(w, r, http.StatusForbidden, "Blocked category: "+category, category)
+		return
+	}
+	if profile := f.blockedByAdblock(r, host, true); profile != "" {
+		f.writeError(w, r, http.StatusForbidden, "Blocked by ad filter", profile)
+		return
+	}
+
+	if f.geo != nil {
+		routed, err := f.routeByCountry(ctx, host)
+		if err != nil {
+			f.logf(r, "Rejected tunnel to %s: %v", r.Host, err)
+			f.logBlocked(r, r.Host, err.Error())
+			f.writeError(w, r, http.StatusForbidden, "Destination country blocked", "")
+			return
+		}
+		r = r.WithContext(routed)
+	}
+
+	// Tunnels can only take the route's upstream; their TLS is the client's
+	r, _ = f.applyRoute(r, host)
+
+	decision, err := f.evaluatePolicy(policyConnectFunc, r)
+	if err != nil {
+		f.logf(r, "Tunnel to %s failed: %v", r.Host, err)
+		f.writeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), "")
+		return
+	}
+	if decision != nil {
+		if decision.Reject != 0 {
+			f.logf(r, "Policy rejected tunnel to %s with %d", r.Host, decision.Reject)
+			f.logBlocked(r, r.Host, fmt.Sprintf("rejected by policy with %d", decision.Reject))
+			if decision.Body != "" {
+				http.Error(w, strings.TrimSuffix(decision.Body, "\n"), decision.Reject)
+			} else {
+				f.writeError(w, r, decision.Reject, http.StatusText(decision.Reject), "")
+			}
+			return
+		}
+		if decision.Upstream != "" {
+			r = r.WithContext(withUpstream(r.Context(), f.upstreamFor(decision.Upstream)))
+		}
+	}
+
+	if err := f.hooks.runConnectHooks(r); err != nil {
+		f.logf(r, "Tunnel to %s rejected: %v", r.Host, err)
+		f.writeError(w, r, http.StatusForbidden, "Tunnel rejected", "")
+		return
+	}
+
+	r = f.withBypass(r, r.Host)
+	r = f.guardDestination(r, host)
+	r = f.markTraffic(r, host)
+	r, passAuth := f.passAuth(r)
+	r = f.markTunnel(r)
+	if message, seconds := f.recentFailure(r, r.Host); message != "" {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		f.writeError(w, r, http.StatusBadGateway, message, "")
+		return
+	}
+	up, err := f.selectUpstream(r.Context(), 0)
+	if err != nil {
+		f.logf(r, "Tunnel to %s failed: %v", r.Host, err)
+		f.writeError(w, r, http.StatusServiceUnavailable, "Upstream proxy unavailable", "")
+		return
+	}
+
+	dialCtx := r.Context()
+	if timeout := f.config.Timeouts.Dial.Timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(dialCtx, timeout)
+		defer cancel()
+	}
+	upstreamConn, err := up.dialTunnel(dialCtx, r.Host)
+	if errors.Is(err, ErrDestinationRefused) {
+		up.breaker.success()
+		f.writeError(w, r, http.StatusForbidden, "Destination address refused", "")
+		return
+	}
+	if challenges := upstreamChallenge(err); passAuth && challenges != nil {
+		up.breaker.success()
+		up.latency.success()
+		f.logf(r, "Relaying the authentication challenge of upstream %s for %s", up.name, r.Host)
+		w.Header()["Proxy-Authenticate"] = challenges
+		f.writeError(w, r, http.StatusProxyAuthRequired, "Upstream proxy authentication required", "")
+		return
+	}
+	if status, message, ok := connectRefusal(err); ok {
+		up.breaker.success()
+		up.latency.success()
+		f.logf(r, "Tunnel to %s refused by upstream %s: %v", r.Host, up.name, err)
+		f.writeError(w, r, status, message, "")
+		return
+	}
+	if err != nil {
+		if clientGone(r, err) {
+			up.breaker.release()
+		} else {
+			up.breaker.failure()
+			up.latency.failure(err)
+		}
+		f.logf(r, "Tunnel to %s via %s failed: %v", r.Host, up.name, err)
+		f.recordFailure(r, r.Host, err)
+		f.writeError(w, r, http.StatusBadGateway, "Failed to connect to upstream proxy", "")
+		return
+	}
+	up.breaker.success()
+	up.latency.success()
+	f.failures.forget(r.Host)
+	f.hot.hit(r.Host)
+	conn.setUpstream(up.name)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstreamConn.Close()
+		http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		upstreamConn.Close()
+		f.logf(r, "Failed to hijack connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		upstreamConn.Close()
+		return
+	}
+	// Established tunnels no longer count against admission
+	releaseAdmission(r)
+
+	// The client may have pipelined tunnel bytes behind its CONNECT request
+	if clientBuf.Reader.Buffered() > 0 {
+		clientConn = &tunnel.BufferedConn{Conn: clientConn, Reader: clientBuf.Reader}
+	}
+
+	if captured, err := f.capture.wrap(clientConn, r.Host); err != nil {
+		f.logf(r, "Failed to capture tunnel to %s: %v", r.Host, err)
+	} else {
+		clientConn = captured
+	}
+
+	clientConn = f.devices.sniff(clientConn, remoteIP(r))
+	clientConn = &countingConn{Conn: clientConn, conn: conn}
+	kill := func() {
+		clientConn.Close()
+		upstreamConn.Close()
+	}
+	conn.setKill(kill)
+	if idle := f.config.Timeouts.TunnelIdle.Timeout(); idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			f.logf(r, "Closing tunnel to %s after %v without traffic", r.Host, idle)
+			kill()
+		})
+		defer timer.Stop()
+		clientConn = &idleConn{Conn: clientConn, timer: timer, timeout: idle}
+	}
+	if watch := f.watchStalls(r, conn, kill); watch != nil {
+		defer watch.stop()
+		clientConn = &stallConn{Conn: clientConn, watch: watch}
+	}
+	clientConn = f.shapeTunnel(r, clientConn)
+
+	started := time.Now()
+	err = f.setupBidirectionalForward(r, clientConn, upstreamConn)
+	f.account(r, conn, host)
+	quota.add(quotaKey, conn.sent.Load()+conn.received.Load())
+	f.hooks.runTunnelCloseHooks(TunnelInfo{
+		Target:     r.Host,
+		ClientAddr: r.RemoteAddr,
+		Upstream:   up.name,
+		Started:    started,
+		Duration:   time.Since(started),
+		Err:        err,
+	})
+}
+
+// setupBidirectionalForward relays bytes both ways until each side is done
+func (f *Forwarder) setupBidirectionalForward(r *http.Request, clientConn, upstreamConn net.Conn) error {
+	err := tunnel.Relay(clientConn, upstreamConn, f.config.BufferSize)
+	if err != nil {
+		f.logf(r, "Tunnel copy error: %v", err)
+	}
+	return err
+}
+
+// idleConn restarts timer whenever data passes through the connection in
+// either direction
+type idleConn struct {
+	net.Conn
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *idleConn) CloseWrite() error {
+	tunnel.CloseWrite(c.Conn)
+	return nil
+}
+
+// connectRefusal maps an upstream's refusal to open a tunnel to the status and
+// message for the client. A refusal shows the upstream itself is working.
+func connectRefusal(err error) (int, string, bool) {
+	var refused *tunnel.ConnectError
+	if !errors.As(err, &refused) {
+		return 0, "", false
+	}
+	switch refused.StatusCode {
+	case http.StatusProxyAuthRequired:
+		return http.StatusBadGateway, "Upstream proxy requires authentication", true
+	case http.StatusForbidden, http.StatusNotFound, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return refused.StatusCode, "Upstream proxy refused the tunnel: " + refused.Status, true
+	default:
+		return http.StatusBadGateway, "Upstream proxy refused the tunnel: " + refused.Status, true
+	}
+}
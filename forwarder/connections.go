@@ -0,0 +1,334 @@
+package forwarder
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// Kinds of entries in the connection table
+const (
+	ConnectionRequest = "request"
+	ConnectionTunnel  = "tunnel"
+)
+
+// Connection describes an in-flight proxy request or an open CONNECT tunnel
+type Connection struct {
+	ID            uint64        `json:"id"`
+	Kind          string        `json:"kind"`
+	Client        string        `json:"client"`
+	ClientName    string        `json:"client_name,omitempty"` // Host name, when known
+	Target        string        `json:"target"`
+	Upstream      string        `json:"upstream,omitempty"`
+	Started       time.Time     `json:"started"`
+	Age           time.Duration `json:"age"`
+	BytesSent     int64         `json:"bytes_sent"`     // Client to upstream
+	BytesReceived int64         `json:"bytes_received"` // Upstream to client
+	Stalled       bool          `json:"stalled,omitempty"`
+}
+
+// activeConn is a live entry of the connection table
+type activeConn struct {
+	id       uint64
+	kind     string
+	client   string
+	name     string
+	target   string
+	started  time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+	stalled  atomic.Bool
+
+	mu       sync.Mutex
+	upstream string
+	kill     func()
+}
+
+// setKill replaces the function that terminates the connection
+func (c *activeConn) setKill(kill func()) {
+	c.mu.Lock()
+	c.kill = kill
+	c.mu.Unlock()
+}
+
+// setUpstream records the upstream proxy serving the connection
+func (c *activeConn) setUpstream(addr string) {
+	c.mu.Lock()
+	c.upstream = addr
+	c.mu.Unlock()
+}
+
+// connectionTable tracks in-flight requests and tunnels
+type connectionTable struct {
+	nextID atomic.Uint64
+
+	// Bytes carried by the connections already removed
+	closedSent     atomic.Int64
+	closedReceived atomic.Int64
+
+	mu    sync.Mutex
+	conns map[uint64]*activeConn
+}
+
+func newConnectionTable() *connectionTable {
+	return &connectionTable{conns: make(map[uint64]*activeConn)}
+}
+
+// add registers a connection of the client named name that kill terminates
+func (t *connectionTable) add(kind, client, name, target string, kill func()) *activeConn {
+	c := &activeConn{
+		id:      t.nextID.Add(1),
+		kind:    kind,
+		client:  client,
+		name:    name,
+		target:  target,
+		started: time.Now(),
+		kill:    kill,
+	}
+	t.mu.Lock()
+	t.conns[c.id] = c
+	t.mu.Unlock()
+	return c
+}
+
+// remove drops a finished connection
+func (t *connectionTable) remove(c *activeConn) {
+	t.mu.Lock()
+	delete(t.conns, c.id)
+	t.closedSent.Add(c.sent.Load())
+	t.closedReceived.Add(c.received.Load())
+	t.mu.Unlock()
+}
+
+// totals counts the open connections and the bytes carried by every
+// connection so far, open ones included
+func (t *connectionTable) totals() (counts ConnectionCounts, sent, received int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts.Open = len(t.conns)
+	counts.Handled = t.nextID.Load()
+	sent, received = t.closedSent.Load(), t.closedReceived.Load()
+	for _, c := range t.conns {
+		if c.kind == ConnectionTunnel {
+			counts.Tunnels++
+		} else {
+			counts.Requests++
+		}
+		if c.stalled.Load() {
+			counts.Stalled++
+		}
+		sent += c.sent.Load()
+		received += c.received.Load()
+	}
+	return counts, sent, received
+}
+
+// list returns a snapshot ordered by ID
+func (t *connectionTable) list() []Connection {
+	now := time.Now()
+	t.mu.Lock()
+	result := make([]Connection, 0, len(t.conns))
+	for _, c := range t.conns {
+		c.mu.Lock()
+		upstream := c.upstream
+		c.mu.Unlock()
+		result = append(result, Connection{
+			ID:            c.id,
+			Kind:          c.kind,
+			Client:        c.client,
+			ClientName:    c.name,
+			Target:        c.target,
+			Upstream:      upstream,
+			Started:       c.started,
+			Age:           now.Sub(c.started),
+			BytesSent:     c.sent.Load(),
+			BytesReceived: c.received.Load(),
+			Stalled:       c.stalled.Load(),
+		})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// kill terminates the connection with the given ID, reporting whether it existed
+func (t *connectionTable) kill(id uint64) bool {
+	t.mu.Lock()
+	c, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	kill := c.kill
+	c.mu.Unlock()
+	if kill != nil {
+		kill()
+	}
+	return true
+}
+
+// killAll terminates every connection, returning how many there were
+func (t *connectionTable) killAll() int {
+	t.mu.Lock()
+	open := make([]uint64, 0, len(t.conns))
+	for id := range t.conns {
+		open = append(open, id)
+	}
+	t.mu.Unlock()
+	for _, id := range open {
+		t.kill(id)
+	}
+	return len(open)
+}
+
+// count returns the number of open connections
+func (t *connectionTable) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// drain waits for every connection to finish, killing the ones still open
+// when ctx ends
+func (t *connectionTable) drain(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		open := make([]uint64, 0, len(t.conns))
+		for id := range t.conns {
+			open = append(open, id)
+		}
+		t.mu.Unlock()
+		if len(open) == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, id := range open {
+				t.kill(id)
+			}
+			return
+		}
+	}
+}
+
+// Connections returns the in-flight requests and open tunnels
+func (f *Forwarder) Connections() []Connection {
+	return f.connections.list()
+}
+
+// KillConnection forcibly terminates a connection listed by Connections,
+// reporting whether it was found
+func (f *Forwarder) KillConnection(id uint64) bool {
+	return f.connections.kill(id)
+}
+
+// countingConn counts the bytes read from and written to a tunnel client
+type countingConn struct {
+	net.Conn
+	conn *activeConn
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.conn.sent.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.conn.received.Add(int64(n))
+	return n, err
+}
+
+// ReadFrom lets the underlying connection receive from r without a
+// user-space copy where possible, such as from another socket
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	return tunnel.CopyCounted(c.Conn, r, func(n int64) {
+		c.conn.received.Add(n)
+	})
+}
+
+// WriteTo sends the connection's data to w without a user-space copy where
+// possible
+func (c *countingConn) WriteTo(w io.Writer) (int64, error) {
+	return tunnel.CopyCounted(w, c.Conn, func(n int64) {
+		c.conn.sent.Add(n)
+	})
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// countingBody counts the request body bytes read by the upstream transport
+type countingBody struct {
+	io.ReadCloser
+	conn *activeConn
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.conn.sent.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the response bytes relayed to the client
+type countingWriter struct {
+	io.Writer
+	conn *activeConn
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.conn.received.Add(int64(n))
+	return n, err
+}
+
+// Histogram bounds of what requests and tunnels carried down to clients, in
+// bytes, and of how long they took, in seconds
+var (
+	responseSizeBuckets     = []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30}
+	transferDurationBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+)
+
+// account logs the bytes conn, serving r, carried when it closes and adds them to the
+// usage reports, the per client and per destination domain counters and the
+// per domain size and duration histograms. Clients and domains label separate
+// series, each capped by metrics.bound, to keep their number in check.
+func (f *Forwarder) account(r *http.Request, conn *activeConn, domain string) {
+	client := f.clientKey(r)
+	sent, received := conn.sent.Load(), conn.received.Load()
+	duration := time.Since(conn.started)
+	f.logf(r, "Closed %s to %s for %s after %v: %d bytes up, %d bytes down",
+		conn.kind, conn.target, f.clientLabel(r), duration.Round(time.Millisecond), sent, received)
+	clientLabel, domainLabel := f.metrics.bound("client", client), f.metrics.bound("domain", domain)
+	f.metrics.add("gatelan_bytes_sent_total", float64(sent), "kind", conn.kind, "domain", domainLabel)
+	f.metrics.add("gatelan_bytes_received_total", float64(received), "kind", conn.kind, "domain", domainLabel)
+	f.metrics.add("gatelan_client_bytes_sent_total", float64(sent), "kind", conn.kind, "client", clientLabel)
+	f.metrics.add("gatelan_client_bytes_received_total", float64(received), "kind", conn.kind, "client", clientLabel)
+	f.metrics.observe("gatelan_response_size_bytes", responseSizeBuckets, float64(received), "kind", conn.kind, "domain", domainLabel)
+	f.metrics.observe("gatelan_transfer_duration_seconds", transferDurationBuckets, duration.Seconds(), "kind", conn.kind, "domain", domainLabel)
+	f.stats.record(domain, client, sent, received)
+	if t := requestTenant(r); t != nil {
+		f.metrics.add("gatelan_tenant_bytes_sent_total", float64(sent), "tenant", t.config.Name, "kind", conn.kind)
+		f.metrics.add("gatelan_tenant_bytes_received_total", float64(received), "tenant", t.config.Name, "kind", conn.kind)
+		t.stats.record(domain, client, sent, received)
+	}
+}
@@ -0,0 +1,92 @@
+package forwarder
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// credentialRule is a CredentialRule with its secrets loaded
+type credentialRule struct {
+	name          string
+	domains       []string
+	clients       []*net.IPNet
+	authorization string // Authorization header value
+}
+
+// newCredentialRules loads the secrets of the configured rules
+func newCredentialRules(rules []config.CredentialRule) ([]credentialRule, error) {
+	loaded := make([]credentialRule, 0, len(rules))
+	for i, rc := range rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		clients, err := acl.ParseNetworks(rc.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("credential rule %s: %w", name, err)
+		}
+		rule := credentialRule{name: name, domains: rc.Domains, clients: clients}
+
+		if rc.TokenFile != "" {
+			token, err := readSecret(rc.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("credential rule %s: %w", name, err)
+			}
+			rule.authorization = "Bearer " + token
+		} else {
+			password := rc.Password
+			if rc.PasswordFile != "" {
+				if password, err = readSecret(rc.PasswordFile); err != nil {
+					return nil, fmt.Errorf("credential rule %s: %w", name, err)
+				}
+			}
+			rule.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(rc.Username+":"+password))
+		}
+		loaded = append(loaded, rule)
+	}
+	return loaded, nil
+}
+
+// readSecret reads a secret from a file, without surrounding whitespace
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// injectCredentials sets the Authorization header of proxyReq from the first
+// credential rule matching its destination and the client of req, replacing
+// whatever the client sent, and reports whether a rule applied
+func (f *Forwarder) injectCredentials(req *http.Request, proxyReq *http.Request) bool {
+	if len(f.credentials) == 0 {
+		return false
+	}
+	host := proxyReq.URL.Hostname()
+	client := net.ParseIP(remoteIP(req))
+	for _, rule := range f.credentials {
+		if !acl.MatchHost(host, rule.domains) {
+			continue
+		}
+		if len(rule.clients) > 0 && !acl.ContainsIP(rule.clients, client) {
+			continue
+		}
+		proxyReq.Header.Set("Authorization", rule.authorization)
+		f.metrics.inc("gatelan_credentials_injected_total", "rule", rule.name)
+		f.logf(req, "Attached credentials of rule %s for %s", rule.name, host)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,345 @@
+package forwarder
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// deviceUnknown is the class of clients no class recognized
+const deviceUnknown = "unknown"
+
+// Sources a device class is recognized from
+const (
+	deviceSourceUserAgent = "user-agent"
+	deviceSourceTLS       = "tls"
+)
+
+// builtinDeviceClasses are tried after the configured classes. Consoles and
+// TVs come first as their User-Agents also name desktop or mobile systems.
+var builtinDeviceClasses = []config.DeviceClass{
+	{Name: "console", UserAgents: []string{"playstation", "xbox", "nintendo"}},
+	{Name: "iot", UserAgents: []string{"smarttv", "smart-tv", "hbbtv", "tizen", "webos", "web0s", "roku", "crkey", "appletv", "sonos", "esp8266", "esp32", "tasmota", "shelly"}},
+	{Name: "phone", UserAgents: []string{"iphone", "ipod", "windows phone", "android", "mobile"}},
+	{Name: "desktop", UserAgents: []string{"windows nt", "macintosh", "x11", "cros"}},
+}
+
+// Device is the class a client was last recognized as
+type Device struct {
+	Client         string    `json:"client"`
+	Class          string    `json:"class"`
+	Source         string    `json:"source"`                    // "user-agent" or "tls"
+	TLSFingerprint string    `json:"tls_fingerprint,omitempty"` // JA3 hash of the client's last ClientHello
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+// deviceClassifier remembers the device class of each client IP. A nil
+// classifier classifies nothing.
+type deviceClassifier struct {
+	config  config.DevicesConfig
+	classes []config.DeviceClass // Configured then built-in, patterns lowercased
+
+	mu      sync.Mutex
+	clients map[string]*Device
+}
+
+// newDeviceClassifier returns nil when device classes are disabled
+func newDeviceClassifier(cfg config.DevicesConfig) *deviceClassifier {
+	if !cfg.Enabled {
+		return nil
+	}
+	d := &deviceClassifier{config: cfg, clients: make(map[string]*Device)}
+	for _, class := range append(append([]config.DeviceClass{}, cfg.Classes...), builtinDeviceClasses...) {
+		lowered := config.DeviceClass{Name: class.Name, TLSFingerprints: class.TLSFingerprints}
+		for _, pattern := range class.UserAgents {
+			lowered.UserAgents = append(lowered.UserAgents, strings.ToLower(pattern))
+		}
+		d.classes = append(d.classes, lowered)
+	}
+	return d
+}
+
+// classify returns the device class of the client sending req, learning it
+// from the User-Agent when one is recognized
+func (d *deviceClassifier) classify(req *http.Request) string {
+	if d == nil {
+		return ""
+	}
+	client := remoteIP(req)
+	if ua := strings.ToLower(req.Header.Get("User-Agent")); ua != "" {
+		for _, class := range d.classes {
+			for _, pattern := range class.UserAgents {
+				if strings.Contains(ua, pattern) {
+					d.remember(client, class.Name, deviceSourceUserAgent, "")
+					return class.Name
+				}
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if device, ok := d.clients[client]; ok && device.Class != "" && time.Since(device.LastSeen) < time.Duration(d.config.TTL) {
+		return device.Class
+	}
+	return deviceUnknown
+}
+
+// remember records the class of client, keeping its last TLS fingerprint
+func (d *deviceClassifier) remember(client, class, source, fingerprint string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	device, ok := d.clients[client]
+	if !ok {
+		device = &Device{Client: client}
+		d.clients[client] = device
+	}
+	if class != "" {
+		device.Class, device.Source = class, source
+	}
+	if fingerprint != "" {
+		device.TLSFingerprint = fingerprint
+	}
+	device.LastSeen = time.Now()
+
+	// Forget clients gone for longer than the TTL
+	if len(d.clients) > 1024 {
+		for ip, other := range d.clients {
+			if time.Since(other.LastSeen) >= time.Duration(d.config.TTL) {
+				delete(d.clients, ip)
+			}
+		}
+	}
+}
+
+// fingerprinted classifies client by the JA3 hash of its ClientHello
+func (d *deviceClassifier) fingerprinted(client, fingerprint string) {
+	for _, class := range d.classes {
+		for _, known := range class.TLSFingerprints {
+			if strings.EqualFold(known, fingerprint) {
+				d.remember(client, class.Name, deviceSourceTLS, fingerprint)
+				return
+			}
+		}
+	}
+	d.remember(client, "", "", fingerprint)
+}
+
+// sniff returns conn reading through a watcher that fingerprints the TLS
+// ClientHello the client sends into its tunnel. The class it recognizes
+// applies from the client's next request on, as this tunnel is already open.
+func (d *deviceClassifier) sniff(conn net.Conn, client string) net.Conn {
+	if d == nil {
+		return conn
+	}
+	return &helloConn{Conn: conn, done: func(hello []byte) {
+		if fingerprint, ok := ja3(hello); ok {
+			d.fingerprinted(client, fingerprint)
+		}
+	}}
+}
+
+// list returns the remembered clients ordered by address
+func (d *deviceClassifier) list() []Device {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	devices := make([]Device, 0, len(d.clients))
+	for _, device := range d.clients {
+		if time.Since(device.LastSeen) >= time.Duration(d.config.TTL) {
+			continue
+		}
+		listed := *device
+		if listed.Class == "" {
+			listed.Class = deviceUnknown
+		}
+		devices = append(devices, listed)
+	}
+	d.mu.Unlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Client < devices[j].Client })
+	return devices
+}
+
+// Devices lists the device classes recognized for clients
+func (f *Forwarder) Devices() []Device {
+	return f.devices.list()
+}
+
+// handleDevices serves the recognized device classes
+func (f *Forwarder) handleDevices(w http.ResponseWriter, r *http.Request) {
+	if f.devices == nil {
+		http.Error(w, "Device classes are not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, f.Devices())
+}
+
+// maxHelloRecord bounds the TLS record buffered for fingerprinting
+const maxHelloRecord = 5 + 1<<14
+
+// helloConn keeps the first TLS record a client sends and hands it to done
+// once complete, or stops looking when the stream is not TLS
+type helloConn struct {
+	net.Conn
+	done     func(hello []byte)
+	buf      []byte
+	finished bool
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.finished && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		switch {
+		case c.buf[0] != 0x16:
+			c.finish(nil)
+		case len(c.buf) >= 5:
+			size := 5 + int(binary.BigEndian.Uint16(c.buf[3:5]))
+			if size > maxHelloRecord {
+				c.finish(nil)
+			} else if len(c.buf) >= size {
+				c.finish(c.buf[:size])
+			}
+		}
+	}
+	if err != nil && !c.finished {
+		c.finish(nil)
+	}
+	return n, err
+}
+
+func (c *helloConn) finish(record []byte) {
+	c.finished = true
+	if record != nil {
+		c.done(record)
+	}
+	c.buf = nil
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *helloConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// ja3 computes the JA3 hash of a TLS record holding a ClientHello: the MD5
+// of its version, cipher suites, extensions, groups and point formats, GREASE
+// values left out
+func ja3(record []byte) (string, bool) {
+	r := helloReader{buf: record}
+	if r.uint8() != 0x16 {
+		return "", false
+	}
+	r.skip(4) // Record version and length
+	if r.uint8() != 1 {
+		return "", false
+	}
+	r.skip(3) // Handshake length
+	version := r.uint16()
+	r.skip(32) // Random
+	r.skip(int(r.uint8()))
+
+	ciphers := r.sub(int(r.uint16()))
+	r.skip(int(r.uint8())) // Compression methods
+
+	var cipherList, extensionList, groupList, formatList []string
+	for ciphers.ok() && len(ciphers.buf) > 0 {
+		if cipher := ciphers.uint16(); !greaseValue(cipher) {
+			cipherList = append(cipherList, strconv.Itoa(int(cipher)))
+		}
+	}
+
+	extensions := r.sub(int(r.uint16()))
+	for extensions.ok() && len(extensions.buf) > 0 {
+		kind := extensions.uint16()
+		data := extensions.sub(int(extensions.uint16()))
+		if greaseValue(kind) {
+			continue
+		}
+		extensionList = append(extensionList, strconv.Itoa(int(kind)))
+		switch kind {
+		case 10: // supported_groups
+			groups := data.sub(int(data.uint16()))
+			for groups.ok() && len(groups.buf) > 0 {
+				if group := groups.uint16(); !greaseValue(group) {
+					groupList = append(groupList, strconv.Itoa(int(group)))
+				}
+			}
+		case 11: // ec_point_formats
+			formats := data.sub(int(data.uint8()))
+			for formats.ok() && len(formats.buf) > 0 {
+				formatList = append(formatList, strconv.Itoa(int(formats.uint8())))
+			}
+		}
+	}
+	if !r.ok() || !extensions.ok() {
+		return "", false
+	}
+
+	text := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		strings.Join(cipherList, "-"),
+		strings.Join(extensionList, "-"),
+		strings.Join(groupList, "-"),
+		strings.Join(formatList, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(text))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// greaseValue reports whether v is a GREASE value (RFC 8701)
+func greaseValue(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloReader reads a ClientHello, turning bad once it runs past the end
+type helloReader struct {
+	buf []byte
+	bad bool
+}
+
+func (r *helloReader) ok() bool { return !r.bad }
+
+func (r *helloReader) take(n int) []byte {
+	if r.bad || n > len(r.buf) {
+		r.bad = true
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *helloReader) skip(n int) { r.take(n) }
+
+func (r *helloReader) uint8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *helloReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// sub returns a reader of the next n bytes
+func (r *helloReader) sub(n int) *helloReader {
+	b := r.take(n)
+	return &helloReader{buf: b, bad: r.bad}
+}
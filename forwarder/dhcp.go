@@ -0,0 +1,658 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// dhcpMissRefresh is how soon an unknown client makes the leases be checked
+// again, as it may just have been given one
+const dhcpMissRefresh = 5 * time.Second
+
+// DHCPLease is what the DHCP server assigned to one client
+type DHCPLease struct {
+	IP       string    `json:"ip,omitempty"`  // Empty for static assignments of a name only
+	MAC      string    `json:"mac,omitempty"` // Empty for DHCPv6 clients known by DUID
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  time.Time `json:"expires"`          // Zero for static assignments and infinite leases
+	Static   bool      `json:"static,omitempty"` // Assigned in the server's configuration
+}
+
+// active reports whether the lease is still held
+func (l *DHCPLease) active(now time.Time) bool {
+	return l.Expires.IsZero() || now.Before(l.Expires)
+}
+
+// dhcpLeases knows the clients the DHCP server assigned addresses and names
+// to, from its lease files or API. A nil table knows none.
+type dhcpLeases struct {
+	config config.DHCPConfig
+	client *http.Client
+	logger func(format string, args ...any)
+
+	mu       sync.Mutex
+	leases   []DHCPLease
+	byIP     map[string]*DHCPLease
+	byMAC    map[string]*DHCPLease // Static assignments, for clients seen at another address
+	versions map[string]string     // Size and modification time of each file read
+	checked  time.Time
+	pending  bool
+	lastErr  string
+}
+
+// newDHCPLeases returns nil when no DHCP server is configured
+func newDHCPLeases(cfg config.DHCPConfig, logger func(format string, args ...any)) *dhcpLeases {
+	if cfg.Server == "" {
+		return nil
+	}
+	return &dhcpLeases{
+		config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+		byIP:   make(map[string]*DHCPLease),
+		byMAC:  make(map[string]*DHCPLease),
+	}
+}
+
+// lookup returns the current lease of the client at ip, or the static
+// assignment of mac, or nil. A miss has the lease files checked again soon;
+// the Kea API is only asked once per refresh interval.
+func (d *dhcpLeases) lookup(ip, mac string) *DHCPLease {
+	if d == nil || ip == "" {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if lease := d.byIP[ip]; lease != nil && lease.active(time.Now()) {
+		return lease
+	}
+	if lease := d.byMAC[mac]; mac != "" && lease != nil {
+		return lease
+	}
+	if d.config.API == "" && !d.pending && time.Since(d.checked) >= dhcpMissRefresh {
+		d.pending = true
+		go d.refresh(context.Background())
+	}
+	return nil
+}
+
+// hostname returns the name the DHCP server gave the client at ip with MAC
+// address mac, or ""
+func (d *dhcpLeases) hostname(ip, mac string) string {
+	if lease := d.lookup(ip, mac); lease != nil {
+		return lease.Hostname
+	}
+	return ""
+}
+
+// mac returns the MAC address the client at ip holds its lease with, or ""
+func (d *dhcpLeases) mac(ip string) string {
+	if lease := d.lookup(ip, ""); lease != nil {
+		return lease.MAC
+	}
+	return ""
+}
+
+// list returns the current leases and static assignments ordered by address
+func (d *dhcpLeases) list() []DHCPLease {
+	if d == nil {
+		return nil
+	}
+	now := time.Now()
+	d.mu.Lock()
+	leases := make([]DHCPLease, 0, len(d.leases))
+	for _, lease := range d.leases {
+		if lease.active(now) {
+			leases = append(leases, lease)
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].IP != leases[j].IP {
+			return leases[i].IP < leases[j].IP
+		}
+		return leases[i].MAC < leases[j].MAC
+	})
+	return leases
+}
+
+// refresh reads the leases again when they may have changed, keeping the
+// previous ones when that fails
+func (d *dhcpLeases) refresh(ctx context.Context) error {
+	leases, versions, err := d.read(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.checked = time.Now()
+	d.pending = false
+	if err != nil {
+		if err.Error() != d.lastErr {
+			d.logger("Failed to read the %s leases: %v", d.config.Server, err)
+			d.lastErr = err.Error()
+		}
+		return err
+	}
+	d.lastErr = ""
+	if leases == nil {
+		return nil
+	}
+	d.leases, d.versions = leases, versions
+	d.byIP = make(map[string]*DHCPLease, len(leases))
+	d.byMAC = make(map[string]*DHCPLease)
+	for i := range leases {
+		lease := &leases[i]
+		// Static assignments win over the leases handed out for them
+		if previous := d.byIP[lease.IP]; lease.IP != "" && (previous == nil || !previous.Static) {
+			d.byIP[lease.IP] = lease
+		}
+		if lease.Static && lease.MAC != "" {
+			d.byMAC[lease.MAC] = lease
+		}
+	}
+	return nil
+}
+
+// read returns the leases and static assignments with the versions of the
+// files they came from, or nil leases when no file changed since the last
+// read
+func (d *dhcpLeases) read(ctx context.Context) ([]DHCPLease, map[string]string, error) {
+	if d.config.API != "" {
+		leases, err := d.query(ctx)
+		return leases, nil, err
+	}
+
+	d.mu.Lock()
+	previous := d.versions
+	d.mu.Unlock()
+	var files []string
+	optional := make(map[string]bool)
+	for _, path := range d.config.Leases {
+		if d.config.Server == config.DHCPKea {
+			// The lease file cleanup leaves the older leases in .2 and .1
+			files = append(files, path+".2", path+".1")
+			optional[path+".2"], optional[path+".1"] = true, true
+		}
+		files = append(files, path)
+	}
+	files = append(files, d.config.Hosts...)
+	versions := make(map[string]string, len(files))
+	changed := previous == nil
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) && optional[path] {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		versions[path] = fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+		changed = changed || versions[path] != previous[path]
+	}
+	if !changed && len(versions) == len(previous) {
+		return nil, nil, nil
+	}
+
+	var leases []DHCPLease
+	for _, path := range d.config.Leases {
+		var read []DHCPLease
+		var err error
+		if d.config.Server == config.DHCPKea {
+			read, err = readKeaLeases(path)
+		} else {
+			read, err = readLeaseFile(path, parseDnsmasqLeases)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		leases = append(leases, read...)
+	}
+	for _, path := range d.config.Hosts {
+		read, err := readLeaseFile(path, parseDnsmasqHosts)
+		if err != nil {
+			return nil, nil, err
+		}
+		leases = append(leases, read...)
+	}
+	if leases == nil {
+		leases = []DHCPLease{}
+	}
+	return leases, versions, nil
+}
+
+// readLeaseFile parses the file at path with parse
+func readLeaseFile(path string, parse func(io.Reader) ([]DHCPLease, error)) ([]DHCPLease, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	leases, err := parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return leases, nil
+}
+
+// parseDnsmasqLeases reads "expiry MAC IP hostname client-id" lines, expiry
+// being a Unix time or 0 for infinite leases and hostname "*" when unknown.
+// DHCPv6 lines carry an IAID instead of the MAC address.
+func parseDnsmasqLeases(r io.Reader) ([]DHCPLease, error) {
+	var leases []DHCPLease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		ip := net.ParseIP(fields[2])
+		if err != nil || ip == nil {
+			continue
+		}
+		lease := DHCPLease{IP: ip.String()}
+		if expiry > 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		if mac, err := net.ParseMAC(fields[1]); err == nil {
+			lease.MAC = mac.String()
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// parseDnsmasqHosts reads the dhcp-host lines of a dnsmasq configuration
+// file, or those of a dhcp-hostsfile without the "dhcp-host=" prefix:
+// comma-separated MAC addresses, client IDs, tags, an address, a host name
+// and a lease time in any order. Other options are skipped.
+func parseDnsmasqHosts(r io.Reader) ([]DHCPLease, error) {
+	var leases []DHCPLease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if option, value, ok := strings.Cut(line, "="); ok && !strings.Contains(option, ",") {
+			if strings.TrimSpace(option) != "dhcp-host" {
+				continue
+			}
+			line = value
+		}
+
+		var macs []string
+		var host DHCPLease
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if mac, err := net.ParseMAC(field); err == nil {
+				macs = append(macs, mac.String())
+				continue
+			}
+			if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(field, "["), "]")); ip != nil {
+				host.IP = ip.String()
+				continue
+			}
+			switch {
+			case field == "", field == "ignore", field == "infinite", strings.Contains(field, ":"), isLeaseTime(field):
+				// Client IDs, tags, wildcard MAC addresses and lease times
+			default:
+				host.Hostname = field
+			}
+		}
+		// Option lines without an address are not host assignments
+		if host.IP == "" && (len(macs) == 0 || host.Hostname == "") {
+			continue
+		}
+		host.Static = true
+		if len(macs) == 0 {
+			leases = append(leases, host)
+		}
+		for _, mac := range macs {
+			host.MAC = mac
+			leases = append(leases, host)
+		}
+	}
+	return leases, scanner.Err()
+}
+
+// isLeaseTime reports whether s is a dnsmasq lease time such as "45m" or
+// "3600"
+func isLeaseTime(s string) bool {
+	digits := strings.TrimRight(s, "smhdw")
+	if digits == "" || len(s)-len(digits) > 1 {
+		return false
+	}
+	_, err := strconv.Atoi(digits)
+	return err == nil
+}
+
+// readKeaLeases reads a Kea memfile lease file along with the older leases
+// its cleanup left in path.2 and path.1, later lines replacing earlier ones
+// for the same address
+func readKeaLeases(path string) ([]DHCPLease, error) {
+	byAddr := make(map[string]DHCPLease)
+	var order []string
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		file, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) && name != path {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = parseKeaLeases(file, func(addr string, lease *DHCPLease) {
+			if _, ok := byAddr[addr]; !ok {
+				order = append(order, addr)
+			}
+			if lease == nil {
+				delete(byAddr, addr)
+			} else {
+				byAddr[addr] = *lease
+			}
+		})
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	var leases []DHCPLease
+	for _, addr := range order {
+		if lease, ok := byAddr[addr]; ok {
+			leases = append(leases, lease)
+			delete(byAddr, addr)
+		}
+	}
+	return leases, nil
+}
+
+// parseKeaLeases hands the rows of a Kea lease4 or lease6 CSV file to apply,
+// with a nil lease for those releasing or expiring the address
+func parseKeaLeases(r io.Reader, apply func(addr string, lease *DHCPLease)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	get := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			// Kea escapes the commas in its fields
+			return strings.ReplaceAll(record[i], "&#x2c", ",")
+		}
+		return ""
+	}
+	if _, ok := columns["address"]; !ok {
+		return errors.New("not a Kea lease file, no address column")
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(get(record, "address"))
+		if ip == nil {
+			continue
+		}
+		// Released and reclaimed leases are written with a zero lifetime or
+		// a state other than default
+		if get(record, "valid_lifetime") == "0" || get(record, "state") != "" && get(record, "state") != "0" {
+			apply(ip.String(), nil)
+			continue
+		}
+		lease := DHCPLease{IP: ip.String(), Hostname: strings.TrimSuffix(get(record, "hostname"), ".")}
+		if mac, err := net.ParseMAC(get(record, "hwaddr")); err == nil {
+			lease.MAC = mac.String()
+		}
+		if expire, err := strconv.ParseInt(get(record, "expire"), 10, 64); err == nil && expire > 0 {
+			lease.Expires = time.Unix(expire, 0)
+		}
+		apply(ip.String(), &lease)
+	}
+}
+
+// keaLease is a lease in a lease4-get-all or lease6-get-all answer
+type keaLease struct {
+	IPAddress string `json:"ip-address"`
+	HWAddress string `json:"hw-address"`
+	Hostname  string `json:"hostname"`
+	CLTT      int64  `json:"cltt"`      // Last transmission to the client, Unix time
+	ValidLft  int64  `json:"valid-lft"` // Seconds from CLTT
+	State     int    `json:"state"`
+}
+
+// keaReservation is a host reservation in a config-get answer
+type keaReservation struct {
+	HWAddress   string   `json:"hw-address"`
+	IPAddress   string   `json:"ip-address"`   // DHCPv4
+	IPAddresses []string `json:"ip-addresses"` // DHCPv6
+	Hostname    string   `json:"hostname"`
+}
+
+// keaSubnet holds the reservations of one subnet
+type keaSubnet struct {
+	Reservations []keaReservation `json:"reservations"`
+}
+
+// keaServerConfig is the part of a Dhcp4 or Dhcp6 configuration holding
+// reservations
+type keaServerConfig struct {
+	Reservations   []keaReservation `json:"reservations"`
+	Subnet4        []keaSubnet      `json:"subnet4"`
+	Subnet6        []keaSubnet      `json:"subnet6"`
+	SharedNetworks []struct {
+		Subnet4 []keaSubnet `json:"subnet4"`
+		Subnet6 []keaSubnet `json:"subnet6"`
+	} `json:"shared-networks"`
+}
+
+// Kea command results
+const (
+	keaResultSuccess = 0
+	keaResultEmpty   = 3
+)
+
+// query asks the Kea control agent for the leases and the reservations of
+// the configuration of every service. Reservations kept in a host database
+// are not listed.
+func (d *dhcpLeases) query(ctx context.Context) ([]DHCPLease, error) {
+	leases := []DHCPLease{}
+	for _, service := range d.config.Services {
+		var answer struct {
+			Leases []keaLease `json:"leases"`
+		}
+		command := "lease4-get-all"
+		if service == "dhcp6" {
+			command = "lease6-get-all"
+		}
+		if err := d.command(ctx, command, service, &answer); err != nil {
+			return nil, err
+		}
+		for _, kl := range answer.Leases {
+			ip := net.ParseIP(kl.IPAddress)
+			if ip == nil || kl.State != 0 {
+				continue
+			}
+			lease := DHCPLease{IP: ip.String(), Hostname: strings.TrimSuffix(kl.Hostname, ".")}
+			if mac, err := net.ParseMAC(kl.HWAddress); err == nil {
+				lease.MAC = mac.String()
+			}
+			if kl.ValidLft > 0 && kl.ValidLft != 0xffffffff {
+				lease.Expires = time.Unix(kl.CLTT+kl.ValidLft, 0)
+			}
+			leases = append(leases, lease)
+		}
+
+		var configs struct {
+			Dhcp4 *keaServerConfig `json:"Dhcp4"`
+			Dhcp6 *keaServerConfig `json:"Dhcp6"`
+		}
+		if err := d.command(ctx, "config-get", service, &configs); err != nil {
+			return nil, err
+		}
+		for _, server := range []*keaServerConfig{configs.Dhcp4, configs.Dhcp6} {
+			if server == nil {
+				continue
+			}
+			reservations := server.Reservations
+			subnets := append(append([]keaSubnet{}, server.Subnet4...), server.Subnet6...)
+			for _, shared := range server.SharedNetworks {
+				subnets = append(append(subnets, shared.Subnet4...), shared.Subnet6...)
+			}
+			for _, subnet := range subnets {
+				reservations = append(reservations, subnet.Reservations...)
+			}
+			for _, r := range reservations {
+				leases = append(leases, r.leases()...)
+			}
+		}
+	}
+	return leases, nil
+}
+
+// leases returns the static assignments of a reservation, one per address
+func (r keaReservation) leases() []DHCPLease {
+	host := DHCPLease{Hostname: strings.TrimSuffix(r.Hostname, "."), Static: true}
+	if mac, err := net.ParseMAC(r.HWAddress); err == nil {
+		host.MAC = mac.String()
+	}
+	var addresses []string
+	for _, addr := range append([]string{r.IPAddress}, r.IPAddresses...) {
+		if ip := net.ParseIP(addr); ip != nil {
+			addresses = append(addresses, ip.String())
+		}
+	}
+	if len(addresses) == 0 {
+		if host.Hostname == "" || host.MAC == "" {
+			return nil
+		}
+		return []DHCPLease{host}
+	}
+	var leases []DHCPLease
+	for _, addr := range addresses {
+		host.IP = addr
+		leases = append(leases, host)
+	}
+	return leases
+}
+
+// command sends a command to service through the Kea control agent and
+// decodes the arguments of its answer into v
+func (d *dhcpLeases) command(ctx context.Context, command, service string, v any) error {
+	body, err := json.Marshal(map[string]any{"command": command, "service": []string{service}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.config.API, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %w", command, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", command, resp.Status)
+	}
+
+	var answers []struct {
+		Result    int             `json:"result"`
+		Text      string          `json:"text"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answers); err != nil {
+		return fmt.Errorf("failed to decode the answer to %s: %w", command, err)
+	}
+	if len(answers) == 0 {
+		return fmt.Errorf("%s: no answer from %s", command, service)
+	}
+	switch answer := answers[0]; answer.Result {
+	case keaResultEmpty:
+		return nil
+	case keaResultSuccess:
+		if len(answer.Arguments) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(answer.Arguments, v); err != nil {
+			return fmt.Errorf("failed to decode the answer to %s: %w", command, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s failed on %s: %s", command, service, answer.Text)
+	}
+}
+
+// refreshLeases reads the DHCP leases now and then checks them once per
+// dhcp.refresh interval until ctx is cancelled
+func (f *Forwarder) refreshLeases(ctx context.Context) {
+	if f.leases == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(f.config.DHCP.Refresh))
+	defer ticker.Stop()
+	for {
+		f.leases.refresh(ctx)
+		dynamic, static := 0, 0
+		for _, lease := range f.leases.list() {
+			if lease.Static {
+				static++
+			} else {
+				dynamic++
+			}
+		}
+		f.metrics.set("gatelan_dhcp_leases", float64(dynamic), "kind", "dynamic")
+		f.metrics.set("gatelan_dhcp_leases", float64(static), "kind", "static")
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DHCPLeases lists the active leases and static assignments of the DHCP
+// server
+func (f *Forwarder) DHCPLeases() []DHCPLease {
+	return f.leases.list()
+}
+
+// handleDHCPLeases serves the DHCP leases
+func (f *Forwarder) handleDHCPLeases(w http.ResponseWriter, r *http.Request) {
+	if f.leases == nil {
+		http.Error(w, "No DHCP server is configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, f.DHCPLeases())
+}
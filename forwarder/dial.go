@@ -0,0 +1,212 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// familyDialer dials outgoing connections restricted to, or preferring, one
+// address family. With a fallback delay it races the resolved addresses
+// Happy Eyeballs style (RFC 8305).
+type familyDialer struct {
+	dialer        *net.Dialer
+	family        string
+	fallbackDelay time.Duration // Zero dials one address at a time
+	resolver      *net.Resolver
+	tcp           config.TCPOptions
+}
+
+// newFamilyDialer creates a dialer with the configured address family, dial
+// timeout and upstream socket options
+func newFamilyDialer(cfg *config.Config, fallbackDelay time.Duration) *familyDialer {
+	return &familyDialer{
+		dialer: &net.Dialer{
+			Timeout:   cfg.Timeouts.Dial.Timeout(),
+			KeepAlive: 30 * time.Second,
+		},
+		family:        cfg.IPFamily,
+		fallbackDelay: max(fallbackDelay, 0),
+		resolver:      net.DefaultResolver,
+		tcp:           cfg.TCP.Upstream,
+	}
+}
+
+// DialContext dials addr over network, applying the family preference,
+// socket options and the DSCP mark of the request to TCP connections
+func (d *familyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tuneTCP(conn, d.tcp)
+	if dscp, ok := ctx.Value(dscpContextKey{}).(int); ok {
+		// Unmarked traffic still flows, only without the priority
+		setDSCP(conn, dscp)
+	}
+	return conn, nil
+}
+
+// dial connects to addr in the family preference's order
+func (d *familyDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	if d.fallbackDelay == 0 {
+		switch d.family {
+		case config.IPv4Only:
+			return d.dialer.DialContext(ctx, "tcp4", addr)
+		case config.IPv6Only:
+			return d.dialer.DialContext(ctx, "tcp6", addr)
+		case config.PreferIPv4, config.PreferIPv6:
+		default:
+			return d.dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, d.network(), addr)
+	}
+	resolved, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := d.order(resolved)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no usable addresses for %s", host)
+	}
+
+	if d.fallbackDelay > 0 {
+		return d.race(ctx, port, addrs)
+	}
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// network returns the dial network for the family restriction
+func (d *familyDialer) network() string {
+	switch d.family {
+	case config.IPv4Only:
+		return "tcp4"
+	case config.IPv6Only:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// order drops addresses of an excluded family and puts the preferred family
+// first. When racing, the families alternate as RFC 8305 section 4 suggests.
+func (d *familyDialer) order(addrs []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	first, second := v6, v4
+	switch d.family {
+	case config.IPv4Only:
+		return v4
+	case config.IPv6Only:
+		return v6
+	case config.PreferIPv4:
+		first, second = v4, v6
+	case config.PreferIPv6:
+	default:
+		if len(addrs) > 0 && addrs[0].IP.To4() != nil {
+			first, second = v4, v6
+		}
+	}
+
+	if d.fallbackDelay == 0 {
+		return append(first, second...)
+	}
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// race starts a connection attempt to each address in turn, moving on when
+// the previous attempt fails or has had fallbackDelay to succeed, and returns
+// the first established connection
+func (d *familyDialer) race(ctx context.Context, port string, addrs []net.IPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		target := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialer.DialContext(ctx, "tcp", target)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(d.fallbackDelay)
+	defer timer.Stop()
+	var errs []error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close connections from attempts that complete afterwards
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			errs = append(errs, result.err)
+			if next < len(addrs) {
+				start()
+				timer.Reset(d.fallbackDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(d.fallbackDelay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
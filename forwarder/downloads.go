@@ -0,0 +1,96 @@
+package forwarder
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// downloadFilter refuses responses by content type or file extension
+type downloadFilter struct {
+	rules []downloadRule
+}
+
+// downloadRule is a compiled DownloadRule
+type downloadRule struct {
+	name       string
+	clients    []*net.IPNet
+	types      map[string]bool // Lower case media types, "video/*" for a whole top level type
+	extensions map[string]bool // Lower case, with the leading dot
+}
+
+func newDownloadFilter(cfg config.DownloadsConfig) (*downloadFilter, error) {
+	d := &downloadFilter{}
+	for i, rc := range cfg.Rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		clients, err := acl.ParseNetworks(rc.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("download rule %s: %w", name, err)
+		}
+		rule := downloadRule{name: name, clients: clients, types: make(map[string]bool), extensions: make(map[string]bool)}
+		for _, t := range rc.ContentTypes {
+			rule.types[strings.ToLower(strings.TrimSpace(t))] = true
+		}
+		for _, ext := range rc.Extensions {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			rule.extensions[ext] = true
+		}
+		d.rules = append(d.rules, rule)
+	}
+	return d, nil
+}
+
+// blocked returns the rule refusing resp to client and why, or empty strings
+func (d *downloadFilter) blocked(client net.IP, req *http.Request, resp *http.Response) (string, string) {
+	if d == nil {
+		return "", ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	topLevel, _, _ := strings.Cut(mediaType, "/")
+	extensions := []string{strings.ToLower(path.Ext(req.URL.Path))}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		extensions = append(extensions, strings.ToLower(path.Ext(params["filename"])))
+	}
+
+	for _, rule := range d.rules {
+		if len(rule.clients) > 0 && !acl.ContainsIP(rule.clients, client) {
+			continue
+		}
+		if mediaType != "" && (rule.types[mediaType] || rule.types[topLevel+"/*"]) {
+			return rule.name, "content type " + mediaType
+		}
+		for _, ext := range extensions {
+			if ext != "" && rule.extensions[ext] {
+				return rule.name, "extension " + ext
+			}
+		}
+	}
+	return "", ""
+}
+
+// blockedDownload answers in place of resp when a download rule refuses it,
+// logging and counting the refusal. It returns nil when resp may pass.
+func (f *Forwarder) blockedDownload(req *http.Request, resp *http.Response) *http.Response {
+	rule, reason := f.downloads.blocked(net.ParseIP(remoteIP(req)), req, resp)
+	if rule == "" {
+		return nil
+	}
+	resp.Body.Close()
+	f.logf(req, "Download rule %s blocked %s (%s) for %s", rule, req.URL.String(), reason, f.clientLabel(req))
+	f.metrics.inc("gatelan_downloads_blocked_total", "rule", rule)
+	f.logBlocked(req, req.URL.Host, fmt.Sprintf("%s blocked by download rule %s", reason, rule))
+	return f.errorResponse(req, http.StatusForbidden, "Blocked download: "+reason, rule)
+}
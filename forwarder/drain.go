@@ -0,0 +1,95 @@
+package forwarder
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultDrainTimeout = 5 * time.Minute
+
+// drainState is an ongoing maintenance drain
+type drainState struct {
+	deadline time.Time     // When connections still open are closed
+	resumed  chan struct{} // Closed when the drain ends early or is replaced
+}
+
+// Drain puts the forwarder in maintenance mode: new proxy requests are
+// refused with 503 while open requests and tunnels may finish until timeout,
+// when the rest are closed. It lasts until Resume.
+func (f *Forwarder) Drain(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	state := &drainState{deadline: time.Now().Add(timeout), resumed: make(chan struct{})}
+	if previous := f.drain.Swap(state); previous != nil {
+		close(previous.resumed)
+	}
+	f.logger.Printf("Draining for maintenance, closing open connections in %v", timeout)
+
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-state.resumed:
+			return
+		case <-timer.C:
+		}
+		if killed := f.connections.killAll(); killed > 0 {
+			f.logger.Printf("Drain timeout reached, closed %d connections", killed)
+		}
+	}()
+}
+
+// Resume ends maintenance mode, reporting whether the forwarder was draining
+func (f *Forwarder) Resume() bool {
+	state := f.drain.Swap(nil)
+	if state == nil {
+		return false
+	}
+	close(state.resumed)
+	f.logger.Printf("Resumed serving after maintenance")
+	return true
+}
+
+// draining returns the time left until open connections are closed, and
+// whether the forwarder is draining at all
+func (f *Forwarder) draining() (time.Duration, bool) {
+	state := f.drain.Load()
+	if state == nil {
+		return 0, false
+	}
+	return max(time.Until(state.deadline), 0), true
+}
+
+// writeDraining refuses a proxy request during maintenance
+func (f *Forwarder) writeDraining(w http.ResponseWriter, r *http.Request, remaining time.Duration) {
+	f.logf(r, "Draining, refused %s %s for %s", r.Method, r.Host, f.clientLabel(r))
+	retry := int(math.Ceil(remaining.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retry, 1)))
+	f.writeError(w, r, http.StatusServiceUnavailable, "Down for maintenance", "")
+}
+
+// handleDrain starts draining, for the timeout query parameter or the default
+func (f *Forwarder) handleDrain(w http.ResponseWriter, r *http.Request) {
+	var timeout time.Duration
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+	f.Drain(timeout)
+	writeJSONStatus(w, http.StatusAccepted, f.GetReadiness())
+}
+
+// handleResume ends draining
+func (f *Forwarder) handleResume(w http.ResponseWriter, r *http.Request) {
+	if !f.Resume() {
+		http.Error(w, "Not draining", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
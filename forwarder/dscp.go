@@ -0,0 +1,49 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// dscpContextKey carries the DSCP code point of a request's upstream connections
+type dscpContextKey struct{}
+
+// dscpRule is a DSCPRule with its class resolved
+type dscpRule struct {
+	name    string
+	domains []string
+	value   int
+}
+
+// newDSCPRules resolves the classes of the configured DSCP rules
+func newDSCPRules(rules []config.DSCPRule) ([]dscpRule, error) {
+	marks := make([]dscpRule, 0, len(rules))
+	for i, rc := range rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		value, err := config.ParseDSCP(rc.Class)
+		if err != nil {
+			return nil, fmt.Errorf("dscp rule %s: %w", name, err)
+		}
+		marks = append(marks, dscpRule{name: name, domains: rc.Domains, value: value})
+	}
+	return marks, nil
+}
+
+// markTraffic has the upstream connections of req to host carry the code
+// point of the first matching DSCP rule
+func (f *Forwarder) markTraffic(req *http.Request, host string) *http.Request {
+	for _, rule := range f.dscp {
+		if acl.MatchHost(host, rule.domains) {
+			f.metrics.inc("gatelan_dscp_marked_total", "rule", rule.name)
+			return req.WithContext(context.WithValue(req.Context(), dscpContextKey{}, rule.value))
+		}
+	}
+	return req
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package forwarder
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDSCP sets the traffic class of conn to the code point dscp, leaving
+// the ECN bits clear
+func setDSCP(conn net.Conn, dscp int) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, option := unix.IPPROTO_IP, unix.IP_TOS
+	if addr, ok := tcp.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, option = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, option, dscp<<2)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
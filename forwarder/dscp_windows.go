@@ -0,0 +1,10 @@
+//go:build windows
+
+package forwarder
+
+import "net"
+
+// setDSCP does nothing, as Windows only marks traffic as its QoS policies say
+func setDSCP(net.Conn, int) error {
+	return nil
+}
@@ -0,0 +1,120 @@
+package forwarder
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// ErrorPage is the data error page templates are executed with
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	Message    string // Why the request was refused or failed
+	Rule       string // Access rule, feed, category or quota identity responsible, if any
+	Method     string
+	URL        string
+	Host       string
+	Client     string // IP address of the client
+	User       string // Authenticated proxy user, if any
+	RequestID  string
+	Time       time.Time
+}
+
+// errorPages holds the configured templates by response status
+type errorPages map[int]*template.Template
+
+// newErrorPages parses the configured templates, returning nil when there are none
+func newErrorPages(cfg config.ErrorPagesConfig) (errorPages, error) {
+	pages := make(errorPages)
+	for _, page := range []struct {
+		file     string
+		statuses []int
+	}{
+		{cfg.Blocked, []int{http.StatusForbidden}},
+		{cfg.AuthRequired, []int{http.StatusProxyAuthRequired}},
+		{cfg.RateLimited, []int{http.StatusTooManyRequests}},
+		{cfg.UpstreamError, []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}},
+	} {
+		if page.file == "" {
+			continue
+		}
+		tmpl, err := template.ParseFiles(page.file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load error page: %w", err)
+		}
+		for _, status := range page.statuses {
+			pages[status] = tmpl
+		}
+	}
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	return pages, nil
+}
+
+// renderErrorPage executes the page configured for status about req. It
+// reports false when there is none or it fails.
+func (f *Forwarder) renderErrorPage(req *http.Request, status int, message, rule string) (string, bool) {
+	tmpl := f.errorPages[status]
+	if tmpl == nil {
+		return "", false
+	}
+
+	page := ErrorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		Rule:       rule,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Host:       req.URL.Hostname(),
+		Client:     remoteIP(req),
+		User:       requestUser(req),
+		RequestID:  requestID(req),
+		Time:       time.Now(),
+	}
+	if req.Method == http.MethodConnect {
+		page.URL = req.Host
+	}
+	if page.Host == "" {
+		page.Host = stripPort(req.Host)
+	}
+
+	var body strings.Builder
+	if err := tmpl.Execute(&body, page); err != nil {
+		f.logf(req, "Failed to render error page for %d: %v", status, err)
+		return "", false
+	}
+	return body.String(), true
+}
+
+// errorResponse answers req with status, showing the configured page or
+// else message as plain text
+func (f *Forwarder) errorResponse(req *http.Request, status int, message, rule string) *http.Response {
+	body, ok := f.renderErrorPage(req, status, message, rule)
+	if !ok {
+		return newResponse(req, status, message+"\n")
+	}
+	resp := newResponse(req, status, body)
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return resp
+}
+
+// writeError is errorResponse for handlers answering on w
+func (f *Forwarder) writeError(w http.ResponseWriter, req *http.Request, status int, message, rule string) {
+	body, ok := f.renderErrorPage(req, status, message, rule)
+	if !ok {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
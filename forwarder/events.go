@@ -0,0 +1,98 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	eventQueueSize = 64
+	webhookTimeout = 10 * time.Second
+)
+
+// Event is an operational event delivered to the configured webhooks and
+// notifiers
+type Event struct {
+	Type     string    `json:"type"` // One of the config.Event constants
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message"`
+	Upstream string    `json:"upstream,omitempty"`
+	Key      string    `json:"key,omitempty"` // User or client whose quota ran out
+	Error    string    `json:"error,omitempty"`
+}
+
+// emit queues event for delivery without blocking, dropping it when the
+// queue is full. Nothing is queued without webhooks or notifiers.
+func (f *Forwarder) emit(event Event) {
+	if f.events == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case f.events <- event:
+	default:
+		f.logger.Printf("Dropped %s event, the delivery queue is full", event.Type)
+	}
+}
+
+// deliverEvents sends queued events to the webhooks and notifiers that want
+// them until ctx is cancelled
+func (f *Forwarder) deliverEvents(ctx context.Context) {
+	if f.events == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-f.events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			for _, hook := range f.config.Webhooks {
+				if !hook.Wants(event.Type) {
+					continue
+				}
+				if err := postJSON(ctx, hook.URL, hook.Headers, data); err != nil {
+					f.logger.Printf("Failed to send %s event to webhook: %v", event.Type, err)
+				}
+			}
+			f.notify(ctx, event)
+		}
+	}
+}
+
+// postJSON sends an encoded event or message to target with extra headers.
+// Errors leave out the URL, which may carry a token.
+func postJSON(ctx context.Context, target string, headers map[string]string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return errors.New("failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// failureCacheSweep is the number of remembered destinations beyond which
+// recording a failure first drops the expired ones
+const failureCacheSweep = 1024
+
+// failureCache remembers destinations recently failing to connect. A nil
+// cache remembers nothing.
+type failureCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	until map[string]time.Time // By host:port
+}
+
+// newFailureCache returns nil when the cache is disabled
+func newFailureCache(cfg config.FailureCacheConfig) *failureCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &failureCache{ttl: time.Duration(cfg.TTL), until: make(map[string]time.Time)}
+}
+
+// record remembers that destination could not be reached
+func (c *failureCache) record(destination string) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.until) >= failureCacheSweep {
+		for key, until := range c.until {
+			if now.After(until) {
+				delete(c.until, key)
+			}
+		}
+	}
+	c.until[destination] = now.Add(c.ttl)
+}
+
+// forget drops the failure of destination, which was just reached
+func (c *failureCache) forget(destination string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.until, destination)
+	c.mu.Unlock()
+}
+
+// remaining returns how long the failure of destination is still
+// remembered, 0 when it is not
+func (c *failureCache) remaining(destination string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	left := time.Until(c.until[destination])
+	if left <= 0 {
+		delete(c.until, destination)
+		return 0
+	}
+	return left
+}
+
+// destinationAddr returns the host:port requests to u connect to
+func destinationAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "ftp":
+		port = "21"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// clientGone reports whether err came from the client of req going away
+// rather than from the upstream
+func clientGone(req *http.Request, err error) bool {
+	return req.Context().Err() != nil || errors.Is(err, context.Canceled)
+}
+
+// recordFailure remembers destination unless the failure to reach it came
+// from the client of req going away
+func (f *Forwarder) recordFailure(req *http.Request, destination string, err error) {
+	if f.failures == nil || clientGone(req, err) {
+		return
+	}
+	f.failures.record(destination)
+}
+
+// recentFailure returns the message answering req while destination is
+// remembered as failing, with the seconds until it is tried again, or ""
+func (f *Forwarder) recentFailure(req *http.Request, destination string) (string, int) {
+	left := f.failures.remaining(destination)
+	if left <= 0 {
+		return "", 0
+	}
+	seconds := int(math.Ceil(left.Seconds()))
+	f.logf(req, "Not trying %s again for %ds after it failed", destination, seconds)
+	f.metrics.inc("gatelan_failure_cache_hits_total")
+	return fmt.Sprintf("Upstream unreachable, retrying in %ds", seconds), seconds
+}
+
+// failureResponse answers req with the message of a remembered failure
+func (f *Forwarder) failureResponse(req *http.Request, message string, seconds int) *http.Response {
+	resp := f.errorResponse(req, http.StatusBadGateway, message, "")
+	resp.Header.Set("Retry-After", strconv.Itoa(seconds))
+	return resp
+}
@@ -0,0 +1,214 @@
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// defaultFilterMaxSize is the largest body buffered for filtering when no limit is configured
+const defaultFilterMaxSize = 1 << 20
+
+// ErrContentBlocked is returned by a BodyFilter to reject the whole response
+var ErrContentBlocked = errors.New("content blocked by filter")
+
+// BodyFilter transforms a buffered text/html response body
+type BodyFilter interface {
+	Filter(body []byte) ([]byte, error)
+}
+
+// BodyFilterFunc adapts a plain function to the BodyFilter interface
+type BodyFilterFunc func(body []byte) ([]byte, error)
+
+// Filter calls fn(body)
+func (fn BodyFilterFunc) Filter(body []byte) ([]byte, error) {
+	return fn(body)
+}
+
+// bodyFilterPipeline runs the configured filters in order
+type bodyFilterPipeline struct {
+	config  config.BodyFilterConfig
+	filters []BodyFilter
+}
+
+// newBodyFilterPipeline builds the filter chain from configuration
+func newBodyFilterPipeline(cfg config.BodyFilterConfig) (*bodyFilterPipeline, error) {
+	p := &bodyFilterPipeline{config: cfg}
+	if p.config.MaxSize == 0 {
+		p.config.MaxSize = defaultFilterMaxSize
+	}
+
+	if len(cfg.BlockKeywords) > 0 {
+		p.filters = append(p.filters, keywordFilter(cfg.BlockKeywords))
+	}
+
+	for _, rule := range cfg.Replacements {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replacement pattern %q: %w", rule.Pattern, err)
+		}
+		replace := []byte(rule.Replace)
+		p.filters = append(p.filters, BodyFilterFunc(func(body []byte) ([]byte, error) {
+			return re.ReplaceAll(body, replace), nil
+		}))
+	}
+
+	if cfg.StripScripts {
+		p.filters = append(p.filters, BodyFilterFunc(stripScripts))
+	}
+
+	return p, nil
+}
+
+// add appends a custom filter to the end of the pipeline
+func (p *bodyFilterPipeline) add(filter BodyFilter) {
+	p.filters = append(p.filters, filter)
+}
+
+// appliesTo reports whether the pipeline should run for the given request and response
+func (p *bodyFilterPipeline) appliesTo(req *http.Request, resp *http.Response) bool {
+	if !p.config.Enabled || len(p.filters) == 0 {
+		return false
+	}
+	if req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+
+	// Bodies are decoded for inspection, other codings cannot be inspected
+	if enc := contentEncoding(resp.Header); enc != "" && !decodable(enc) {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" {
+		return false
+	}
+
+	if resp.ContentLength > p.config.MaxSize {
+		return false
+	}
+
+	host := req.URL.Hostname()
+	if acl.MatchHost(host, p.config.DisabledDomains) {
+		return false
+	}
+	if len(p.config.Domains) > 0 && !acl.MatchHost(host, p.config.Domains) {
+		return false
+	}
+
+	return true
+}
+
+// apply buffers the response body and runs it through every filter.
+// Compressed bodies are decoded first and encoded again as the origin sent
+// them unless SendDecoded is set. Bodies that turn out larger than MaxSize,
+// decoded, are passed through untouched, and so are ones that fail to decode.
+func (p *bodyFilterPipeline) apply(resp *http.Response) error {
+	encoding := contentEncoding(resp.Header)
+	if encoding != "" {
+		return p.applyDecoded(resp, encoding)
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, p.config.MaxSize+1))
+	if err != nil {
+		resp.Body.Close()
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if int64(len(buf)) > p.config.MaxSize {
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(buf), resp.Body), Closer: resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	if buf, err = p.run(buf); err != nil {
+		return err
+	}
+	p.setBody(resp, buf)
+	return nil
+}
+
+// applyDecoded filters a body compressed with encoding
+func (p *bodyFilterPipeline) applyDecoded(resp *http.Response, encoding string) error {
+	// Keep the bytes as received to pass them on when the body is not filtered
+	var raw bytes.Buffer
+	decoded, err := decodeBody(encoding, io.TeeReader(resp.Body, &raw))
+	var buf []byte
+	if err == nil {
+		buf, err = io.ReadAll(io.LimitReader(decoded, p.config.MaxSize+1))
+	}
+	if err != nil || int64(len(buf)) > p.config.MaxSize {
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(&raw, resp.Body), Closer: resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	if buf, err = p.run(buf); err != nil {
+		return err
+	}
+	if p.config.SendDecoded {
+		resp.Header.Del("Content-Encoding")
+	} else if buf, err = encodeBody(encoding, buf); err != nil {
+		return fmt.Errorf("failed to encode filtered body: %w", err)
+	}
+	p.setBody(resp, buf)
+	return nil
+}
+
+// run passes body through every filter in order
+func (p *bodyFilterPipeline) run(body []byte) ([]byte, error) {
+	var err error
+	for _, filter := range p.filters {
+		if body, err = filter.Filter(body); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// setBody replaces the response body with a filtered one
+func (p *bodyFilterPipeline) setBody(resp *http.Response, buf []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
+	resp.ContentLength = int64(len(buf))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	resp.Header.Del("ETag")
+}
+
+// keywordFilter blocks bodies containing any of the keywords (case-insensitive)
+func keywordFilter(keywords []string) BodyFilter {
+	lowered := make([][]byte, len(keywords))
+	for i, keyword := range keywords {
+		lowered[i] = bytes.ToLower([]byte(keyword))
+	}
+
+	return BodyFilterFunc(func(body []byte) ([]byte, error) {
+		lowerBody := bytes.ToLower(body)
+		for _, keyword := range lowered {
+			if bytes.Contains(lowerBody, keyword) {
+				return nil, fmt.Errorf("%w: keyword %q", ErrContentBlocked, keyword)
+			}
+		}
+		return body, nil
+	})
+}
+
+var scriptTagPattern = regexp.MustCompile(`(?is)<script\b[^>]*>.*?</script\s*>|<script\b[^>]*/>`)
+
+// stripScripts removes all <script> elements from an HTML body
+func stripScripts(body []byte) ([]byte, error) {
+	return scriptTagPattern.ReplaceAll(body, nil), nil
+}
+
+// multiReadCloser pairs a combined reader with the underlying body's Closer
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,769 @@
+// Package forwarder implements the GateLAN proxy: an HTTP forwarder that sends
+// requests through upstream proxies and serves LAN clients on its listeners
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// Forwarder represents the simple HTTP client forwarder
+type Forwarder struct {
+	config      *config.Config
+	active      atomic.Pointer[profile]
+	profileMu   sync.Mutex // Serializes profile switches
+	metrics     *metrics
+	listeners   []*proxyListener
+	bodyFilter  *bodyFilterPipeline
+	cache       *httpCache
+	compressor  *compressor
+	hooks       hooks
+	policy      *policyEngine
+	affinity    *affinityTable
+	geo         *geoRouter
+	pauses      []pauseWindow
+	stubs       []stubRule
+	portal      *captivePortal
+	lists       *managedLists
+	cluster     *clusterNode
+	events      chan Event // Queued for webhooks and notifiers, nil without any
+	notifiers   []*notifier
+	quota       *quotaTracker
+	ldap        *ldapAuthenticator
+	jwt         *jwtVerifier
+	audit       *auditSink
+	icap        *icapClient
+	blocklist   *blocklist
+	adblock     *adblocker
+	categories  *categoryFilter
+	downloads   *downloadFilter
+	har         *harRecorder
+	capture     *tunnelCapture
+	stats       *usageStats
+	clientNames *clientNamer
+	neighbors   *neighborTable
+	leases      *dhcpLeases
+	devices     *deviceClassifier
+	credentials []credentialRule
+	mirrors     *requestMirror
+	failures    *failureCache
+	dscp        []dscpRule
+	shaper      *shaper
+	proxyAuth   *upstreamAuth
+	bodyLog     *bodyLogger
+	hot         *hotDestinations
+	tenants     []*tenant
+	admission   *admission
+	timeouts    []*net.IPNet // Clients trusted with the request timeout header
+	ssrf        *ssrfGuard
+	errorPages  errorPages
+	connections *connectionTable
+	drain       atomic.Pointer[drainState] // Maintenance mode, nil while serving normally
+	admin       *http.Server
+	grpc        *http.Server
+	clusterAPI  *http.Server
+	wpad        *http.Server
+	wpadDNS     net.PacketConn
+	udp         []*udpForwarder
+	mdns        *mdnsResponder
+	acme        *autocert.Manager
+	acmeHTTP    *http.Server
+	logFile     *rotatingFile
+	logger      *log.Logger
+	serving     atomic.Bool           // Between Start binding the listeners and Stop
+	fallback    atomic.Bool           // Every upstream is down and requests go direct
+	sockets     map[string]socketFile // Bound sockets, by the key Upgrade hands them over with
+	inherited   map[string]*os.File   // Sockets handed over by the previous instance, until Start binds them
+	upgraded    bool                  // The sockets now belong to a new instance
+	handedOver  chan struct{}         // Closed once Upgrade succeeded
+
+	lifecycleMu sync.Mutex         // Serializes Start, Stop and Shutdown
+	state       int                // One of the lifecycle states, guarded by lifecycleMu
+	cancelRun   context.CancelFunc // Ends the background work of a running forwarder
+
+	dedicatedMu sync.Mutex
+	dedicated   map[string]*upstream // Upstreams outside the pool, by address
+	bound       []*profile           // Profiles of listeners, guarded by dedicatedMu
+
+	certsMu sync.Mutex
+	certs   map[string]*certReloader // Served certificates by their files
+
+	startedMu sync.Mutex
+	started   time.Time        // When Start bound the listeners, zero while not serving
+	listening []ListenerStatus // The listeners bound then
+}
+
+// New creates a Forwarder from cfg, filling in defaults for unset options
+func New(cfg *config.Config) (*Forwarder, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Fall back to the proxy the machine is already configured with
+	var detected proxySettings
+	if cfg.ProxyAddr == "" && cfg.Profiles[cfg.Profile].ProxyAddr == "" {
+		var ok bool
+		if detected, ok = detectProxy(); !ok {
+			return nil, errors.New("no proxy_addr configured and no system proxy detected")
+		}
+		cfg.ProxyAddr = detected.addr
+		cfg.NoProxy = append(cfg.NoProxy, detected.noProxy...)
+	}
+
+	bodyFilter, err := newBodyFilterPipeline(cfg.BodyFilter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create body filter: %w", err)
+	}
+
+	var logOutput io.Writer = os.Stdout
+	var logFile *rotatingFile
+	if cfg.Log.File != "" {
+		if logFile, err = newRotatingFile(cfg.Log); err != nil {
+			return nil, err
+		}
+		logOutput = logFile
+	}
+
+	if cfg.State.Dir != "" {
+		if err := os.MkdirAll(cfg.State.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create state dir: %w", err)
+		}
+	}
+
+	fwd := &Forwarder{
+		config:      cfg,
+		metrics:     newMetrics(),
+		connections: newConnectionTable(),
+		handedOver:  make(chan struct{}),
+		bodyFilter:  bodyFilter,
+		compressor:  newCompressor(cfg.Compression),
+		logFile:     logFile,
+		logger:      log.New(logOutput, "[Forwarder] ", log.LstdFlags|log.Lshortfile),
+	}
+
+	if detected.source != "" {
+		fwd.logger.Printf("Using upstream proxy %s from %s", detected.addr, detected.source)
+	}
+
+	// Create HTTP clients that will forward all requests through the upstream proxies
+	active, err := fwd.newProfile(cfg.Profile)
+	if err != nil {
+		return nil, err
+	}
+	fwd.active.Store(active)
+
+	if cfg.Affinity.Enabled {
+		fwd.affinity = newAffinityTable(cfg.Affinity)
+	}
+
+	if fwd.pauses, err = newPauseWindows(cfg.Pauses); err != nil {
+		return nil, err
+	}
+	if fwd.stubs, err = newStubRules(cfg.Stubs); err != nil {
+		return nil, err
+	}
+	for _, nc := range cfg.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, err
+		}
+		fwd.notifiers = append(fwd.notifiers, n)
+	}
+	if len(cfg.Webhooks) > 0 || len(fwd.notifiers) > 0 {
+		fwd.events = make(chan Event, eventQueueSize)
+	}
+	if fwd.lists, err = newManagedLists(cfg.Lists); err != nil {
+		return nil, err
+	}
+	fwd.cluster = newClusterNode(cfg.Cluster)
+	fwd.devices = newDeviceClassifier(cfg.Devices)
+	fwd.admission = newAdmission(cfg.Admission, fwd.metrics)
+	if fwd.timeouts, err = acl.ParseNetworks(cfg.RequestTimeout.Clients); err != nil {
+		return nil, fmt.Errorf("invalid request_timeout.clients: %w", err)
+	}
+	fwd.ssrf = newSSRFGuard(cfg.SSRF)
+	if cfg.UsesACME() {
+		fwd.acme = newACMEManager(cfg.ACME)
+	}
+	if cfg.Portal.Enabled {
+		if fwd.portal, err = newCaptivePortal(cfg.Portal); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.LDAP.URL != "" {
+		fwd.ldap = newLDAPAuthenticator(cfg.LDAP)
+	}
+	if cfg.JWT.Enabled() {
+		fwd.jwt = newJWTVerifier(cfg.JWT)
+	}
+
+	if cfg.Syslog.Addr != "" {
+		if fwd.audit, err = newAuditSink(cfg.Syslog, fwd.logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.Blocklist.Feeds) > 0 {
+		fwd.blocklist = newBlocklist(cfg.Blocklist)
+	}
+
+	if len(cfg.Adblock.Profiles) > 0 {
+		if fwd.adblock, err = newAdblocker(cfg.Adblock); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Categories.Database != "" {
+		if fwd.categories, err = newCategoryFilter(cfg.Categories); err != nil {
+			return nil, err
+		}
+	}
+
+	if fwd.credentials, err = newCredentialRules(cfg.Credentials); err != nil {
+		return nil, err
+	}
+	if fwd.mirrors, err = newRequestMirror(cfg.Mirrors); err != nil {
+		return nil, err
+	}
+	fwd.failures = newFailureCache(cfg.FailureCache)
+	fwd.hot = newHotDestinations(cfg.Prewarm)
+	if fwd.dscp, err = newDSCPRules(cfg.DSCP); err != nil {
+		return nil, err
+	}
+	if fwd.shaper, err = newShaper(cfg.Shaping, fwd.metrics); err != nil {
+		return nil, err
+	}
+	if fwd.proxyAuth, err = newUpstreamAuth(cfg.UpstreamAuth); err != nil {
+		return nil, err
+	}
+	if fwd.bodyLog, err = newBodyLogger(cfg.BodyLog); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Downloads.Rules) > 0 {
+		if fwd.downloads, err = newDownloadFilter(cfg.Downloads); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ICAP.ReqMod != "" || cfg.ICAP.RespMod != "" {
+		fwd.icap = newICAPClient(cfg.ICAP)
+	}
+
+	if cfg.Quota.Enabled {
+		if fwd.quota, err = newQuotaTracker(cfg.Quota); err != nil {
+			return nil, err
+		}
+	}
+	if fwd.tenants, err = fwd.newTenants(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.GeoIP.Database != "" {
+		if fwd.geo, err = fwd.newGeoRouter(cfg.GeoIP); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Policy.Script != "" {
+		if fwd.policy, err = newPolicyEngine(cfg.Policy); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.HAR.Enabled {
+		fwd.har = newHARRecorder(cfg.HAR)
+	}
+
+	if cfg.Capture.Enabled {
+		if fwd.capture, err = newTunnelCapture(cfg.Capture); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Stats.Enabled {
+		if fwd.stats, err = newUsageStats(cfg.Stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ClientNames.Enabled() {
+		if fwd.clientNames, err = newClientNamer(cfg.ClientNames, fwd.logger.Printf); err != nil {
+			return nil, err
+		}
+	}
+	fwd.neighbors = newNeighborTable(cfg.Neighbors, fwd.logger.Printf)
+	fwd.leases = newDHCPLeases(cfg.DHCP, fwd.logger.Printf)
+
+	if fwd.errorPages, err = newErrorPages(cfg.ErrorPages); err != nil {
+		return nil, err
+	}
+
+	if cfg.Cache.Enabled {
+		if fwd.cache, err = newHTTPCache(cfg.Cache); err != nil {
+			return nil, fmt.Errorf("failed to create cache: %w", err)
+		}
+	}
+
+	return fwd, nil
+}
+
+// NewFromFile loads the config file at configPath and creates a Forwarder
+func NewFromFile(configPath string) (*Forwarder, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return New(cfg)
+}
+
+// ForwardRequest forwards an HTTP request through the upstream proxy
+func (f *Forwarder) ForwardRequest(req *http.Request) (*http.Response, error) {
+	req = withRequestID(req)
+	req = canonicalizeHost(req)
+	if f.bodyLog.matches(req) {
+		return f.logBodies(req, f.recordHAR)
+	}
+	return f.recordHAR(req)
+}
+
+// recordHAR forwards req, recording the exchange when HAR recording is enabled
+func (f *Forwarder) recordHAR(req *http.Request) (*http.Response, error) {
+	if f.har != nil {
+		return f.har.record(req, f.forward)
+	}
+	return f.forward(req)
+}
+
+// forward runs the request pipeline for ForwardRequest
+func (f *Forwarder) forward(req *http.Request) (*http.Response, error) {
+	f.logf(req, "Forwarding request: %s %s%s", req.Method, req.URL.String(), unicodeNote(req.URL.Hostname()))
+
+	// Refuse requests that already passed through this instance
+	if f.detectLoop(req) {
+		f.logf(req, "Loop detected for %s %s", req.Method, req.URL.String())
+		return f.errorResponse(req, http.StatusLoopDetected, "Proxy loop detected", ""), nil
+	}
+
+	// Serve the captive portal and send clients to it until they accept
+	if resp := f.portalResponse(req); resp != nil {
+		return resp, nil
+	}
+
+	// Hold everything back during scheduled pauses
+	if window := f.pausedBy(req); window != nil {
+		f.logf(req, "Pause %s held back %s %s for %s", window.name, req.Method, req.URL.String(), f.clientLabel(req))
+		f.logBlocked(req, req.URL.Host, "paused by "+window.name)
+		return f.pauseResponse(req, window), nil
+	}
+
+	// Send the client elsewhere instead of forwarding
+	if resp := f.redirectResponse(req); resp != nil {
+		return resp, nil
+	}
+
+	// Answer from stub rules without contacting upstream
+	if resp := f.stubResponse(req); resp != nil {
+		return resp, nil
+	}
+
+	// Point the request at its rewritten URL, so that the rules below judge
+	// the destination actually contacted
+	req = canonicalizeHost(f.rewriteURL(req))
+
+	// Refuse destinations on the block list; those on the allow list skip
+	// the filters below
+	if f.blockedByList(req, req.URL.Hostname()) {
+		return f.errorResponse(req, http.StatusForbidden, "Blocked by administrator", ListBlock), nil
+	}
+
+	// Keep clients out of the networks around the gateway
+	if reason := f.blockedBySSRF(req, req.URL.Hostname()); reason != "" {
+		return f.errorResponse(req, http.StatusForbidden, "Destination refused: "+reason, ""), nil
+	}
+
+	// Apply scheduled access rules
+	if rule := f.blockingRule(req, req.URL.Hostname()); rule != nil {
+		f.logf(req, "Access rule %s blocked %s %s for %s", rule.Name, req.Method, req.URL.String(), f.clientLabel(req))
+		f.logBlocked(req, req.URL.Host, "blocked by access rule "+rule.Name)
+		return f.errorResponse(req, http.StatusForbidden, "Blocked by access rule", rule.Name), nil
+	}
+
+	// Refuse destinations listed in threat feeds
+	if feed := f.blockedByFeed(req, req.URL.Hostname()); feed != "" {
+		return f.errorResponse(req, http.StatusForbidden, "Blocked by threat feed", feed), nil
+	}
+
+	// Enforce the client's category profile
+	if category := f.blockedCategory(req, req.URL.Hostname()); category != "" {
+		return f.categoryResponse(req, req.URL.Hostname(), category), nil
+	}
+
+	// Answer ads and trackers locally
+	if f.blockedByAdblock(req, req.URL.Hostname(), false) != "" {
+		return newResponse(req, f.config.Adblock.Response, ""), nil
+	}
+
+	// Route or refuse by destination country
+	if f.geo != nil {
+		ctx, err := f.routeByCountry(req.Context(), req.URL.Hostname())
+		if err != nil {
+			f.logf(req, "Rejected %s %s: %v", req.Method, req.URL.String(), err)
+			f.logBlocked(req, req.URL.Host, err.Error())
+			return f.errorResponse(req, http.StatusForbidden, "Destination country blocked", ""), nil
+		}
+		req = req.WithContext(ctx)
+	}
+
+	// Apply the routing rule for the destination
+	req, route := f.applyRoute(req, req.URL.Hostname())
+
+	// Let the policy script reject or reroute the request
+	decision, err := f.evaluatePolicy(policyRequestFunc, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate policy: %w", err)
+	}
+	if decision != nil {
+		if decision.Reject != 0 {
+			f.logf(req, "Policy rejected %s %s with %d", req.Method, req.URL.String(), decision.Reject)
+			f.logBlocked(req, req.URL.Host, fmt.Sprintf("rejected by policy with %d", decision.Reject))
+			if decision.Body != "" {
+				return newResponse(req, decision.Reject, decision.Body), nil
+			}
+			return f.errorResponse(req, decision.Reject, http.StatusText(decision.Reject), ""), nil
+		}
+		if decision.Upstream != "" {
+			req = req.WithContext(withUpstream(req.Context(), f.upstreamFor(decision.Upstream)))
+		}
+	}
+
+	// Let plugins rewrite or answer the request
+	if resp, err := f.hooks.runRequestHooks(req); err != nil {
+		return nil, fmt.Errorf("request hook failed: %w", err)
+	} else if resp != nil {
+		return f.hooks.runResponseHooks(req, resp)
+	}
+
+	// Take the timeouts a trusted client asked for
+	req = f.withRequestTimeout(req)
+
+	// Check the addresses direct connections resolve the destination to
+	req = f.guardDestination(req, req.URL.Hostname())
+
+	// Mark the upstream connections for the router's QoS
+	req = f.markTraffic(req, req.URL.Hostname())
+
+	// Clients authenticating with the upstream themselves pass their
+	// credentials on, except through the pooled tunnels of https URLs
+	passAuth := false
+	if req.URL.Scheme == "http" {
+		req, passAuth = f.passAuth(req)
+	}
+
+	// Fetch ftp:// URLs over FTP on the client's behalf
+	if req.URL.Scheme == "ftp" && f.config.FTP.Enabled {
+		return f.serveFTP(req)
+	}
+
+	// Create a copy of the request to avoid modifying the original
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proxy request: %w", err)
+	}
+
+	// Copy headers from original request
+	for name, values := range req.Header {
+		for _, value := range values {
+			proxyReq.Header.Add(name, value)
+		}
+	}
+
+	// Remove hop-by-hop headers that shouldn't be forwarded
+	f.removeHopByHopHeaders(proxyReq.Header)
+
+	// Relay the body as framed by the client, trailers included
+	proxyReq.ContentLength = req.ContentLength
+	proxyReq.TransferEncoding = req.TransferEncoding
+	proxyReq.Trailer = req.Trailer
+	if acceptsTrailers(req.Header) {
+		proxyReq.Header.Set("TE", "trailers")
+	}
+	// The transport holds back the body until the upstream sends 100
+	// Continue, and reading it prompts the server to send 100 to the client
+	if req.Body == nil || req.Body == http.NoBody {
+		proxyReq.Header.Del("Expect")
+	}
+
+	// Set additional headers for proxy request
+	f.applyHeaderOverrides(proxyReq)
+	f.applyForwardedHeaders(req, proxyReq)
+	f.markRequest(proxyReq)
+	if route != nil && route.Host != "" {
+		proxyReq.Host = route.Host
+	}
+	if f.config.RequestID.Inject {
+		proxyReq.Header.Set(f.config.RequestID.Header, requestID(req))
+	}
+	if decision != nil {
+		decision.applyHeaders(proxyReq.Header)
+	}
+	credentialed := f.injectCredentials(req, proxyReq)
+
+	// Hand the request to the ICAP scanner
+	if resp, err := f.scanRequest(proxyReq); err != nil {
+		return nil, err
+	} else if resp != nil {
+		return f.hooks.runResponseHooks(req, resp)
+	}
+
+	// Enforce the request body size limit
+	limitedReq, rejected := f.limitRequest(req, proxyReq)
+	if rejected != nil {
+		return rejected, nil
+	}
+
+	// Serve fresh responses from the cache, revalidate stale ones. Responses
+	// to attached credentials are private to the clients of their rule.
+	var cached *cacheEntry
+	if f.cache != nil && !credentialed && f.cache.lookable(req) {
+		if cached = f.cache.lookup(req); cached != nil {
+			if cached.fresh(req, time.Now()) {
+				if resp, err := f.cache.response(req, cached); err == nil {
+					return f.processResponse(req, resp)
+				}
+				cached = nil
+			} else {
+				f.cache.addValidators(proxyReq.Header, cached)
+			}
+		}
+		// Ask the cluster peers' caches before going upstream
+		if cached == nil {
+			requestTime := time.Now()
+			if resp := f.peerCache(req); resp != nil {
+				if resp, err := f.cache.handleResponse(req, nil, requestTime, resp); err == nil {
+					return f.processResponse(req, resp)
+				}
+			}
+		}
+	}
+
+	// Answer right away while the destination is remembered as unreachable
+	destination := destinationAddr(req.URL)
+	if message, seconds := f.recentFailure(req, destination); message != "" {
+		return f.failureResponse(req, message, seconds), nil
+	}
+
+	// Copy the request to the secondary upstream of its mirror rule
+	f.mirror(req, proxyReq)
+
+	// Forward the request to upstream proxy
+	req = f.withBypass(req, destination)
+	requestTime := time.Now()
+	resp, err := f.roundTrip(req, proxyReq)
+	if err != nil {
+		if limitedReq != nil && limitedReq.exceeded {
+			f.logf(req, "Rejected request to %s: body exceeds limit of %d", req.URL.String(), f.config.Limits.MaxRequestBody)
+			return f.errorResponse(req, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the %d byte limit", f.config.Limits.MaxRequestBody), ""), nil
+		}
+		if status, message, ok := connectRefusal(err); ok {
+			f.logf(req, "Upstream refused tunnel for %s: %v", req.URL.String(), err)
+			return f.errorResponse(req, status, message, ""), nil
+		}
+		if errors.Is(err, ErrDestinationRefused) {
+			return f.errorResponse(req, http.StatusForbidden, "Destination address refused", ""), nil
+		}
+		if !errors.Is(err, ErrUpstreamUnavailable) {
+			f.recordFailure(req, destination, err)
+		}
+		return nil, fmt.Errorf("failed to forward request: %w", err)
+	}
+	f.failures.forget(destination)
+	f.hot.hit(destination)
+
+	// Only the clients answering them see the upstream's challenges
+	if resp.StatusCode == http.StatusProxyAuthRequired && !passAuth {
+		resp.Body.Close()
+		f.logf(req, "Upstream proxy requires authentication for %s", req.URL.String())
+		return f.errorResponse(req, http.StatusBadGateway, "Upstream proxy requires authentication", ""), nil
+	}
+
+	// Scan before caching so hits are served already scanned
+	if resp, err = f.scanResponse(req, resp); err != nil {
+		return nil, err
+	}
+
+	if f.cache != nil && !credentialed {
+		if resp, err = f.cache.handleResponse(req, cached, requestTime, resp); err != nil {
+			return nil, err
+		}
+	}
+
+	return f.processResponse(req, resp)
+}
+
+// processResponse applies response-side features before handing resp to the caller
+func (f *Forwarder) processResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	// Refuse blocked file types before any of the body is relayed
+	if blocked := f.blockedDownload(req, resp); blocked != nil {
+		return blocked, nil
+	}
+
+	// Enforce the response body size limit
+	resp = f.limitResponse(req, resp)
+
+	// Run text/html bodies through the content filter pipeline
+	if f.bodyFilter.appliesTo(req, resp) {
+		if err := f.bodyFilter.apply(resp); err != nil {
+			if errors.Is(err, ErrContentBlocked) {
+				f.logf(req, "Blocked response for %s: %v", req.URL.String(), err)
+				f.logBlocked(req, req.URL.Host, err.Error())
+				return f.errorResponse(req, http.StatusForbidden, "Blocked by content filter", ""), nil
+			}
+			return nil, fmt.Errorf("failed to filter response: %w", err)
+		}
+	}
+
+	// Compress toward the client when the origin didn't
+	if encoding := f.compressor.negotiate(req, resp); encoding != "" {
+		f.compressor.apply(resp, encoding)
+	}
+
+	return f.hooks.runResponseHooks(req, resp)
+}
+
+// ForwardHTTPRequest is a convenience method for simple HTTP requests
+func (f *Forwarder) ForwardHTTPRequest(method, urlStr string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, urlStr, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	return f.ForwardRequest(req)
+}
+
+// AddBodyFilter registers a custom filter that runs after the configured ones
+func (f *Forwarder) AddBodyFilter(filter BodyFilter) {
+	f.bodyFilter.add(filter)
+}
+
+// PurgeCache removes the cached response for rawURL, reporting whether one existed
+func (f *Forwarder) PurgeCache(rawURL string) bool {
+	if f.cache == nil {
+		return false
+	}
+	return f.cache.remove(http.MethodGet + " " + rawURL)
+}
+
+// PurgeAllCache empties the response cache and returns the number of removed entries
+func (f *Forwarder) PurgeAllCache() int {
+	if f.cache == nil {
+		return 0
+	}
+	return f.cache.purgeAll()
+}
+
+// GetCacheStats returns the response cache occupancy
+func (f *Forwarder) GetCacheStats() CacheStats {
+	if f.cache == nil {
+		return CacheStats{}
+	}
+	return f.cache.stats()
+}
+
+// GetMetrics returns a snapshot of all counters and gauges keyed by Prometheus series name
+func (f *Forwarder) GetMetrics() map[string]float64 {
+	f.collectPoolMetrics()
+	return f.metrics.snapshot()
+}
+
+// WriteMetrics writes all counters and gauges in the Prometheus text format
+func (f *Forwarder) WriteMetrics(w io.Writer) error {
+	f.collectPoolMetrics()
+	return f.metrics.writePrometheus(w)
+}
+
+// GetHTTPClient returns the HTTP client of the active profile's first
+// upstream for direct use
+func (f *Forwarder) GetHTTPClient() *http.Client {
+	return f.current().upstreams[0].client
+}
+
+// GetConfig returns the forwarder configuration
+func (f *Forwarder) GetConfig() *config.Config {
+	return f.config
+}
+
+// LogOutput returns the writer the forwarder logs to, the rotating log file
+// when one is configured
+func (f *Forwarder) LogOutput() io.Writer {
+	return f.logger.Writer()
+}
+
+// removeHopByHopHeaders removes hop-by-hop headers
+func (f *Forwarder) removeHopByHopHeaders(headers http.Header) {
+	hopByHopHeaders := []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"TE",
+		"Trailers",
+		"Transfer-Encoding",
+		"Upgrade",
+		"Proxy-Connection",
+	}
+
+	for _, header := range hopByHopHeaders {
+		headers.Del(header)
+	}
+}
+
+// acceptsTrailers reports whether the TE header lists trailers, which gRPC
+// requires and proxies may pass on since they relay trailers
+func acceptsTrailers(header http.Header) bool {
+	for _, value := range header.Values("TE") {
+		for _, coding := range strings.Split(value, ",") {
+			coding, _, _ = strings.Cut(coding, ";")
+			if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newResponse builds a locally generated plain-text response for req
+func newResponse(req *http.Request, statusCode int, body string) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,470 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// ftpSession is an FTP control connection logged in for one request
+type ftpSession struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	route   tunnel.Dialer
+	host    string        // Data connections go to the server's host, whatever PASV says
+	timeout time.Duration // Of each data connection's dial, none when 0
+	stop    func() bool
+}
+
+// cmd sends a command and reads its reply, expecting a code as
+// textproto.Reader.ReadResponse does
+func (s *ftpSession) cmd(expect int, format string, args ...any) (int, string, error) {
+	if _, err := s.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return s.text.ReadResponse(expect)
+}
+
+// close ends the session without waiting for the server
+func (s *ftpSession) close() {
+	s.stop()
+	s.text.Cmd("QUIT")
+	s.conn.Close()
+}
+
+// dialFTP connects to the server of u along up's route and logs in with the
+// URL's credentials, anonymously when it has none
+func (f *Forwarder) dialFTP(ctx context.Context, up *upstream, u *url.URL) (*ftpSession, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	timeout := f.config.Timeouts.Dial.Timeout()
+	dialCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := up.route.Dial(dialCtx, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &ftpSession{
+		conn:    conn,
+		text:    textproto.NewConn(conn),
+		route:   up.route,
+		host:    u.Hostname(),
+		timeout: timeout,
+		stop:    context.AfterFunc(ctx, func() { conn.Close() }),
+	}
+
+	user, password := "anonymous", f.config.FTP.Password
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if _, _, err = s.text.ReadResponse(2); err == nil {
+		var code int
+		var msg string
+		if code, msg, err = s.cmd(0, "USER %s", user); err == nil && code == 331 {
+			code, msg, err = s.cmd(0, "PASS %s", password)
+		}
+		if err == nil && code != 230 && code != 202 {
+			err = &textproto.Error{Code: code, Msg: msg}
+		}
+	}
+	if err == nil {
+		_, _, err = s.cmd(2, "TYPE I")
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openData opens a passive data connection, extended (RFC 2428) if the
+// server supports it
+func (s *ftpSession) openData(ctx context.Context) (net.Conn, error) {
+	var port int
+	_, msg, err := s.cmd(229, "EPSV")
+	if err == nil {
+		port, err = parseEPSV(msg)
+	} else if _, msg, err = s.cmd(227, "PASV"); err == nil {
+		port, err = parsePASV(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	return s.route.Dial(ctx, net.JoinHostPort(s.host, strconv.Itoa(port)))
+}
+
+// parseEPSV returns the port of "Entering Extended Passive Mode (|||6446|)"
+func parseEPSV(msg string) (int, error) {
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start+2 {
+		return 0, fmt.Errorf("invalid EPSV reply %q", msg)
+	}
+	// The delimiter is the reply's choice, usually "|"
+	fields := strings.Split(msg[start+1:end], msg[start+1:start+2])
+	if len(fields) != 5 {
+		return 0, fmt.Errorf("invalid EPSV reply %q", msg)
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid EPSV reply %q", msg)
+	}
+	return int(port), nil
+}
+
+// parsePASV returns the port of "Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+// The address is ignored, which keeps servers from pointing data
+// connections elsewhere.
+func parsePASV(msg string) (int, error) {
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+	high, err1 := strconv.ParseUint(fields[4], 10, 8)
+	low, err2 := strconv.ParseUint(fields[5], 10, 8)
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid PASV reply %q", msg)
+	}
+	return int(high<<8 | low), nil
+}
+
+// ftpBody streams a download, ending the session once read or closed
+type ftpBody struct {
+	data    net.Conn
+	session *ftpSession
+	once    sync.Once
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	return b.data.Read(p)
+}
+
+func (b *ftpBody) Close() error {
+	b.once.Do(func() {
+		b.data.Close()
+		b.session.close()
+	})
+	return nil
+}
+
+// ftpEntry is a directory listing entry. Lines of LIST output that could not
+// be parsed keep only their text.
+type ftpEntry struct {
+	name     string
+	dir      bool
+	size     int64 // -1 when unknown
+	modified string
+	raw      string
+}
+
+// list reads the listing of dir, machine-readable (RFC 3659) where the
+// server supports it
+func (s *ftpSession) list(ctx context.Context, dir string) ([]ftpEntry, error) {
+	lines, err := s.transferLines(ctx, "MLSD", dir)
+	var replyErr *textproto.Error
+	if errors.As(err, &replyErr) && replyErr.Code >= 500 && replyErr.Code != 550 {
+		lines, err = s.transferLines(ctx, "LIST", dir)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]ftpEntry, 0, len(lines))
+		for _, line := range lines {
+			entries = append(entries, parseListLine(line))
+		}
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ftpEntry, 0, len(lines))
+	for _, line := range lines {
+		if entry, ok := parseMLSDLine(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// transferLines runs a listing command and returns the lines it sent over
+// the data connection
+func (s *ftpSession) transferLines(ctx context.Context, command, dir string) ([]string, error) {
+	data, err := s.openData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	if dir != "" {
+		command += " " + dir
+	}
+	if _, _, err := s.cmd(1, "%s", command); err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	data.Close()
+	if _, _, err := s.text.ReadResponse(2); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// parseMLSDLine parses "type=file;size=1024;modify=20240102030405; name",
+// skipping the entries of the directory itself and its parent
+func parseMLSDLine(line string) (ftpEntry, bool) {
+	facts, name, ok := strings.Cut(line, " ")
+	if !ok || name == "" {
+		return ftpEntry{}, false
+	}
+	entry := ftpEntry{name: name, size: -1}
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, _ := strings.Cut(fact, "=")
+		switch strings.ToLower(key) {
+		case "type":
+			switch strings.ToLower(value) {
+			case "cdir", "pdir":
+				return ftpEntry{}, false
+			case "dir":
+				entry.dir = true
+			}
+		case "size":
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+				entry.size = size
+			}
+		case "modify":
+			if t, err := time.Parse("20060102150405", value[:min(len(value), 14)]); err == nil {
+				entry.modified = t.Format("2006-01-02 15:04")
+			}
+		}
+	}
+	return entry, true
+}
+
+// parseListLine parses a Unix "ls -l" line of LIST output such as
+// "drwxr-xr-x 2 ftp ftp 4096 Jan 02 03:04 pub"
+func parseListLine(line string) ftpEntry {
+	if strings.HasPrefix(line, "total ") {
+		return ftpEntry{}
+	}
+	entry := ftpEntry{size: -1, raw: line}
+	fields := strings.Fields(line)
+	if len(fields) < 9 || len(fields[0]) != 10 || !strings.ContainsRune("-dl", rune(fields[0][0])) {
+		return entry
+	}
+	// The name is what follows the eighth field, spaces included
+	rest := line
+	for i := 0; i < 8; i++ {
+		rest = strings.TrimLeft(rest, " \t")
+		rest = rest[strings.IndexAny(rest, " \t"):]
+	}
+	name := strings.TrimLeft(rest, " \t")
+	if fields[0][0] == 'l' {
+		name, _, _ = strings.Cut(name, " -> ")
+	}
+	if name == "." || name == ".." {
+		return ftpEntry{}
+	}
+	entry.name, entry.raw = name, ""
+	entry.dir = fields[0][0] == 'd'
+	if size, err := strconv.ParseInt(fields[4], 10, 64); err == nil {
+		entry.size = size
+	}
+	entry.modified = strings.Join(fields[5:8], " ")
+	return entry
+}
+
+// renderFTPListing renders the listing of the directory at u as HTML
+func renderFTPListing(u *url.URL, entries []ftpEntry) string {
+	location := *u
+	location.User = nil
+	title := html.EscapeString("Index of " + location.String())
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title></head><body>\n<h1>%s</h1>\n<table>\n", title, title)
+	if u.Path != "" && u.Path != "/" {
+		b.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, entry := range entries {
+		if entry.name == "" {
+			if entry.raw != "" {
+				fmt.Fprintf(&b, "<tr><td colspan=\"3\">%s</td></tr>\n", html.EscapeString(entry.raw))
+			}
+			continue
+		}
+		name, href := entry.name, (&url.URL{Path: entry.name}).EscapedPath()
+		size := ""
+		if entry.dir {
+			name += "/"
+			href += "/"
+		} else if entry.size >= 0 {
+			size = strconv.FormatInt(entry.size, 10)
+		}
+		if strings.Contains(entry.name, ":") {
+			// Not to be taken for a scheme
+			href = "./" + href
+		}
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), size, html.EscapeString(entry.modified))
+	}
+	b.WriteString("</table>\n</body></html>\n")
+	return b.String()
+}
+
+// serveFTP answers a request for an ftp:// URL with the file, streamed as it
+// is downloaded, or an HTML listing of the directory, both passing through
+// the response-side features. Paths are relative to the login directory, as
+// in RFC 1738.
+func (f *Forwarder) serveFTP(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return f.errorResponse(req, http.StatusMethodNotAllowed, "Only GET and HEAD are supported for ftp:// URLs", ""), nil
+	}
+	// The login is sent decoded in USER and PASS, and the path in commands
+	p := strings.TrimPrefix(req.URL.Path, "/")
+	login := ""
+	if req.URL.User != nil {
+		password, _ := req.URL.User.Password()
+		login = req.URL.User.Username() + password
+	}
+	if strings.ContainsAny(p+login, "\r\n") {
+		return f.errorResponse(req, http.StatusBadRequest, "Invalid ftp:// URL", ""), nil
+	}
+
+	req = f.withBypass(req, destinationAddr(req.URL))
+	up, err := f.selectUpstream(req.Context(), 0)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.dialFTP(req.Context(), up, req.URL)
+	// FTP failures are the server's as often as the upstream's, so they give
+	// no verdict on the breaker
+	up.breaker.release()
+	if err != nil {
+		return f.ftpFailure(req, err)
+	}
+	f.metrics.inc("gatelan_ftp_requests_total")
+
+	if p != "" && !strings.HasSuffix(p, "/") {
+		if _, _, err := s.cmd(250, "CWD %s", p); err == nil {
+			s.close()
+			// Relative links of the listing need the trailing slash
+			location := *req.URL
+			location.Path += "/"
+			resp := newResponse(req, http.StatusMovedPermanently, "")
+			resp.Header.Set("Location", location.String())
+			return resp, nil
+		}
+		return f.ftpFile(req, s, p)
+	}
+
+	entries, err := s.list(req.Context(), strings.TrimSuffix(p, "/"))
+	s.close()
+	if err != nil {
+		return f.ftpFailure(req, err)
+	}
+	resp := newResponse(req, http.StatusOK, renderFTPListing(req.URL, entries))
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return f.processResponse(req, resp)
+}
+
+// ftpFile answers with the file at p, taking over the session
+func (f *Forwarder) ftpFile(req *http.Request, s *ftpSession, p string) (*http.Response, error) {
+	size := int64(-1)
+	if _, msg, err := s.cmd(213, "SIZE %s", p); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			size = n
+		}
+	}
+	header := make(http.Header)
+	contentType := mime.TypeByExtension(path.Ext(p))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: size,
+		Request:       req,
+	}
+	if size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if req.Method == http.MethodHead {
+		s.close()
+		if size < 0 {
+			return f.errorResponse(req, http.StatusNotFound, "Not found on the FTP server", ""), nil
+		}
+		resp.Body = http.NoBody
+		return f.processResponse(req, resp)
+	}
+
+	data, err := s.openData(req.Context())
+	if err == nil {
+		if _, _, err = s.cmd(1, "RETR %s", p); err != nil {
+			data.Close()
+		}
+	}
+	if err != nil {
+		s.close()
+		return f.ftpFailure(req, err)
+	}
+	resp.Body = &ftpBody{data: data, session: s}
+	return f.processResponse(req, resp)
+}
+
+// ftpFailure maps a failed FTP exchange to the response for the client
+func (f *Forwarder) ftpFailure(req *http.Request, err error) (*http.Response, error) {
+	f.logf(req, "FTP request for %s failed: %v", req.URL.Redacted(), err)
+	var replyErr *textproto.Error
+	switch {
+	case errors.Is(err, ErrDestinationRefused):
+		return f.errorResponse(req, http.StatusForbidden, "Destination address refused", ""), nil
+	case errors.As(err, &replyErr) && replyErr.Code == 530:
+		return f.errorResponse(req, http.StatusForbidden, "FTP login refused: "+replyErr.Msg, ""), nil
+	case errors.As(err, &replyErr) && replyErr.Code == 550:
+		return f.errorResponse(req, http.StatusNotFound, "Not found on the FTP server: "+replyErr.Msg, ""), nil
+	case errors.As(err, &replyErr):
+		return f.errorResponse(req, http.StatusBadGateway, fmt.Sprintf("FTP server replied %d %s", replyErr.Code, replyErr.Msg), ""), nil
+	}
+	return nil, fmt.Errorf("failed to fetch %s: %w", req.URL.Redacted(), err)
+}
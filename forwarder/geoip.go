@@ -0,0 +1,100 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// ErrCountryBlocked is returned for destinations in a blocked country
+var ErrCountryBlocked = errors.New("destination country is blocked")
+
+// geoRouter picks upstreams and refuses destinations by GeoIP country
+type geoRouter struct {
+	db       *maxminddb.Reader
+	block    map[string]bool
+	routes   map[string]*upstream
+	resolver *net.Resolver
+}
+
+// geoRecord is the subset of a MaxMind record used for routing
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// newGeoRouter opens the database and resolves the route upstreams
+func (f *Forwarder) newGeoRouter(cfg config.GeoIPConfig) (*geoRouter, error) {
+	db, err := maxminddb.Open(cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+
+	g := &geoRouter{
+		db:       db,
+		block:    make(map[string]bool),
+		routes:   make(map[string]*upstream),
+		resolver: net.DefaultResolver,
+	}
+	for _, code := range cfg.Block {
+		g.block[strings.ToUpper(code)] = true
+	}
+	for code, addr := range cfg.Routes {
+		g.routes[strings.ToUpper(code)] = f.upstreamFor(addr)
+	}
+	return g, nil
+}
+
+// country resolves host and returns the ISO code of its first address
+func (g *geoRouter) country(ctx context.Context, host string) (string, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := g.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		if len(addrs) == 0 {
+			return "", fmt.Errorf("no addresses for %s", host)
+		}
+		ip = addrs[0].IP
+	}
+
+	var record geoRecord
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode, nil
+	}
+	return record.RegisteredCountry.ISOCode, nil
+}
+
+// routeByCountry returns ctx routed to the upstream for the country of host,
+// or ErrCountryBlocked. Destinations that cannot be located pass unchanged.
+func (f *Forwarder) routeByCountry(ctx context.Context, host string) (context.Context, error) {
+	if f.geo == nil {
+		return ctx, nil
+	}
+	code, err := f.geo.country(ctx, host)
+	if err != nil {
+		f.logger.Printf("GeoIP lookup for %s failed: %v", host, err)
+		return ctx, nil
+	}
+	if f.geo.block[code] {
+		return ctx, fmt.Errorf("%w: %s is in %s", ErrCountryBlocked, host, code)
+	}
+	if up, ok := f.geo.routes[code]; ok {
+		return withUpstream(ctx, up), nil
+	}
+	return ctx, nil
+}
@@ -0,0 +1,376 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	grpcService    = "/gatelan.v1.Control/"
+	grpcMaxMessage = 4 << 20
+)
+
+// gRPC status codes answered by the control API
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is a failed call with its gRPC status code
+type grpcError struct {
+	code    int
+	message string
+}
+
+// Error returns the status message
+func (e *grpcError) Error() string { return e.message }
+
+// grpcMethod handles one unary call of the control API, decoding the request
+// message and encoding the response
+type grpcMethod func(ctx context.Context, req []pbField) (*pbMessage, error)
+
+// GRPCHandler returns the control API as a gRPC service, as described by
+// api/control.proto, for mounting in another HTTP/2 server instead of the
+// configured admin.grpc_addr. Calls need the admin credentials in their
+// authorization metadata.
+func (f *Forwarder) GRPCHandler() http.Handler {
+	methods := map[string]grpcMethod{
+		"GetStatus":       f.grpcGetStatus,
+		"ListConnections": f.grpcListConnections,
+		"KillConnection":  f.grpcKillConnection,
+		"GetLists":        f.grpcGetLists,
+		"AddListEntry":    f.grpcAddListEntry,
+		"RemoveListEntry": f.grpcRemoveListEntry,
+		"Reload":          f.grpcReload,
+		"Drain":           f.grpcDrain,
+		"Resume":          f.grpcResume,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		if !f.adminAuthorized(r) {
+			writeGRPCStatus(w, grpcUnauthenticated, "missing or invalid admin credentials")
+			return
+		}
+
+		method, ok := methods[strings.TrimPrefix(r.URL.Path, grpcService)]
+		if !ok || !strings.HasPrefix(r.URL.Path, grpcService) {
+			writeGRPCStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+			return
+		}
+		req, err := readGRPCMessage(r.Body)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		fields, err := decodePB(req)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		resp, err := method(r.Context(), fields)
+		if err != nil {
+			var callErr *grpcError
+			if errors.As(err, &callErr) {
+				writeGRPCStatus(w, callErr.code, callErr.message)
+			} else {
+				writeGRPCStatus(w, grpcInternal, err.Error())
+			}
+			return
+		}
+		frame := make([]byte, 5, 5+len(resp.buf))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp.buf)))
+		w.Write(append(frame, resp.buf...))
+		writeGRPCStatus(w, grpcOK, "")
+	})
+}
+
+// readGRPCMessage reads the single length-prefixed message of a unary call
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read request: %w", err)
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed requests are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, errors.New("request too large")
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, fmt.Errorf("failed to read request: %w", err)
+	}
+	return msg, nil
+}
+
+// writeGRPCStatus ends a call with the status trailers
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(message))
+	}
+}
+
+// grpcEscape percent-encodes a status message as the gRPC protocol requires
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// startGRPC serves the control API over plaintext HTTP/2 when an address is
+// configured
+func (f *Forwarder) startGRPC(ctx context.Context) error {
+	if f.config.Admin.GRPCAddr == "" {
+		return nil
+	}
+	listener, err := f.listenTCP(f.config.Admin.GRPCAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on gRPC address: %w", err)
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	f.grpc = &http.Server{
+		Handler:           f.GRPCHandler(),
+		Protocols:         &protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	f.logger.Printf("gRPC control API on %s", listener.Addr())
+	go func() {
+		if err := f.grpc.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			f.logger.Printf("gRPC control API stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// grpcGetStatus answers GetStatus
+func (f *Forwarder) grpcGetStatus(ctx context.Context, req []pbField) (*pbMessage, error) {
+	status := f.GetStatus()
+	var msg pbMessage
+	msg.string(1, status.Version.Version)
+	msg.string(2, status.Version.Commit)
+	msg.string(3, status.Version.BuildDate)
+	msg.string(4, status.Version.GoVersion)
+	msg.string(5, status.Profile)
+	for _, u := range status.Upstreams {
+		var upstream pbMessage
+		upstream.string(1, u.Addr)
+		upstream.string(2, u.Breaker)
+		upstream.uint(3, u.Requests)
+		upstream.uint(4, u.Failures)
+		upstream.double(5, u.ConnectMS)
+		upstream.double(6, u.TTFBMS)
+		upstream.int(7, unixMilli(u.LastSuccess))
+		upstream.int(8, unixMilli(u.LastFailure))
+		upstream.string(9, u.LastError)
+		msg.message(6, &upstream)
+	}
+	msg.message(7, readinessMessage(status.Readiness))
+	msg.int(8, int64(status.StatusVersion))
+	msg.int(9, unixMilli(status.Started))
+	msg.double(10, status.UptimeSeconds)
+	for _, l := range status.Listeners {
+		var listener pbMessage
+		listener.string(1, l.Name)
+		listener.string(2, l.Addr)
+		listener.bool(3, l.TLS)
+		listener.string(4, l.Auth)
+		listener.string(5, l.Profile)
+		msg.message(11, &listener)
+	}
+	var connections pbMessage
+	connections.int(1, int64(status.Connections.Open))
+	connections.int(2, int64(status.Connections.Requests))
+	connections.int(3, int64(status.Connections.Tunnels))
+	connections.int(4, int64(status.Connections.Stalled))
+	connections.uint(5, status.Connections.Handled)
+	msg.message(12, &connections)
+	msg.int(13, status.BytesSent)
+	msg.int(14, status.BytesReceived)
+	return &msg, nil
+}
+
+// grpcListConnections answers ListConnections
+func (f *Forwarder) grpcListConnections(ctx context.Context, req []pbField) (*pbMessage, error) {
+	var msg pbMessage
+	for _, c := range f.Connections() {
+		var conn pbMessage
+		conn.uint(1, c.ID)
+		conn.string(2, c.Kind)
+		conn.string(3, c.Client)
+		conn.string(4, c.Target)
+		conn.string(5, c.Upstream)
+		conn.int(6, unixMilli(c.Started))
+		conn.double(7, c.Age.Seconds())
+		conn.int(8, c.BytesSent)
+		conn.int(9, c.BytesReceived)
+		conn.bool(10, c.Stalled)
+		conn.string(11, c.ClientName)
+		msg.message(1, &conn)
+	}
+	return &msg, nil
+}
+
+// grpcKillConnection answers KillConnection
+func (f *Forwarder) grpcKillConnection(ctx context.Context, req []pbField) (*pbMessage, error) {
+	var id uint64
+	for _, field := range req {
+		if field.number == 1 && field.wire == pbVarint {
+			id = field.num
+		}
+	}
+	if !f.KillConnection(id) {
+		return nil, &grpcError{grpcNotFound, "connection not found"}
+	}
+	f.logger.Printf("Killed connection %d via gRPC API", id)
+	return &pbMessage{}, nil
+}
+
+// grpcGetLists answers GetLists
+func (f *Forwarder) grpcGetLists(ctx context.Context, req []pbField) (*pbMessage, error) {
+	return listsMessage(f.Lists()), nil
+}
+
+// grpcAddListEntry answers AddListEntry
+func (f *Forwarder) grpcAddListEntry(ctx context.Context, req []pbField) (*pbMessage, error) {
+	list, entry, err := grpcListEntry(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.AddListEntry(list, entry); err != nil {
+		return nil, err
+	}
+	f.logger.Printf("Added %s to the %s list via gRPC API", entry, list)
+	return listsMessage(f.Lists()), nil
+}
+
+// grpcRemoveListEntry answers RemoveListEntry
+func (f *Forwarder) grpcRemoveListEntry(ctx context.Context, req []pbField) (*pbMessage, error) {
+	list, entry, err := grpcListEntry(req)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := f.RemoveListEntry(list, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !removed {
+		return nil, &grpcError{grpcNotFound, "entry not found"}
+	}
+	f.logger.Printf("Removed %s from the %s list via gRPC API", entry, list)
+	return listsMessage(f.Lists()), nil
+}
+
+// grpcListEntry reads the list name and normalized entry of a
+// ListEntryRequest
+func grpcListEntry(req []pbField) (string, string, error) {
+	var list, entry string
+	for _, field := range req {
+		switch {
+		case field.number == 1 && field.wire == pbBytes:
+			list = string(field.data)
+		case field.number == 2 && field.wire == pbBytes:
+			entry = string(field.data)
+		}
+	}
+	if list != ListBlock && list != ListAllow {
+		return "", "", &grpcError{grpcNotFound, "list not found"}
+	}
+	entry, err := normalizeListEntry(entry)
+	if err != nil {
+		return "", "", &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return list, entry, nil
+}
+
+// grpcReload answers Reload once the new instance serves
+func (f *Forwarder) grpcReload(ctx context.Context, req []pbField) (*pbMessage, error) {
+	f.logger.Printf("Upgrading to a new instance via gRPC API")
+	if err := f.Upgrade(ctx); err != nil {
+		return nil, &grpcError{grpcFailedPrecondition, err.Error()}
+	}
+	return &pbMessage{}, nil
+}
+
+// grpcDrain answers Drain, for the default timeout when unset
+func (f *Forwarder) grpcDrain(ctx context.Context, req []pbField) (*pbMessage, error) {
+	var timeout time.Duration
+	for _, field := range req {
+		if field.number == 1 && (field.wire == pbFixed64 || field.wire == pbFixed32) {
+			timeout = time.Duration(field.float() * float64(time.Second))
+		}
+	}
+	if timeout < 0 {
+		return nil, &grpcError{grpcInvalidArgument, "invalid timeout"}
+	}
+	f.Drain(timeout)
+	return readinessMessage(f.GetReadiness()), nil
+}
+
+// grpcResume answers Resume
+func (f *Forwarder) grpcResume(ctx context.Context, req []pbField) (*pbMessage, error) {
+	if !f.Resume() {
+		return nil, &grpcError{grpcFailedPrecondition, "not draining"}
+	}
+	return readinessMessage(f.GetReadiness()), nil
+}
+
+// readinessMessage encodes r as a Readiness message
+func readinessMessage(r Readiness) *pbMessage {
+	var msg pbMessage
+	msg.bool(1, r.Ready)
+	msg.int(2, int64(r.Listeners))
+	msg.int(3, int64(r.Upstreams))
+	msg.int(4, int64(r.HealthyUpstreams))
+	msg.bool(5, r.Draining)
+	msg.int(6, int64(r.DrainSeconds))
+	msg.int(7, int64(r.OpenConnections))
+	msg.strings(8, r.Problems)
+	return &msg
+}
+
+// listsMessage encodes l as a Lists message
+func listsMessage(l Lists) *pbMessage {
+	var msg pbMessage
+	msg.strings(1, l.Block)
+	msg.strings(2, l.Allow)
+	return &msg
+}
+
+// unixMilli returns t in Unix milliseconds, 0 for the zero time
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
@@ -0,0 +1,111 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// handshakeListener gives every accepted connection timeouts.handshake to
+// deliver its first request headers. Each phase before them, the PROXY
+// protocol header, the TLS handshake and the headers themselves, otherwise
+// has a timeout of its own, so a client trickling bytes (slowloris) would
+// hold the connection for their sum.
+type handshakeListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &handshakeConn{Conn: conn, deadline: time.Now().Add(l.timeout)}
+	conn.SetReadDeadline(c.deadline)
+	return c, nil
+}
+
+// handshakeConn keeps read deadlines within the handshake deadline until the
+// first request headers are in
+type handshakeConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	deadline time.Time // Zero once the handshake is over
+	read     time.Time // Read deadline last asked for
+}
+
+// clamp returns the earlier of t and the handshake deadline; c.mu must be
+// held
+func (c *handshakeConn) clamp(t time.Time) time.Time {
+	if c.deadline.IsZero() || (!t.IsZero() && t.Before(c.deadline)) {
+		return t
+	}
+	return c.deadline
+}
+
+func (c *handshakeConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read = t
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetReadDeadline(c.clamp(t))
+}
+
+func (c *handshakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read = t
+	return c.Conn.SetReadDeadline(c.clamp(t))
+}
+
+// done ends the handshake, restoring the read deadline last asked for
+func (c *handshakeConn) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.deadline.IsZero() {
+		return
+	}
+	c.deadline = time.Time{}
+	c.Conn.SetReadDeadline(c.read)
+}
+
+// ReadFrom and WriteTo keep the kernel copies of tunnels between sockets
+func (c *handshakeConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+func (c *handshakeConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, c.Conn)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *handshakeConn) CloseWrite() error {
+	tunnel.CloseWrite(c.Conn)
+	return nil
+}
+
+// handshakeDone ends the handshake of the connection beneath conn, as the
+// server's ConnState hook once a request's headers are read
+func handshakeDone(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *handshakeConn:
+			c.done()
+			return
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyProtoConn:
+			conn = c.Conn
+		default:
+			return
+		}
+	}
+}
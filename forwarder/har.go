@@ -0,0 +1,338 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// harRecorder keeps the most recent forwarded exchanges in HTTP Archive form
+type harRecorder struct {
+	config config.HARConfig
+
+	mu      sync.Mutex
+	entries []*harEntry
+}
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harNVP    `json:"cookies"`
+	Headers     []harNVP    `json:"headers"`
+	QueryString []harNVP    `json:"queryString"`
+	PostData    *harContent `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNVP   `json:"cookies"`
+	Headers     []harNVP   `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+	Error       string     `json:"_error,omitempty"`
+}
+
+type harContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+}
+
+type harNVP struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// newHARRecorder creates a recorder keeping up to cfg.MaxEntries exchanges
+func newHARRecorder(cfg config.HARConfig) *harRecorder {
+	return &harRecorder{config: cfg}
+}
+
+// record forwards req with next and records the exchange once the response
+// body has been consumed
+func (h *harRecorder) record(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	started := time.Now()
+
+	var reqBody *captureBody
+	if h.config.MaxBodySize > 0 && req.Body != nil && req.Body != http.NoBody {
+		reqBody = &captureBody{ReadCloser: req.Body, max: h.config.MaxBodySize}
+		req = req.WithContext(req.Context())
+		req.Body = reqBody
+	}
+
+	resp, err := next(req)
+	wait := time.Since(started)
+
+	entry := &harEntry{
+		StartedDateTime: started.Format(time.RFC3339Nano),
+		Request:         harRequestFrom(req, reqBody),
+		Timings:         harTimings{Wait: milliseconds(wait), Receive: -1},
+	}
+	if err != nil {
+		entry.Time = milliseconds(wait)
+		entry.Response = harResponse{Cookies: []harNVP{}, Headers: []harNVP{}, HeadersSize: -1, BodySize: -1, Error: err.Error()}
+		h.add(entry)
+		return nil, err
+	}
+
+	entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []harNVP{},
+		Headers:     harHeaders(resp.Header),
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+
+	encoding := contentEncoding(resp.Header)
+	body := &captureBody{ReadCloser: resp.Body, max: h.config.MaxBodySize}
+	body.onClose = func() {
+		receive := time.Since(started) - wait
+		entry.Time = milliseconds(wait + receive)
+		entry.Timings.Receive = milliseconds(receive)
+		entry.Response.BodySize = body.size
+		entry.Response.Content.Size = body.size
+		captured := body.buf.Bytes()
+		if decoded, complete, ok := h.decode(encoding, captured); ok {
+			captured = decoded
+			// The decoded size is only known when all of the body was captured
+			if complete && body.size == int64(body.buf.Len()) {
+				entry.Response.Content.Size = int64(len(decoded))
+				entry.Response.Content.Compression = entry.Response.Content.Size - body.size
+			}
+		}
+		entry.Response.Content.Text, entry.Response.Content.Encoding = harText(captured)
+		h.add(entry)
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// decode returns a captured gzip or brotli body decoded, up to MaxBodySize
+// bytes, and whether that is all of it. A body captured in part decodes to
+// its beginning.
+func (h *harRecorder) decode(encoding string, body []byte) ([]byte, bool, bool) {
+	if encoding == "" || len(body) == 0 || !decodable(encoding) {
+		return nil, false, false
+	}
+	r, err := decodeBody(encoding, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, false
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, h.config.MaxBodySize+1))
+	if len(decoded) == 0 {
+		return nil, false, false
+	}
+	if int64(len(decoded)) > h.config.MaxBodySize {
+		return decoded[:h.config.MaxBodySize], false, true
+	}
+	return decoded, err == nil, true
+}
+
+// add appends entry, dropping the oldest once the limit is reached
+func (h *harRecorder) add(entry *harEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) >= h.config.MaxEntries {
+		h.entries = append(h.entries[:0:0], h.entries[len(h.entries)-h.config.MaxEntries+1:]...)
+	}
+	h.entries = append(h.entries, entry)
+}
+
+// write encodes the recorded entries as a HAR document
+func (h *harRecorder) write(w io.Writer) error {
+	h.mu.Lock()
+	doc := harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "GateLAN", Version: GetVersion().Version},
+		Entries: append([]*harEntry{}, h.entries...),
+	}
+	h.mu.Unlock()
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]harLog{"log": doc})
+}
+
+// writeFile saves the archive to the configured file, if any
+func (h *harRecorder) writeFile() error {
+	if h == nil || h.config.File == "" {
+		return nil
+	}
+	file, err := os.Create(h.config.File)
+	if err != nil {
+		return fmt.Errorf("failed to create HAR file: %w", err)
+	}
+	if err := h.write(file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write HAR file: %w", err)
+	}
+	return file.Close()
+}
+
+// WriteHAR writes the recorded exchanges as an HTTP Archive
+func (f *Forwarder) WriteHAR(w io.Writer) error {
+	if f.har == nil {
+		return errors.New("HAR recording is not enabled")
+	}
+	return f.har.write(w)
+}
+
+// ReadHAR parses an HTTP Archive and returns its requests in recorded order.
+// Request bodies are restored from postData and can be re-read with GetBody.
+func ReadHAR(r io.Reader) ([]*http.Request, error) {
+	var doc struct {
+		Log harLog `json:"log"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse HAR: %w", err)
+	}
+
+	requests := make([]*http.Request, 0, len(doc.Log.Entries))
+	for i, entry := range doc.Log.Entries {
+		var body io.Reader
+		if entry.Request.PostData != nil && entry.Request.PostData.Text != "" {
+			body = strings.NewReader(entry.Request.PostData.Text)
+		}
+		req, err := http.NewRequest(entry.Request.Method, entry.Request.URL, body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HAR entry %d: %w", i, err)
+		}
+		for _, h := range entry.Request.Headers {
+			// The body may have been truncated when recorded
+			if !strings.EqualFold(h.Name, "Content-Length") {
+				req.Header.Add(h.Name, h.Value)
+			}
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+// captureBody counts the bytes read through it and keeps the first max of them
+type captureBody struct {
+	io.ReadCloser
+	max     int64
+	size    int64
+	buf     bytes.Buffer
+	onClose func()
+	once    sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if room := b.max - int64(b.buf.Len()); room > 0 {
+		b.buf.Write(p[:min(int64(n), room)])
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.onClose != nil {
+		b.once.Do(b.onClose)
+	}
+	return err
+}
+
+// harRequestFrom describes req, including the captured body if any
+func harRequestFrom(req *http.Request, body *captureBody) harRequest {
+	r := harRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     []harNVP{},
+		Headers:     harHeaders(req.Header),
+		QueryString: []harNVP{},
+		HeadersSize: -1,
+		BodySize:    req.ContentLength,
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			r.QueryString = append(r.QueryString, harNVP{Name: name, Value: value})
+		}
+	}
+	if body != nil {
+		r.BodySize = body.size
+		text, _ := harText(body.buf.Bytes())
+		r.PostData = &harContent{Size: body.size, MimeType: req.Header.Get("Content-Type"), Text: text}
+	}
+	return r
+}
+
+// harHeaders flattens header into name/value pairs
+func harHeaders(header http.Header) []harNVP {
+	pairs := []harNVP{}
+	for name, values := range header {
+		for _, value := range values {
+			pairs = append(pairs, harNVP{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+// harText returns body as text, base64 encoding binary content
+func harText(body []byte) (string, string) {
+	if len(body) == 0 {
+		return "", ""
+	}
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// milliseconds converts d to the fractional milliseconds HAR uses
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,129 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// applyHeaderOverrides applies the configured header overrides to proxyReq
+func (f *Forwarder) applyHeaderOverrides(proxyReq *http.Request) {
+	cfg := f.config.Headers
+
+	for _, name := range cfg.Remove {
+		proxyReq.Header.Del(name)
+	}
+	for name, value := range cfg.Set {
+		proxyReq.Header.Set(name, value)
+	}
+	if cfg.UserAgent != "" {
+		proxyReq.Header.Set("User-Agent", cfg.UserAgent)
+	} else if _, ok := proxyReq.Header["User-Agent"]; !ok {
+		// An empty value stops net/http from adding its own User-Agent
+		proxyReq.Header["User-Agent"] = []string{""}
+	}
+}
+
+// applyForwardedHeaders rewrites the client identification headers on proxyReq
+func (f *Forwarder) applyForwardedHeaders(req *http.Request, proxyReq *http.Request) {
+	cfg := f.config.ForwardedHeaders
+
+	switch cfg.ForwardedFor {
+	case config.ForwardedForStrip:
+		proxyReq.Header.Del("X-Forwarded-For")
+		proxyReq.Header.Del("X-Real-IP")
+		proxyReq.Header.Del("Forwarded")
+	case config.ForwardedForAppend:
+		if clientIP := remoteIP(req); clientIP != "" {
+			if prior := proxyReq.Header.Get("X-Forwarded-For"); prior != "" {
+				proxyReq.Header.Set("X-Forwarded-For", prior+", "+clientIP)
+			} else {
+				proxyReq.Header.Set("X-Forwarded-For", clientIP)
+			}
+			if cfg.RealIP && proxyReq.Header.Get("X-Real-IP") == "" {
+				proxyReq.Header.Set("X-Real-IP", clientIP)
+			}
+		}
+	}
+
+	if cfg.Via {
+		proxyReq.Header.Add("Via", f.viaValue(req))
+	}
+}
+
+// viaValue formats this hop's Via entry (RFC 7230 section 5.7.1)
+func (f *Forwarder) viaValue(req *http.Request) string {
+	major, minor := req.ProtoMajor, req.ProtoMinor
+	if major == 0 {
+		major, minor = 1, 1
+	}
+	return fmt.Sprintf("%d.%d %s", major, minor, f.config.ForwardedHeaders.ViaPseudonym)
+}
+
+// remoteIP extracts the client IP from req.RemoteAddr without any zone, with
+// IPv4-mapped IPv6 addresses of dual-stack listeners in dotted form. It is
+// empty for clients without an IP address, such as Unix socket peers.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	host, _, _ = strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// stripPort strips the port and any IPv6 brackets from a host[:port]
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+}
+
+// canonicalHostPort puts the host of a host[:port] in canonical form (see
+// acl.CanonicalHost), leaving IP literals alone
+func canonicalHostPort(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+	if host == "" || net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")) != nil {
+		return hostport
+	}
+	if port == "" {
+		return acl.CanonicalHost(host)
+	}
+	return net.JoinHostPort(acl.CanonicalHost(host), port)
+}
+
+// canonicalizeHost returns req with its destination in canonical form, so
+// that every rule sees, and every log line shows, one spelling of it
+func canonicalizeHost(req *http.Request) *http.Request {
+	host, urlHost := canonicalHostPort(req.Host), canonicalHostPort(req.URL.Host)
+	if host == req.Host && urlHost == req.URL.Host {
+		return req
+	}
+	req = req.WithContext(req.Context())
+	u := *req.URL
+	u.Host = urlHost
+	req.URL = &u
+	req.Host = host
+	return req
+}
+
+// unicodeNote returns, for the log lines about an internationalized host,
+// its Unicode form in parentheses
+func unicodeNote(host string) string {
+	if unicode := acl.UnicodeHost(host); unicode != host {
+		return " (" + unicode + ")"
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package forwarder
+
+import (
+	"math"
+	"net/http"
+)
+
+// Readiness reports whether the forwarder can serve proxy requests
+type Readiness struct {
+	Ready            bool     `json:"ready"`
+	Listeners        int      `json:"listeners"`         // Listeners bound and accepting connections
+	Upstreams        int      `json:"upstreams"`         // Members of the upstream pool
+	HealthyUpstreams int      `json:"healthy_upstreams"` // Pool members whose circuit breaker is not open
+	Draining         bool     `json:"draining,omitempty"`
+	DrainSeconds     int      `json:"drain_seconds,omitempty"`    // Left until the connections still open are closed
+	OpenConnections  int      `json:"open_connections,omitempty"` // Requests and tunnels still running while draining
+	Problems         []string `json:"problems,omitempty"`
+}
+
+// GetReadiness reports ready once Start has bound the listeners, until
+// Shutdown, while at least one pool upstream is healthy or requests can fall
+// back to direct connections, and not while draining for maintenance
+func (f *Forwarder) GetReadiness() Readiness {
+	upstreams := f.current().upstreams
+	readiness := Readiness{Upstreams: len(upstreams)}
+	if f.serving.Load() {
+		readiness.Listeners = len(f.config.Listeners)
+	} else {
+		readiness.Problems = append(readiness.Problems, "listeners are not serving")
+	}
+	for _, up := range upstreams {
+		if up.breaker.currentState() != breakerOpen {
+			readiness.HealthyUpstreams++
+		}
+	}
+	if readiness.HealthyUpstreams == 0 && !f.config.CircuitBreaker.FallbackDirect {
+		readiness.Problems = append(readiness.Problems, "no healthy upstream")
+	}
+	if remaining, ok := f.draining(); ok {
+		readiness.Draining = true
+		readiness.DrainSeconds = int(math.Ceil(remaining.Seconds()))
+		readiness.OpenConnections = f.connections.count()
+		readiness.Problems = append(readiness.Problems, "draining for maintenance")
+	}
+	readiness.Ready = len(readiness.Problems) == 0
+	return readiness
+}
+
+// handleHealthz answers liveness probes whenever the process can respond
+func (f *Forwarder) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// handleReadyz answers readiness probes, with 503 while not ready
+func (f *Forwarder) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := f.GetReadiness()
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONStatus(w, status, readiness)
+}
@@ -0,0 +1,102 @@
+package forwarder
+
+import (
+	"net/http"
+	"time"
+)
+
+// RequestHook runs before a proxy request is forwarded. It may modify req;
+// returning a non-nil response answers the client without contacting the
+// upstream, and returning an error fails the request.
+type RequestHook func(req *http.Request) (*http.Response, error)
+
+// ResponseHook runs before a response is returned to the client. It may modify
+// resp or return a replacement.
+type ResponseHook func(req *http.Request, resp *http.Response) (*http.Response, error)
+
+// ConnectHook runs before a CONNECT tunnel is opened; an error rejects it
+type ConnectHook func(req *http.Request) error
+
+// TunnelCloseHook runs after a CONNECT tunnel has been torn down
+type TunnelCloseHook func(info TunnelInfo)
+
+// TunnelInfo describes a finished CONNECT tunnel
+type TunnelInfo struct {
+	Target     string
+	ClientAddr string
+	Upstream   string
+	Started    time.Time
+	Duration   time.Duration
+	Err        error // First relay error, nil on a clean close
+}
+
+// hooks holds the registered plugin callbacks, run in registration order
+type hooks struct {
+	request     []RequestHook
+	response    []ResponseHook
+	connect     []ConnectHook
+	tunnelClose []TunnelCloseHook
+}
+
+// OnRequest registers a hook run for every forwarded request. Hooks must be
+// registered before the forwarder starts serving.
+func (f *Forwarder) OnRequest(hook RequestHook) {
+	f.hooks.request = append(f.hooks.request, hook)
+}
+
+// OnResponse registers a hook run for every response, including cached ones
+func (f *Forwarder) OnResponse(hook ResponseHook) {
+	f.hooks.response = append(f.hooks.response, hook)
+}
+
+// OnConnect registers a hook run before each CONNECT tunnel is established
+func (f *Forwarder) OnConnect(hook ConnectHook) {
+	f.hooks.connect = append(f.hooks.connect, hook)
+}
+
+// OnTunnelClose registers a hook run when a CONNECT tunnel closes
+func (f *Forwarder) OnTunnelClose(hook TunnelCloseHook) {
+	f.hooks.tunnelClose = append(f.hooks.tunnelClose, hook)
+}
+
+// runRequestHooks stops at the first hook that answers or fails the request
+func (h *hooks) runRequestHooks(req *http.Request) (*http.Response, error) {
+	for _, hook := range h.request {
+		if resp, err := hook(req); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+	return nil, nil
+}
+
+// runResponseHooks threads resp through every response hook
+func (h *hooks) runResponseHooks(req *http.Request, resp *http.Response) (*http.Response, error) {
+	for _, hook := range h.response {
+		next, err := hook(req, resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if next != nil {
+			resp = next
+		}
+	}
+	return resp, nil
+}
+
+// runConnectHooks returns the first rejection
+func (h *hooks) runConnectHooks(req *http.Request) error {
+	for _, hook := range h.connect {
+		if err := hook(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTunnelCloseHooks notifies every hook of a finished tunnel
+func (h *hooks) runTunnelCloseHooks(info TunnelInfo) {
+	for _, hook := range h.tunnelClose {
+		hook(info)
+	}
+}
@@ -0,0 +1,342 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+const defaultICAPPort = "1344"
+
+// icapClient sends requests and responses to an ICAP (RFC 3507) scanner
+type icapClient struct {
+	config  config.ICAPConfig
+	reqMod  *url.URL
+	respMod *url.URL
+}
+
+func newICAPClient(cfg config.ICAPConfig) *icapClient {
+	c := &icapClient{config: cfg}
+	if cfg.ReqMod != "" {
+		c.reqMod, _ = url.Parse(cfg.ReqMod)
+	}
+	if cfg.RespMod != "" {
+		c.respMod, _ = url.Parse(cfg.RespMod)
+	}
+	return c
+}
+
+// icapReply holds the encapsulated parts of a 200 ICAP response
+type icapReply struct {
+	reqHdr  []byte
+	resHdr  []byte
+	body    []byte
+	hasBody bool
+}
+
+// scanRequest runs proxyReq through REQMOD. It returns a response to send
+// instead of forwarding when the scanner answers with one, and otherwise
+// applies any modifications to proxyReq.
+func (f *Forwarder) scanRequest(proxyReq *http.Request) (*http.Response, error) {
+	if f.icap == nil || f.icap.reqMod == nil {
+		return nil, nil
+	}
+	c := f.icap
+
+	hasBody := proxyReq.Body != nil && proxyReq.Body != http.NoBody
+	body, ok, err := bufferBody(&proxyReq.Body, c.config.MaxBodySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if !ok {
+		f.logf(proxyReq, "Request body for %s exceeds the ICAP limit, forwarding unscanned", proxyReq.URL.String())
+		return nil, nil
+	}
+	proxyReq.Header.Del("Expect") // The whole body has been received already
+
+	var reqHdr bytes.Buffer
+	fmt.Fprintf(&reqHdr, "%s %s HTTP/1.1\r\nHost: %s\r\n", proxyReq.Method, proxyReq.URL.String(), proxyReq.URL.Host)
+	// Leave out the empty User-Agent that only suppresses the net/http default
+	proxyReq.Header.WriteSubset(&reqHdr, map[string]bool{"User-Agent": proxyReq.Header.Get("User-Agent") == ""})
+	reqHdr.WriteString("\r\n")
+
+	reply, err := c.exchange(proxyReq.Context(), "REQMOD", c.reqMod, reqHdr.Bytes(), nil, body, hasBody)
+	if err != nil {
+		if c.config.FailOpen {
+			f.logf(proxyReq, "ICAP scan of %s failed, forwarding unscanned: %v", proxyReq.URL.String(), err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ICAP request scan failed: %w", err)
+	}
+	if reply == nil {
+		return nil, nil
+	}
+
+	if reply.resHdr != nil {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reply.resHdr)), proxyReq)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ICAP response: %w", err)
+		}
+		setBody(resp, reply.body)
+		f.logf(proxyReq, "ICAP scanner answered %s %s with %d", proxyReq.Method, proxyReq.URL.String(), resp.StatusCode)
+		f.logBlocked(proxyReq, proxyReq.URL.Host, fmt.Sprintf("request answered by ICAP scanner with %d", resp.StatusCode))
+		return resp, nil
+	}
+	if reply.reqHdr != nil {
+		modified, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reply.reqHdr)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ICAP request: %w", err)
+		}
+		if modified.URL.IsAbs() {
+			proxyReq.URL = modified.URL
+		}
+		proxyReq.Method = modified.Method
+		proxyReq.Header = modified.Header
+		if _, ok := proxyReq.Header["User-Agent"]; !ok {
+			proxyReq.Header["User-Agent"] = []string{""}
+		}
+		proxyReq.Body = io.NopCloser(bytes.NewReader(reply.body))
+		proxyReq.ContentLength = int64(len(reply.body))
+		proxyReq.TransferEncoding = nil
+		if !reply.hasBody {
+			proxyReq.Body, proxyReq.ContentLength = http.NoBody, 0
+		}
+	}
+	return nil, nil
+}
+
+// scanResponse runs resp through RESPMOD and returns it, or the scanner's
+// replacement
+func (f *Forwarder) scanResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if f.icap == nil || f.icap.respMod == nil || isEventStream(resp) {
+		return resp, nil
+	}
+	c := f.icap
+
+	body, ok, err := bufferBody(&resp.Body, c.config.MaxBodySize)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if !ok {
+		f.logf(req, "Response body for %s exceeds the ICAP limit, returning unscanned", req.URL.String())
+		return resp, nil
+	}
+
+	var reqHdr, resHdr bytes.Buffer
+	fmt.Fprintf(&reqHdr, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.String(), req.URL.Host)
+	req.Header.Write(&reqHdr)
+	reqHdr.WriteString("\r\n")
+	fmt.Fprintf(&resHdr, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(&resHdr)
+	resHdr.WriteString("\r\n")
+
+	reply, err := c.exchange(req.Context(), "RESPMOD", c.respMod, reqHdr.Bytes(), resHdr.Bytes(), body, req.Method != http.MethodHead)
+	if err != nil {
+		if c.config.FailOpen {
+			f.logf(req, "ICAP scan of %s failed, returning unscanned: %v", req.URL.String(), err)
+			return resp, nil
+		}
+		return nil, fmt.Errorf("ICAP response scan failed: %w", err)
+	}
+	if reply == nil || reply.resHdr == nil {
+		return resp, nil
+	}
+
+	modified, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reply.resHdr)), req)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ICAP response: %w", err)
+	}
+	setBody(modified, reply.body)
+	if modified.StatusCode != resp.StatusCode {
+		f.logf(req, "ICAP scanner replaced response for %s with %d", req.URL.String(), modified.StatusCode)
+		f.logBlocked(req, req.URL.Host, fmt.Sprintf("response replaced by ICAP scanner with %d", modified.StatusCode))
+	}
+	return modified, nil
+}
+
+// exchange sends one ICAP request and reads the reply, which is nil for
+// "204 No Content" (unmodified)
+func (c *icapClient) exchange(ctx context.Context, method string, service *url.URL, reqHdr, resHdr, body []byte, hasBody bool) (*icapReply, error) {
+	addr := service.Host
+	if service.Port() == "" {
+		addr = net.JoinHostPort(service.Hostname(), defaultICAPPort)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.config.Timeout))
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ICAP server: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	// Encapsulated offsets count from the start of the first HTTP header
+	encapsulated := "req-hdr=0"
+	offset := len(reqHdr)
+	if resHdr != nil {
+		encapsulated += fmt.Sprintf(", res-hdr=%d", offset)
+		offset += len(resHdr)
+	}
+	bodyName := "req-body"
+	if resHdr != nil {
+		bodyName = "res-body"
+	}
+	if !hasBody {
+		bodyName = "null-body"
+	}
+	encapsulated += fmt.Sprintf(", %s=%d", bodyName, offset)
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s ICAP/1.0\r\n", method, service.String())
+	fmt.Fprintf(w, "Host: %s\r\n", service.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Connection: close\r\n")
+	fmt.Fprintf(w, "Encapsulated: %s\r\n\r\n", encapsulated)
+	w.Write(reqHdr)
+	w.Write(resHdr)
+	if hasBody {
+		if len(body) > 0 {
+			fmt.Fprintf(w, "%x\r\n", len(body))
+			w.Write(body)
+			w.WriteString("\r\n")
+		}
+		w.WriteString("0\r\n\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to send ICAP request: %w", err)
+	}
+
+	return readICAPReply(bufio.NewReader(conn))
+}
+
+// readICAPReply parses an ICAP response and its encapsulated sections
+func readICAPReply(br *bufio.Reader) (*icapReply, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ICAP response: %w", err)
+	}
+	proto, status, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(status, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return nil, fmt.Errorf("malformed ICAP status line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ICAP headers: %w", err)
+	}
+
+	switch code {
+	case "204":
+		return nil, nil
+	case "200":
+	default:
+		return nil, fmt.Errorf("ICAP server returned %s", status)
+	}
+
+	sections, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil {
+		return nil, err
+	}
+	reply := &icapReply{}
+	for i, section := range sections {
+		if strings.HasSuffix(section.name, "-body") {
+			if section.name == "null-body" {
+				break
+			}
+			reply.hasBody = true
+			if reply.body, err = io.ReadAll(httputil.NewChunkedReader(br)); err != nil {
+				return nil, fmt.Errorf("failed to read ICAP body: %w", err)
+			}
+			break
+		}
+		if i+1 == len(sections) {
+			return nil, errors.New("ICAP Encapsulated header has no body entry")
+		}
+		data := make([]byte, sections[i+1].offset-section.offset)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("failed to read ICAP %s: %w", section.name, err)
+		}
+		switch section.name {
+		case "req-hdr":
+			reply.reqHdr = data
+		case "res-hdr":
+			reply.resHdr = data
+		}
+	}
+	return reply, nil
+}
+
+// icapSection is one entry of an Encapsulated header
+type icapSection struct {
+	name   string
+	offset int
+}
+
+// parseEncapsulated parses "req-hdr=0, res-hdr=123, res-body=456"
+func parseEncapsulated(value string) ([]icapSection, error) {
+	var sections []icapSection
+	last := -1
+	for _, entry := range strings.Split(value, ",") {
+		name, offset, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		n, err := strconv.Atoi(offset)
+		if !ok || err != nil || n < last {
+			return nil, fmt.Errorf("malformed ICAP Encapsulated header %q", value)
+		}
+		sections = append(sections, icapSection{name: name, offset: n})
+		last = n
+	}
+	return sections, nil
+}
+
+// bufferBody reads *body into memory when it fits in limit, replacing *body
+// with an equivalent reader either way. ok is false for oversized bodies.
+func bufferBody(body *io.ReadCloser, limit int64) (data []byte, ok bool, err error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, true, nil
+	}
+	original := *body
+	data, err = io.ReadAll(io.LimitReader(original, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) > limit {
+		*body = readCloser{io.MultiReader(bytes.NewReader(data), original), original}
+		return nil, false, nil
+	}
+	original.Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, true, nil
+}
+
+// readCloser pairs a reader with the closer of the body it continues
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// setBody replaces the body of a response parsed from ICAP headers
+func setBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
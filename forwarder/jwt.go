@@ -0,0 +1,376 @@
+package forwarder
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// errInvalidToken is returned for malformed, expired or badly signed tokens
+var errInvalidToken = errors.New("invalid bearer token")
+
+// jwksRetryInterval limits key set refetches triggered by unknown key IDs
+const jwksRetryInterval = time.Minute
+
+// jwtVerifier validates bearer tokens signed with a shared secret or with a
+// key from a JWKS endpoint
+type jwtVerifier struct {
+	config config.JWTConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching chan struct{} // Closed when the fetch in progress completes
+	fetchErr error         // Outcome of the last completed fetch
+}
+
+func newJWTVerifier(cfg config.JWTConfig) *jwtVerifier {
+	return &jwtVerifier{
+		config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]crypto.PublicKey),
+	}
+}
+
+// jwtHeader is the subset of the JOSE header used for verification
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks token and returns its user and groups claims
+func (v *jwtVerifier) verify(ctx context.Context, token string) (string, []string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, errInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, errInvalidToken
+	}
+	if err := v.checkSignature(ctx, header, parts[0]+"."+parts[1], signature); err != nil {
+		return "", nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", nil, errInvalidToken
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return "", nil, err
+	}
+
+	user, _ := claims[v.config.UserClaim].(string)
+	if user == "" {
+		return "", nil, fmt.Errorf("%w: missing %s claim", errInvalidToken, v.config.UserClaim)
+	}
+	return user, stringList(claims[v.config.GroupsClaim]), nil
+}
+
+// checkSignature verifies signature over signed with the key header selects
+func (v *jwtVerifier) checkSignature(ctx context.Context, header jwtHeader, signed string, signature []byte) error {
+	var hashFunc crypto.Hash
+	switch header.Alg[min(2, len(header.Alg)):] {
+	case "256":
+		hashFunc = crypto.SHA256
+	case "384":
+		hashFunc = crypto.SHA384
+	case "512":
+		hashFunc = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, header.Alg)
+	}
+
+	if strings.HasPrefix(header.Alg, "HS") {
+		if v.config.Secret == "" {
+			return fmt.Errorf("%w: no secret for %s", errInvalidToken, header.Alg)
+		}
+		mac := hmac.New(newHash(hashFunc), []byte(v.config.Secret))
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errInvalidToken
+		}
+		return nil
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	h := newHash(hashFunc)()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(header.Alg, "RS"):
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, hashFunc, digest, signature) != nil {
+			return errInvalidToken
+		}
+	case strings.HasPrefix(header.Alg, "PS"):
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(rsaKey, hashFunc, digest, signature, nil) != nil {
+			return errInvalidToken
+		}
+	case strings.HasPrefix(header.Alg, "ES"):
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature)%2 != 0 {
+			return errInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errInvalidToken
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, header.Alg)
+	}
+	return nil
+}
+
+// checkClaims enforces expiry, not-before, issuer and audience
+func (v *jwtVerifier) checkClaims(claims map[string]any, now time.Time) error {
+	const leeway = 30 * time.Second
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", errInvalidToken)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return fmt.Errorf("%w: token expired", errInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token not yet valid", errInvalidToken)
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return fmt.Errorf("%w: unexpected issuer", errInvalidToken)
+	}
+	if v.config.Audience != "" {
+		found := false
+		for _, aud := range stringList(claims["aud"]) {
+			if aud == v.config.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: unexpected audience", errInvalidToken)
+		}
+	}
+	return nil
+}
+
+// key returns the JWKS key for kid, refreshing the key set when it is stale
+// or doesn't contain kid. The fetch runs without v.mu held and is shared by
+// every request waiting on it; known keys are used without waiting, and
+// misses trigger at most one fetch per jwksRetryInterval.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if v.config.JWKSURL == "" {
+		return nil, fmt.Errorf("%w: no jwks_url for asymmetric tokens", errInvalidToken)
+	}
+
+	v.mu.Lock()
+	age := time.Since(v.fetched)
+	key, ok := v.lookup(kid)
+	done := v.fetching
+	if done == nil && (age > time.Duration(v.config.JWKSRefresh) || (!ok && age > jwksRetryInterval)) {
+		done = make(chan struct{})
+		v.fetching, v.fetched = done, time.Now()
+		go v.refresh(context.WithoutCancel(ctx), done)
+	}
+	v.mu.Unlock()
+	if ok {
+		// Keep using the cached key while the set is fetched again
+		return key, nil
+	}
+	if done == nil {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	v.mu.Lock()
+	key, ok = v.lookup(kid)
+	err := v.fetchErr
+	v.mu.Unlock()
+	if !ok {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+	return key, nil
+}
+
+// lookup finds kid in the cached keys; tokens without a kid match a set with
+// a single key. v.mu must be held.
+func (v *jwtVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// jwk is a single JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// refresh downloads the key set, replacing the cached one on success, and
+// closes done
+func (v *jwtVerifier) refresh(ctx context.Context, done chan struct{}) {
+	keys, err := v.fetch(ctx)
+	v.mu.Lock()
+	if err == nil {
+		v.keys = keys
+	}
+	v.fetchErr, v.fetching = err, nil
+	v.mu.Unlock()
+	close(done)
+}
+
+// fetch downloads and parses the key set
+func (v *jwtVerifier) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.config.JWKSURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWKS request: %w", err)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey converts an RSA or EC JWK to a public key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeSegment decodes a base64url JSON token segment into v
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// newHash returns the constructor for h
+func newHash(h crypto.Hash) func() hash.Hash {
+	switch h {
+	case crypto.SHA384:
+		return sha512.New384
+	case crypto.SHA512:
+		return sha512.New
+	}
+	return sha256.New
+}
+
+// stringList converts a claim holding a string or an array of strings
+func stringList(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyWeight is the weight of the newest sample in the moving averages
+const latencyWeight = 0.2
+
+// latencyBuckets are the histogram bounds, in seconds, of upstream latencies
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// UpstreamStatus describes the recent behaviour of one upstream
+type UpstreamStatus struct {
+	Addr        string    `json:"addr"`
+	Breaker     string    `json:"breaker"`
+	Requests    uint64    `json:"requests"`
+	Failures    uint64    `json:"failures"`
+	ConnectMS   float64   `json:"connect_ms"` // Moving average of new connections
+	TTFBMS      float64   `json:"ttfb_ms"`    // Moving average of time to first byte
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// latencyTracker keeps moving averages and outcomes of one upstream's
+// exchanges, mirroring samples into the metrics histograms
+type latencyTracker struct {
+	addr    string
+	metrics *metrics
+
+	mu          sync.Mutex
+	connect     time.Duration
+	ttfb        time.Duration
+	requests    uint64
+	failures    uint64
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+// newLatencyTracker creates the tracker for the upstream at addr
+func (f *Forwarder) newLatencyTracker(addr string) *latencyTracker {
+	return &latencyTracker{addr: addr, metrics: f.metrics}
+}
+
+// observeConnect records the time to establish a connection to the upstream
+func (t *latencyTracker) observeConnect(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.metrics.observe("gatelan_upstream_connect_seconds", latencyBuckets, d.Seconds(), "upstream", t.addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connect = ewma(t.connect, d)
+}
+
+// observeTTFB records the time from sending a request to its first response byte
+func (t *latencyTracker) observeTTFB(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.metrics.observe("gatelan_upstream_ttfb_seconds", latencyBuckets, d.Seconds(), "upstream", t.addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ttfb = ewma(t.ttfb, d)
+}
+
+// success records a completed exchange
+func (t *latencyTracker) success() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	t.lastSuccess = time.Now()
+}
+
+// failure records a failed exchange and its error
+func (t *latencyTracker) failure(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	t.failures++
+	t.lastFailure = time.Now()
+	t.lastError = err.Error()
+}
+
+// averages returns the moving averages of connect time and time to first byte
+func (t *latencyTracker) averages() (connect, ttfb time.Duration) {
+	if t == nil {
+		return 0, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.connect, t.ttfb
+}
+
+// ewma folds sample into the moving average avg, seeding it when empty
+func ewma(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return time.Duration(latencyWeight*float64(sample) + (1-latencyWeight)*float64(avg))
+}
+
+// status reports the upstream for GetStatus
+func (u *upstream) status() UpstreamStatus {
+	status := UpstreamStatus{Addr: u.name, Breaker: u.breaker.currentState()}
+	if t := u.latency; t != nil {
+		t.mu.Lock()
+		status.Requests, status.Failures = t.requests, t.failures
+		status.ConnectMS = float64(t.connect) / float64(time.Millisecond)
+		status.TTFBMS = float64(t.ttfb) / float64(time.Millisecond)
+		status.LastSuccess, status.LastFailure, status.LastError = t.lastSuccess, t.lastFailure, t.lastError
+		t.mu.Unlock()
+	}
+	return status
+}
@@ -0,0 +1,192 @@
+package forwarder
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// errInvalidCredentials is returned for unknown users or wrong passwords
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// ldapAuthenticator checks credentials with a search-then-bind against an
+// LDAP or AD server, reusing pooled connections and caching successful logins
+type ldapAuthenticator struct {
+	config config.LDAPConfig
+	pool   chan *ldap.Conn
+
+	mu    sync.Mutex
+	cache map[string]ldapLogin
+}
+
+// ldapLogin is a cached successful login
+type ldapLogin struct {
+	digest  [32]byte
+	groups  []string
+	expires time.Time
+}
+
+func newLDAPAuthenticator(cfg config.LDAPConfig) *ldapAuthenticator {
+	return &ldapAuthenticator{
+		config: cfg,
+		pool:   make(chan *ldap.Conn, cfg.PoolSize),
+		cache:  make(map[string]ldapLogin),
+	}
+}
+
+// authenticate verifies user and password and returns the user's groups
+func (a *ldapAuthenticator) authenticate(user, password string) ([]string, error) {
+	if user == "" || password == "" {
+		return nil, errInvalidCredentials
+	}
+
+	digest := sha256.Sum256([]byte(user + "\x00" + password))
+	a.mu.Lock()
+	login, ok := a.cache[user]
+	a.mu.Unlock()
+	if ok && login.digest == digest && time.Now().Before(login.expires) {
+		return login.groups, nil
+	}
+
+	conn, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := a.login(conn, user, password)
+	if err != nil && !errors.Is(err, errInvalidCredentials) {
+		// The connection may be broken, don't pool it
+		conn.Close()
+		return nil, err
+	}
+	a.put(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.cache[user] = ldapLogin{digest: digest, groups: groups, expires: time.Now().Add(time.Duration(a.config.CacheTTL))}
+	a.mu.Unlock()
+	return groups, nil
+}
+
+// login looks the user up with the service account, then binds as the user.
+// conn is left bound as the service account.
+func (a *ldapAuthenticator) login(conn *ldap.Conn, user, password string) ([]string, error) {
+	if err := a.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	search := ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(user)),
+		[]string{a.config.GroupAttribute}, nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP search failed: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, errInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			a.bindService(conn)
+			return nil, errInvalidCredentials
+		}
+		return nil, fmt.Errorf("LDAP bind failed: %w", err)
+	}
+	if err := a.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, value := range entry.GetAttributeValues(a.config.GroupAttribute) {
+		groups = append(groups, groupName(value))
+	}
+	return groups, nil
+}
+
+// bindService binds conn as the service account, anonymously when none is set
+func (a *ldapAuthenticator) bindService(conn *ldap.Conn) error {
+	var err error
+	if a.config.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(a.config.BindDN, a.config.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("LDAP service bind failed: %w", err)
+	}
+	return nil
+}
+
+// get takes a pooled connection or dials a new one
+func (a *ldapAuthenticator) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-a.pool:
+			if !conn.IsClosing() {
+				return conn, nil
+			}
+		default:
+			return a.dial()
+		}
+	}
+}
+
+// put returns conn to the pool, closing it when the pool is full
+func (a *ldapAuthenticator) put(conn *ldap.Conn) {
+	select {
+	case a.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// dial connects to the server, upgrading with StartTLS when configured
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.config.InsecureSkipVerify}
+	// StartTLS hands the config to tls.Client as is, which needs the name to
+	// verify the server
+	if u, err := url.Parse(a.config.URL); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	conn.SetTimeout(10 * time.Second)
+	if a.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// groupName returns the CN of a group DN, or the value itself when it is
+// not a DN
+func groupName(value string) string {
+	dn, err := ldap.ParseDN(value)
+	if err != nil || len(dn.RDNs) == 0 {
+		return value
+	}
+	for _, attr := range dn.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+	return value
+}
@@ -0,0 +1,91 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+var (
+	// ErrRequestTooLarge is returned when a request body exceeds MaxRequestBody
+	ErrRequestTooLarge = errors.New("request body exceeds size limit")
+
+	// ErrResponseTooLarge is returned when a response body exceeds MaxResponseBody
+	ErrResponseTooLarge = errors.New("response body exceeds size limit")
+)
+
+// limitedBody fails with err once more than limit bytes have been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Probe for one more byte to tell an exact fit from an overflow
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			b.exceeded = true
+			return 0, b.err
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// limitRequest enforces MaxRequestBody, returning a 413 response when the
+// declared length is already too large
+func (f *Forwarder) limitRequest(req *http.Request, proxyReq *http.Request) (*limitedBody, *http.Response) {
+	max := f.config.Limits.MaxRequestBody
+	if max <= 0 || proxyReq.Body == nil || proxyReq.Body == http.NoBody {
+		return nil, nil
+	}
+
+	if req.ContentLength > max {
+		f.logf(req, "Rejected request to %s: %d byte body exceeds limit of %d", req.URL.String(), req.ContentLength, max)
+		return nil, f.errorResponse(req, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the %d byte limit", max), "")
+	}
+
+	body := &limitedBody{ReadCloser: proxyReq.Body, remaining: max, err: ErrRequestTooLarge}
+	proxyReq.Body = body
+	return body, nil
+}
+
+// limitResponse enforces MaxResponseBody according to the configured action
+func (f *Forwarder) limitResponse(req *http.Request, resp *http.Response) *http.Response {
+	max := f.config.Limits.MaxResponseBody
+	if max <= 0 {
+		return resp
+	}
+
+	if f.config.Limits.ResponseAction == config.LimitActionTruncate {
+		if resp.ContentLength > max {
+			f.logf(req, "Truncating response from %s to %d bytes", req.URL.String(), max)
+			resp.ContentLength = max
+			resp.Header.Del("Content-Length")
+		}
+		resp.Body = &multiReadCloser{Reader: io.LimitReader(resp.Body, max), Closer: resp.Body}
+		return resp
+	}
+
+	if resp.ContentLength > max {
+		resp.Body.Close()
+		f.logf(req, "Rejected response from %s: %d byte body exceeds limit of %d", req.URL.String(), resp.ContentLength, max)
+		return f.errorResponse(req, http.StatusBadGateway, fmt.Sprintf("Response body exceeds the %d byte limit", max), "")
+	}
+
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: max, err: ErrResponseTooLarge}
+	return resp
+}
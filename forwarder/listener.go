@@ -0,0 +1,778 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+const defaultAuthRealm = "GateLAN"
+
+// Listener auth backends besides the static users list
+const (
+	listenerAuthLDAP = "ldap"
+	listenerAuthJWT  = "jwt"
+)
+
+// proxyListener serves proxy requests accepted on one listener
+type proxyListener struct {
+	config    config.ListenerConfig
+	forwarder *Forwarder
+	acl       *acl.ACL
+	upstream  *upstream
+	profile   *profile // Applies instead of the active profile when set
+	listener  net.Listener
+	tls       *tls.Config  // Wraps accepted connections when the listener serves TLS
+	proxyFrom []*net.IPNet // Load balancers sending the PROXY protocol
+	server    *http.Server
+}
+
+// newProxyListener validates the listener config and binds its socket
+func (f *Forwarder) newProxyListener(ctx context.Context, cfg config.ListenerConfig, activated map[string][]net.Listener) (*proxyListener, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Addr
+		if cfg.Socket != "" {
+			cfg.Name = cfg.Socket
+		}
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = defaultAuthRealm
+	}
+
+	if cfg.Auth == listenerAuthLDAP && f.ldap == nil {
+		return nil, fmt.Errorf("listener %s: ldap auth requires ldap.url", cfg.Name)
+	}
+	if cfg.Auth == listenerAuthJWT && f.jwt == nil {
+		return nil, fmt.Errorf("listener %s: jwt auth requires jwt.secret or jwt.jwks_url", cfg.Name)
+	}
+	if cfg.Auth != "" && cfg.Auth != listenerAuthLDAP && cfg.Auth != listenerAuthJWT {
+		return nil, fmt.Errorf("listener %s: invalid auth %q", cfg.Name, cfg.Auth)
+	}
+
+	clientACL, err := acl.New(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+	}
+
+	l := &proxyListener{
+		config:    cfg,
+		forwarder: f,
+		acl:       clientACL,
+	}
+	if l.proxyFrom, err = acl.ParseNetworks(cfg.ProxyProtocol); err != nil {
+		return nil, fmt.Errorf("listener %s: invalid proxy_protocol: %w", cfg.Name, err)
+	}
+	if cfg.Upstream != "" {
+		l.upstream = f.upstreamFor(cfg.Upstream)
+	}
+	if cfg.TLS.Enabled() {
+		if l.tls, err = f.serverTLS(cfg.TLS, "http/1.1"); err != nil {
+			return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+		}
+	}
+	if cfg.Profile != "" {
+		if l.profile, err = f.newProfile(cfg.Profile); err != nil {
+			return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+		}
+		f.dedicatedMu.Lock()
+		f.bound = append(f.bound, l.profile)
+		f.dedicatedMu.Unlock()
+	}
+
+	key := "tcp/" + cfg.Addr
+	if cfg.Socket != "" {
+		key = "unix/" + cfg.Socket
+	}
+	l.listener, err = f.inheritedListener(key)
+	if err == nil && l.listener == nil {
+		if cfg.Socket != "" {
+			l.listener, err = bindUnixListener(cfg.Socket, cfg.Mode)
+		} else {
+			l.listener, err = bindListener(cfg.Addr, activated)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+	}
+	f.registerSocket(key, l.listener)
+
+	l.server = &http.Server{
+		Handler:           l,
+		ReadHeaderTimeout: f.config.Timeouts.ReadHeader.Timeout(),
+		ReadTimeout:       f.config.Timeouts.Read.Timeout(),
+		WriteTimeout:      f.config.Timeouts.Write.Timeout(),
+		IdleTimeout:       f.config.Timeouts.Idle.Timeout(),
+		MaxHeaderBytes:    f.config.Limits.MaxHeaderBytes,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateActive {
+				handshakeDone(conn)
+			}
+		},
+	}
+	return l, nil
+}
+
+// bindListener opens addr, taking sockets passed by systemd for "systemd"
+// (any socket) and "systemd:<name>" (FileDescriptorName=) addresses
+func bindListener(addr string, activated map[string][]net.Listener) (net.Listener, error) {
+	name, ok := strings.CutPrefix(addr, "systemd")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	name = strings.TrimPrefix(name, ":")
+	if name == "" {
+		names := make([]string, 0, len(activated))
+		for candidate := range activated {
+			names = append(names, candidate)
+		}
+		sort.Strings(names)
+		for _, candidate := range names {
+			if len(activated[candidate]) > 0 {
+				name = candidate
+				break
+			}
+		}
+	}
+
+	listeners := activated[name]
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no socket passed by systemd for %q", addr)
+	}
+	activated[name] = listeners[1:]
+	return listeners[0], nil
+}
+
+// bindUnixListener listens on a Unix domain socket at path, replacing a stale
+// socket file left by a previous run, and applies mode when set
+func bindUnixListener(path, mode string) (net.Listener, error) {
+	var perm os.FileMode
+	if mode != "" {
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket mode %q: %w", mode, err)
+		}
+		perm = os.FileMode(parsed)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		if err := os.Chmod(path, perm); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket mode: %w", err)
+		}
+	}
+	return listener, nil
+}
+
+// ServeHTTP applies the listener's access policy and dispatches the request
+func (l *proxyListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f := l.forwarder
+	r = withRequestID(r)
+
+	if remaining, ok := f.draining(); ok {
+		f.writeDraining(w, r, remaining)
+		return
+	}
+
+	if !l.acl.Allowed(net.ParseIP(remoteIP(r))) {
+		f.logf(r, "Denied %s %s for %s on listener %s", r.Method, r.Host, f.clientLabel(r), l.config.Name)
+		f.audit.log(severityNotice, auditACLDenied, r, r.Host, "client denied on listener "+l.config.Name)
+		f.writeError(w, r, http.StatusForbidden, "Access denied", "")
+		return
+	}
+
+	var user string
+	var groups []string
+	if len(l.config.Users) > 0 || l.config.Auth != "" {
+		var ok bool
+		if user, groups, ok = l.authenticate(r); !ok {
+			if r.Header.Get("Proxy-Authorization") != "" {
+				f.audit.log(severityWarning, auditAuthFailure, r, r.Host, "proxy authentication failed on listener "+l.config.Name)
+			}
+			if l.config.Auth != listenerAuthJWT {
+				w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", l.config.Realm))
+			}
+			if f.jwt != nil {
+				w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q", l.config.Realm))
+			}
+			f.writeError(w, r, http.StatusProxyAuthRequired, "Proxy authentication required", "")
+			return
+		}
+	}
+
+	ctx := withProfile(r.Context(), l.profile)
+	realm := ""
+	if user != "" {
+		realm = l.config.Realm
+	}
+	upstream := l.upstream
+	if t := f.tenantOf(net.ParseIP(remoteIP(r)), realm); t != nil {
+		ctx = withProfile(withTenant(ctx, t), t.profile)
+		f.metrics.inc("gatelan_tenant_requests_total", "tenant", t.config.Name)
+		if t.profile != nil {
+			// The upstreams of the tenant's profile replace the listener's
+			upstream = nil
+		}
+	}
+	ctx = withUpstream(ctx, upstream)
+	ctx = withUpstream(ctx, f.groupUpstream(groups))
+	ctx = withUser(ctx, user, groups)
+	ctx = withAffinity(ctx, f.affinityKey(remoteIP(r), user))
+	f.serveProxy(w, r.WithContext(ctx))
+}
+
+// Handler returns an http.Handler serving proxy requests without any listener
+// policy, for embedding the forwarder in another server. Like AdminHandler it
+// belongs to f alone and registers nothing on http.DefaultServeMux.
+func (f *Forwarder) Handler() http.Handler {
+	return http.HandlerFunc(f.serveProxy)
+}
+
+// serveProxy dispatches CONNECT tunnels and plain proxy requests
+func (f *Forwarder) serveProxy(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(r)
+	r = canonicalizeHost(r)
+	r, admitted := f.admit(w, r)
+	if !admitted {
+		return
+	}
+	defer releaseAdmission(r)
+	if r.Method == http.MethodConnect {
+		f.handleConnect(w, r)
+		return
+	}
+	f.handleHTTPRequest(w, r)
+}
+
+// authenticate checks Basic or Bearer Proxy-Authorization credentials,
+// returning the user and, for LDAP and JWT, their groups
+func (l *proxyListener) authenticate(r *http.Request) (string, []string, bool) {
+	header := r.Header.Get("Proxy-Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok && l.forwarder.jwt != nil {
+		user, groups, err := l.forwarder.jwt.verify(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			l.forwarder.logf(r, "Bearer authentication from %s failed: %v", r.RemoteAddr, err)
+			return "", nil, false
+		}
+		return user, groups, true
+	}
+	if l.config.Auth == listenerAuthJWT {
+		return "", nil, false
+	}
+
+	encoded, ok := strings.CutPrefix(header, "Basic ")
+	if !ok {
+		return "", nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", nil, false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", nil, false
+	}
+
+	if l.config.Auth == listenerAuthLDAP {
+		groups, err := l.forwarder.ldap.authenticate(user, password)
+		if err != nil {
+			if !errors.Is(err, errInvalidCredentials) {
+				l.forwarder.logf(r, "LDAP authentication of %s failed: %v", user, err)
+			}
+			return "", nil, false
+		}
+		return user, groups, true
+	}
+
+	expected, ok := l.config.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return "", nil, false
+	}
+	return user, nil, true
+}
+
+// userContextKey carries the authenticated proxy user of a request
+type userContextKey struct{}
+
+// proxyUser is an authenticated user and their groups
+type proxyUser struct {
+	name   string
+	groups []string
+}
+
+// withUser records the authenticated user in ctx
+func withUser(ctx context.Context, user string, groups []string) context.Context {
+	if user == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, userContextKey{}, proxyUser{name: user, groups: groups})
+}
+
+// requestUser returns the authenticated proxy user of req, if any
+func requestUser(req *http.Request) string {
+	user, _ := req.Context().Value(userContextKey{}).(proxyUser)
+	return user.name
+}
+
+// requestGroups returns the groups of the authenticated proxy user of req
+func requestGroups(req *http.Request) []string {
+	user, _ := req.Context().Value(userContextKey{}).(proxyUser)
+	return user.groups
+}
+
+// groupUpstream returns the upstream mapped to the first of groups that has
+// one, or nil
+func (f *Forwarder) groupUpstream(groups []string) *upstream {
+	for _, group := range groups {
+		for name, addr := range f.config.LDAP.GroupUpstreams {
+			if strings.EqualFold(name, group) {
+				return f.upstreamFor(addr)
+			}
+		}
+	}
+	return nil
+}
+
+// identity returns the user, MAC address or client IP a per-client feature
+// keys req on
+func (f *Forwarder) identity(req *http.Request, key string) string {
+	switch key {
+	case config.IdentityUser:
+		if user := requestUser(req); user != "" {
+			return user
+		}
+	case config.IdentityMAC:
+		if mac := f.clientMAC(req); mac != "" {
+			return mac
+		}
+	}
+	return remoteIP(req)
+}
+
+// handleHTTPRequest forwards a plain proxy request and relays the response
+func (f *Forwarder) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a proxy server; requests must use an absolute URL", http.StatusBadRequest)
+		return
+	}
+
+	quota, quotaKey := f.quotaOf(r), f.quotaKey(r)
+	if quota.exceeded(quotaKey) {
+		f.logf(r, "Quota exceeded for %s, refusing %s", quotaKey, r.URL.String())
+		f.audit.log(severityNotice, auditQuotaExceeded, r, r.URL.Host, "quota exceeded for "+quotaKey)
+		f.announceQuotaExceeded(r, quotaKey)
+		f.writeQuotaExceeded(w, r, quotaKey)
+		return
+	}
+
+	// Register the request so it can be listed and cancelled
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	conn := f.connections.add(ConnectionRequest, r.RemoteAddr, f.clientName(r), r.URL.Host, cancel)
+	defer func() {
+		f.connections.remove(conn)
+		f.account(r, conn, r.URL.Hostname())
+		quota.add(quotaKey, conn.sent.Load()+conn.received.Load())
+	}()
+	r = r.WithContext(ctx)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingBody{ReadCloser: r.Body, conn: conn}
+		if upload := f.shaper.flow(ctx, remoteIP(r), shapeUpload); upload != nil {
+			r.Body = &shapedBody{ReadCloser: r.Body, flow: upload}
+		}
+	}
+
+	resp, err := f.ForwardRequest(r)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrUpstreamUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
+		f.logf(r, "Request %s %s failed: %v", r.Method, r.URL.String(), err)
+		f.writeError(w, r, status, http.StatusText(status), "")
+		return
+	}
+	defer resp.Body.Close()
+
+	// The challenges of a 407 only reach clients answering the upstream's
+	challenges := resp.Header.Values("Proxy-Authenticate")
+	f.removeHopByHopHeaders(resp.Header)
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		resp.Header["Proxy-Authenticate"] = challenges
+	}
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	// Announcing trailers makes the response chunked toward the client
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var out io.Writer = &countingWriter{Writer: w, conn: conn}
+	if isStreaming(resp) {
+		// Send headers now and every chunk as it arrives
+		controller := http.NewResponseController(w)
+		controller.Flush()
+		out = &flushWriter{Writer: out, controller: controller}
+	}
+	// A blocked write fails once its deadline passes, ending the copy
+	if watch := f.watchStalls(r, conn, func() {
+		http.NewResponseController(w).SetWriteDeadline(time.Now())
+		cancel()
+	}); watch != nil {
+		defer watch.stop()
+		out = &stallWriter{Writer: out, watch: watch}
+	}
+	// Outermost, so that waiting for the link is not taken for a stall
+	if download := f.shaper.flow(ctx, remoteIP(r), shapeDownload); download != nil {
+		out = &shapedWriter{Writer: out, flow: download}
+	}
+
+	buf := make([]byte, f.config.BufferSize)
+	if _, err := io.CopyBuffer(out, resp.Body, buf); err != nil {
+		f.logf(r, "Failed to relay response for %s: %v", r.URL.String(), err)
+		return
+	}
+
+	// Trailer values are known once the body has been read, including ones
+	// the upstream sent without announcing
+	for name, values := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+name] = values
+	}
+}
+
+// upstreamFor returns the pool upstream for addr, creating a dedicated one if
+// needed. It is nil, after logging why, when addr is invalid.
+func (f *Forwarder) upstreamFor(addr string) *upstream {
+	for _, up := range f.current().upstreams {
+		if up.addr == addr {
+			return up
+		}
+	}
+
+	f.dedicatedMu.Lock()
+	defer f.dedicatedMu.Unlock()
+	if up, ok := f.dedicated[addr]; ok {
+		return up
+	}
+	up, err := newUpstream(addr, f.config)
+	if err != nil {
+		f.logger.Printf("Ignoring upstream: %v", err)
+		return nil
+	}
+	up.breaker = f.newBreaker(up.name)
+	up.latency = f.newLatencyTracker(up.name)
+	if f.dedicated == nil {
+		f.dedicated = make(map[string]*upstream)
+	}
+	f.dedicated[addr] = up
+	return up
+}
+
+// Lifecycle errors
+var (
+	ErrRunning    = errors.New("forwarder is already running")
+	ErrNotRunning = errors.New("forwarder is not running")
+	ErrClosed     = errors.New("forwarder is shut down")
+)
+
+// Lifecycle states: a new forwarder is stopped, Start and Stop move it
+// between stopped and running, and Shutdown closes it for good
+const (
+	stateStopped = iota
+	stateRunning
+	stateClosed
+)
+
+// Start binds every configured listener and the admin API and serves them in
+// the background, also after a Stop. Requests inherit ctx, so cancelling it
+// aborts in-flight upstream calls.
+func (f *Forwarder) Start(ctx context.Context) error {
+	f.lifecycleMu.Lock()
+	defer f.lifecycleMu.Unlock()
+	switch f.state {
+	case stateRunning:
+		return ErrRunning
+	case stateClosed:
+		return ErrClosed
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	if err := f.start(ctx); err != nil {
+		cancel()
+		f.sockets = nil
+		return err
+	}
+	f.cancelRun = cancel
+	f.state = stateRunning
+	return nil
+}
+
+// start binds and serves for Start; background work runs until ctx ends
+func (f *Forwarder) start(ctx context.Context) error {
+	activated, err := systemdListeners()
+	if err != nil {
+		return fmt.Errorf("failed to use systemd sockets: %w", err)
+	}
+	f.inherited = inheritedSockets()
+	defer f.closeInherited()
+
+	for _, cfg := range f.config.Listeners {
+		l, err := f.newProxyListener(ctx, cfg, activated)
+		if err != nil {
+			f.closeListeners()
+			return err
+		}
+		f.listeners = append(f.listeners, l)
+	}
+
+	if err := f.startAdmin(ctx); err != nil {
+		f.closeListeners()
+		return err
+	}
+	err = f.startGRPC(ctx)
+	if err == nil {
+		err = f.startCluster(ctx)
+	}
+	if err == nil {
+		err = f.startWPAD(ctx)
+	}
+	if err == nil {
+		err = f.startACME(ctx)
+	}
+	if err == nil {
+		err = f.startUDP(ctx)
+	}
+	if err == nil {
+		err = f.startMDNS()
+	}
+	if err != nil {
+		f.closeListeners()
+		f.closeUDP()
+		if f.admin != nil {
+			f.admin.Close()
+			f.admin = nil
+		}
+		if f.grpc != nil {
+			f.grpc.Close()
+			f.grpc = nil
+		}
+		if f.clusterAPI != nil {
+			f.clusterAPI.Close()
+			f.clusterAPI = nil
+		}
+		if f.wpad != nil {
+			f.wpad.Close()
+			f.wpad = nil
+		}
+		if f.wpadDNS != nil {
+			f.wpadDNS.Close()
+			f.wpadDNS = nil
+		}
+		if f.acmeHTTP != nil {
+			f.acmeHTTP.Close()
+			f.acmeHTTP = nil
+		}
+		return err
+	}
+	go f.saveQuotaPeriodically(ctx)
+	go f.refreshBlocklists(ctx)
+	go f.refreshAdblock(ctx)
+	go f.watchUpstreamDNS(ctx)
+	go f.reapIdleConns(ctx)
+	go f.prewarm(ctx)
+	go f.refreshLeases(ctx)
+	go f.runReports(ctx)
+	go f.deliverEvents(ctx)
+	go f.syncCluster(ctx)
+	go f.obtainCertificates(ctx)
+	for _, target := range f.config.MetricsPush {
+		go f.pushMetrics(ctx, target)
+	}
+
+	for _, l := range f.listeners {
+		f.logger.Printf("Listening on %s (%s)", l.listener.Addr(), l.config.Name)
+		go func(l *proxyListener) {
+			var listener net.Listener = &tunedListener{Listener: l.listener, opts: f.config.TCP.Client}
+			if timeout := f.config.Timeouts.Handshake.Timeout(); timeout > 0 {
+				listener = &handshakeListener{Listener: listener, timeout: timeout}
+			}
+			if len(l.config.ProxyProtocol) > 0 {
+				listener = &proxyProtoListener{Listener: listener, trusted: l.proxyFrom, failed: l.proxyProtocolFailed}
+			}
+			if l.tls != nil {
+				listener = tls.NewListener(listener, l.tls)
+			}
+			if err := l.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				f.logger.Printf("Listener %s stopped: %v", l.config.Name, err)
+			}
+		}(l)
+	}
+	f.startedMu.Lock()
+	f.started, f.listening = time.Now(), nil
+	for _, l := range f.listeners {
+		f.listening = append(f.listening, l.status())
+	}
+	f.startedMu.Unlock()
+	f.serving.Store(true)
+	notifyUpgraded()
+	return nil
+}
+
+// Stop stops accepting requests and waits for in-flight ones and open
+// tunnels until ctx expires, then terminates what is left and saves the
+// usage state. Start may serve again afterwards.
+func (f *Forwarder) Stop(ctx context.Context) error {
+	f.lifecycleMu.Lock()
+	defer f.lifecycleMu.Unlock()
+	if f.state != stateRunning {
+		return ErrNotRunning
+	}
+	errs := []error{f.stop(ctx)}
+	f.state = stateStopped
+	if err := f.saveUsage(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown stops the forwarder like Stop when it is running, then saves the
+// usage state and closes the log, audit, HAR and capture files for good
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	f.lifecycleMu.Lock()
+	defer f.lifecycleMu.Unlock()
+	if f.state == stateClosed {
+		return ErrClosed
+	}
+	var errs []error
+	if f.state == stateRunning {
+		errs = append(errs, f.stop(ctx))
+	}
+	f.state = stateClosed
+
+	if err := f.har.writeFile(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := f.capture.close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := f.saveUsage(); err != nil {
+		errs = append(errs, err)
+	}
+	f.audit.close()
+	if f.logFile != nil {
+		if err := f.logFile.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := f.closeTenantLogs(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// stop closes what start opened, draining connections until ctx expires;
+// f.lifecycleMu must be held
+func (f *Forwarder) stop(ctx context.Context) error {
+	f.serving.Store(false)
+	f.startedMu.Lock()
+	f.started, f.listening = time.Time{}, nil
+	f.startedMu.Unlock()
+
+	// Every server stops accepting at once and their connections drain
+	// together, rather than later ones accepting while earlier ones drain
+	type namedServer struct {
+		name   string
+		server *http.Server
+	}
+	var servers []namedServer
+	for _, l := range f.listeners {
+		servers = append(servers, namedServer{"listener " + l.config.Name, l.server})
+	}
+	for _, s := range []namedServer{
+		{"admin API", f.admin},
+		{"gRPC API", f.grpc},
+		{"cluster API", f.clusterAPI},
+		{"WPAD server", f.wpad},
+		{"ACME HTTP server", f.acmeHTTP},
+	} {
+		if s.server != nil {
+			servers = append(servers, s)
+		}
+	}
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.server.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", s.name, err)
+			}
+		}()
+	}
+	if f.wpadDNS != nil {
+		f.wpadDNS.Close()
+		f.wpadDNS = nil
+	}
+	f.closeUDP()
+	wg.Wait()
+	f.listeners = nil
+	f.admin, f.grpc, f.clusterAPI, f.wpad, f.acmeHTTP = nil, nil, nil, nil, nil
+	f.mdns.close(!f.upgraded)
+	f.mdns = nil
+	f.connections.drain(ctx)
+	f.cancelRun()
+	f.cancelRun = nil
+
+	// The next start binds and registers its sockets and listener profiles anew
+	f.sockets = nil
+	f.dedicatedMu.Lock()
+	f.bound = nil
+	f.dedicatedMu.Unlock()
+	return errors.Join(errs...)
+}
+
+// closeListeners releases sockets bound by a failed Start
+func (f *Forwarder) closeListeners() {
+	for _, l := range f.listeners {
+		l.listener.Close()
+	}
+	f.listeners = nil
+}
@@ -0,0 +1,365 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// Runtime-managed lists
+const (
+	ListBlock = "block" // Destinations refused before any other filter
+	ListAllow = "allow" // Destinations exempt from access rules, feeds, categories and ad filtering
+)
+
+// ErrUnknownList is returned for list names other than ListBlock and ListAllow
+var ErrUnknownList = errors.New("unknown list")
+
+// Lists are the entries of the runtime-managed lists: domains, which match
+// their subdomains too, IP addresses and CIDRs
+type Lists struct {
+	Block []string `json:"block"`
+	Allow []string `json:"allow"`
+}
+
+// listChange is the latest change of a list entry, as exchanged with cluster
+// peers
+type listChange struct {
+	List string    `json:"list,omitempty"` // Where the entry is now, none once removed
+	Time time.Time `json:"time"`           // Zero for entries loaded from the file
+}
+
+// managedList is one list with its entries split for matching
+type managedList struct {
+	entries  []string
+	domains  []string
+	networks []*net.IPNet
+}
+
+// add inserts entry, reporting whether it was new
+func (l *managedList) add(entry string) bool {
+	if slices.Contains(l.entries, entry) {
+		return false
+	}
+	l.entries = append(l.entries, entry)
+	l.index()
+	return true
+}
+
+// remove deletes entry, reporting whether it was listed
+func (l *managedList) remove(entry string) bool {
+	i := slices.Index(l.entries, entry)
+	if i < 0 {
+		return false
+	}
+	l.entries = slices.Delete(l.entries, i, i+1)
+	l.index()
+	return true
+}
+
+// index rebuilds the domains and networks from the entries
+func (l *managedList) index() {
+	l.domains, l.networks = nil, nil
+	for _, entry := range l.entries {
+		if networks, err := acl.ParseNetworks([]string{entry}); err == nil {
+			l.networks = append(l.networks, networks...)
+		} else {
+			l.domains = append(l.domains, entry)
+		}
+	}
+}
+
+// matches reports whether host, a name or an IP literal, is listed
+func (l *managedList) matches(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return acl.ContainsIP(l.networks, ip)
+	}
+	return acl.MatchHost(host, l.domains)
+}
+
+// managedLists holds the block and allow lists, persisting every change to
+// the configured file. Blocks take precedence over allows.
+type managedLists struct {
+	file string
+
+	mu      sync.RWMutex
+	block   managedList
+	allow   managedList
+	changes map[string]listChange // Entries changed while running, for the cluster
+}
+
+// newManagedLists creates the lists, restoring persisted entries if any
+func newManagedLists(cfg config.ListsConfig) (*managedLists, error) {
+	m := &managedLists{file: cfg.File}
+	if cfg.File == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lists file: %w", err)
+	}
+	var lists Lists
+	if err := json.Unmarshal(data, &lists); err != nil {
+		return nil, fmt.Errorf("failed to parse lists file: %w", err)
+	}
+	for _, entry := range lists.Block {
+		if entry, err = normalizeListEntry(entry); err != nil {
+			return nil, fmt.Errorf("invalid block list entry: %w", err)
+		}
+		m.block.add(entry)
+	}
+	for _, entry := range lists.Allow {
+		if entry, err = normalizeListEntry(entry); err != nil {
+			return nil, fmt.Errorf("invalid allow list entry: %w", err)
+		}
+		m.allow.add(entry)
+	}
+	return m, nil
+}
+
+// normalizeListEntry returns the canonical form of a domain, IP address or
+// CIDR entry
+func normalizeListEntry(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if networks, err := acl.ParseNetworks([]string{entry}); err == nil {
+		if strings.Contains(entry, "/") {
+			return networks[0].String(), nil
+		}
+		return networks[0].IP.String(), nil
+	}
+	entry = acl.CanonicalHost(strings.TrimPrefix(strings.TrimPrefix(entry, "*"), "."))
+	if entry == "" || strings.ContainsAny(entry, "/:@ \t*") {
+		return "", fmt.Errorf("invalid domain or address %q", entry)
+	}
+	return entry, nil
+}
+
+// list returns the named list, nil when there is none
+func (m *managedLists) list(name string) *managedList {
+	switch name {
+	case ListBlock:
+		return &m.block
+	case ListAllow:
+		return &m.allow
+	}
+	return nil
+}
+
+// blocks reports whether host is on the block list
+func (m *managedLists) blocks(host string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.block.matches(host)
+}
+
+// allows reports whether host is on the allow list
+func (m *managedLists) allows(host string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.allow.matches(host)
+}
+
+// add puts entry on the named list, taking it off the other one, and
+// persists the lists when that changed them
+func (m *managedLists) add(name, entry string) error {
+	entry, err := normalizeListEntry(entry)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.list(name)
+	if list == nil {
+		return ErrUnknownList
+	}
+	other := &m.allow
+	if name == ListAllow {
+		other = &m.block
+	}
+	added := list.add(entry)
+	if removed := other.remove(entry); !added && !removed {
+		return nil
+	}
+	m.record(entry, name)
+	return m.save()
+}
+
+// remove takes entry off the named list, reporting whether it was listed
+func (m *managedLists) remove(name, entry string) (bool, error) {
+	entry, err := normalizeListEntry(entry)
+	if err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.list(name)
+	if list == nil {
+		return false, ErrUnknownList
+	}
+	if !list.remove(entry) {
+		return false, nil
+	}
+	m.record(entry, "")
+	return true, m.save()
+}
+
+// record notes that entry moved to the named list, or off both lists when
+// it is empty; callers hold mu
+func (m *managedLists) record(entry, list string) {
+	if m.changes == nil {
+		m.changes = make(map[string]listChange)
+	}
+	m.changes[entry] = listChange{List: list, Time: time.Now()}
+}
+
+// listOf returns the list entry is on, empty when on neither; callers hold mu
+func (m *managedLists) listOf(entry string) string {
+	switch {
+	case slices.Contains(m.block.entries, entry):
+		return ListBlock
+	case slices.Contains(m.allow.entries, entry):
+		return ListAllow
+	}
+	return ""
+}
+
+// clusterState returns every listed entry and recent removal with its latest
+// change, for the cluster peers
+func (m *managedLists) clusterState() map[string]listChange {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state := make(map[string]listChange)
+	for _, entry := range m.block.entries {
+		state[entry] = listChange{List: ListBlock}
+	}
+	for _, entry := range m.allow.entries {
+		state[entry] = listChange{List: ListAllow}
+	}
+	for entry, change := range m.changes {
+		if change.List == "" && time.Since(change.Time) > clusterTombstoneAge {
+			continue
+		}
+		state[entry] = change
+	}
+	return state
+}
+
+// merge applies the changes of a peer that are newer than the local ones,
+// and entries both only know from their files, persisting the lists when
+// that changed them
+func (m *managedLists) merge(state map[string]listChange) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := false
+	for entry, remote := range state {
+		if normalized, err := normalizeListEntry(entry); err != nil || normalized != entry {
+			continue
+		}
+		if remote.List != "" && m.list(remote.List) == nil {
+			continue
+		}
+		local := m.changes[entry]
+		current := m.listOf(entry)
+		switch {
+		case remote.Time.After(local.Time):
+			if m.changes == nil {
+				m.changes = make(map[string]listChange)
+			}
+			m.changes[entry] = remote
+		case remote.Time.IsZero() && local.Time.IsZero() && current == "":
+		default:
+			continue
+		}
+		if current == remote.List {
+			continue
+		}
+		if current != "" {
+			m.list(current).remove(entry)
+		}
+		if remote.List != "" {
+			m.list(remote.List).add(entry)
+		}
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, m.save()
+}
+
+// snapshot copies the entries of both lists
+func (m *managedLists) snapshot() Lists {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Lists{
+		Block: append([]string{}, m.block.entries...),
+		Allow: append([]string{}, m.allow.entries...),
+	}
+}
+
+// save persists the lists to the configured file, if any. The caller holds mu.
+func (m *managedLists) save() error {
+	if m.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(Lists{Block: m.block.entries, Allow: m.allow.entries}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lists: %w", err)
+	}
+
+	// Write then rename so a crash never leaves a truncated file
+	tmp := m.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write lists file: %w", err)
+	}
+	return os.Rename(tmp, m.file)
+}
+
+// blockedByList reports whether host is on the block list, logging and
+// counting the refusal of req
+func (f *Forwarder) blockedByList(req *http.Request, host string) bool {
+	if !f.lists.blocks(host) {
+		return false
+	}
+	f.logf(req, "Block list blocked %s for %s", host, f.clientLabel(req))
+	f.metrics.inc("gatelan_list_hits_total", "list", ListBlock)
+	f.logBlocked(req, host, "on the block list")
+	return true
+}
+
+// Lists returns the entries of the runtime-managed block and allow lists
+func (f *Forwarder) Lists() Lists {
+	return f.lists.snapshot()
+}
+
+// AddListEntry puts a domain, IP address or CIDR on the named list, taking it
+// off the other one
+func (f *Forwarder) AddListEntry(list, entry string) error {
+	return f.lists.add(list, entry)
+}
+
+// RemoveListEntry takes entry off the named list, reporting whether it was
+// listed
+func (f *Forwarder) RemoveListEntry(list, entry string) (bool, error) {
+	return f.lists.remove(list, entry)
+}
@@ -0,0 +1,203 @@
+package forwarder
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// rotatingFile is a log file that is renamed aside once it grows past
+// MaxSize or gets older than MaxAge. Rotated files are optionally gzipped and
+// pruned by count and age.
+type rotatingFile struct {
+	config config.LogConfig
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	wg      sync.WaitGroup // Background compression and pruning
+	pruneMu sync.Mutex     // Serializes background work
+}
+
+func newRotatingFile(cfg config.LogConfig) (*rotatingFile, error) {
+	if dir := filepath.Dir(cfg.File); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+	r := &rotatingFile{config: cfg}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write appends p, rotating first when the file is full or too old
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	maxAge := time.Duration(r.config.MaxAge)
+	if r.size+int64(len(p)) > r.config.MaxSize && r.size > 0 || maxAge > 0 && time.Since(r.opened) >= maxAge {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// open opens the log file for appending, continuing an existing one
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+// rotate renames the current file aside and starts a new one. r.mu must be held.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	r.file = nil
+
+	ext := filepath.Ext(r.config.File)
+	stem := fmt.Sprintf("%s-%s", strings.TrimSuffix(r.config.File, ext), time.Now().Format("20060102-150405.000"))
+	backup := stem + ext
+	for i := 1; fileExists(backup) || fileExists(backup+".gz"); i++ {
+		backup = fmt.Sprintf("%s.%d%s", stem, i, ext)
+	}
+	if err := os.Rename(r.config.File, backup); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.pruneMu.Lock()
+		defer r.pruneMu.Unlock()
+		if r.config.Compress {
+			if err := compressFile(backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "Failed to compress %s: %v\n", backup, err)
+			}
+		}
+		r.prune()
+	}()
+	return nil
+}
+
+// prune removes rotated files beyond MaxBackups or older than Retention
+func (r *rotatingFile) prune() {
+	ext := filepath.Ext(r.config.File)
+	matches, err := filepath.Glob(strings.TrimSuffix(r.config.File, ext) + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var backups []backup
+	for _, path := range matches {
+		// Skip files still being compressed
+		if strings.HasSuffix(path, ".tmp") {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			backups = append(backups, backup{path, info.ModTime()})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+
+	retention := time.Duration(r.config.Retention)
+	for i, b := range backups {
+		if i >= r.config.MaxBackups || retention > 0 && time.Since(b.modTime) > retention {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// fileExists reports whether path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// compressFile gzips path to path.gz and removes the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	src.Close()
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the file after background compression finishes
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
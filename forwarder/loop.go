@@ -0,0 +1,61 @@
+package forwarder
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// detectLoop reports whether req has already been forwarded by this instance
+func (f *Forwarder) detectLoop(req *http.Request) bool {
+	cfg := f.config.LoopDetection
+	if cfg.Disabled {
+		return false
+	}
+
+	for _, value := range req.Header.Values(cfg.Header) {
+		for _, id := range strings.Split(value, ",") {
+			if strings.TrimSpace(id) == cfg.InstanceID {
+				return true
+			}
+		}
+	}
+
+	if cfg.CheckVia {
+		for _, value := range req.Header.Values("Via") {
+			for _, entry := range strings.Split(value, ",") {
+				fields := strings.Fields(entry)
+				if len(fields) >= 2 && strings.EqualFold(fields[1], f.config.ForwardedHeaders.ViaPseudonym) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// markRequest stamps proxyReq with this instance's loop marker
+func (f *Forwarder) markRequest(proxyReq *http.Request) {
+	if f.config.LoopDetection.Disabled {
+		return
+	}
+	proxyReq.Header.Add(f.config.LoopDetection.Header, f.config.LoopDetection.InstanceID)
+}
+
+// markTunnel stamps the CONNECTs dialed for r with this instance's loop
+// marker and, when enabled, its Via entry
+func (f *Forwarder) markTunnel(r *http.Request) *http.Request {
+	header := make(http.Header)
+	if !f.config.LoopDetection.Disabled {
+		header.Add(f.config.LoopDetection.Header, f.config.LoopDetection.InstanceID)
+	}
+	if f.config.ForwardedHeaders.Via {
+		header.Add("Via", f.viaValue(r))
+	}
+	if len(header) == 0 {
+		return r
+	}
+	return r.WithContext(tunnel.WithExtraHeader(r.Context(), header))
+}
@@ -0,0 +1,338 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mdnsService    = "_http-proxy._tcp.local."
+	mdnsServices   = "_services._dns-sd._udp.local."
+	mdnsServiceTTL = 4500 // Seconds, for records not naming a host
+	mdnsHostTTL    = 120  // Seconds, for records naming a host or address
+	mdnsCacheFlush = 0x8000
+	mdnsUnicast    = 0x8000 // Question class bit asking for a unicast reply
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsResponder answers multicast DNS queries for the proxy service
+type mdnsResponder struct {
+	conn     *net.UDPConn
+	instance string // Fully qualified service instance name
+	host     string // Fully qualified host name
+	ip       net.IP
+	port     uint16
+	txt      []string
+	logger   *log.Logger
+}
+
+// startMDNS joins the mDNS group and announces the proxy service
+func (f *Forwarder) startMDNS() error {
+	cfg := f.config.MDNS
+	if !cfg.Enabled {
+		return nil
+	}
+	proxy, err := f.advertisedProxy(cfg.Proxy)
+	if err != nil {
+		return fmt.Errorf("failed to determine mDNS proxy address: %w", err)
+	}
+	host, portText, err := net.SplitHostPort(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid mDNS proxy address: %w", err)
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return fmt.Errorf("mDNS needs an IPv4 proxy address, have %s", host)
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid mDNS proxy port %q", portText)
+	}
+
+	var iface *net.Interface
+	if cfg.Interface != "" {
+		if iface, err = net.InterfaceByName(cfg.Interface); err != nil {
+			return fmt.Errorf("failed to find mDNS interface: %w", err)
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", iface, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("failed to join mDNS group: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if hostname == "" {
+		hostname = "gatelan"
+	}
+	instance := cfg.Instance
+	if instance == "" {
+		instance = "GateLAN on " + hostname
+	}
+
+	f.mdns = &mdnsResponder{
+		conn:     conn,
+		instance: strings.ReplaceAll(instance, ".", "\\.") + "." + mdnsService,
+		host:     hostname + ".local.",
+		ip:       ip,
+		port:     uint16(port),
+		txt:      cfg.TXT,
+		logger:   f.logger,
+	}
+	f.logger.Printf("Advertising %s via mDNS at %s", instance, proxy)
+	go f.mdns.serve()
+	go f.mdns.announce()
+	return nil
+}
+
+// serve answers queries until the connection is closed
+func (m *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				m.logger.Printf("mDNS responder stopped: %v", err)
+			}
+			return
+		}
+		m.handle(buf[:n], addr)
+	}
+}
+
+// announce sends the unsolicited announcements of RFC 6762 section 8.3
+func (m *mdnsResponder) announce() {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		if _, err := m.conn.WriteToUDP(m.message(0, nil, m.records(dnsTypeANY, mdnsService), nil, false), mdnsGroup); err != nil {
+			return
+		}
+	}
+}
+
+// close leaves the group, first sending a goodbye so browsers forget the
+// service unless a new instance is taking over
+func (m *mdnsResponder) close(goodbye bool) {
+	if m == nil {
+		return
+	}
+	if goodbye {
+		m.conn.WriteToUDP(m.message(0, nil, m.records(dnsTypeANY, mdnsService), nil, true), mdnsGroup)
+	}
+	m.conn.Close()
+}
+
+// handle replies to the questions in query that name this service
+func (m *mdnsResponder) handle(query []byte, from *net.UDPAddr) {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return
+	}
+	count := int(binary.BigEndian.Uint16(query[4:6]))
+	offset := 12
+	var answers []mdnsRecord
+	unicast := false
+	for i := 0; i < count; i++ {
+		name, next, err := readDNSName(query, offset)
+		if err != nil || next+4 > len(query) {
+			return
+		}
+		qtype := binary.BigEndian.Uint16(query[next : next+2])
+		qclass := binary.BigEndian.Uint16(query[next+2 : next+4])
+		offset = next + 4
+		if qclass&mdnsUnicast != 0 {
+			unicast = true
+		}
+		for _, record := range m.records(qtype, name) {
+			if !containsRecord(answers, record) {
+				answers = append(answers, record)
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	var additional []mdnsRecord
+	for _, record := range m.records(dnsTypeANY, mdnsService) {
+		if !containsRecord(answers, record) {
+			additional = append(additional, record)
+		}
+	}
+
+	// Legacy resolvers querying from another port get a conventional reply
+	if from.Port != mdnsGroup.Port {
+		id := binary.BigEndian.Uint16(query[:2])
+		reply := m.message(id, query[12:offset], answers, additional, false)
+		binary.BigEndian.PutUint16(reply[4:6], uint16(count))
+		m.conn.WriteToUDP(reply, from)
+		return
+	}
+	to := mdnsGroup
+	if unicast {
+		to = from
+	}
+	m.conn.WriteToUDP(m.message(0, nil, answers, additional, false), to)
+}
+
+// mdnsRecord is one resource record of the service
+type mdnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	flush bool
+	data  []byte
+}
+
+// containsRecord reports whether records already holds record
+func containsRecord(records []mdnsRecord, record mdnsRecord) bool {
+	for _, r := range records {
+		if r.name == record.name && r.rtype == record.rtype {
+			return true
+		}
+	}
+	return false
+}
+
+// records returns the records answering a question for name and qtype.
+// Asking for the service type with ANY returns the full set.
+func (m *mdnsResponder) records(qtype uint16, name string) []mdnsRecord {
+	port := binary.BigEndian.AppendUint16([]byte{0, 0, 0, 0}, m.port)
+	all := []mdnsRecord{
+		{name: mdnsServices, rtype: dnsTypePTR, ttl: mdnsServiceTTL, data: encodeDNSName(mdnsService)},
+		{name: mdnsService, rtype: dnsTypePTR, ttl: mdnsServiceTTL, data: encodeDNSName(m.instance)},
+		{name: m.instance, rtype: dnsTypeSRV, ttl: mdnsHostTTL, flush: true, data: append(port, encodeDNSName(m.host)...)},
+		{name: m.instance, rtype: dnsTypeTXT, ttl: mdnsServiceTTL, flush: true, data: encodeTXT(m.txt)},
+		{name: m.host, rtype: dnsTypeA, ttl: mdnsHostTTL, flush: true, data: m.ip},
+	}
+	if qtype == dnsTypeANY && strings.EqualFold(name, mdnsService) {
+		return all[1:]
+	}
+	var matched []mdnsRecord
+	for _, record := range all {
+		if strings.EqualFold(record.name, name) && (qtype == dnsTypeANY || qtype == record.rtype) {
+			matched = append(matched, record)
+		}
+	}
+	return matched
+}
+
+// message encodes a response; a goodbye zeroes the TTLs so caches drop the records
+func (m *mdnsResponder) message(id uint16, question []byte, answers, additional []mdnsRecord, goodbye bool) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x84, 0) // Response, authoritative
+	questions := 0
+	if question != nil {
+		questions = 1
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(questions))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(additional)))
+	msg = append(msg, question...)
+
+	for _, record := range append(answers, additional...) {
+		class := uint16(dnsClassIN)
+		if record.flush && id == 0 {
+			class |= mdnsCacheFlush
+		}
+		msg = append(msg, encodeDNSName(record.name)...)
+		msg = binary.BigEndian.AppendUint16(msg, record.rtype)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		ttl := record.ttl
+		if goodbye {
+			ttl = 0
+		}
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(record.data)))
+		msg = append(msg, record.data...)
+	}
+	return msg
+}
+
+// encodeDNSName encodes a dotted name, where "\." is a literal dot within a
+// label, as uncompressed DNS labels
+func encodeDNSName(name string) []byte {
+	var encoded []byte
+	var label []byte
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name):
+			i++
+			label = append(label, name[i])
+		case name[i] == '.':
+			encoded = append(append(encoded, byte(len(label))), label...)
+			label = label[:0]
+		default:
+			label = append(label, name[i])
+		}
+	}
+	if len(label) > 0 {
+		encoded = append(append(encoded, byte(len(label))), label...)
+	}
+	return append(encoded, 0)
+}
+
+// encodeTXT encodes TXT strings, a single empty one when there are none
+func encodeTXT(entries []string) []byte {
+	if len(entries) == 0 {
+		return []byte{0}
+	}
+	var data []byte
+	for _, entry := range entries {
+		if len(entry) > 255 {
+			entry = entry[:255]
+		}
+		data = append(append(data, byte(len(entry))), entry...)
+	}
+	return data
+}
+
+// readDNSName decodes the possibly compressed name at offset in msg, with
+// literal dots escaped, returning it and the offset just past it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var name strings.Builder
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("name overflows message")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			if name.Len() == 0 {
+				name.WriteByte('.')
+			}
+			return name.String(), end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid name pointer")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errors.New("label overflows message")
+			}
+			label := string(msg[offset+1 : offset+1+length])
+			name.WriteString(strings.ReplaceAll(label, ".", "\\."))
+			name.WriteByte('.')
+			offset += 1 + length
+		}
+	}
+}
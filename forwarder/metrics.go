@@ -0,0 +1,207 @@
+package forwarder
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metrics is a minimal registry of labeled counters, gauges and histograms
+// with Prometheus text output
+type metrics struct {
+	mu         sync.Mutex
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+	bounded    map[string]map[string]bool // Values admitted per label capped by bound
+}
+
+// maxLabelValues caps the distinct values bound admits for a label; series
+// beyond it share the value "other"
+const maxLabelValues = 100
+
+// histogram counts observations into fixed buckets
+type histogram struct {
+	name    string
+	labels  []string
+	buckets []float64
+	counts  []uint64 // Per bucket, not cumulative; the last is +Inf
+	sum     float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{counters: make(map[string]float64), gauges: make(map[string]float64), histograms: make(map[string]*histogram), bounded: make(map[string]map[string]bool)}
+}
+
+// bound returns value for use as the label, or "other" once the label has
+// maxLabelValues values, since the registry never forgets a series
+func (m *metrics) bound(label, value string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := m.bounded[label]
+	if values == nil {
+		values = make(map[string]bool)
+		m.bounded[label] = values
+	}
+	if !values[value] && len(values) >= maxLabelValues {
+		return "other"
+	}
+	values[value] = true
+	return value
+}
+
+// seriesKey renders name and label pairs as a Prometheus series identifier
+func seriesKey(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// add increases the counter identified by name and label pairs
+func (m *metrics) add(name string, value float64, labels ...string) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	m.counters[key] += value
+	m.mu.Unlock()
+}
+
+// inc increases the counter by one
+func (m *metrics) inc(name string, labels ...string) {
+	m.add(name, 1, labels...)
+}
+
+// store sets the counter to a total kept elsewhere
+func (m *metrics) store(name string, value float64, labels ...string) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	m.counters[key] = value
+	m.mu.Unlock()
+}
+
+// set sets the gauge identified by name and label pairs
+func (m *metrics) set(name string, value float64, labels ...string) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	m.gauges[key] = value
+	m.mu.Unlock()
+}
+
+// observe adds value to the histogram identified by name and label pairs,
+// creating it with buckets on first use
+func (m *metrics) observe(name string, buckets []float64, value float64, labels ...string) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &histogram{name: name, labels: labels, buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+		m.histograms[key] = h
+	}
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.counts[i]++
+	h.sum += value
+}
+
+// snapshot copies all counters and gauges
+func (m *metrics) snapshot() map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]float64, len(m.counters)+len(m.gauges))
+	for key, value := range m.counters {
+		out[key] = value
+	}
+	for key, value := range m.gauges {
+		out[key] = value
+	}
+	return out
+}
+
+// writePrometheus writes all counters and gauges in the Prometheus text exposition format
+func (m *metrics) writePrometheus(w io.Writer) error {
+	counters := m.snapshot()
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lastName := ""
+	for _, key := range keys {
+		name, _, _ := strings.Cut(key, "{")
+		if name != lastName {
+			if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind(key)); err != nil {
+				return err
+			}
+			lastName = name
+		}
+		if _, err := fmt.Fprintf(w, "%s %g\n", key, counters[key]); err != nil {
+			return err
+		}
+	}
+	return m.writeHistograms(w)
+}
+
+// kind returns the Prometheus type of the series key
+func (m *metrics) kind(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.gauges[key]; ok {
+		return "gauge"
+	}
+	return "counter"
+}
+
+// writeHistograms writes the histograms with cumulative buckets
+func (m *metrics) writeHistograms(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.histograms))
+	for key := range m.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lastName := ""
+	for _, key := range keys {
+		h := m.histograms[key]
+		if h.name != lastName {
+			if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", h.name); err != nil {
+				return err
+			}
+			lastName = h.name
+		}
+		var cumulative uint64
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+			}
+			labels := append(slices.Clone(h.labels), "le", le)
+			if _, err := fmt.Fprintf(w, "%s %d\n", seriesKey(h.name+"_bucket", labels), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s %g\n%s %d\n", seriesKey(h.name+"_sum", h.labels), h.sum, seriesKey(h.name+"_count", h.labels), cumulative); err != nil {
+			return err
+		}
+	}
+	return nil
+}
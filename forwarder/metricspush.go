@@ -0,0 +1,209 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+const metricsPushTimeout = 10 * time.Second
+
+// metricPoint is the current value of one series
+type metricPoint struct {
+	name   string
+	labels []string // Name and value pairs
+	value  float64
+}
+
+// parseSeriesKey splits a key made by seriesKey into the name and label pairs
+func parseSeriesKey(key string) (string, []string) {
+	name, rest, ok := strings.Cut(key, "{")
+	if !ok {
+		return name, nil
+	}
+	rest = strings.TrimSuffix(rest, "}")
+	var labels []string
+	for rest != "" {
+		label, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			break
+		}
+		unquoted, _ := strconv.Unquote(quoted)
+		labels = append(labels, label, unquoted)
+		rest = strings.TrimPrefix(value[len(quoted):], ",")
+	}
+	return name, labels
+}
+
+// points returns every counter plus the sum and count of every histogram,
+// sorted by series
+func (m *metrics) points() []metricPoint {
+	counters := m.snapshot()
+	points := make([]metricPoint, 0, len(counters))
+	for key, value := range counters {
+		name, labels := parseSeriesKey(key)
+		points = append(points, metricPoint{name: name, labels: labels, value: value})
+	}
+
+	m.mu.Lock()
+	for _, h := range m.histograms {
+		var count uint64
+		for _, c := range h.counts {
+			count += c
+		}
+		points = append(points,
+			metricPoint{name: h.name + "_sum", labels: h.labels, value: h.sum},
+			metricPoint{name: h.name + "_count", labels: h.labels, value: float64(count)},
+		)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(points, func(i, j int) bool {
+		return seriesKey(points[i].name, points[i].labels) < seriesKey(points[j].name, points[j].labels)
+	})
+	return points
+}
+
+// writeInflux renders points in the InfluxDB line protocol with tags added
+// to each, as measurements with a single value field
+func writeInflux(w io.Writer, points []metricPoint, tags map[string]string, now time.Time) {
+	escapeTag := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace
+	extra := sortedPairs(tags)
+	for _, p := range points {
+		fmt.Fprint(w, strings.NewReplacer(",", `\,`, " ", `\ `).Replace(p.name))
+		labels := append(append([]string{}, p.labels...), extra...)
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i+1] != "" {
+				fmt.Fprintf(w, ",%s=%s", escapeTag(labels[i]), escapeTag(labels[i+1]))
+			}
+		}
+		fmt.Fprintf(w, " value=%s %d\n", strconv.FormatFloat(p.value, 'g', -1, 64), now.UnixNano())
+	}
+}
+
+// writeGraphite renders points in the Graphite plaintext protocol, with
+// labels and tags as Graphite tags
+func writeGraphite(w io.Writer, points []metricPoint, prefix string, tags map[string]string, now time.Time) {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r == ';' || r == '~' || r == '!' || r == '^' || r == '=' || r <= ' ' {
+				return '_'
+			}
+			return r
+		}, s)
+	}
+	extra := sortedPairs(tags)
+	for _, p := range points {
+		path := p.name
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		fmt.Fprint(w, clean(path))
+		labels := append(append([]string{}, p.labels...), extra...)
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i+1] != "" {
+				fmt.Fprintf(w, ";%s=%s", clean(labels[i]), clean(labels[i+1]))
+			}
+		}
+		fmt.Fprintf(w, " %s %d\n", strconv.FormatFloat(p.value, 'g', -1, 64), now.Unix())
+	}
+}
+
+// sortedPairs flattens m into name and value pairs ordered by name
+func sortedPairs(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		pairs = append(pairs, name, m[name])
+	}
+	return pairs
+}
+
+// pushMetrics sends the metrics to target every interval until ctx is
+// cancelled, logging when pushes start and stop failing
+func (f *Forwarder) pushMetrics(ctx context.Context, target config.MetricsPushConfig) {
+	ticker := time.NewTicker(time.Duration(target.Interval))
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var body bytes.Buffer
+		now := time.Now()
+		f.collectPoolMetrics()
+		points := f.metrics.points()
+		if target.Format == config.MetricsGraphite {
+			writeGraphite(&body, points, target.Prefix, target.Tags, now)
+		} else {
+			writeInflux(&body, points, target.Tags, now)
+		}
+
+		err := sendMetrics(ctx, target, body.Bytes())
+		switch {
+		case err != nil && !failing:
+			f.logger.Printf("Failed to push metrics to %s: %v", target.Format, err)
+		case err == nil && failing:
+			f.logger.Printf("Pushing metrics to %s again", target.Format)
+		}
+		failing = err != nil
+	}
+}
+
+// sendMetrics delivers rendered points to target
+func sendMetrics(ctx context.Context, target config.MetricsPushConfig, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, metricsPushTimeout)
+	defer cancel()
+
+	if target.Format == config.MetricsGraphite {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", target.Addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		_, err = conn.Write(data)
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.Addr, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create write request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if target.Token != "" {
+		req.Header.Set("Authorization", "Token "+target.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("write answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// mirrorInFlight bounds the copies being sent at once; further ones are
+// dropped rather than queued behind a slow secondary upstream
+const mirrorInFlight = 64
+
+// mirrorRule is a MirrorRule with its clients parsed
+type mirrorRule struct {
+	name    string
+	domains []string
+	clients []*net.IPNet
+	config  config.MirrorRule
+}
+
+// requestMirror copies requests for the mirror rules. A nil mirror copies
+// nothing.
+type requestMirror struct {
+	rules []mirrorRule
+	slots chan struct{}
+}
+
+// newRequestMirror parses the configured mirror rules, returning nil when
+// there are none
+func newRequestMirror(rules []config.MirrorRule) (*requestMirror, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	m := &requestMirror{slots: make(chan struct{}, mirrorInFlight)}
+	for i, rc := range rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		clients, err := acl.ParseNetworks(rc.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("mirror rule %s: %w", name, err)
+		}
+		m.rules = append(m.rules, mirrorRule{name: name, domains: rc.Domains, clients: clients, config: rc})
+	}
+	return m, nil
+}
+
+// match returns the first rule matching the destination and client of req, or nil
+func (m *requestMirror) match(req *http.Request) *mirrorRule {
+	if m == nil {
+		return nil
+	}
+	host := req.URL.Hostname()
+	client := net.ParseIP(remoteIP(req))
+	for i := range m.rules {
+		rule := &m.rules[i]
+		if len(rule.domains) > 0 && !acl.MatchHost(host, rule.domains) {
+			continue
+		}
+		if len(rule.clients) > 0 && !acl.ContainsIP(rule.clients, client) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// mirror sends a copy of proxyReq through the upstream of the first matching
+// mirror rule in the background. A body to copy is read ahead, and proxyReq
+// then sends what was read.
+func (f *Forwarder) mirror(req *http.Request, proxyReq *http.Request) {
+	rule := f.mirrors.match(req)
+	if rule == nil || rand.IntN(100) >= rule.config.Percent {
+		return
+	}
+	var body []byte
+	if proxyReq.Body != nil && proxyReq.Body != http.NoBody {
+		if proxyReq.ContentLength < 0 || proxyReq.ContentLength > rule.config.MaxBody {
+			f.metrics.inc("gatelan_mirror_dropped_total", "rule", rule.name, "reason", "body")
+			return
+		}
+		original := proxyReq.Body
+		data, err := io.ReadAll(original)
+		proxyReq.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), original), original}
+		if err != nil {
+			return
+		}
+		body = data
+	}
+	up := f.upstreamFor(rule.config.Upstream)
+	if up == nil {
+		return
+	}
+	select {
+	case f.mirrors.slots <- struct{}{}:
+	default:
+		f.metrics.inc("gatelan_mirror_dropped_total", "rule", rule.name, "reason", "busy")
+		return
+	}
+
+	// The copy outlives the request, keeping its values such as the guard of
+	// direct connections
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(proxyReq.Context()), time.Duration(rule.config.Timeout))
+	copyReq := proxyReq.Clone(ctx)
+	copyReq.Body = http.NoBody
+	if body != nil {
+		copyReq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	go func() {
+		defer func() { <-f.mirrors.slots }()
+		defer cancel()
+		resp, err := up.transport.RoundTrip(copyReq)
+		if err != nil {
+			f.logf(req, "Mirror rule %s failed to copy %s %s via %s: %v", rule.name, copyReq.Method, copyReq.URL.String(), up.name, err)
+			f.metrics.inc("gatelan_mirror_errors_total", "rule", rule.name)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		f.metrics.inc("gatelan_mirror_responses_total", "rule", rule.name, "status", strconv.Itoa(resp.StatusCode))
+	}()
+}
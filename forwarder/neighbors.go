@@ -0,0 +1,115 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// neighborMissRefresh is how soon an unknown client makes the table be read
+// again, as clients appear in it once they first talk to the gateway
+const neighborMissRefresh = time.Second
+
+// neighborTable maps client IPs to the MAC addresses the gateway's neighbor
+// table holds for them. A nil table knows no addresses.
+type neighborTable struct {
+	refresh time.Duration
+	read    func() ([]byte, error)
+	logger  func(format string, args ...any)
+
+	mu      sync.Mutex
+	macs    map[string]string
+	loaded  time.Time
+	lastErr string
+}
+
+// newNeighborTable returns nil when neighbors are disabled
+func newNeighborTable(cfg config.NeighborsConfig, logger func(format string, args ...any)) *neighborTable {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &neighborTable{
+		refresh: time.Duration(cfg.Refresh),
+		read:    readNeighborTable,
+		logger:  logger,
+		macs:    make(map[string]string),
+	}
+}
+
+// lookup returns the MAC address of the client at ip, or "" when it is not
+// a neighbor. The table is read again when stale, or soon after a miss.
+func (t *neighborTable) lookup(ip string) string {
+	if t == nil || ip == "" {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	mac, ok := t.macs[ip]
+	age := time.Since(t.loaded)
+	if age >= t.refresh || (!ok && age >= neighborMissRefresh) {
+		t.load()
+		mac = t.macs[ip]
+	}
+	return mac
+}
+
+// load reads the table, keeping the previous one when that fails; t.mu must
+// be held
+func (t *neighborTable) load() {
+	t.loaded = time.Now()
+	output, err := t.read()
+	if err != nil {
+		if err.Error() != t.lastErr {
+			t.logger("Failed to read the neighbor table: %v", err)
+			t.lastErr = err.Error()
+		}
+		return
+	}
+	t.lastErr = ""
+	t.macs = parseNeighbors(output)
+}
+
+// parseNeighbors extracts IP and MAC address pairs from the lines of
+// /proc/net/arp, "ip neigh" or "arp -a" output. Incomplete entries, listed
+// with an all-zero address or none, are skipped.
+func parseNeighbors(output []byte) map[string]string {
+	macs := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		var ip net.IP
+		var mac net.HardwareAddr
+		for _, field := range strings.Fields(scanner.Text()) {
+			if ip == nil {
+				host, _, _ := strings.Cut(strings.Trim(field, "()"), "%")
+				ip = net.ParseIP(host)
+				continue
+			}
+			// Windows separates the bytes with dashes
+			if parsed, err := net.ParseMAC(strings.ReplaceAll(field, "-", ":")); err == nil {
+				mac = parsed
+				break
+			}
+		}
+		if ip == nil || mac == nil || bytes.Equal(mac, make(net.HardwareAddr, len(mac))) {
+			continue
+		}
+		macs[ip.String()] = mac.String()
+	}
+	return macs
+}
+
+// clientMAC returns the MAC address of the client of req, from the neighbor
+// table or else its DHCP lease, or ""
+func (f *Forwarder) clientMAC(req *http.Request) string {
+	ip := remoteIP(req)
+	if mac := f.neighbors.lookup(ip); mac != "" {
+		return mac
+	}
+	return f.leases.mac(ip)
+}
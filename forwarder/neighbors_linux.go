@@ -0,0 +1,22 @@
+//go:build linux
+
+package forwarder
+
+import (
+	"os"
+	"os/exec"
+)
+
+// readNeighborTable returns the kernel's ARP table followed by its IPv6
+// neighbors, which only "ip neigh" lists; without iproute2 IPv6 clients go
+// unrecognized
+func readNeighborTable() ([]byte, error) {
+	output, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	if neighbors, err := exec.Command("ip", "-6", "neigh", "show").Output(); err == nil {
+		output = append(output, neighbors...)
+	}
+	return output, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package forwarder
+
+import "os/exec"
+
+// readNeighborTable returns the ARP table as listed by arp, without resolving
+// names
+func readNeighborTable() ([]byte, error) {
+	return exec.Command("arp", "-an").Output()
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package forwarder
+
+import "os/exec"
+
+// readNeighborTable returns the ARP cache as listed by arp
+func readNeighborTable() ([]byte, error) {
+	return exec.Command("arp", "-a").Output()
+}
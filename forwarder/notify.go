@@ -0,0 +1,102 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// Notification is the data notifier message templates are executed with
+type Notification struct {
+	Event
+	Suppressed int // Events with the same type and subject held back since the last message
+}
+
+var defaultNotification = template.Must(template.New("notification").Parse(
+	`GateLAN: {{.Message}}{{if .Error}} ({{.Error}}){{end}}{{if .Suppressed}} [{{.Suppressed}} similar events suppressed]{{end}}`))
+
+// notifier posts events to one chat channel, at most one message per event
+// type and subject within the rate limit. It is only used by deliverEvents.
+type notifier struct {
+	config     config.NotifierConfig
+	message    *template.Template
+	sent       map[string]time.Time // Last message by event type and subject
+	suppressed map[string]int
+}
+
+// newNotifier creates the notifier, parsing its message template
+func newNotifier(cfg config.NotifierConfig) (*notifier, error) {
+	n := &notifier{
+		config:     cfg,
+		message:    defaultNotification,
+		sent:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	if cfg.Template != "" {
+		var err error
+		if n.message, err = template.New("notification").Parse(cfg.Template); err != nil {
+			return nil, fmt.Errorf("invalid %s notifier template: %w", cfg.Type, err)
+		}
+	}
+	return n, nil
+}
+
+// admit reports whether event may be posted now, with the number of similar
+// events held back before it
+func (n *notifier) admit(event Event) (int, bool) {
+	key := event.Type + " " + event.Upstream + " " + event.Key
+	if last, ok := n.sent[key]; ok && event.Time.Sub(last) < time.Duration(n.config.RateLimit) {
+		n.suppressed[key]++
+		return 0, false
+	}
+	n.sent[key] = event.Time
+	suppressed := n.suppressed[key]
+	delete(n.suppressed, key)
+	return suppressed, true
+}
+
+// post renders the message for event and sends it to the channel
+func (n *notifier) post(ctx context.Context, event Event, suppressed int) error {
+	var text strings.Builder
+	if err := n.message.Execute(&text, Notification{Event: event, Suppressed: suppressed}); err != nil {
+		return fmt.Errorf("failed to render message: %w", err)
+	}
+
+	url := n.config.URL
+	var payload any
+	switch n.config.Type {
+	case config.ChatSlack:
+		payload = map[string]string{"text": text.String()}
+	case config.ChatDiscord:
+		payload = map[string]string{"content": text.String()}
+	case config.ChatTelegram:
+		url = strings.TrimSuffix(url, "/") + "/bot" + n.config.Token + "/sendMessage"
+		payload = map[string]string{"chat_id": n.config.ChatID, "text": text.String()}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	return postJSON(ctx, url, nil, data)
+}
+
+// notify posts event to every notifier that wants it and is not rate limited
+func (f *Forwarder) notify(ctx context.Context, event Event) {
+	for _, n := range f.notifiers {
+		if !n.config.Wants(event.Type) {
+			continue
+		}
+		suppressed, ok := n.admit(event)
+		if !ok {
+			continue
+		}
+		if err := n.post(ctx, event, suppressed); err != nil {
+			f.logger.Printf("Failed to post %s event to %s: %v", event.Type, n.config.Type, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package forwarder
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// pauseWindow is a compiled config.PauseWindow
+type pauseWindow struct {
+	name     string
+	profiles []string
+	clients  []*net.IPNet
+	schedule *acl.Schedule // Always active when nil
+	until    string
+	message  string
+}
+
+// newPauseWindows compiles the pause windows in the configured timezone
+func newPauseWindows(cfg config.PausesConfig) ([]pauseWindow, error) {
+	location := time.Local
+	if cfg.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid pauses timezone: %w", err)
+		}
+	}
+
+	windows := make([]pauseWindow, 0, len(cfg.Windows))
+	for i, wc := range cfg.Windows {
+		name := wc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		window := pauseWindow{name: name, profiles: wc.Profiles, until: wc.To, message: wc.Message}
+		var err error
+		if window.clients, err = acl.ParseNetworks(wc.Clients); err != nil {
+			return nil, fmt.Errorf("pause %s: %w", name, err)
+		}
+		if len(wc.Days) > 0 || wc.From != "" || wc.To != "" {
+			if window.schedule, err = acl.ParseSchedule(wc.Days, wc.From, wc.To, location); err != nil {
+				return nil, fmt.Errorf("pause %s: %w", name, err)
+			}
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// pausedBy returns the active pause window covering req, if any
+func (f *Forwarder) pausedBy(req *http.Request) *pauseWindow {
+	if len(f.pauses) == 0 {
+		return nil
+	}
+	now := time.Now()
+	client := net.ParseIP(remoteIP(req))
+	profile := f.profileFor(req.Context()).name
+	for i := range f.pauses {
+		window := &f.pauses[i]
+		if len(window.profiles) > 0 && !slices.Contains(window.profiles, profile) {
+			continue
+		}
+		if len(window.clients) > 0 && (client == nil || !acl.ContainsIP(window.clients, client)) {
+			continue
+		}
+		if window.schedule == nil || window.schedule.Active(now) {
+			f.metrics.inc("gatelan_paused_requests_total", "pause", window.name)
+			return window
+		}
+	}
+	return nil
+}
+
+var pausePage = template.Must(template.New("pause").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Internet access paused</title></head>
+<body>
+<h1>Internet access is paused</h1>
+{{if .Message}}<p>{{.Message}}</p>
+{{end}}{{if .Until}}<p>Access resumes at {{.Until}}.</p>
+{{end}}</body>
+</html>
+`))
+
+// text returns the message explaining the pause
+func (w *pauseWindow) text() string {
+	if w.message == "" {
+		return "Internet access is paused"
+	}
+	return w.message
+}
+
+// pauseResponse builds the page explaining window, the configured blocked
+// page when there is one
+func (f *Forwarder) pauseResponse(req *http.Request, window *pauseWindow) *http.Response {
+	if f.errorPages[http.StatusForbidden] != nil {
+		return f.errorResponse(req, http.StatusForbidden, window.text(), window.name)
+	}
+	var body strings.Builder
+	pausePage.Execute(&body, struct{ Message, Until string }{window.message, window.until})
+	resp := newResponse(req, http.StatusForbidden, body.String())
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return resp
+}
+
+// writePaused is pauseResponse for handlers answering on w
+func (f *Forwarder) writePaused(w http.ResponseWriter, req *http.Request, window *pauseWindow) {
+	if f.errorPages[http.StatusForbidden] != nil {
+		f.writeError(w, req, http.StatusForbidden, window.text(), window.name)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	pausePage.Execute(w, struct{ Message, Until string }{window.message, window.until})
+}
@@ -0,0 +1,375 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// pcap file constants, see https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapSnapLen    = 65535
+	pcapLinkRaw    = 101 // LINKTYPE_RAW: packets start with an IPv4 or IPv6 header
+	pcapMaxPayload = 65000
+)
+
+// TCP header flags used in synthesized segments
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// tunnelCapture writes pcap files for CONNECT tunnels. The relayed bytes are
+// wrapped in synthesized TCP/IP packets between the client and the listener
+// so Wireshark can reassemble the streams, e.g. to inspect TLS handshakes.
+type tunnelCapture struct {
+	config config.CaptureConfig
+
+	mu     sync.Mutex
+	shared *pcapFile
+}
+
+// newTunnelCapture prepares the capture directory
+func newTunnelCapture(cfg config.CaptureConfig) (*tunnelCapture, error) {
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create capture directory: %w", err)
+		}
+	}
+	return &tunnelCapture{config: cfg}, nil
+}
+
+// wrap returns clientConn recording the tunnel to host, or clientConn itself
+// when the host is not selected for capture
+func (c *tunnelCapture) wrap(clientConn net.Conn, host string) (net.Conn, error) {
+	if c == nil {
+		return clientConn, nil
+	}
+	host = stripPort(host)
+	if len(c.config.Hosts) > 0 && !acl.MatchHost(host, c.config.Hosts) {
+		return clientConn, nil
+	}
+
+	var file *pcapFile
+	if c.config.PerTunnel {
+		file = &pcapFile{capture: c, prefix: "tunnel-" + sanitizeFileName(host)}
+	} else {
+		c.mu.Lock()
+		if c.shared == nil {
+			c.shared = &pcapFile{capture: c, prefix: "tunnels"}
+		}
+		file = c.shared
+		c.mu.Unlock()
+	}
+
+	conn := &captureConn{Conn: clientConn, file: file, perTunnel: c.config.PerTunnel}
+	conn.client = endpointOf(clientConn.RemoteAddr())
+	conn.server = endpointOf(clientConn.LocalAddr())
+	if err := conn.handshake(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// close flushes the shared capture file
+func (c *tunnelCapture) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shared == nil {
+		return nil
+	}
+	return c.shared.close()
+}
+
+// prune removes the oldest capture files beyond MaxFiles
+func (c *tunnelCapture) prune() {
+	matches, err := filepath.Glob(filepath.Join(c.config.Dir, "*.pcap"))
+	if err != nil || len(matches) <= c.config.MaxFiles {
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, errA := os.Stat(matches[i])
+		b, errB := os.Stat(matches[j])
+		return errA == nil && errB == nil && a.ModTime().Before(b.ModTime())
+	})
+	for _, path := range matches[:len(matches)-c.config.MaxFiles] {
+		os.Remove(path)
+	}
+}
+
+// pcapFile is a rotating pcap output
+type pcapFile struct {
+	capture *tunnelCapture
+	prefix  string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// writePacket appends one packet, rotating the file when it is full
+func (p *pcapFile) writePacket(ts time.Time, packet []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.file != nil && p.size >= p.capture.config.MaxFileSize {
+		p.file.Close()
+		p.file = nil
+	}
+	if p.file == nil {
+		if err := p.open(ts); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	copy(record[16:], packet)
+
+	n, err := p.file.Write(record)
+	p.size += int64(n)
+	return err
+}
+
+// open starts a new file with the pcap global header
+func (p *pcapFile) open(ts time.Time) error {
+	name := fmt.Sprintf("%s-%s.pcap", p.prefix, ts.Format("20060102-150405.000000"))
+	file, err := os.Create(filepath.Join(p.capture.config.Dir, name))
+	if err != nil {
+		return fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write capture file: %w", err)
+	}
+
+	p.file = file
+	p.size = int64(len(header))
+	p.capture.prune()
+	return nil
+}
+
+// close closes the current file
+func (p *pcapFile) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+// endpoint is one side of a synthesized TCP connection
+type endpoint struct {
+	ip   net.IP
+	port uint16
+	seq  uint32
+}
+
+// endpointOf converts addr, falling back to loopback for non-TCP addresses
+func endpointOf(addr net.Addr) endpoint {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return endpoint{ip: tcp.IP, port: uint16(tcp.Port)}
+	}
+	return endpoint{ip: net.IPv4(127, 0, 0, 1)}
+}
+
+// captureConn records the bytes read from and written to the client
+type captureConn struct {
+	net.Conn
+	file      *pcapFile
+	perTunnel bool
+
+	mu       sync.Mutex
+	client   endpoint
+	server   endpoint
+	finished int
+}
+
+// handshake emits the SYN, SYN-ACK and ACK that open the stream
+func (c *captureConn) handshake() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.client.seq, c.server.seq = 1000, 5000
+	if err := c.emit(now, &c.client, &c.server, tcpSYN, nil); err != nil {
+		return err
+	}
+	c.client.seq++
+	if err := c.emit(now, &c.server, &c.client, tcpSYN|tcpACK, nil); err != nil {
+		return err
+	}
+	c.server.seq++
+	return c.emit(now, &c.client, &c.server, tcpACK, nil)
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.record(&c.client, &c.server, p[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.record(&c.server, &c.client, p[:n])
+	}
+	return n, err
+}
+
+// CloseWrite records the server side FIN and half-closes the client
+func (c *captureConn) CloseWrite() error {
+	c.fin(&c.server, &c.client)
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *captureConn) Close() error {
+	c.fin(&c.client, &c.server)
+	err := c.Conn.Close()
+	if c.perTunnel {
+		c.file.close()
+	}
+	return err
+}
+
+// record emits data sent from src to dst as PSH-ACK segments
+func (c *captureConn) record(src, dst *endpoint, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for len(data) > 0 {
+		chunk := data[:min(len(data), pcapMaxPayload)]
+		if c.emit(now, src, dst, tcpPSH|tcpACK, chunk) != nil {
+			return
+		}
+		src.seq += uint32(len(chunk))
+		data = data[len(chunk):]
+	}
+}
+
+// fin emits a FIN from src once per direction
+func (c *captureConn) fin(src, dst *endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bit := 1
+	if src == &c.server {
+		bit = 2
+	}
+	if c.finished&bit != 0 {
+		return
+	}
+	c.finished |= bit
+	c.emit(time.Now(), src, dst, tcpFIN|tcpACK, nil)
+	src.seq++
+}
+
+// emit writes one TCP segment from src to dst
+func (c *captureConn) emit(ts time.Time, src, dst *endpoint, flags byte, payload []byte) error {
+	ack := dst.seq
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+	return c.file.writePacket(ts, tcpPacket(src, dst, src.seq, ack, flags, payload))
+}
+
+// tcpPacket builds an IPv4 or IPv6 packet carrying a TCP segment
+func tcpPacket(src, dst *endpoint, seq, ack uint32, flags byte, payload []byte) []byte {
+	segment := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:], src.port)
+	binary.BigEndian.PutUint16(segment[2:], dst.port)
+	binary.BigEndian.PutUint32(segment[4:], seq)
+	binary.BigEndian.PutUint32(segment[8:], ack)
+	segment[12] = 5 << 4
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], 65535)
+	copy(segment[20:], payload)
+
+	src4, dst4 := src.ip.To4(), dst.ip.To4()
+	if src4 != nil && dst4 != nil {
+		pseudo := append(append(append([]byte{}, src4...), dst4...), 0, 6, byte(len(segment)>>8), byte(len(segment)))
+		binary.BigEndian.PutUint16(segment[16:], checksum(pseudo, segment))
+
+		header := make([]byte, 20)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(segment)))
+		binary.BigEndian.PutUint16(header[6:], 0x4000) // Don't fragment
+		header[8] = 64
+		header[9] = 6
+		copy(header[12:], src4)
+		copy(header[16:], dst4)
+		binary.BigEndian.PutUint16(header[10:], checksum(header, nil))
+		return append(header, segment...)
+	}
+
+	src16, dst16 := src.ip.To16(), dst.ip.To16()
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:], src16)
+	copy(pseudo[16:], dst16)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(segment)))
+	pseudo[39] = 6
+	binary.BigEndian.PutUint16(segment[16:], checksum(pseudo, segment))
+
+	header := make([]byte, 40)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:], uint16(len(segment)))
+	header[6] = 6
+	header[7] = 64
+	copy(header[8:], src16)
+	copy(header[24:], dst16)
+	return append(header, segment...)
+}
+
+// checksum computes the Internet checksum over a and b
+func checksum(a, b []byte) uint16 {
+	var sum uint32
+	data := append(append([]byte{}, a...), b...)
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitizeFileName makes host safe to use in a file name
+func sanitizeFileName(host string) string {
+	return unsafeFileChars.ReplaceAllString(host, "_")
+}
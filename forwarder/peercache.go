@@ -0,0 +1,140 @@
+package forwarder
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// peerCacheHeader marks a peer's cache hit, so that a cached 404 is not
+// taken for a miss, and names the peer that answered
+const peerCacheHeader = "X-Gatelan-Peer-Cache"
+
+// newPeerCacheClient creates the client asking the peers' caches. Only
+// connecting and the response headers are bounded by timeout, a hit's body
+// may take as long as the client waits for it.
+func newPeerCacheClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			ResponseHeaderTimeout: timeout,
+			DisableCompression:    true,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// handlePeerCache answers a peer's cache miss from the local cache. Only
+// fresh entries are served and the request is never forwarded upstream, so
+// peers cannot loop.
+func (f *Forwarder) handlePeerCache(w http.ResponseWriter, r *http.Request) {
+	if !f.clusterAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	target, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || !target.IsAbs() {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Authorization")
+
+	if f.cache == nil || !f.cache.lookable(req) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	entry := f.cache.lookup(req)
+	if entry == nil || !entry.fresh(req, time.Now()) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp, err := f.cache.response(req, entry)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(peerCacheHeader, f.cluster.name)
+	if resp.StatusCode != http.StatusNotModified {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// peerCache asks every peer for a fresh copy of the response to req, which
+// missed the local cache, returning the first hit or nil when no peer has
+// one in time. Requests with credentials are not shared.
+func (f *Forwarder) peerCache(req *http.Request) *http.Response {
+	if f.cluster == nil || f.cluster.cacheClient == nil || len(f.cluster.config.Peers) == 0 {
+		return nil
+	}
+	if req.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	peers := f.cluster.config.Peers
+	results := make(chan *http.Response, len(peers))
+	for _, peer := range peers {
+		go func() { results <- f.askPeerCache(req, peer) }()
+	}
+	for i := range peers {
+		if resp := <-results; resp != nil {
+			// Close the hits of slower peers as they come in
+			go func(pending int) {
+				for range pending {
+					if resp := <-results; resp != nil {
+						resp.Body.Close()
+					}
+				}
+			}(len(peers) - i - 1)
+			f.metrics.inc("gatelan_cluster_cache_lookups_total", "result", "hit")
+			return resp
+		}
+	}
+	f.metrics.inc("gatelan_cluster_cache_lookups_total", "result", "miss")
+	return nil
+}
+
+// askPeerCache asks one peer's cache for req, returning nil on a miss or
+// when the peer cannot be reached
+func (f *Forwarder) askPeerCache(req *http.Request, peer string) *http.Response {
+	target := "http://" + peer + "/cluster/cache?url=" + url.QueryEscape(req.URL.String())
+	peerReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, target, nil)
+	if err != nil {
+		return nil
+	}
+	peerReq.Header = req.Header.Clone()
+	f.removeHopByHopHeaders(peerReq.Header)
+	peerReq.Header.Set("Authorization", "Bearer "+f.cluster.config.Secret)
+
+	resp, err := f.cluster.cacheClient.Do(peerReq)
+	if err != nil {
+		return nil
+	}
+	if resp.Header.Get(peerCacheHeader) == "" {
+		resp.Body.Close()
+		return nil
+	}
+	resp.Header.Del(peerCacheHeader)
+	resp.Header.Set("X-Cache", "PEER")
+	resp.Request = req
+	return resp
+}
@@ -0,0 +1,206 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// Global functions a policy script may define
+const (
+	policyRequestFunc = "on_request"
+	policyConnectFunc = "on_connect"
+)
+
+// policyDecision is what a policy script returned for one request
+type policyDecision struct {
+	Reject        int    // Status code to answer with instead of forwarding
+	Body          string // Body of the rejection
+	Upstream      string // Upstream proxy to use instead of the default
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+// policyEngine runs a compiled Lua script. LStates are not safe for
+// concurrent use, so idle ones are kept in a free list.
+type policyEngine struct {
+	proto   *lua.FunctionProto
+	timeout time.Duration
+
+	mu     sync.Mutex
+	states []*lua.LState
+}
+
+// newPolicyEngine compiles the script and runs it once to catch errors early
+func newPolicyEngine(cfg config.PolicyConfig) (*policyEngine, error) {
+	file, err := os.Open(cfg.Script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy script: %w", err)
+	}
+	defer file.Close()
+
+	chunk, err := parse.Parse(file, cfg.Script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy script: %w", err)
+	}
+	proto, err := lua.Compile(chunk, cfg.Script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile policy script: %w", err)
+	}
+
+	e := &policyEngine{proto: proto, timeout: time.Duration(cfg.Timeout)}
+	L, err := e.newState()
+	if err != nil {
+		return nil, err
+	}
+	e.put(L)
+	return e, nil
+}
+
+// newState creates a sandboxed interpreter with the script loaded
+func (e *policyEngine) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	L.Push(L.NewFunctionFromProto(e.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to run policy script: %w", err)
+	}
+	return L, nil
+}
+
+// get takes an idle interpreter or creates a new one
+func (e *policyEngine) get() (*lua.LState, error) {
+	e.mu.Lock()
+	if n := len(e.states); n > 0 {
+		L := e.states[n-1]
+		e.states = e.states[:n-1]
+		e.mu.Unlock()
+		return L, nil
+	}
+	e.mu.Unlock()
+	return e.newState()
+}
+
+// put returns an interpreter to the free list
+func (e *policyEngine) put(L *lua.LState) {
+	e.mu.Lock()
+	e.states = append(e.states, L)
+	e.mu.Unlock()
+}
+
+// evaluate calls the script function fn with a table describing req. It
+// returns nil when the script does not define fn or returns nothing.
+func (e *policyEngine) evaluate(fn string, req *http.Request) (*policyDecision, error) {
+	L, err := e.get()
+	if err != nil {
+		return nil, err
+	}
+
+	callback, ok := L.GetGlobal(fn).(*lua.LFunction)
+	if !ok {
+		e.put(L)
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), e.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	err = L.CallByParam(lua.P{Fn: callback, NRet: 1, Protect: true}, requestTable(L, req))
+	if err != nil {
+		// An aborted call can leave the stack in any state, so drop the interpreter
+		L.Close()
+		return nil, fmt.Errorf("policy %s failed: %w", fn, err)
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	L.RemoveContext()
+	e.put(L)
+
+	table, ok := result.(*lua.LTable)
+	if !ok {
+		return nil, nil
+	}
+	return parseDecision(table), nil
+}
+
+// requestTable exposes the request fields a script may inspect
+func requestTable(L *lua.LState, req *http.Request) *lua.LTable {
+	headers := L.NewTable()
+	for name := range req.Header {
+		headers.RawSetString(strings.ToLower(name), lua.LString(req.Header.Get(name)))
+	}
+
+	t := L.NewTable()
+	t.RawSetString("method", lua.LString(req.Method))
+	t.RawSetString("url", lua.LString(req.URL.String()))
+	t.RawSetString("host", lua.LString(req.Host))
+	t.RawSetString("path", lua.LString(req.URL.Path))
+	t.RawSetString("client", lua.LString(remoteIP(req)))
+	t.RawSetString("headers", headers)
+	return t
+}
+
+// parseDecision reads the fields of the table returned by the script
+func parseDecision(t *lua.LTable) *policyDecision {
+	d := &policyDecision{}
+	if status, ok := t.RawGetString("reject").(lua.LNumber); ok {
+		d.Reject = int(status)
+	}
+	d.Body = lua.LVAsString(t.RawGetString("body"))
+	d.Upstream = lua.LVAsString(t.RawGetString("upstream"))
+
+	if set, ok := t.RawGetString("set_headers").(*lua.LTable); ok {
+		d.SetHeaders = make(map[string]string)
+		set.ForEach(func(name, value lua.LValue) {
+			d.SetHeaders[lua.LVAsString(name)] = lua.LVAsString(value)
+		})
+	}
+	if remove, ok := t.RawGetString("remove_headers").(*lua.LTable); ok {
+		remove.ForEach(func(_, name lua.LValue) {
+			d.RemoveHeaders = append(d.RemoveHeaders, lua.LVAsString(name))
+		})
+	}
+	return d
+}
+
+// applyHeaders rewrites proxyReq headers as the script asked
+func (d *policyDecision) applyHeaders(header http.Header) {
+	for _, name := range d.RemoveHeaders {
+		header.Del(name)
+	}
+	for name, value := range d.SetHeaders {
+		header.Set(name, value)
+	}
+}
+
+// evaluatePolicy runs the policy script for req, if one is configured
+func (f *Forwarder) evaluatePolicy(fn string, req *http.Request) (*policyDecision, error) {
+	if f.policy == nil {
+		return nil, nil
+	}
+	return f.policy.evaluate(fn, req)
+}
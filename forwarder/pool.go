@@ -0,0 +1,151 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// poolStats counts the connections of one upstream's pool
+type poolStats struct {
+	created  atomic.Uint64
+	reused   atomic.Uint64
+	reaped   atomic.Uint64
+	warmed   atomic.Uint64 // Connections handed out from those opened ahead of requests
+	open     atomic.Int64
+	inUse    atomic.Int64
+	lastUsed atomic.Int64 // Unix nanoseconds of the last request taking a connection
+}
+
+// idle returns the open connections no request holds
+func (s *poolStats) idle() int64 {
+	return max(s.open.Load()-s.inUse.Load(), 0)
+}
+
+// countDials wraps a transport's dial function to count the connections it
+// opens and closes
+func (s *poolStats) countDials(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		s.created.Add(1)
+		s.open.Add(1)
+		return &pooledConn{Conn: conn, stats: s}, nil
+	}
+}
+
+// pooledConn leaves the open count when closed
+type pooledConn struct {
+	net.Conn
+	stats *poolStats
+	once  sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() { c.stats.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// poolTake tracks the connections one attempt takes from the pool, until
+// its exchange is over
+type poolTake struct {
+	stats *poolStats
+	held  atomic.Int64
+}
+
+// got records a connection handed to the attempt
+func (t *poolTake) got(reused bool) {
+	if reused {
+		t.stats.reused.Add(1)
+	}
+	t.stats.inUse.Add(1)
+	t.stats.lastUsed.Store(time.Now().UnixNano())
+	t.held.Add(1)
+}
+
+// done gives the connections back once the response is read or failed
+func (t *poolTake) done() {
+	t.stats.inUse.Add(-t.held.Swap(0))
+}
+
+// poolUpstreams returns every upstream with a pool once: those of the active
+// profile, listener and tenant profiles and dedicated ones, direct ones
+// included
+func (f *Forwarder) poolUpstreams() []*upstream {
+	var result []*upstream
+	seen := make(map[*upstream]bool)
+	add := func(ups ...*upstream) {
+		for _, up := range ups {
+			if up != nil && !seen[up] {
+				seen[up] = true
+				result = append(result, up)
+			}
+		}
+	}
+	current := f.current()
+	add(current.upstreams...)
+	add(current.direct)
+	f.dedicatedMu.Lock()
+	defer f.dedicatedMu.Unlock()
+	for _, up := range f.dedicated {
+		add(up)
+	}
+	for _, p := range f.bound {
+		add(p.upstreams...)
+		add(p.direct)
+	}
+	for _, t := range f.tenants {
+		if t.profile != nil {
+			add(t.profile.upstreams...)
+			add(t.profile.direct)
+		}
+	}
+	return result
+}
+
+// collectPoolMetrics copies the pool statistics into the metrics ahead of
+// an export
+func (f *Forwarder) collectPoolMetrics() {
+	for _, up := range f.poolUpstreams() {
+		s := up.pool
+		f.metrics.set("gatelan_upstream_conns", float64(s.idle()), "upstream", up.name, "state", "idle")
+		f.metrics.set("gatelan_upstream_conns", float64(s.inUse.Load()), "upstream", up.name, "state", "in_use")
+		f.metrics.store("gatelan_upstream_conns_created_total", float64(s.created.Load()), "upstream", up.name)
+		f.metrics.store("gatelan_upstream_conns_reused_total", float64(s.reused.Load()), "upstream", up.name)
+		f.metrics.store("gatelan_upstream_conns_reaped_total", float64(s.reaped.Load()), "upstream", up.name)
+		f.metrics.store("gatelan_upstream_conns_prewarmed_total", float64(s.warmed.Load()), "upstream", up.name)
+	}
+}
+
+// reapIdleConns closes, once per pool.reap_interval until ctx is cancelled,
+// the idle connections of upstreams no request used since the previous
+// sweep. Without an idle_conn_timeout the transport would keep them open.
+func (f *Forwarder) reapIdleConns(ctx context.Context) {
+	interval := time.Duration(f.config.Pool.ReapInterval)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, up := range f.poolUpstreams() {
+			s := up.pool
+			idle := s.idle()
+			if idle == 0 || time.Since(time.Unix(0, s.lastUsed.Load())) < interval {
+				continue
+			}
+			up.closeIdleConnections()
+			s.reaped.Add(uint64(idle))
+			f.logger.Printf("Closed %d idle connections to upstream %s", idle, up.name)
+		}
+	}
+}
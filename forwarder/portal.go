@@ -0,0 +1,364 @@
+package forwarder
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// PortalPage is the data portal page templates are executed with
+type PortalPage struct {
+	Action   string // URL the form posts to
+	URL      string // Where the client was going, resumed after accepting
+	Password bool   // Whether the form must ask for the shared passphrase
+	Accepted bool   // The client has accepted and may browse
+	Expires  time.Time
+	Error    string
+	Client   string
+}
+
+// PortalClient is an accepted client in the portal table
+type PortalClient struct {
+	Client  string    `json:"client"`
+	Expires time.Time `json:"expires"`
+}
+
+var defaultPortalPage = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Network access</title></head>
+<body>
+<h1>Network access</h1>
+{{if .Accepted}}<p>You are connected until {{.Expires.Format "2006-01-02 15:04"}}.</p>
+{{else}}<form method="post" action="{{.Action}}">
+<input type="hidden" name="url" value="{{.URL}}">
+{{if .Error}}<p><strong>{{.Error}}</strong></p>
+{{end}}<p><label><input type="checkbox" name="accept" value="1"> I accept the terms of use of this network</label></p>
+{{if .Password}}<p><label>Passphrase <input type="password" name="password"></label></p>
+{{end}}<p><button type="submit">Continue</button></p>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// portalChange is the latest acceptance or revocation of a client, as
+// exchanged with cluster peers
+type portalChange struct {
+	Expires time.Time `json:"expires,omitempty"` // Zero once revoked
+	Time    time.Time `json:"time"`              // Zero for acceptances loaded from the file
+}
+
+// captivePortal tracks which clients accepted the terms and until when
+type captivePortal struct {
+	config config.PortalConfig
+	page   *template.Template
+	exempt []*net.IPNet
+
+	mu       sync.Mutex
+	accepted map[string]time.Time // Client IP to expiry
+	changed  map[string]time.Time // When clients were accepted or revoked while running, for the cluster
+
+	saveMu sync.Mutex // Serialises writes of the file
+}
+
+// newCaptivePortal creates the portal, restoring persisted acceptances if any
+func newCaptivePortal(cfg config.PortalConfig) (*captivePortal, error) {
+	p := &captivePortal{
+		config:   cfg,
+		page:     defaultPortalPage,
+		accepted: make(map[string]time.Time),
+		changed:  make(map[string]time.Time),
+	}
+	var err error
+	if p.exempt, err = acl.ParseNetworks(cfg.Exempt); err != nil {
+		return nil, fmt.Errorf("invalid portal exempt: %w", err)
+	}
+	if cfg.Page != "" {
+		if p.page, err = template.ParseFiles(cfg.Page); err != nil {
+			return nil, fmt.Errorf("failed to load portal page: %w", err)
+		}
+	}
+	if cfg.File == "" {
+		return p, nil
+	}
+
+	data, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read portal file: %w", err)
+	}
+	if err := json.Unmarshal(data, &p.accepted); err != nil {
+		return nil, fmt.Errorf("failed to parse portal file: %w", err)
+	}
+	return p, nil
+}
+
+// expiry returns when the acceptance of client ends, zero when it has none.
+// Clients whose acceptance ran out are dropped.
+func (p *captivePortal) expiry(client string) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expires, ok := p.accepted[client]
+	if ok && time.Now().After(expires) {
+		delete(p.accepted, client)
+		return time.Time{}
+	}
+	return expires
+}
+
+// admitted reports whether client may browse
+func (p *captivePortal) admitted(client string) bool {
+	if p == nil || client == "" {
+		return true
+	}
+	if ip := net.ParseIP(client); ip != nil && acl.ContainsIP(p.exempt, ip) {
+		return true
+	}
+	return !p.expiry(client).IsZero()
+}
+
+// accept admits client for the configured expiry and persists the table
+func (p *captivePortal) accept(client string) (time.Time, error) {
+	now := time.Now()
+	expires := now.Add(time.Duration(p.config.Expiry))
+	p.mu.Lock()
+	p.accepted[client] = expires
+	p.changed[client] = now
+	p.mu.Unlock()
+	return expires, p.save()
+}
+
+// revoke removes the acceptance of client, reporting whether it had one
+func (p *captivePortal) revoke(client string) (bool, error) {
+	p.mu.Lock()
+	_, ok := p.accepted[client]
+	delete(p.accepted, client)
+	if ok {
+		p.changed[client] = time.Now()
+	}
+	p.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, p.save()
+}
+
+// clients lists the unexpired acceptances by client
+func (p *captivePortal) clients() []PortalClient {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	p.mu.Lock()
+	result := make([]PortalClient, 0, len(p.accepted))
+	for client, expires := range p.accepted {
+		if now.Before(expires) {
+			result = append(result, PortalClient{Client: client, Expires: expires})
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Client < result[j].Client })
+	return result
+}
+
+// clusterState returns the unexpired acceptances and recent revocations with
+// their latest change, for the cluster peers
+func (p *captivePortal) clusterState() map[string]portalChange {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := make(map[string]portalChange)
+	for client, expires := range p.accepted {
+		if now.Before(expires) {
+			state[client] = portalChange{Expires: expires, Time: p.changed[client]}
+		}
+	}
+	for client, changed := range p.changed {
+		if _, ok := state[client]; !ok && now.Sub(changed) < clusterTombstoneAge {
+			state[client] = portalChange{Time: changed}
+		}
+	}
+	return state
+}
+
+// merge applies the acceptances and revocations of a peer that are newer
+// than the local ones, and the later expiry of acceptances both only know
+// from their files, persisting the table when that changed it
+func (p *captivePortal) merge(state map[string]portalChange) (bool, error) {
+	if p == nil {
+		return false, nil
+	}
+	changed := false
+	p.mu.Lock()
+	for client, remote := range state {
+		if net.ParseIP(client) == nil {
+			continue
+		}
+		local, ok := p.accepted[client]
+		switch {
+		case remote.Time.After(p.changed[client]):
+			p.changed[client] = remote.Time
+		case remote.Time.IsZero() && p.changed[client].IsZero() && remote.Expires.After(local):
+		default:
+			continue
+		}
+		switch {
+		case remote.Expires.IsZero():
+			if ok {
+				delete(p.accepted, client)
+				changed = true
+			}
+		case !remote.Expires.Equal(local):
+			p.accepted[client] = remote.Expires
+			changed = true
+		}
+	}
+	p.mu.Unlock()
+	if !changed {
+		return false, nil
+	}
+	return true, p.save()
+}
+
+// compact drops expired acceptances and saves the rest
+func (p *captivePortal) compact() error {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	p.mu.Lock()
+	for client, expires := range p.accepted {
+		if !now.Before(expires) {
+			delete(p.accepted, client)
+		}
+	}
+	p.mu.Unlock()
+	return p.save()
+}
+
+// save persists the unexpired acceptances to the configured file, if any
+func (p *captivePortal) save() error {
+	if p.config.File == "" {
+		return nil
+	}
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	accepted := make(map[string]time.Time)
+	for _, c := range p.clients() {
+		accepted[c.Client] = c.Expires
+	}
+	data, err := json.Marshal(accepted)
+	if err != nil {
+		return fmt.Errorf("failed to encode portal clients: %w", err)
+	}
+
+	// Write then rename so a crash never leaves a truncated file
+	tmp := p.config.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write portal file: %w", err)
+	}
+	return os.Rename(tmp, p.config.File)
+}
+
+// portalResponse serves the portal page for requests to its host and
+// redirects clients that have not accepted yet to it. It returns nil for
+// requests to forward.
+func (f *Forwarder) portalResponse(req *http.Request) *http.Response {
+	if f.portal == nil {
+		return nil
+	}
+	client := remoteIP(req)
+	if !strings.EqualFold(req.URL.Hostname(), f.portal.config.Host) {
+		if f.portal.admitted(client) {
+			return nil
+		}
+		f.logf(req, "Sending %s to the portal before %s %s", f.clientLabel(req), req.Method, req.URL.String())
+		resp := newResponse(req, http.StatusFound, "")
+		resp.Header.Set("Location", f.portalURL(req.URL.String()))
+		resp.Header.Set("Cache-Control", "no-store")
+		return resp
+	}
+
+	page := PortalPage{
+		Action:   f.portalURL(""),
+		URL:      req.URL.Query().Get("url"),
+		Password: f.portal.config.Password != "",
+		Client:   client,
+	}
+	if req.Method == http.MethodPost {
+		req.ParseForm()
+		page.URL = req.PostFormValue("url")
+		switch {
+		case req.PostFormValue("accept") == "":
+			page.Error = "Please accept the terms to continue."
+		case page.Password && subtle.ConstantTimeCompare([]byte(req.PostFormValue("password")), []byte(f.portal.config.Password)) != 1:
+			page.Error = "The passphrase is not correct."
+		default:
+			expires, err := f.portal.accept(client)
+			if err != nil {
+				f.logf(req, "Failed to save portal clients: %v", err)
+			}
+			f.logf(req, "Portal accepted %s until %s", f.clientLabel(req), expires.Format(time.RFC3339))
+			f.metrics.inc("gatelan_portal_acceptances_total")
+			if target, err := url.Parse(page.URL); err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != "" {
+				resp := newResponse(req, http.StatusSeeOther, "")
+				resp.Header.Set("Location", target.String())
+				return resp
+			}
+		}
+	}
+	if expires := f.portal.expiry(client); !expires.IsZero() {
+		page.Accepted, page.Expires = true, expires
+	}
+
+	var body strings.Builder
+	if err := f.portal.page.Execute(&body, page); err != nil {
+		f.logf(req, "Failed to render portal page: %v", err)
+		return newResponse(req, http.StatusInternalServerError, "Failed to render portal page\n")
+	}
+	resp := newResponse(req, http.StatusOK, body.String())
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// portalURL returns the address of the portal page, resuming at target after
+// accepting when it is set
+func (f *Forwarder) portalURL(target string) string {
+	u := url.URL{Scheme: "http", Host: f.portal.config.Host, Path: "/"}
+	if target != "" {
+		u.RawQuery = url.Values{"url": {target}}.Encode()
+	}
+	return u.String()
+}
+
+// PortalClients lists the clients that accepted the portal terms and until when
+func (f *Forwarder) PortalClients() []PortalClient {
+	return f.portal.clients()
+}
+
+// RevokePortalClient makes client accept the portal terms again, reporting
+// whether it had accepted them
+func (f *Forwarder) RevokePortalClient(client string) (bool, error) {
+	if f.portal == nil {
+		return false, nil
+	}
+	return f.portal.revoke(client)
+}
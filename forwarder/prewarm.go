@@ -0,0 +1,298 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// hotDestinationsMax is the number of ranked destinations beyond which the
+// lower half is dropped
+const hotDestinationsMax = 4096
+
+// hotDestinations ranks destinations by their requests, each counting half
+// as much once it is a half-life old. A nil ranking ranks nothing.
+type hotDestinations struct {
+	halfLife time.Duration
+
+	mu     sync.Mutex
+	scores map[string]*hotScore // By host:port
+}
+
+// hotScore is the rank of a destination as of its last request
+type hotScore struct {
+	value   float64
+	updated time.Time
+}
+
+// at returns the score decayed to now
+func (s *hotScore) at(now time.Time, halfLife time.Duration) float64 {
+	return s.value * math.Exp2(-now.Sub(s.updated).Seconds()/halfLife.Seconds())
+}
+
+// newHotDestinations returns nil when prewarming is disabled
+func newHotDestinations(cfg config.PrewarmConfig) *hotDestinations {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &hotDestinations{halfLife: time.Duration(cfg.HalfLife), scores: make(map[string]*hotScore)}
+}
+
+// hit counts a request reaching addr
+func (h *hotDestinations) hit(addr string) {
+	if h == nil {
+		return
+	}
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.scores[addr]
+	if s == nil {
+		if len(h.scores) >= hotDestinationsMax {
+			for _, cold := range h.ranked(now)[hotDestinationsMax/2:] {
+				delete(h.scores, cold)
+			}
+		}
+		s = &hotScore{}
+		h.scores[addr] = s
+	}
+	s.value = s.at(now, h.halfLife) + 1
+	s.updated = now
+}
+
+// top returns the n destinations ranked highest
+func (h *hotDestinations) top(n int) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ranked := h.ranked(time.Now())
+	return ranked[:min(n, len(ranked))]
+}
+
+// ranked returns the destinations from the highest score down; h.mu must be
+// held
+func (h *hotDestinations) ranked(now time.Time) []string {
+	addrs := make([]string, 0, len(h.scores))
+	scores := make(map[string]float64, len(h.scores))
+	for addr, s := range h.scores {
+		addrs = append(addrs, addr)
+		scores[addr] = s.at(now, h.halfLife)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return scores[addrs[i]] > scores[addrs[j]] })
+	return addrs
+}
+
+// warmDialer hands out the connections opened ahead of requests before
+// dialing new ones
+type warmDialer struct {
+	tunnel.ContextDialer
+	stats *poolStats
+
+	mu     sync.Mutex
+	parked map[string][]parkedConn // By address dialed, oldest first
+}
+
+// parkedConn is a connection waiting for a request
+type parkedConn struct {
+	conn    net.Conn
+	expires time.Time
+}
+
+// prewarmed returns base handing out the connections prewarming opens for
+// up, or base itself when prewarming does not connect
+func (up *upstream) prewarmed(cfg *config.Config, base tunnel.ContextDialer) tunnel.ContextDialer {
+	if !cfg.Prewarm.Enabled || !cfg.Prewarm.Connect {
+		return base
+	}
+	up.warm = &warmDialer{ContextDialer: base, stats: up.pool, parked: make(map[string][]parkedConn)}
+	return up.warm
+}
+
+func (d *warmDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "tcp" {
+		if conn, err := d.take(ctx, addr); conn != nil || err != nil {
+			return conn, err
+		}
+	}
+	return d.ContextDialer.DialContext(ctx, network, addr)
+}
+
+// take returns the newest live connection parked for addr, after the checks
+// and marks of the request dialing it, or nil when there is none
+func (d *warmDialer) take(ctx context.Context, addr string) (net.Conn, error) {
+	for {
+		d.mu.Lock()
+		parked := d.parked[addr]
+		if len(parked) == 0 {
+			d.mu.Unlock()
+			return nil, nil
+		}
+		p := parked[len(parked)-1]
+		d.parked[addr] = parked[:len(parked)-1]
+		d.mu.Unlock()
+
+		if time.Now().After(p.expires) || !idleAlive(p.conn) {
+			p.conn.Close()
+			continue
+		}
+		if guard, ok := ctx.Value(destinationGuardKey{}).(destinationGuard); ok {
+			if remote, ok := p.conn.RemoteAddr().(*net.TCPAddr); ok {
+				if err := guard(remote.IP); err != nil {
+					p.conn.Close()
+					return nil, err
+				}
+			}
+		}
+		if dscp, ok := ctx.Value(dscpContextKey{}).(int); ok {
+			setDSCP(p.conn, dscp)
+		}
+		d.stats.warmed.Add(1)
+		return p.conn, nil
+	}
+}
+
+// idleAlive reports whether the peer of an idle connection has neither
+// closed it nor sent anything, the read having to time out
+func idleAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	var probe [1]byte
+	_, err := conn.Read(probe[:])
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// prepare keeps wants[addr] connections parked for each address, closing
+// the expired ones and those no longer wanted, and returns the number dialed
+// and failed
+func (d *warmDialer) prepare(ctx context.Context, wants map[string]int, maxIdle, timeout time.Duration) (int, int) {
+	now := time.Now()
+	missing := make(map[string]int)
+	d.mu.Lock()
+	for addr, parked := range d.parked {
+		var kept []parkedConn
+		for i, p := range parked {
+			// The oldest beyond the wanted count go first
+			if now.After(p.expires) || len(parked)-i > wants[addr] {
+				p.conn.Close()
+				continue
+			}
+			kept = append(kept, p)
+		}
+		if len(kept) == 0 {
+			delete(d.parked, addr)
+		} else {
+			d.parked[addr] = kept
+		}
+	}
+	for addr, want := range wants {
+		if n := want - len(d.parked[addr]); n > 0 {
+			missing[addr] = n
+		}
+	}
+	d.mu.Unlock()
+
+	dialed, failed := 0, 0
+	for addr, n := range missing {
+		for range n {
+			dialCtx, cancel := ctx, context.CancelFunc(func() {})
+			if timeout > 0 {
+				dialCtx, cancel = context.WithTimeout(ctx, timeout)
+			}
+			conn, err := d.ContextDialer.DialContext(dialCtx, "tcp", addr)
+			cancel()
+			if err != nil {
+				failed++
+				break
+			}
+			dialed++
+			d.mu.Lock()
+			d.parked[addr] = append(d.parked[addr], parkedConn{conn: conn, expires: time.Now().Add(maxIdle)})
+			d.mu.Unlock()
+		}
+	}
+	return dialed, failed
+}
+
+// release closes the connections parked
+func (d *warmDialer) release() {
+	if d != nil {
+		d.prepare(context.Background(), nil, 0, 0)
+	}
+}
+
+// prewarm prepares for the hottest destinations once per prewarm.interval
+// until ctx is cancelled, then closes the connections left parked
+func (f *Forwarder) prewarm(ctx context.Context) {
+	if f.hot == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(f.config.Prewarm.Interval))
+	defer ticker.Stop()
+	defer func() {
+		for _, up := range f.poolUpstreams() {
+			up.warm.release()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		f.prepareHot(ctx)
+	}
+}
+
+// prepareHot resolves the names of the hottest destinations reached
+// directly and parks connections toward each: to the destination itself, or
+// to the upstream proxy it goes through
+func (f *Forwarder) prepareHot(ctx context.Context) {
+	cfg := f.config.Prewarm
+	p := f.current()
+	wants := make(map[*upstream]map[string]int)
+	for _, addr := range f.hot.top(cfg.Top) {
+		up := p.direct
+		if !p.bypass.match(addr) {
+			var err error
+			if up, err = f.selectUpstream(ctx, 0); err != nil {
+				return
+			}
+			// Real requests probe a half-open upstream
+			up.breaker.release()
+		}
+		target := up.dialAddr
+		if up.direct {
+			target = addr
+			if host, _, err := net.SplitHostPort(addr); cfg.Resolve && err == nil && net.ParseIP(host) == nil {
+				result := "ok"
+				if _, err := net.DefaultResolver.LookupIPAddr(ctx, host); err != nil {
+					result = "error"
+				}
+				f.metrics.inc("gatelan_prewarm_lookups_total", "result", result)
+			}
+		}
+		if !cfg.Connect || up.warm == nil || target == "" {
+			continue
+		}
+		if wants[up] == nil {
+			wants[up] = make(map[string]int)
+		}
+		wants[up][target]++
+	}
+
+	for _, up := range f.poolUpstreams() {
+		if up.warm == nil {
+			continue
+		}
+		dialed, failed := up.warm.prepare(ctx, wants[up], time.Duration(cfg.MaxIdle), f.config.Timeouts.Dial.Timeout())
+		f.metrics.add("gatelan_prewarm_dials_total", float64(dialed), "upstream", up.name, "result", "ok")
+		f.metrics.add("gatelan_prewarm_dials_total", float64(failed), "upstream", up.name, "result", "error")
+	}
+}
@@ -0,0 +1,193 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// profile holds the upstreams and rules of the active configuration profile,
+// replaced as a whole when switching to another
+type profile struct {
+	name      string
+	config    *config.Config // The forwarder's config with the profile applied
+	upstreams []*upstream
+	direct    *upstream // Reaches destinations on the bypass list, or all while falling back, without a proxy
+	bypass    *bypassList
+	rules     acl.Rules
+	rewrites  []urlRewrite
+	redirects []urlRedirect
+}
+
+// newProfile creates the upstreams and rules of the named profile, the
+// top-level ones for the empty name
+func (f *Forwarder) newProfile(name string) (*profile, error) {
+	cfg, err := f.config.WithProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ProxyAddr == "" {
+		return nil, fmt.Errorf("no proxy_addr configured for profile %q", name)
+	}
+
+	p := &profile{name: name, config: cfg}
+	if p.upstreams, err = f.newPool(cfg); err != nil {
+		return nil, err
+	}
+	if p.bypass, err = newBypassList(cfg.NoProxy); err != nil {
+		return nil, err
+	}
+	if p.bypass != nil || cfg.CircuitBreaker.FallbackDirect {
+		p.direct, _ = newUpstream(config.UpstreamDirect, cfg)
+	}
+
+	if p.rules, err = newAccessRules(cfg.AccessRules); err != nil {
+		return nil, err
+	}
+	if p.rewrites, err = newURLRewrites(cfg.Rewrites); err != nil {
+		return nil, err
+	}
+	if p.redirects, err = newURLRedirects(cfg.Redirects); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// newPool creates the upstream pool of cfg: proxy_addr, then upstreams
+func (f *Forwarder) newPool(cfg *config.Config) ([]*upstream, error) {
+	var pool []*upstream
+	for _, addr := range append([]string{cfg.ProxyAddr}, cfg.Upstreams...) {
+		up, err := newUpstream(addr, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create upstream: %w", err)
+		}
+		up.breaker = f.newBreaker(up.name)
+		up.latency = f.newLatencyTracker(up.name)
+		pool = append(pool, up)
+	}
+	return pool, nil
+}
+
+// current returns the active profile
+func (f *Forwarder) current() *profile {
+	return f.active.Load()
+}
+
+// profileContextKey carries the profile of a listener through a request context
+type profileContextKey struct{}
+
+// withProfile makes p apply to requests using ctx instead of the active profile
+func withProfile(ctx context.Context, p *profile) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, profileContextKey{}, p)
+}
+
+// profileFor returns the profile applying to requests using ctx
+func (f *Forwarder) profileFor(ctx context.Context) *profile {
+	if p, ok := ctx.Value(profileContextKey{}).(*profile); ok {
+		return p
+	}
+	return f.current()
+}
+
+// Profile returns the name of the active profile, empty when none is
+func (f *Forwarder) Profile() string {
+	return f.current().name
+}
+
+// Profiles returns the names of the configured profiles in sorted order
+func (f *Forwarder) Profiles() []string {
+	return f.config.ProfileNames()
+}
+
+// SwitchProfile replaces the upstreams and rules with those of the named
+// profile, or the top-level ones for the empty name. Requests in flight
+// finish on the previous upstreams.
+func (f *Forwarder) SwitchProfile(name string) error {
+	f.profileMu.Lock()
+	defer f.profileMu.Unlock()
+	return f.switchProfile(name)
+}
+
+// CycleProfile switches to the profile following the active one in sorted
+// order, wrapping around, and returns its name
+func (f *Forwarder) CycleProfile() (string, error) {
+	f.profileMu.Lock()
+	defer f.profileMu.Unlock()
+
+	names := f.Profiles()
+	if len(names) == 0 {
+		return "", errors.New("no profiles configured")
+	}
+	next := names[0]
+	for i, name := range names {
+		if name == f.Profile() {
+			next = names[(i+1)%len(names)]
+		}
+	}
+	return next, f.switchProfile(next)
+}
+
+// switchProfile activates the named profile; f.profileMu must be held
+func (f *Forwarder) switchProfile(name string) error {
+	p, err := f.newProfile(name)
+	if err != nil {
+		return err
+	}
+	previous := f.active.Swap(p)
+	f.fallback.Store(false)
+	for _, up := range append(previous.upstreams, previous.direct) {
+		if up != nil {
+			up.closeIdleConnections()
+		}
+	}
+	f.logger.Printf("Switched from profile %q to %q", previous.name, name)
+	f.metrics.inc("gatelan_profile_switches_total", "profile", name)
+	return nil
+}
+
+// Upstreams returns the pool of the active profile in order, credentials
+// redacted
+func (f *Forwarder) Upstreams() []string {
+	var names []string
+	for _, up := range f.current().upstreams {
+		names = append(names, up.name)
+	}
+	return names
+}
+
+// SetUpstreams replaces the pool of the active profile with addrs, in the
+// form of proxy_addr and upstreams. New requests and tunnels use it at once,
+// those in flight finish on the previous upstreams. The change lasts until
+// the next profile switch or restart.
+func (f *Forwarder) SetUpstreams(addrs []string) error {
+	if len(addrs) == 0 {
+		return errors.New("at least one upstream is required")
+	}
+	f.profileMu.Lock()
+	defer f.profileMu.Unlock()
+
+	previous := f.current()
+	cfg := *previous.config
+	cfg.ProxyAddr, cfg.Upstreams = addrs[0], addrs[1:]
+	pool, err := f.newPool(&cfg)
+	if err != nil {
+		return err
+	}
+	p := *previous
+	p.config, p.upstreams = &cfg, pool
+	f.active.Store(&p)
+	f.fallback.Store(false)
+	for _, up := range previous.upstreams {
+		up.closeIdleConnections()
+	}
+	f.logger.Printf("Upstreams of profile %q are now %s", p.name, strings.Join(f.Upstreams(), ", "))
+	f.metrics.inc("gatelan_upstream_swaps_total")
+	return nil
+}
@@ -0,0 +1,139 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Protocol Buffers wire types used by the control API
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// pbMessage encodes a protobuf message field by field. Zero scalars are left
+// out as proto3 does.
+type pbMessage struct {
+	buf []byte
+}
+
+// tag writes the key of a field
+func (m *pbMessage) tag(field, wire int) {
+	m.buf = binary.AppendUvarint(m.buf, uint64(field)<<3|uint64(wire))
+}
+
+// uint writes an unsigned varint field
+func (m *pbMessage) uint(field int, v uint64) {
+	if v != 0 {
+		m.tag(field, pbVarint)
+		m.buf = binary.AppendUvarint(m.buf, v)
+	}
+}
+
+// int writes a signed varint field, int64 in the schema
+func (m *pbMessage) int(field int, v int64) {
+	m.uint(field, uint64(v))
+}
+
+// bool writes a bool field
+func (m *pbMessage) bool(field int, v bool) {
+	if v {
+		m.uint(field, 1)
+	}
+}
+
+// double writes a double field
+func (m *pbMessage) double(field int, v float64) {
+	if v != 0 {
+		m.tag(field, pbFixed64)
+		m.buf = binary.LittleEndian.AppendUint64(m.buf, math.Float64bits(v))
+	}
+}
+
+// string writes a string field
+func (m *pbMessage) string(field int, s string) {
+	if s != "" {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// strings writes a repeated string field
+func (m *pbMessage) strings(field int, values []string) {
+	for _, s := range values {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// message embeds sub, also when it is empty, as repeated entries need that
+func (m *pbMessage) message(field int, sub *pbMessage) {
+	m.bytes(field, sub.buf)
+}
+
+// bytes writes a length-delimited field
+func (m *pbMessage) bytes(field int, b []byte) {
+	m.tag(field, pbBytes)
+	m.buf = binary.AppendUvarint(m.buf, uint64(len(b)))
+	m.buf = append(m.buf, b...)
+}
+
+// pbField is one decoded field: varints and fixed values in num, length
+// delimited ones in data
+type pbField struct {
+	number int
+	wire   int
+	num    uint64
+	data   []byte
+}
+
+var errPBTruncated = errors.New("truncated protobuf message")
+
+// decodePB splits a protobuf message into its fields
+func decodePB(buf []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errPBTruncated
+		}
+		buf = buf[n:]
+		field := pbField{number: int(key >> 3), wire: int(key & 7)}
+		switch field.wire {
+		case pbVarint:
+			if field.num, n = binary.Uvarint(buf); n <= 0 {
+				return nil, errPBTruncated
+			}
+			buf = buf[n:]
+		case pbFixed64:
+			if len(buf) < 8 {
+				return nil, errPBTruncated
+			}
+			field.num, buf = binary.LittleEndian.Uint64(buf), buf[8:]
+		case pbFixed32:
+			if len(buf) < 4 {
+				return nil, errPBTruncated
+			}
+			field.num, buf = uint64(binary.LittleEndian.Uint32(buf)), buf[4:]
+		case pbBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < size {
+				return nil, errPBTruncated
+			}
+			field.data, buf = buf[n:n+int(size)], buf[n+int(size):]
+		default:
+			return nil, errors.New("unsupported protobuf wire type")
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// float returns a double field's value
+func (f pbField) float() float64 {
+	if f.wire == pbFixed32 {
+		return float64(math.Float32frombits(uint32(f.num)))
+	}
+	return math.Float64frombits(f.num)
+}
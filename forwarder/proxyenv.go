@@ -0,0 +1,179 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/n0z0/GateLAN/acl"
+)
+
+// proxySettings is an upstream proxy discovered outside the configuration
+type proxySettings struct {
+	addr    string
+	noProxy []string
+	source  string
+}
+
+// detectProxy finds an upstream proxy in the environment, then in the
+// operating system's settings
+func detectProxy() (proxySettings, bool) {
+	for _, name := range []string{"https_proxy", "HTTPS_PROXY", "http_proxy", "HTTP_PROXY"} {
+		addr := proxyHostPort(os.Getenv(name))
+		if addr == "" {
+			continue
+		}
+		noProxy := os.Getenv("no_proxy")
+		if noProxy == "" {
+			noProxy = os.Getenv("NO_PROXY")
+		}
+		return proxySettings{addr: addr, noProxy: splitList(noProxy, ","), source: name}, true
+	}
+	return systemProxy()
+}
+
+// proxyHostPort extracts host:port from a proxy URL or bare address, or ""
+// when it doesn't name an HTTP proxy
+func proxyHostPort(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "http" || u.Hostname() == "" {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// splitList splits a separated list, dropping blank entries
+func splitList(list, sep string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, sep) {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// bypassList holds the destinations reached directly instead of upstream
+type bypassList struct {
+	all     bool
+	local   bool // Host names without a dot, as "<local>" stands for on Windows
+	entries []bypassEntry
+}
+
+// bypassEntry is one destination of a bypass list, matched by one of its
+// domain, network or pattern
+type bypassEntry struct {
+	domain  string // Matching subdomains too
+	network *net.IPNet
+	pattern *regexp.Regexp // Matched against the host name
+	port    string         // Any port when empty
+}
+
+// newBypassList compiles NO_PROXY style entries: "*", host names with
+// optional leading dots or wildcards, IP addresses and CIDR networks, each
+// with an optional port. Entries may also be glob patterns such as "10.*",
+// "<local>" for names without a dot, or regular expressions prefixed with
+// "~" matched against the host name.
+func newBypassList(entries []string) (*bypassList, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	b := &bypassList{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "*":
+			b.all = true
+			continue
+		case strings.EqualFold(entry, "<local>"):
+			b.local = true
+			continue
+		case strings.HasPrefix(entry, "~"):
+			pattern, err := regexp.Compile(entry[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid no_proxy entry %q: %w", entry, err)
+			}
+			b.entries = append(b.entries, bypassEntry{pattern: pattern})
+			continue
+		}
+
+		var e bypassEntry
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			entry, e.port = host, port
+		}
+		entry = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+		if networks, err := acl.ParseNetworks([]string{entry}); err == nil {
+			e.network = networks[0]
+		} else if wildcard := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), "."); strings.Contains(wildcard, "*") {
+			// Globs as in the exception lists of Windows and macOS
+			e.pattern = regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(acl.CanonicalHost(entry)), `\*`, ".*") + "$")
+		} else {
+			e.domain = entry
+		}
+		b.entries = append(b.entries, e)
+	}
+	return b, nil
+}
+
+// match reports whether the destination addr, a host:port, should bypass the
+// upstream proxies
+func (b *bypassList) match(addr string) bool {
+	if b == nil {
+		return false
+	}
+	if b.all {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	ip := net.ParseIP(host)
+	if b.local && ip == nil && !strings.Contains(host, ".") {
+		return true
+	}
+	canonical := acl.CanonicalHost(host)
+	for _, e := range b.entries {
+		if e.port != "" && e.port != port {
+			continue
+		}
+		switch {
+		case e.network != nil:
+			if ip != nil && e.network.Contains(ip) {
+				return true
+			}
+		case e.pattern != nil:
+			if e.pattern.MatchString(canonical) {
+				return true
+			}
+		case ip == nil && acl.MatchHost(host, []string{e.domain}):
+			return true
+		}
+	}
+	return false
+}
+
+// withBypass sends requests for the destination addr, a host:port, directly
+// when it is on the bypass list
+func (f *Forwarder) withBypass(req *http.Request, addr string) *http.Request {
+	p := f.profileFor(req.Context())
+	if !p.bypass.match(addr) {
+		return req
+	}
+	return req.WithContext(withUpstream(req.Context(), p.direct))
+}
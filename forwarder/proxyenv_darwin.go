@@ -0,0 +1,58 @@
+//go:build darwin
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// systemProxy reads the manual proxy of the active network service from
+// scutil
+func systemProxy() (proxySettings, bool) {
+	output, err := exec.Command("scutil", "--proxy").Output()
+	if err != nil {
+		return proxySettings{}, false
+	}
+
+	values := make(map[string]string)
+	var noProxy []string
+	inExceptions := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "}" {
+			inExceptions = false
+			continue
+		}
+		name, value, ok := strings.Cut(line, " : ")
+		if !ok {
+			continue
+		}
+		if inExceptions {
+			noProxy = append(noProxy, value)
+			continue
+		}
+		if name == "ExceptionsList" {
+			inExceptions = true
+			continue
+		}
+		values[name] = value
+	}
+
+	for _, protocol := range []string{"HTTPS", "HTTP"} {
+		if values[protocol+"Enable"] != "1" || values[protocol+"Proxy"] == "" {
+			continue
+		}
+		port := values[protocol+"Port"]
+		if port == "" {
+			port = "80"
+		}
+		addr := net.JoinHostPort(values[protocol+"Proxy"], port)
+		return proxySettings{addr: addr, noProxy: noProxy, source: "system network settings"}, true
+	}
+	return proxySettings{}, false
+}
@@ -0,0 +1,8 @@
+//go:build !windows && !darwin
+
+package forwarder
+
+// systemProxy finds nothing beyond the environment on this platform
+func systemProxy() (proxySettings, bool) {
+	return proxySettings{}, false
+}
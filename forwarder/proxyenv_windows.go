@@ -0,0 +1,54 @@
+//go:build windows
+
+package forwarder
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+const internetSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// systemProxy reads the manual proxy from the current user's Internet Options
+func systemProxy() (proxySettings, bool) {
+	key, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.QUERY_VALUE)
+	if err != nil {
+		return proxySettings{}, false
+	}
+	defer key.Close()
+
+	if enabled, _, err := key.GetIntegerValue("ProxyEnable"); err != nil || enabled == 0 {
+		return proxySettings{}, false
+	}
+	server, _, err := key.GetStringValue("ProxyServer")
+	if err != nil {
+		return proxySettings{}, false
+	}
+
+	// Either one proxy for everything or "http=host:port;https=host:port"
+	addr := proxyHostPort(server)
+	if strings.Contains(server, "=") {
+		addr = ""
+		protocols := make(map[string]string)
+		for _, entry := range splitList(server, ";") {
+			if protocol, value, ok := strings.Cut(entry, "="); ok {
+				protocols[strings.ToLower(protocol)] = value
+			}
+		}
+		for _, protocol := range []string{"https", "http"} {
+			if addr = proxyHostPort(protocols[protocol]); addr != "" {
+				break
+			}
+		}
+	}
+	if addr == "" {
+		return proxySettings{}, false
+	}
+
+	var noProxy []string
+	if override, _, err := key.GetStringValue("ProxyOverride"); err == nil {
+		noProxy = splitList(override, ";")
+	}
+	return proxySettings{addr: addr, noProxy: noProxy, source: "Internet Options"}, true
+}
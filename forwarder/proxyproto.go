@@ -0,0 +1,190 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// proxyHeaderTimeout bounds the wait for the PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener reads the PROXY protocol header load balancers send
+// ahead of each connection, so that the connection reports the client's
+// address. Only connections from trusted networks, or any peer of a Unix
+// socket, must start with one; others are served as they are.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	failed  func(remote net.Addr, err error)
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.UnixAddr:
+	case *net.TCPAddr:
+		if !acl.ContainsIP(l.trusted, addr.IP) {
+			return conn, nil
+		}
+	default:
+		return conn, nil
+	}
+	// The header is read by the connection's goroutine, not the accept loop
+	return &proxyProtoConn{Conn: conn, failed: l.failed}, nil
+}
+
+// proxyProtocolFailed reports a trusted connection without a valid header,
+// which is then closed
+func (l *proxyListener) proxyProtocolFailed(remote net.Addr, err error) {
+	f := l.forwarder
+	f.metrics.inc("gatelan_proxy_protocol_errors_total", "listener", l.config.Name)
+	f.logger.Printf("Closing connection from %s on listener %s: %v", remote, l.config.Name, err)
+}
+
+// proxyProtoConn is a connection starting with a PROXY protocol header
+type proxyProtoConn struct {
+	net.Conn
+	failed func(remote net.Addr, err error)
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr // From the header, nil when it carried no address
+	err    error
+}
+
+// readHeader consumes the header on first use
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil && c.failed != nil {
+			c.failed(c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client's address from the header
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *proxyProtoConn) CloseWrite() error {
+	tunnel.CloseWrite(c.Conn)
+	return nil
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header, returning the
+// source address it carries. Health checks of the load balancer itself
+// (LOCAL, UNKNOWN) carry none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyV1(r)
+	case '\r':
+		return readProxyV2(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyV1 reads a text header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3128\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 && !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if !bytes.HasSuffix(line, []byte("\r\n")) || len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("invalid PROXY protocol v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header, skipping its TLVs
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, errors.New("invalid PROXY protocol v2 header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+
+	switch header[12] & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errors.New("invalid PROXY protocol v2 command")
+	}
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// AF_UNSPEC and AF_UNIX carry no IP address
+	return nil, nil
+}
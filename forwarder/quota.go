@@ -0,0 +1,282 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+const quotaSaveInterval = time.Minute
+
+// quotaTracker counts the bytes each user or client transferred in the
+// current period and reports when a cap is reached
+type quotaTracker struct {
+	config config.QuotaConfig
+
+	mu        sync.Mutex
+	state     quotaState
+	announced map[string]bool       // Keys whose overrun was announced this period
+	peers     map[string]quotaState // Usage counted by the cluster peers, by node
+
+	saveMu sync.Mutex // Serialises writes of the file
+}
+
+// quotaState is the persisted form of the tracker
+type quotaState struct {
+	Period string           `json:"period"`
+	Used   map[string]int64 `json:"used"`
+}
+
+// newQuotaTracker creates the tracker, restoring persisted usage if any
+func newQuotaTracker(cfg config.QuotaConfig) (*quotaTracker, error) {
+	q := &quotaTracker{config: cfg, state: quotaState{Used: make(map[string]int64)}}
+	if cfg.File == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota file: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.state); err != nil {
+		return nil, fmt.Errorf("failed to parse quota file: %w", err)
+	}
+	if q.state.Used == nil {
+		q.state.Used = make(map[string]int64)
+	}
+	return q, nil
+}
+
+// period names the quota period containing t
+func (q *quotaTracker) period(t time.Time) string {
+	if q.config.Period == config.QuotaDaily {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01")
+}
+
+// rotate resets usage when a new period starts; callers hold q.mu
+func (q *quotaTracker) rotate() {
+	if current := q.period(time.Now()); current != q.state.Period {
+		q.state.Period = current
+		q.state.Used = make(map[string]int64)
+		q.announced = nil
+	}
+}
+
+// limit returns the cap for key, 0 meaning unlimited
+func (q *quotaTracker) limit(key string) int64 {
+	if limit, ok := q.config.Overrides[key]; ok {
+		return limit
+	}
+	return q.config.Limit
+}
+
+// exceeded reports whether key has used up its allowance
+func (q *quotaTracker) exceeded(key string) bool {
+	if q == nil {
+		return false
+	}
+	limit := q.limit(key)
+	if limit <= 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rotate()
+	return q.used(key) >= limit
+}
+
+// used returns the bytes key transferred this period through this instance
+// and its cluster peers; callers hold q.mu
+func (q *quotaTracker) used(key string) int64 {
+	used := q.state.Used[key]
+	for _, peer := range q.peers {
+		if peer.Period == q.state.Period {
+			used += peer.Used[key]
+		}
+	}
+	return used
+}
+
+// clusterState copies the usage counted by this instance, for the cluster
+// peers
+func (q *quotaTracker) clusterState() *quotaState {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rotate()
+	state := quotaState{Period: q.state.Period, Used: make(map[string]int64, len(q.state.Used))}
+	for key, used := range q.state.Used {
+		state.Used[key] = used
+	}
+	return &state
+}
+
+// mergePeer replaces the usage counted by the cluster peer node
+func (q *quotaTracker) mergePeer(node string, state quotaState) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.peers == nil {
+		q.peers = make(map[string]quotaState)
+	}
+	q.peers[node] = state
+}
+
+// announce reports whether the overrun of key is not announced yet this
+// period, marking it announced
+func (q *quotaTracker) announce(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rotate()
+	if q.announced[key] {
+		return false
+	}
+	if q.announced == nil {
+		q.announced = make(map[string]bool)
+	}
+	q.announced[key] = true
+	return true
+}
+
+// add charges n bytes to key
+func (q *quotaTracker) add(key string, n int64) {
+	if q == nil || n == 0 {
+		return
+	}
+	q.mu.Lock()
+	q.rotate()
+	q.state.Used[key] += n
+	q.mu.Unlock()
+}
+
+// save persists the usage to the configured file, if any
+func (q *quotaTracker) save() error {
+	if q == nil || q.config.File == "" {
+		return nil
+	}
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+	q.mu.Lock()
+	data, err := json.Marshal(q.state)
+	q.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode quota usage: %w", err)
+	}
+
+	tmp := q.config.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write quota file: %w", err)
+	}
+	return os.Rename(tmp, q.config.File)
+}
+
+// compact drops usage of past periods and saves the current one
+func (q *quotaTracker) compact() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	q.rotate()
+	q.mu.Unlock()
+	return q.save()
+}
+
+// announceQuotaExceeded sends the quota exceeded event the first time key,
+// charged by req, is refused in a period
+func (f *Forwarder) announceQuotaExceeded(req *http.Request, key string) {
+	if f.events == nil || !f.quotaOf(req).announce(key) {
+		return
+	}
+	message := "Quota exceeded for " + key
+	if t := requestTenant(req); t != nil {
+		message += " of tenant " + t.config.Name
+	}
+	f.emit(Event{Type: config.EventQuotaExceeded, Key: key, Message: message})
+}
+
+// saveQuotaPeriodically saves usage, that of the tenants included, until ctx
+// is cancelled, so a crash loses at most one interval
+func (f *Forwarder) saveQuotaPeriodically(ctx context.Context) {
+	trackers := make(map[string]*quotaTracker) // By what they count, for logs
+	if f.quota != nil && f.config.Quota.File != "" {
+		trackers["quota usage"] = f.quota
+	}
+	for _, t := range f.tenants {
+		if t.quota != nil && t.config.Quota.File != "" {
+			trackers["quota usage of tenant "+t.config.Name] = t.quota
+		}
+	}
+	if len(trackers) == 0 {
+		return
+	}
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for what, q := range trackers {
+				if err := q.save(); err != nil {
+					f.logger.Printf("Failed to save %s: %v", what, err)
+				}
+			}
+		}
+	}
+}
+
+// quotaPage is shown to clients whose quota is used up
+const quotaPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Data quota exceeded</title></head>
+<body>
+<h1>Data quota exceeded</h1>
+<p>You have used your data allowance for this period. Access will be restored when the next period starts.</p>
+</body>
+</html>
+`
+
+// quotaOf returns the tracker req is charged to: that of its tenant, or the
+// top-level one for clients of no tenant
+func (f *Forwarder) quotaOf(req *http.Request) *quotaTracker {
+	if t := requestTenant(req); t != nil {
+		return t.quota
+	}
+	return f.quota
+}
+
+// quotaKey returns the identity req is charged to
+func (f *Forwarder) quotaKey(req *http.Request) string {
+	if t := requestTenant(req); t != nil {
+		return f.identity(req, t.config.Quota.Key)
+	}
+	return f.identity(req, f.config.Quota.Key)
+}
+
+// writeQuotaExceeded answers req, charged to key, with the quota block page
+// or the configured blocked page
+func (f *Forwarder) writeQuotaExceeded(w http.ResponseWriter, req *http.Request, key string) {
+	if f.errorPages[http.StatusForbidden] != nil {
+		f.writeError(w, req, http.StatusForbidden, "Data quota exceeded", key)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, quotaPage)
+}
@@ -0,0 +1,87 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// ErrDestinationRefused is returned when a direct connection would reach an
+// address the destination policy refuses
+var ErrDestinationRefused = errors.New("destination address refused")
+
+// destinationGuardKey carries the destinationGuard of a request
+type destinationGuardKey struct{}
+
+// destinationGuard checks an address a direct connection is about to use
+type destinationGuard func(ip net.IP) error
+
+// guardDestination makes the direct connections of req check every address
+// they connect to against the policy applied to IP destinations. Names are
+// judged as names before forwarding, and a name may resolve, or resolve
+// again, to addresses those checks never saw (DNS rebinding).
+func (f *Forwarder) guardDestination(req *http.Request, host string) *http.Request {
+	if net.ParseIP(host) != nil {
+		return req
+	}
+	guard := destinationGuard(func(ip net.IP) error {
+		reason := f.refusedAddress(req.Context(), host, ip)
+		if reason == "" {
+			return nil
+		}
+		f.logf(req, "Refused connection to %s for %s: resolved to %s, %s", host, f.clientLabel(req), ip, reason)
+		f.metrics.inc("gatelan_destination_refused_total")
+		f.logBlocked(req, host, fmt.Sprintf("resolved to %s, %s", ip, reason))
+		return fmt.Errorf("%w: %s resolved to %s, %s", ErrDestinationRefused, host, ip, reason)
+	})
+	return req.WithContext(context.WithValue(req.Context(), destinationGuardKey{}, guard))
+}
+
+// refusedAddress returns why host may not be reached at ip, or "". As for
+// requests, the block list and SSRF protection come first and the allow list
+// exempts from the rest.
+func (f *Forwarder) refusedAddress(ctx context.Context, host string, ip net.IP) string {
+	addr := ip.String()
+	if f.lists.blocks(addr) {
+		return "on the block list"
+	}
+	if reason := f.ssrf.refuses(host, ip); reason != "" {
+		return reason
+	}
+	if f.lists.allows(host) || f.lists.allows(addr) {
+		return ""
+	}
+	if name := f.blocklist.match(addr); name != "" {
+		return "listed in blocklist " + name
+	}
+	if f.geo != nil {
+		if code, err := f.geo.country(ctx, addr); err == nil && f.geo.block[code] {
+			return "in blocked country " + code
+		}
+	}
+	return ""
+}
+
+// checkDestination is the Control function of direct dialers. It runs once
+// the address of each connection attempt is known and applies the guard of
+// the request being dialed for, if any.
+func checkDestination(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	guard, ok := ctx.Value(destinationGuardKey{}).(destinationGuard)
+	if !ok {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	host, _, _ = strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	return guard(ip)
+}
@@ -0,0 +1,57 @@
+package forwarder
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// urlRedirect is a compiled RedirectRule
+type urlRedirect struct {
+	name     string
+	match    *regexp.Regexp
+	location string
+	status   int
+}
+
+// newURLRedirects compiles the configured redirect rules
+func newURLRedirects(rules []config.RedirectRule) ([]urlRedirect, error) {
+	redirects := make([]urlRedirect, 0, len(rules))
+	for i, rc := range rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		match, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("redirect rule %s: %w", name, err)
+		}
+		redirects = append(redirects, urlRedirect{name: name, match: match, location: rc.Location, status: rc.Status})
+	}
+	return redirects, nil
+}
+
+// redirectResponse answers req with the first matching redirect rule, or
+// returns nil when none matches
+func (f *Forwarder) redirectResponse(req *http.Request) *http.Response {
+	redirects := f.profileFor(req.Context()).redirects
+	if len(redirects) == 0 {
+		return nil
+	}
+
+	current := req.URL.String()
+	for _, rule := range redirects {
+		if !rule.match.MatchString(current) {
+			continue
+		}
+		location := rule.match.ReplaceAllString(current, rule.location)
+		f.logf(req, "Redirect rule %s sent %s to %s with %d", rule.name, current, location, rule.status)
+		f.metrics.inc("gatelan_redirects_total", "rule", rule.name)
+		resp := newResponse(req, rule.status, "Redirecting to "+location+"\n")
+		resp.Header.Set("Location", location)
+		return resp
+	}
+	return nil
+}
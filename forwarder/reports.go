@@ -0,0 +1,232 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+const reportWebhookTimeout = 30 * time.Second
+
+// Report summarizes the usage of one reporting period
+type Report struct {
+	Schedule      string    `json:"schedule"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Requests      int64     `json:"requests"`
+	BytesSent     int64     `json:"bytes_sent"`     // Client to upstream
+	BytesReceived int64     `json:"bytes_received"` // Upstream to client
+	Blocked       int64     `json:"blocked"`
+	TopClients    []Usage   `json:"top_clients"`
+	TopDomains    []Usage   `json:"top_domains"`
+	TopBlocked    []Usage   `json:"top_blocked"` // Destination domains by refused requests
+}
+
+// report totals the buckets that started in [start, end), listing the top n
+// keys of each table
+func (s *usageStats) report(start, end time.Time, n int) Report {
+	report := Report{Start: start, End: end}
+	if s == nil {
+		return report
+	}
+	s.mu.Lock()
+	var buckets []*usageBucket
+	for _, bucket := range s.buckets {
+		if !bucket.Start.Before(start) && bucket.Start.Before(end) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	clients := sumUsage(buckets, func(b *usageBucket) map[string]*Usage { return b.Clients })
+	domains := sumUsage(buckets, func(b *usageBucket) map[string]*Usage { return b.Domains })
+	blocked := sumUsage(buckets, func(b *usageBucket) map[string]*Usage { return b.Blocked })
+	s.mu.Unlock()
+
+	for _, u := range domains {
+		report.Requests += u.Requests
+		report.BytesSent += u.BytesSent
+		report.BytesReceived += u.BytesReceived
+	}
+	for _, u := range blocked {
+		report.Blocked += u.Requests
+	}
+	report.TopClients = rankUsage(clients, n)
+	report.TopDomains = rankUsage(domains, n)
+	report.TopBlocked = rankUsage(blocked, n)
+	return report
+}
+
+// nextReport returns when the period after now ends: the next occurrence of
+// the configured time of day, on a Monday for weekly reports
+func nextReport(cfg config.ReportsConfig, now time.Time) time.Time {
+	at, _ := time.Parse("15:04", cfg.At)
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	for !next.After(now) || (cfg.Schedule == config.ReportWeekly && next.Weekday() != time.Monday) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// runReports delivers a report at the end of every period until ctx is cancelled
+func (f *Forwarder) runReports(ctx context.Context) {
+	cfg := f.config.Reports
+	if cfg.Schedule == "" {
+		return
+	}
+	for {
+		end := nextReport(cfg, time.Now())
+		timer := time.NewTimer(time.Until(end))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		report := f.stats.report(end.Add(-cfg.Period()), end, cfg.Top)
+		report.Schedule = cfg.Schedule
+		if err := f.deliverReport(ctx, report); err != nil {
+			f.logger.Printf("Failed to deliver %s report: %v", cfg.Schedule, err)
+			continue
+		}
+		f.logger.Printf("Delivered %s report for %s to %s", cfg.Schedule, report.Start.Format(time.DateOnly), end.Format(time.DateOnly))
+	}
+}
+
+// deliverReport sends report to every configured destination, trying all
+// of them before returning the first error
+func (f *Forwarder) deliverReport(ctx context.Context, report Report) error {
+	cfg := f.config.Reports
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if cfg.Dir != "" {
+		if err := writeReport(cfg.Dir, report, data); err != nil {
+			fail(err)
+		}
+	}
+	if cfg.Webhook != "" {
+		if err := postReport(ctx, cfg.Webhook, data); err != nil {
+			fail(err)
+		}
+	}
+	if cfg.Email.Addr != "" {
+		if err := mailReport(cfg.Email, report); err != nil {
+			fail(err)
+		}
+	}
+	return firstErr
+}
+
+// writeReport stores the encoded report in dir, named after its schedule
+// and last day
+func writeReport(dir string, report Report, data []byte) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create report directory: %w", err)
+	}
+	name := fmt.Sprintf("gatelan-%s-%s.json", report.Schedule, report.End.Format(time.DateOnly))
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// postReport sends the encoded report to a webhook
+func postReport(ctx context.Context, url string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, reportWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post report: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+}).Parse(`GateLAN {{.Schedule}} usage report
+{{.Start.Format "2006-01-02 15:04"}} to {{.End.Format "2006-01-02 15:04"}}
+
+Requests: {{.Requests}}
+Sent:     {{bytes .BytesSent}}
+Received: {{bytes .BytesReceived}}
+Blocked:  {{.Blocked}}
+
+Top clients:
+{{range .TopClients}}  {{.Key}}: {{bytes .BytesReceived}} down, {{bytes .BytesSent}} up, {{.Requests}} requests
+{{else}}  none
+{{end}}
+Top domains:
+{{range .TopDomains}}  {{.Key}}: {{bytes .BytesReceived}} down, {{bytes .BytesSent}} up, {{.Requests}} requests
+{{else}}  none
+{{end}}
+Most blocked domains:
+{{range .TopBlocked}}  {{.Key}}: {{.Requests}} requests
+{{else}}  none
+{{end}}`))
+
+// formatBytes renders n with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// mailReport emails report as plain text
+func mailReport(cfg config.EmailConfig, report Report) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: GateLAN %s usage report for %s\r\n", report.Schedule, report.End.Format(time.DateOnly))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	var body strings.Builder
+	if err := reportTemplate.Execute(&body, report); err != nil {
+		return fmt.Errorf("failed to render report: %w", err)
+	}
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(cfg.Addr)
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	if err := smtp.SendMail(cfg.Addr, auth, cfg.From, cfg.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send report email: %w", err)
+	}
+	return nil
+}
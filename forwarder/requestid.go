@@ -0,0 +1,41 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// requestIDContextKey carries the ID that tags the log lines of a request
+type requestIDContextKey struct{}
+
+// withRequestID returns req tagged with a new random ID unless it already has one
+func withRequestID(req *http.Request) *http.Request {
+	if requestID(req) != "" {
+		return req
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	return req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, hex.EncodeToString(id[:])))
+}
+
+// requestID returns the ID of req, if any
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// logf logs a line about req, prefixed with its ID so that the lines of one
+// request or tunnel can be told apart from concurrent ones
+func (f *Forwarder) logf(req *http.Request, format string, args ...any) {
+	if id := requestID(req); id != "" {
+		format = "[" + id + "] " + format
+	}
+	line := fmt.Sprintf(format, args...)
+	f.logger.Output(2, line)
+	if t := requestTenant(req); t != nil && t.logger != nil {
+		t.logger.Output(2, line)
+	}
+}
@@ -0,0 +1,61 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// watchUpstreamDNS resolves the host names of upstream proxies once per
+// refresh interval until ctx is cancelled. Each dial resolves anew, but
+// pooled connections would otherwise keep using an address after DNS moved
+// the upstream, so when the addresses change the idle ones are closed.
+func (f *Forwarder) watchUpstreamDNS(ctx context.Context) {
+	interval := time.Duration(f.config.DNSRefresh)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	known := make(map[*upstream]string)
+	for {
+		for _, up := range f.resolvableUpstreams() {
+			addrs, err := net.DefaultResolver.LookupHost(ctx, up.host)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				f.logger.Printf("Failed to resolve upstream %s: %v", up.name, err)
+				continue
+			}
+			slices.Sort(addrs)
+			current := strings.Join(addrs, ", ")
+			if previous, ok := known[up]; ok && previous != current {
+				f.logger.Printf("Upstream %s moved from %s to %s", up.name, previous, current)
+				up.closeIdleConnections()
+			}
+			known[up] = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resolvableUpstreams returns the pool, dedicated and listener profile
+// upstreams addressed by host name
+func (f *Forwarder) resolvableUpstreams() []*upstream {
+	var result []*upstream
+	for _, up := range f.poolUpstreams() {
+		if up.host != "" {
+			result = append(result, up)
+		}
+	}
+	return result
+}
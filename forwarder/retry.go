@@ -0,0 +1,91 @@
+package forwarder
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// backoff returns a fully jittered delay before the given retry (1-based)
+func backoff(cfg config.RetryConfig, retry int) time.Duration {
+	ceiling := time.Duration(cfg.InitialBackoff) << (retry - 1)
+	if ceiling <= 0 || ceiling > time.Duration(cfg.MaxBackoff) {
+		ceiling = time.Duration(cfg.MaxBackoff)
+	}
+	return rand.N(ceiling) + 1
+}
+
+// retryable reports whether a failed attempt of req may be repeated safely
+func retryable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// roundTrip sends proxyReq upstream, retrying GET/HEAD with jittered
+// exponential backoff when the upstream connection fails
+func (f *Forwarder) roundTrip(req *http.Request, proxyReq *http.Request) (*http.Response, error) {
+	attempts := 1
+	if retryable(proxyReq) {
+		attempts += f.config.Retry.MaxAttempts
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		start := 0
+		if f.config.Retry.SwitchUpstream {
+			start = attempt
+		}
+		up, err := f.selectUpstream(req.Context(), start)
+		if err != nil {
+			f.metrics.inc("gatelan_circuit_breaker_rejections_total")
+			if lastErr == nil {
+				return nil, err
+			}
+			break
+		}
+
+		if attempt > 0 {
+			delay := backoff(f.config.Retry, attempt)
+			f.metrics.inc("gatelan_retries_total", "upstream", up.name)
+			f.logf(req, "Retrying %s %s via %s in %v (attempt %d/%d): %v",
+				req.Method, req.URL.String(), up.name, delay, attempt+1, attempts, lastErr)
+
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				up.breaker.release()
+				return nil, req.Context().Err()
+			}
+		}
+
+		resp, err := f.send(up, proxyReq)
+		if err == nil {
+			up.breaker.success()
+			up.latency.success()
+			return resp, nil
+		}
+		if _, _, refused := connectRefusal(err); refused || errors.Is(err, ErrDestinationRefused) {
+			up.breaker.success()
+			up.latency.success()
+			return nil, err
+		}
+		if clientGone(req, err) {
+			// Says nothing about the upstream, and nobody waits for a retry
+			up.breaker.release()
+			return nil, err
+		}
+		up.breaker.failure()
+		up.latency.failure(err)
+		lastErr = err
+	}
+
+	if attempts > 1 {
+		f.metrics.inc("gatelan_retries_exhausted_total")
+	}
+	return nil, lastErr
+}
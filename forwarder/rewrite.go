@@ -0,0 +1,69 @@
+package forwarder
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// urlRewrite is a compiled RewriteRule
+type urlRewrite struct {
+	name    string
+	match   *regexp.Regexp
+	replace string
+}
+
+// newURLRewrites compiles the configured rewrite rules
+func newURLRewrites(rules []config.RewriteRule) ([]urlRewrite, error) {
+	rewrites := make([]urlRewrite, 0, len(rules))
+	for i, rc := range rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		match, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %s: %w", name, err)
+		}
+		rewrites = append(rewrites, urlRewrite{name: name, match: match, replace: rc.Replace})
+	}
+	return rewrites, nil
+}
+
+// rewriteURL returns req with its URL transformed by the matching rewrite
+// rules, logging the original and rewritten URLs. Rewrites that do not
+// produce an absolute http or https URL are skipped.
+func (f *Forwarder) rewriteURL(req *http.Request) *http.Request {
+	rewrites := f.profileFor(req.Context()).rewrites
+	if len(rewrites) == 0 {
+		return req
+	}
+
+	original := req.URL.String()
+	rewritten := req.URL
+	for _, rule := range rewrites {
+		current := rewritten.String()
+		if !rule.match.MatchString(current) {
+			continue
+		}
+		u, err := url.Parse(rule.match.ReplaceAllString(current, rule.replace))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			f.logf(req, "Ignoring rewrite rule %s for %s: not an absolute http(s) URL", rule.name, current)
+			continue
+		}
+		f.metrics.inc("gatelan_rewrites_total", "rule", rule.name)
+		rewritten = u
+	}
+	if rewritten == req.URL {
+		return req
+	}
+
+	f.logf(req, "Rewrote %s -> %s", original, rewritten.String())
+	req = req.WithContext(req.Context())
+	req.URL = rewritten
+	req.Host = rewritten.Host
+	return req
+}
@@ -0,0 +1,81 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// routeFor returns the first route rule of the profile for ctx matching
+// host, or nil
+func (f *Forwarder) routeFor(ctx context.Context, host string) *config.RouteRule {
+	routes := f.profileFor(ctx).config.Routes
+	for i := range routes {
+		if acl.MatchHost(host, routes[i].Domains) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// applyRoute sends req through the upstream of the route rule for host and,
+// for https requests, has the TLS handshake present its server name. The
+// rule is returned so that its Host header can be applied to the request
+// sent upstream.
+func (f *Forwarder) applyRoute(req *http.Request, host string) (*http.Request, *config.RouteRule) {
+	route := f.routeFor(req.Context(), host)
+	if route == nil {
+		return req, nil
+	}
+	ctx := req.Context()
+	if route.Upstream != "" {
+		ctx = withUpstream(ctx, f.upstreamFor(route.Upstream))
+	}
+	if route.SNI != "" && req.URL.Scheme == "https" {
+		ctx = context.WithValue(ctx, serverNameContextKey{}, route.SNI)
+	}
+	return req.WithContext(ctx), route
+}
+
+// serverNameContextKey carries the TLS server name overriding the destination's
+type serverNameContextKey struct{}
+
+// tlsDialer performs the TLS handshake with destinations itself so that the
+// server name can differ from the dialed host. The transport also dials the
+// HTTPS proxy at proxyAddr through it, which proxyTLS secures.
+func tlsDialer(cfg *config.Config, dial func(ctx context.Context, network, addr string) (net.Conn, error), proxyAddr string, proxyTLS *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		serverName, _ := ctx.Value(serverNameContextKey{}).(string)
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConfig := &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true, // Allow self-signed certificates for MITM
+		}
+		if proxyTLS != nil && addr == proxyAddr {
+			tlsConfig = proxyTLS
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+
+		if timeout := cfg.Timeouts.TLSHandshake.Timeout(); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,330 @@
+package forwarder
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+const (
+	// shapeChunk is the most bytes a single grant of the link lets through,
+	// bounding how long one transfer holds the others back
+	shapeChunk = 16 << 10
+
+	// shapeBurst is how far the link may catch up after falling behind its
+	// schedule, such as when sleeps overshoot
+	shapeBurst = 50 * time.Millisecond
+)
+
+// Directions of shaped traffic
+const (
+	shapeDownload = "download"
+	shapeUpload   = "upload"
+)
+
+// shapingClass is a ShapingClass with its clients parsed
+type shapingClass struct {
+	name    string
+	clients []*net.IPNet
+}
+
+// shaper divides the download and upload rates between the client classes.
+// A nil shaper, like a nil link, shapes nothing.
+type shaper struct {
+	classes  []shapingClass
+	download *shapedLink
+	upload   *shapedLink
+	metrics  *metrics
+}
+
+// newShaper parses the classes, returning nil when shaping is disabled
+func newShaper(cfg config.ShapingConfig, m *metrics) (*shaper, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	s := &shaper{metrics: m}
+	weights := make([]float64, len(cfg.Classes))
+	for i, rc := range cfg.Classes {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		clients, err := acl.ParseNetworks(rc.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("shaping class %s: %w", name, err)
+		}
+		s.classes = append(s.classes, shapingClass{name: name, clients: clients})
+		weights[i] = float64(rc.Weight)
+	}
+	s.download = newShapedLink(cfg.Download, weights)
+	s.upload = newShapedLink(cfg.Upload, weights)
+	return s, nil
+}
+
+// class returns the index of the first class matching client, or -1
+func (s *shaper) class(client net.IP) int {
+	if s == nil {
+		return -1
+	}
+	for i, class := range s.classes {
+		if len(class.clients) == 0 || acl.ContainsIP(class.clients, client) {
+			return i
+		}
+	}
+	return -1
+}
+
+// shapeWaiter is a chunk waiting for its turn on the link
+type shapeWaiter struct {
+	start     float64 // Virtual time at which the chunk is due
+	seq       uint64  // Order of arrival, breaking ties
+	size      int
+	granted   chan struct{}
+	abandoned bool
+}
+
+// shapeQueue orders the waiters by virtual start time
+type shapeQueue []*shapeWaiter
+
+func (q shapeQueue) Len() int { return len(q) }
+
+func (q shapeQueue) Less(i, j int) bool {
+	if q[i].start != q[j].start {
+		return q[i].start < q[j].start
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q shapeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *shapeQueue) Push(x any) { *q = append(*q, x.(*shapeWaiter)) }
+
+func (q *shapeQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return w
+}
+
+// shapedLink paces chunks through a link of a fixed rate by start-time fair
+// queueing: each chunk is due at the virtual time its class finished its
+// previous one, or now if that is past, and the class's finish time then
+// advances by the chunk's size over its weight. Backlogged classes thus
+// share the link by weight, while an idle class saves up no credit.
+type shapedLink struct {
+	rate    float64 // Bytes per second
+	weights []float64
+
+	mu          sync.Mutex
+	finish      []float64 // Virtual finish time of the last chunk of each class
+	virtual     float64   // Start time of the chunk granted last
+	seq         uint64
+	waiting     shapeQueue
+	dispatching bool
+}
+
+// newShapedLink returns nil when rate is 0
+func newShapedLink(rate int64, weights []float64) *shapedLink {
+	if rate <= 0 {
+		return nil
+	}
+	return &shapedLink{rate: float64(rate), weights: weights, finish: make([]float64, len(weights))}
+}
+
+// wait blocks until the link lets size bytes of class through, or ctx ends
+func (l *shapedLink) wait(ctx context.Context, class, size int) error {
+	l.mu.Lock()
+	w := &shapeWaiter{start: max(l.virtual, l.finish[class]), seq: l.seq, size: size, granted: make(chan struct{})}
+	l.seq++
+	l.finish[class] = w.start + float64(size)/l.weights[class]
+	heap.Push(&l.waiting, w)
+	if !l.dispatching {
+		l.dispatching = true
+		go l.dispatch()
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		w.abandoned = true
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// dispatch grants the waiting chunks in order, each after the link carried
+// the previous one, until none is left
+func (l *shapedLink) dispatch() {
+	next := time.Now()
+	for {
+		l.mu.Lock()
+		var w *shapeWaiter
+		for l.waiting.Len() > 0 {
+			if w = heap.Pop(&l.waiting).(*shapeWaiter); !w.abandoned {
+				break
+			}
+			w = nil
+		}
+		if w == nil {
+			l.dispatching = false
+			l.mu.Unlock()
+			return
+		}
+		l.virtual = w.start
+		l.mu.Unlock()
+		close(w.granted)
+
+		if behind := time.Now().Add(-shapeBurst); next.Before(behind) {
+			next = behind
+		}
+		next = next.Add(time.Duration(float64(w.size) / l.rate * float64(time.Second)))
+		if delay := time.Until(next); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
+
+// shapedFlow paces one direction of a transfer for its class
+type shapedFlow struct {
+	ctx       context.Context
+	link      *shapedLink
+	class     int
+	name      string
+	direction string
+	metrics   *metrics
+}
+
+// flow returns the pacing of the client at ip in direction, or nil when it
+// is not shaped
+func (s *shaper) flow(ctx context.Context, ip string, direction string) *shapedFlow {
+	class := s.class(net.ParseIP(ip))
+	if class < 0 {
+		return nil
+	}
+	link := s.download
+	if direction == shapeUpload {
+		link = s.upload
+	}
+	if link == nil {
+		return nil
+	}
+	return &shapedFlow{ctx: ctx, link: link, class: class, name: s.classes[class].name, direction: direction, metrics: s.metrics}
+}
+
+// wait blocks until size bytes may pass
+func (f *shapedFlow) wait(size int) error {
+	started := time.Now()
+	err := f.link.wait(f.ctx, f.class, size)
+	f.metrics.add("gatelan_shaping_delay_seconds_total", time.Since(started).Seconds(), "class", f.name, "direction", f.direction)
+	if err == nil {
+		f.metrics.add("gatelan_shaped_bytes_total", float64(size), "class", f.name, "direction", f.direction)
+	}
+	return err
+}
+
+// write writes p in chunks, each once the link lets it through
+func (f *shapedFlow) write(write func([]byte) (int, error), p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), shapeChunk)]
+		if err := f.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// read reads at most a chunk into p, then waits for the link to let what was
+// read through before it is passed on
+func (f *shapedFlow) read(read func([]byte) (int, error), p []byte) (int, error) {
+	if len(p) > shapeChunk {
+		p = p[:shapeChunk]
+	}
+	n, err := read(p)
+	if n > 0 {
+		if waitErr := f.wait(n); waitErr != nil {
+			return 0, waitErr
+		}
+	}
+	return n, err
+}
+
+// shapedWriter paces the response writes of a plain request
+type shapedWriter struct {
+	io.Writer
+	flow *shapedFlow
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	return w.flow.write(w.Writer.Write, p)
+}
+
+// shapedBody paces the request body reads of a plain request
+type shapedBody struct {
+	io.ReadCloser
+	flow *shapedFlow
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	return b.flow.read(b.ReadCloser.Read, p)
+}
+
+// shapedConn paces both directions of a tunnel client connection. It hides
+// the ReadFrom and WriteTo of the connection beneath, since a spliced copy
+// cannot be paced.
+type shapedConn struct {
+	net.Conn
+	download *shapedFlow
+	upload   *shapedFlow
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if c.upload == nil {
+		return c.Conn.Read(p)
+	}
+	return c.upload.read(c.Conn.Read, p)
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	if c.download == nil {
+		return c.Conn.Write(p)
+	}
+	return c.download.write(c.Conn.Write, p)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *shapedConn) CloseWrite() error {
+	tunnel.CloseWrite(c.Conn)
+	return nil
+}
+
+// shapeTunnel paces the client connection of the tunnel set up by r for its
+// client's class
+func (f *Forwarder) shapeTunnel(r *http.Request, clientConn net.Conn) net.Conn {
+	client := remoteIP(r)
+	download := f.shaper.flow(r.Context(), client, shapeDownload)
+	upload := f.shaper.flow(r.Context(), client, shapeUpload)
+	if download == nil && upload == nil {
+		return clientConn
+	}
+	return &shapedConn{Conn: clientConn, download: download, upload: upload}
+}
@@ -0,0 +1,85 @@
+package forwarder
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// stallWatch notices writes to a client that block for longer than the
+// stall threshold, the client having stopped reading
+type stallWatch struct {
+	timer *time.Timer
+	stall time.Duration
+}
+
+// watchStalls returns a watch reporting conn as slow, and calling abort when
+// slow clients are aborted, or nil when detection is disabled
+func (f *Forwarder) watchStalls(r *http.Request, conn *activeConn, abort func()) *stallWatch {
+	if !f.config.SlowClients.Enabled {
+		return nil
+	}
+	w := &stallWatch{stall: time.Duration(f.config.SlowClients.Stall)}
+	w.timer = time.AfterFunc(w.stall, func() { f.slowClient(r, conn, w.stall, abort) })
+	w.timer.Stop()
+	return w
+}
+
+// write runs a write with the watch armed
+func (w *stallWatch) write(write func([]byte) (int, error), p []byte) (int, error) {
+	w.timer.Reset(w.stall)
+	n, err := write(p)
+	w.timer.Stop()
+	return n, err
+}
+
+// stop disarms the watch once the transfer is over
+func (w *stallWatch) stop() {
+	w.timer.Stop()
+}
+
+// slowClient reports a stalled client once per connection and aborts the
+// transfer when configured to
+func (f *Forwarder) slowClient(r *http.Request, conn *activeConn, stall time.Duration, abort func()) {
+	if !conn.stalled.CompareAndSwap(false, true) {
+		return
+	}
+	if !f.config.SlowClients.Abort {
+		f.metrics.inc("gatelan_slow_clients_total", "kind", conn.kind, "action", "reported")
+		f.logf(r, "Client %s stopped reading from %s for %v", conn.client, conn.target, stall)
+		return
+	}
+	f.metrics.inc("gatelan_slow_clients_total", "kind", conn.kind, "action", "aborted")
+	f.logf(r, "Aborting %s to %s: client %s stopped reading for %v", conn.kind, conn.target, conn.client, stall)
+	abort()
+}
+
+// stallWriter watches the response writes of a plain request
+type stallWriter struct {
+	io.Writer
+	watch *stallWatch
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	return w.watch.write(w.Writer.Write, p)
+}
+
+// stallConn watches the writes toward a tunnel client. It hides the
+// ReadFrom of the connection beneath, since a spliced copy cannot be watched.
+type stallConn struct {
+	net.Conn
+	watch *stallWatch
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	return c.watch.write(c.Conn.Write, p)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *stallConn) CloseWrite() error {
+	tunnel.CloseWrite(c.Conn)
+	return nil
+}
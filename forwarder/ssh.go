@@ -0,0 +1,84 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/n0z0/GateLAN/config"
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// newSSHRoute creates the route through the jump host at u, authenticating
+// with the configured key, the SSH agent and any password in u
+func newSSHRoute(u *url.URL, cfg *config.Config, base tunnel.ContextDialer) (*tunnel.SSH, error) {
+	var auth []ssh.AuthMethod
+	if cfg.SSH.KeyFile != "" {
+		key, err := os.ReadFile(cfg.SSH.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %w", err)
+		}
+		var signer ssh.Signer
+		if cfg.SSH.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(cfg.SSH.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		// Each handshake asks the agent afresh, so a restarted agent is picked up
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			return agent.NewClient(conn).Signers()
+		}))
+	}
+	if password, ok := u.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no SSH key, agent or password for %s", u.Redacted())
+	}
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if !cfg.SSH.InsecureIgnoreHostKey {
+		file := cfg.SSH.KnownHosts
+		if file == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("failed to locate known_hosts: %w", err)
+			}
+			file = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		var err error
+		if hostKey, err = knownhosts.New(file); err != nil {
+			return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+		}
+	}
+
+	return &tunnel.SSH{
+		Addr: u.Host,
+		Config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            auth,
+			HostKeyCallback: hostKey,
+			Timeout:         cfg.Timeouts.Dial.Timeout(),
+		},
+		KeepAlive: max(time.Duration(cfg.SSH.KeepAlive), 0),
+		Dialer:    base,
+	}, nil
+}
@@ -0,0 +1,74 @@
+package forwarder
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// ssrfGuard refuses destinations inside the networks around the gateway,
+// other than those explicitly allowed. A nil guard refuses nothing.
+type ssrfGuard struct {
+	domains  []string
+	networks []*net.IPNet
+}
+
+// newSSRFGuard splits the allowed entries into domains and networks, and
+// returns nil when the protection is disabled
+func newSSRFGuard(cfg config.SSRFConfig) *ssrfGuard {
+	if cfg.Disabled {
+		return nil
+	}
+	g := &ssrfGuard{}
+	for _, entry := range cfg.Allow {
+		if networks, err := acl.ParseNetworks([]string{entry}); err == nil {
+			g.networks = append(g.networks, networks...)
+		} else {
+			g.domains = append(g.domains, entry)
+		}
+	}
+	return g
+}
+
+// refuses returns why host may not be reached at ip, or "". Allowed domains
+// may resolve to any address.
+func (g *ssrfGuard) refuses(host string, ip net.IP) string {
+	if g == nil || acl.MatchHost(host, g.domains) || acl.ContainsIP(g.networks, ip) {
+		return ""
+	}
+	switch {
+	case ip.IsLoopback():
+		return "loopback address"
+	case ip.IsPrivate():
+		return "private address"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		// Including 169.254.169.254, where clouds serve instance metadata
+		return "link-local address"
+	case ip.IsUnspecified(), ip.To4() != nil && ip.To4()[0] == 0:
+		// Connecting to 0.0.0.0 reaches the gateway itself
+		return "unspecified address"
+	}
+	return ""
+}
+
+// blockedBySSRF returns why the address host refers to may not be reached,
+// logging and counting the refusal of r. Names are checked once resolved,
+// by the guard of direct connections; upstream proxies resolve them in their
+// own networks.
+func (f *Forwarder) blockedBySSRF(r *http.Request, host string) string {
+	addr, _, _ := strings.Cut(host, "%")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	reason := f.ssrf.refuses(host, ip)
+	if reason != "" {
+		f.logf(r, "Refused %s for %s: %s", host, f.clientLabel(r), reason)
+		f.metrics.inc("gatelan_ssrf_blocked_total")
+		f.logBlocked(r, host, reason)
+	}
+	return reason
+}
@@ -0,0 +1,110 @@
+package forwarder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// StateCompaction reports what CompactState removed besides expired entries
+type StateCompaction struct {
+	CacheFiles int `json:"cache_files"` // Cache files no entry referred to
+}
+
+// CompactState drops expired quota periods, stats buckets and portal
+// acceptances, rewrites their files and deletes orphaned cache files
+func (f *Forwarder) CompactState() (StateCompaction, error) {
+	var result StateCompaction
+	var errs []error
+	if err := f.quota.compact(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := f.stats.compact(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, t := range f.tenants {
+		if err := t.quota.compact(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", t.config.Name, err))
+		}
+		if err := t.stats.compact(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", t.config.Name, err))
+		}
+	}
+	if err := f.portal.compact(); err != nil {
+		errs = append(errs, err)
+	}
+	var err error
+	if result.CacheFiles, err = f.cache.compact(); err != nil {
+		errs = append(errs, err)
+	}
+	return result, errors.Join(errs...)
+}
+
+// stateFiles returns the persisted state files by archive name
+func (f *Forwarder) stateFiles() map[string]string {
+	files := make(map[string]string)
+	if f.quota != nil && f.config.Quota.File != "" {
+		files["quota.json"] = f.config.Quota.File
+	}
+	if f.stats != nil && f.config.Stats.File != "" {
+		files["stats.json"] = f.config.Stats.File
+	}
+	if f.portal != nil && f.config.Portal.File != "" {
+		files["portal.json"] = f.config.Portal.File
+	}
+	if f.lists.file != "" {
+		files["lists.json"] = f.lists.file
+	}
+	for _, t := range f.tenants {
+		if t.quota != nil && t.config.Quota.File != "" {
+			files["quota-"+t.config.Name+".json"] = t.config.Quota.File
+		}
+		if t.stats != nil && t.config.StatsFile != "" {
+			files["stats-"+t.config.Name+".json"] = t.config.StatsFile
+		}
+	}
+	return files
+}
+
+// WriteStateBackup saves the current quota, stats, portal and lists state and
+// writes their files to w as a gzipped tar archive. Extracting it into the
+// state directory restores them. The cache is left out as it refills itself.
+func (f *Forwarder) WriteStateBackup(w io.Writer) error {
+	if _, err := f.CompactState(); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	files := f.stateFiles()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data, err := os.ReadFile(files[name])
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		header := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: time.Now()}
+		if err := archive.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+		if _, err := archive.Write(data); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return gz.Close()
+}
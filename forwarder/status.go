@@ -0,0 +1,105 @@
+package forwarder
+
+import (
+	"sort"
+	"time"
+)
+
+// StatusVersion is the version of the Status document. It is raised when a
+// field changes meaning or goes away, not when fields are added.
+const StatusVersion = 1
+
+// Status is the status document of the forwarder, the same one the admin
+// API, the gRPC API, the dashboard and gatelan status report
+type Status struct {
+	StatusVersion int              `json:"status_version"`
+	Version       VersionInfo      `json:"version"`
+	Started       time.Time        `json:"started"`        // When Start bound the listeners, zero while not serving
+	UptimeSeconds float64          `json:"uptime_seconds"` // Since Started
+	Profile       string           `json:"profile,omitempty"`
+	Listeners     []ListenerStatus `json:"listeners"`
+	Upstreams     []UpstreamStatus `json:"upstreams"`
+	Connections   ConnectionCounts `json:"connections"`
+	BytesSent     int64            `json:"bytes_sent"`     // Client to upstream, since the process started
+	BytesReceived int64            `json:"bytes_received"` // Upstream to client, since the process started
+	Readiness     Readiness        `json:"readiness"`
+}
+
+// Uptime returns UptimeSeconds rounded to the second
+func (s Status) Uptime() time.Duration {
+	return time.Duration(s.UptimeSeconds * float64(time.Second)).Round(time.Second)
+}
+
+// ListenerStatus describes one listener serving proxy requests
+type ListenerStatus struct {
+	Name    string `json:"name"`
+	Addr    string `json:"addr"` // Bound address or socket path
+	TLS     bool   `json:"tls,omitempty"`
+	Auth    string `json:"auth,omitempty"` // "basic", "ldap" or "jwt", none when empty
+	Profile string `json:"profile,omitempty"`
+}
+
+// ConnectionCounts counts the requests and tunnels of the connection table
+type ConnectionCounts struct {
+	Open     int    `json:"open"`
+	Requests int    `json:"requests"` // Open plain requests
+	Tunnels  int    `json:"tunnels"`  // Open CONNECT tunnels
+	Stalled  int    `json:"stalled"`  // Open ones whose client stopped reading
+	Handled  uint64 `json:"handled"`  // Requests and tunnels since the process started
+}
+
+// status reports the listener for GetStatus
+func (l *proxyListener) status() ListenerStatus {
+	status := ListenerStatus{Name: l.config.Name, Addr: l.listener.Addr().String(), TLS: l.tls != nil, Profile: l.config.Profile}
+	switch {
+	case l.config.Auth != "":
+		status.Auth = l.config.Auth
+	case len(l.config.Users) > 0:
+		status.Auth = "basic"
+	}
+	return status
+}
+
+// GetStatus reports the build, uptime, listeners and traffic, and the health
+// and latency of every pool upstream followed by the dedicated and profile
+// upstreams of listeners and tenants
+func (f *Forwarder) GetStatus() Status {
+	p := f.current()
+	status := Status{StatusVersion: StatusVersion, Version: GetVersion(), Profile: p.name, Upstreams: make([]UpstreamStatus, 0, len(p.upstreams))}
+
+	f.startedMu.Lock()
+	status.Started = f.started
+	status.Listeners = append([]ListenerStatus{}, f.listening...)
+	f.startedMu.Unlock()
+	if !status.Started.IsZero() {
+		status.UptimeSeconds = time.Since(status.Started).Seconds()
+	}
+
+	for _, up := range p.upstreams {
+		status.Upstreams = append(status.Upstreams, up.status())
+	}
+	f.dedicatedMu.Lock()
+	dedicated := make([]UpstreamStatus, 0, len(f.dedicated))
+	for _, up := range f.dedicated {
+		dedicated = append(dedicated, up.status())
+	}
+	for _, p := range f.bound {
+		for _, up := range p.upstreams {
+			dedicated = append(dedicated, up.status())
+		}
+	}
+	for _, t := range f.tenants {
+		if t.profile != nil {
+			for _, up := range t.profile.upstreams {
+				dedicated = append(dedicated, up.status())
+			}
+		}
+	}
+	f.dedicatedMu.Unlock()
+	sort.Slice(dedicated, func(i, j int) bool { return dedicated[i].Addr < dedicated[j].Addr })
+	status.Upstreams = append(status.Upstreams, dedicated...)
+
+	status.Connections, status.BytesSent, status.BytesReceived = f.connections.totals()
+	status.Readiness = f.GetReadiness()
+	return status
+}
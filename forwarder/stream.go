@@ -0,0 +1,157 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// isEventStream reports whether resp is a server-sent event stream
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// isStreaming reports whether resp may stay open indefinitely and should be
+// relayed as it arrives: event streams and chunked bodies of unknown length
+func isStreaming(resp *http.Response) bool {
+	return isEventStream(resp) || resp.ContentLength < 0 && slices.Contains(resp.TransferEncoding, "chunked")
+}
+
+// send performs one attempt of proxyReq through up. The transport bounds the
+// phases up to the response headers; after that the body may take as long as
+// it needs, provided data keeps arriving within the idle timeout. Streaming
+// responses last as long as the client keeps reading.
+func (f *Forwarder) send(up *upstream, proxyReq *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(proxyReq.Context())
+	// Plain HTTP requests carry the credentials of clients answering the
+	// upstream's challenges themselves
+	if auth := tunnel.ProxyAuthorization(ctx); auth != "" && up.takesAuth && proxyReq.URL.Scheme == "http" {
+		proxyReq = proxyReq.Clone(ctx)
+		proxyReq.Header.Set("Proxy-Authorization", auth)
+	}
+	take := &poolTake{stats: up.pool}
+	trace := up.trace(take)
+	client, idle := up.client, up.idle
+
+	// A timeout the client asked for bounds the wait for the response
+	// headers from the request being written, as the transport's would
+	var headerTimer atomic.Pointer[time.Timer]
+	var returned, expired atomic.Bool
+	timeout, overridden := requestTimeout(ctx)
+	if overridden {
+		client, idle = up.clientFor(timeout), timeout
+		trace.WroteRequest = func(httptrace.WroteRequestInfo) {
+			timer := time.AfterFunc(timeout, func() {
+				expired.Store(true)
+				cancel()
+			})
+			headerTimer.Store(timer)
+			if returned.Load() {
+				timer.Stop()
+			}
+		}
+	}
+	ctx = httptrace.WithClientTrace(ctx, trace)
+
+	resp, err := client.Do(proxyReq.WithContext(ctx))
+	returned.Store(true)
+	if timer := headerTimer.Load(); timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		take.done()
+		cancel()
+		if expired.Load() {
+			err = fmt.Errorf("timeout awaiting response headers after %v: %w", timeout, err)
+		}
+		return nil, err
+	}
+
+	body := &idleBody{ReadCloser: resp.Body, cancel: cancel, done: take.done, timeout: idle}
+	if idle > 0 && !isStreaming(resp) {
+		body.timer = time.AfterFunc(idle, func() {
+			body.idle.Store(true)
+			cancel()
+		})
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// trace measures the connect time of new connections and the time to first
+// response byte of one attempt through u, recording the connections it takes
+func (u *upstream) trace(take *poolTake) *httptrace.ClientTrace {
+	start := time.Now()
+	var dialStart time.Time
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			dialStart = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			take.got(info.Reused)
+			if !info.Reused {
+				u.latency.observeConnect(time.Since(dialStart))
+			}
+		},
+		GotFirstResponseByte: func() {
+			u.latency.observeTTFB(time.Since(start))
+		},
+	}
+}
+
+// idleBody releases an attempt's context and connection once its body is
+// closed, or once no data has arrived for timeout when it has a timer
+type idleBody struct {
+	io.ReadCloser
+	cancel  func()
+	done    func()
+	timeout time.Duration
+	timer   *time.Timer
+	idle    atomic.Bool
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timer != nil {
+		if err != nil && b.idle.Load() {
+			err = fmt.Errorf("upstream idle for %v: %w", b.timeout, err)
+		} else if n > 0 {
+			b.timer.Reset(b.timeout)
+		}
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.cancel()
+	b.done()
+	return err
+}
+
+// flushWriter flushes the client connection after every write so streamed
+// responses reach the client as they arrive
+type flushWriter struct {
+	io.Writer
+	controller *http.ResponseController
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil {
+		err = w.controller.Flush()
+	}
+	return n, err
+}
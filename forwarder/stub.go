@@ -0,0 +1,162 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// stubRule is a compiled StubRule
+type stubRule struct {
+	name    string
+	match   *regexp.Regexp
+	methods []string // Upper case
+	config  config.StubRule
+}
+
+// newStubRules compiles the configured stub rules
+func newStubRules(rules []config.StubRule) ([]stubRule, error) {
+	stubs := make([]stubRule, 0, len(rules))
+	for i, rc := range rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		match, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("stub rule %s: %w", name, err)
+		}
+		rule := stubRule{name: name, match: match, config: rc}
+		for _, method := range rc.Methods {
+			rule.methods = append(rule.methods, strings.ToUpper(method))
+		}
+		stubs = append(stubs, rule)
+	}
+	return stubs, nil
+}
+
+// stubResponse answers req with the first matching stub rule, or returns nil
+// when none matches
+func (f *Forwarder) stubResponse(req *http.Request) *http.Response {
+	if len(f.stubs) == 0 {
+		return nil
+	}
+
+	current := req.URL.String()
+	for _, rule := range f.stubs {
+		if !rule.match.MatchString(current) {
+			continue
+		}
+		if len(rule.methods) > 0 && !slices.Contains(rule.methods, req.Method) {
+			continue
+		}
+		if rule.config.Offline && !f.upstreamsDown(req.Context()) {
+			continue
+		}
+		resp := f.stubAnswer(req, rule)
+		f.logf(req, "Stub rule %s answered %s %s with %d", rule.name, req.Method, current, resp.StatusCode)
+		f.metrics.inc("gatelan_stub_responses_total", "rule", rule.name)
+		return resp
+	}
+	return nil
+}
+
+// stubAnswer builds the response of rule to req
+func (f *Forwarder) stubAnswer(req *http.Request, rule stubRule) *http.Response {
+	cfg := rule.config
+	var resp *http.Response
+	switch {
+	case cfg.Dir != "":
+		resp = f.stubFile(req, cfg.Dir)
+	case cfg.BodyFile != "":
+		// Read at each request, so the file can be updated in place
+		body, err := os.ReadFile(cfg.BodyFile)
+		if err != nil {
+			f.logf(req, "Stub rule %s failed to read %s: %v", rule.name, cfg.BodyFile, err)
+			return f.errorResponse(req, http.StatusInternalServerError, "Stub response unavailable", "")
+		}
+		resp = newResponse(req, cfg.Status, string(body))
+		if contentType := mime.TypeByExtension(path.Ext(cfg.BodyFile)); contentType != "" {
+			resp.Header.Set("Content-Type", contentType)
+		}
+	default:
+		resp = newResponse(req, cfg.Status, cfg.Body)
+	}
+	for name, value := range cfg.Headers {
+		resp.Header.Set(name, value)
+	}
+	if req.Method == http.MethodHead {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+// stubFile answers req with the file its URL path names under dir, or the
+// index.html of a directory
+func (f *Forwarder) stubFile(req *http.Request, dir string) *http.Response {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := f.errorResponse(req, http.StatusMethodNotAllowed, "Method not allowed", "")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return resp
+	}
+	name := path.Clean("/" + req.URL.Path)
+	root := http.Dir(dir)
+	file, err := root.Open(name)
+	if err != nil {
+		return f.errorResponse(req, http.StatusNotFound, "Not found", "")
+	}
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		file.Close()
+		name = path.Join(name, "index.html")
+		if file, err = root.Open(name); err != nil {
+			return f.errorResponse(req, http.StatusNotFound, "Not found", "")
+		}
+		info, err = file.Stat()
+	}
+	if err != nil || info.IsDir() {
+		file.Close()
+		return f.errorResponse(req, http.StatusNotFound, "Not found", "")
+	}
+
+	header := make(http.Header)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          file,
+		ContentLength: info.Size(),
+		Request:       req,
+	}
+}
+
+// upstreamsDown reports whether the circuit breakers of every upstream of
+// the profile in ctx are open
+func (f *Forwarder) upstreamsDown(ctx context.Context) bool {
+	for _, up := range f.profileFor(ctx).upstreams {
+		if up.breaker.currentState() != breakerOpen {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// Audit event message IDs
+const (
+	auditAuthFailure   = "AUTH_FAILURE"
+	auditACLDenied     = "ACL_DENIED"
+	auditBlocked       = "BLOCKED"
+	auditQuotaExceeded = "QUOTA_EXCEEDED"
+)
+
+// Syslog severities used for audit events
+const (
+	severityWarning = 4
+	severityNotice  = 5
+)
+
+// auditQueueSize bounds the events waiting to be sent; more are dropped so a
+// slow collector never stalls requests
+const auditQueueSize = 1024
+
+// auditSink ships RFC 5424 audit events to a syslog collector over UDP, TCP
+// or TLS, reconnecting when the stream breaks
+type auditSink struct {
+	config    config.SyslogConfig
+	facility  int
+	hostname  string
+	tlsConfig *tls.Config
+	queue     chan string
+	done      chan struct{}
+	logger    *log.Logger
+	conn      net.Conn // Owned by run
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAuditSink(cfg config.SyslogConfig, logger *log.Logger) (*auditSink, error) {
+	s := &auditSink{
+		config:   cfg,
+		facility: config.SyslogFacilities[cfg.Facility],
+		hostname: cfg.Hostname,
+		queue:    make(chan string, auditQueueSize),
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+	if s.hostname == "" {
+		if name, err := os.Hostname(); err == nil {
+			s.hostname = name
+		} else {
+			s.hostname = "-"
+		}
+	}
+
+	if cfg.Network == config.SyslogTLS {
+		host, _, _ := net.SplitHostPort(cfg.Addr)
+		s.tlsConfig = &tls.Config{ServerName: host, InsecureSkipVerify: cfg.InsecureSkipVerify}
+		if cfg.CAFile != "" {
+			pem, err := os.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read syslog CA file: %w", err)
+			}
+			s.tlsConfig.RootCAs = x509.NewCertPool()
+			if !s.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in syslog CA file %s", cfg.CAFile)
+			}
+		}
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// logBlocked audits the refusal of r to host and counts it for the usage reports
+func (f *Forwarder) logBlocked(r *http.Request, host, msg string) {
+	f.audit.log(severityNotice, auditBlocked, r, host, msg)
+	f.countBlocked(r, stripPort(host))
+}
+
+// log queues an event about r. host is the destination, if any.
+func (s *auditSink) log(severity int, msgID string, r *http.Request, host, msg string) {
+	if s == nil {
+		return
+	}
+
+	params := []string{"client", remoteIP(r)}
+	if user := requestUser(r); user != "" {
+		params = append(params, "user", user)
+	}
+	if id := requestID(r); id != "" {
+		params = append(params, "request_id", id)
+	}
+	params = append(params, "method", r.Method)
+	if host != "" {
+		params = append(params, "host", host)
+	}
+
+	var sd strings.Builder
+	sd.WriteString("[gatelan@32473")
+	for i := 0; i < len(params); i += 2 {
+		fmt.Fprintf(&sd, " %s=\"%s\"", params[i], sdEscaper.Replace(params[i+1]))
+	}
+	sd.WriteString("]")
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		s.facility*8+severity,
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.config.AppName, os.Getpid(), msgID, sd.String(), msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- line:
+	default:
+		s.logger.Printf("Syslog queue full, dropping %s event", msgID)
+	}
+}
+
+// sdEscaper escapes structured data parameter values
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// run sends queued events until the sink is closed
+func (s *auditSink) run() {
+	defer close(s.done)
+	for line := range s.queue {
+		// Retry once on a fresh connection when the old one went away
+		for attempt := 0; attempt < 2; attempt++ {
+			if err := s.send(line); err != nil {
+				s.logger.Printf("Failed to send syslog event: %v", err)
+				if s.conn != nil {
+					s.conn.Close()
+					s.conn = nil
+				}
+				continue
+			}
+			break
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// send writes one message, dialing the collector if needed. Stream
+// transports use octet-counting framing.
+func (s *auditSink) send(line string) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		var conn net.Conn
+		var err error
+		if s.config.Network == config.SyslogTLS {
+			conn, err = tls.DialWithDialer(dialer, "tcp", s.config.Addr, s.tlsConfig)
+		} else {
+			conn, err = dialer.Dial(s.config.Network, s.config.Addr)
+		}
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if s.config.Network == config.SyslogUDP {
+		_, err := s.conn.Write([]byte(line))
+		return err
+	}
+	_, err := fmt.Fprintf(s.conn, "%d %s", len(line), line)
+	return err
+}
+
+// close flushes queued events and closes the connection
+func (s *auditSink) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
@@ -0,0 +1,50 @@
+package forwarder
+
+import (
+	"net"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// tuneTCP applies the configured socket options to conn when it is a TCP
+// connection. Options that cannot be set don't fail the connection.
+func tuneTCP(conn net.Conn, opts config.TCPOptions) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if opts.Nagle {
+		tcp.SetNoDelay(false)
+	}
+	if opts.KeepAlive < 0 {
+		tcp.SetKeepAlive(false)
+	} else if opts.KeepAlive > 0 || opts.KeepAliveCount > 0 {
+		tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     time.Duration(opts.KeepAlive),
+			Interval: time.Duration(opts.KeepAlive),
+			Count:    opts.KeepAliveCount,
+		})
+	}
+	if opts.ReadBuffer > 0 {
+		tcp.SetReadBuffer(opts.ReadBuffer)
+	}
+	if opts.WriteBuffer > 0 {
+		tcp.SetWriteBuffer(opts.WriteBuffer)
+	}
+}
+
+// tunedListener applies socket options to every accepted connection
+type tunedListener struct {
+	net.Listener
+	opts config.TCPOptions
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		tuneTCP(conn, l.opts)
+	}
+	return conn, err
+}
@@ -0,0 +1,138 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// tenant is a TenantConfig with its networks parsed and its rules, quota,
+// stats and log set up
+type tenant struct {
+	config   config.TenantConfig
+	networks []*net.IPNet
+	profile  *profile      // Replaces that of the listener, nil when none is configured
+	quota    *quotaTracker // Nil leaves its clients uncapped
+	stats    *usageStats
+	logFile  *rotatingFile
+	logger   *log.Logger // Nil without a log file of its own
+}
+
+// newTenants sets up the tenants of cfg in order
+func (f *Forwarder) newTenants(cfg *config.Config) ([]*tenant, error) {
+	var tenants []*tenant
+	for _, tc := range cfg.Tenants {
+		t := &tenant{config: tc}
+		var err error
+		if t.networks, err = acl.ParseNetworks(tc.Networks); err != nil {
+			return nil, fmt.Errorf("tenant %s: invalid networks: %w", tc.Name, err)
+		}
+		if tc.Profile != "" {
+			if t.profile, err = f.newProfile(tc.Profile); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", tc.Name, err)
+			}
+		}
+		if tc.Quota.Enabled {
+			if t.quota, err = newQuotaTracker(tc.Quota); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", tc.Name, err)
+			}
+		}
+		if cfg.Stats.Enabled {
+			stats := cfg.Stats
+			stats.File = tc.StatsFile
+			if t.stats, err = newUsageStats(stats); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", tc.Name, err)
+			}
+		}
+		if tc.Log.File != "" {
+			if t.logFile, err = newRotatingFile(tc.Log); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", tc.Name, err)
+			}
+			t.logger = log.New(t.logFile, "[Forwarder] ", log.LstdFlags|log.Lshortfile)
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// tenantOf returns the first tenant the client at ip belongs to, by its
+// address or the realm of the listener it authenticated on, or nil
+func (f *Forwarder) tenantOf(ip net.IP, realm string) *tenant {
+	for _, t := range f.tenants {
+		if acl.ContainsIP(t.networks, ip) || realm != "" && slices.Contains(t.config.Realms, realm) {
+			return t
+		}
+	}
+	return nil
+}
+
+// tenantNamed returns the tenant called name, or nil
+func (f *Forwarder) tenantNamed(name string) *tenant {
+	for _, t := range f.tenants {
+		if t.config.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// tenantContextKey carries the tenant of a request
+type tenantContextKey struct{}
+
+// withTenant attributes the requests using ctx to t
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantContextKey{}, t)
+}
+
+// requestTenant returns the tenant of req, nil when it belongs to none
+func requestTenant(req *http.Request) *tenant {
+	t, _ := req.Context().Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// countBlocked counts a refused request of req to domain in the usage
+// reports, those of its tenant included
+func (f *Forwarder) countBlocked(req *http.Request, domain string) {
+	f.stats.block(domain)
+	if t := requestTenant(req); t != nil {
+		t.stats.block(domain)
+	}
+}
+
+// saveUsage persists the usage statistics and quota usage, those of the
+// tenants included
+func (f *Forwarder) saveUsage() error {
+	errs := []error{f.stats.save(), f.quota.save()}
+	for _, t := range f.tenants {
+		if err := t.stats.save(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", t.config.Name, err))
+		}
+		if err := t.quota.save(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", t.config.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeTenantLogs closes the log files of the tenants
+func (f *Forwarder) closeTenantLogs() error {
+	var errs []error
+	for _, t := range f.tenants {
+		if t.logFile != nil {
+			if err := t.logFile.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("tenant %s: %w", t.config.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
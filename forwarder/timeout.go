@@ -0,0 +1,69 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+)
+
+// timeoutContextKey carries the timeout a trusted client asked for
+type timeoutContextKey struct{}
+
+// requestTimeout returns the timeout requested for the request using ctx
+func requestTimeout(ctx context.Context) (time.Duration, bool) {
+	timeout, ok := ctx.Value(timeoutContextKey{}).(time.Duration)
+	return timeout, ok
+}
+
+// withRequestTimeout applies the timeout header of a trusted client to req,
+// capped at request_timeout.max. The header never goes upstream.
+func (f *Forwarder) withRequestTimeout(req *http.Request) *http.Request {
+	cfg := f.config.RequestTimeout
+	value := req.Header.Get(cfg.Header)
+	if value == "" {
+		return req
+	}
+	req.Header.Del(cfg.Header)
+	if !acl.ContainsIP(f.timeouts, net.ParseIP(remoteIP(req))) {
+		return req
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		f.logf(req, "Ignoring invalid %s %q from %s", cfg.Header, value, f.clientLabel(req))
+		return req
+	}
+	if max := time.Duration(cfg.Max); timeout > max {
+		f.logf(req, "Capping %s of %v from %s to %v", cfg.Header, timeout, f.clientLabel(req), max)
+		timeout = max
+	}
+	f.metrics.inc("gatelan_request_timeout_overrides_total")
+	return req.WithContext(context.WithValue(req.Context(), timeoutContextKey{}, timeout))
+}
+
+// clientFor returns the client able to wait timeout for response headers:
+// the upstream's own, or one whose transport has no header timeout of its own
+// when timeout exceeds it
+func (u *upstream) clientFor(timeout time.Duration) *http.Client {
+	if u.header <= 0 || timeout <= u.header {
+		return u.client
+	}
+	u.relaxedOnce.Do(func() {
+		transport := u.transport.Clone()
+		transport.ResponseHeaderTimeout = 0
+		u.relaxed.Store(&http.Client{Transport: transport})
+	})
+	return u.relaxed.Load()
+}
+
+// closeIdleConnections closes the idle connections of every transport of u
+// and those prewarming opened
+func (u *upstream) closeIdleConnections() {
+	u.transport.CloseIdleConnections()
+	u.warm.release()
+	if relaxed := u.relaxed.Load(); relaxed != nil {
+		relaxed.CloseIdleConnections()
+	}
+}
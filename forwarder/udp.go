@@ -0,0 +1,198 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+)
+
+// udpBufferSize holds the largest UDP payload
+const udpBufferSize = 65535
+
+// udpForwarder relays the datagrams its clients send to the configured target
+type udpForwarder struct {
+	name   string
+	config config.UDPForwarderConfig
+	allow  []*net.IPNet
+	conn   net.PacketConn
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession // By client address
+	closed   bool
+}
+
+// udpSession is the upstream socket of one client, which replies come back on
+type udpSession struct {
+	client   net.Addr
+	upstream net.Conn
+	active   atomic.Int64 // Unix nanoseconds of the last datagram either way
+}
+
+// startUDP binds the configured UDP forwarders and relays until they close
+func (f *Forwarder) startUDP(ctx context.Context) error {
+	for i, cfg := range f.config.UDPForwarders {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		allow, err := acl.ParseNetworks(cfg.Allow)
+		if err != nil {
+			return fmt.Errorf("UDP forwarder %s: %w", name, err)
+		}
+		conn, err := f.listenUDP(cfg.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for UDP forwarder %s: %w", name, err)
+		}
+		u := &udpForwarder{
+			name:     name,
+			config:   cfg,
+			allow:    allow,
+			conn:     conn,
+			sessions: make(map[string]*udpSession),
+		}
+		f.udp = append(f.udp, u)
+		f.logger.Printf("UDP forwarder %s on %s relaying to %s", name, conn.LocalAddr(), cfg.Target)
+		go f.serveUDP(ctx, u)
+	}
+	return nil
+}
+
+// closeUDP closes the UDP forwarders and their sessions
+func (f *Forwarder) closeUDP() {
+	for _, u := range f.udp {
+		u.close()
+	}
+	f.udp = nil
+}
+
+// serveUDP relays the datagrams of u's clients until u is closed
+func (f *Forwarder) serveUDP(ctx context.Context, u *udpForwarder) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.logger.Printf("UDP forwarder %s stopped: %v", u.name, err)
+			}
+			return
+		}
+		if len(u.allow) > 0 && !acl.ContainsIP(u.allow, udpAddrIP(addr)) {
+			f.metrics.inc("gatelan_udp_dropped_total", "forwarder", u.name, "reason", "client")
+			continue
+		}
+		s := f.udpSession(ctx, u, addr)
+		if s == nil {
+			continue
+		}
+		s.active.Store(time.Now().UnixNano())
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			f.metrics.inc("gatelan_udp_dropped_total", "forwarder", u.name, "reason", "upstream")
+			continue
+		}
+		f.metrics.inc("gatelan_udp_datagrams_total", "forwarder", u.name, "direction", "upstream")
+		f.metrics.add("gatelan_udp_bytes_total", float64(n), "forwarder", u.name, "direction", "upstream")
+	}
+}
+
+// udpSession returns the session of client, opening one when there is room,
+// or nil when its datagram is to be dropped
+func (f *Forwarder) udpSession(ctx context.Context, u *udpForwarder, client net.Addr) *udpSession {
+	key := client.String()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if s, ok := u.sessions[key]; ok {
+		return s
+	}
+	if u.closed {
+		return nil
+	}
+	if len(u.sessions) >= u.config.MaxSessions {
+		f.metrics.inc("gatelan_udp_dropped_total", "forwarder", u.name, "reason", "sessions")
+		return nil
+	}
+	var dialer net.Dialer
+	upstream, err := dialer.DialContext(ctx, "udp", u.config.Target)
+	if err != nil {
+		f.logger.Printf("UDP forwarder %s failed to reach %s for %s: %v", u.name, u.config.Target, key, err)
+		f.metrics.inc("gatelan_udp_dropped_total", "forwarder", u.name, "reason", "upstream")
+		return nil
+	}
+	s := &udpSession{client: client, upstream: upstream}
+	s.active.Store(time.Now().UnixNano())
+	u.sessions[key] = s
+	f.metrics.inc("gatelan_udp_sessions_total", "forwarder", u.name)
+	f.metrics.set("gatelan_udp_sessions", float64(len(u.sessions)), "forwarder", u.name)
+	go f.relayUDPReplies(u, s, key)
+	return s
+}
+
+// relayUDPReplies sends what the target answers on s back to its client,
+// ending s once no datagram went either way for the idle timeout
+func (f *Forwarder) relayUDPReplies(u *udpForwarder, s *udpSession, key string) {
+	defer f.endUDPSession(u, key, s)
+	idle := time.Duration(u.config.Idle)
+	buf := make([]byte, udpBufferSize)
+	for {
+		s.upstream.SetReadDeadline(time.Unix(0, s.active.Load()).Add(idle))
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, s.active.Load())) >= idle {
+				return
+			}
+			// Datagrams from the client came in meanwhile, or the target
+			// refused one (ICMP port unreachable); later ones may still pass
+			continue
+		}
+		s.active.Store(time.Now().UnixNano())
+		if _, err := u.conn.WriteTo(buf[:n], s.client); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			f.metrics.inc("gatelan_udp_dropped_total", "forwarder", u.name, "reason", "client")
+			continue
+		}
+		f.metrics.inc("gatelan_udp_datagrams_total", "forwarder", u.name, "direction", "downstream")
+		f.metrics.add("gatelan_udp_bytes_total", float64(n), "forwarder", u.name, "direction", "downstream")
+	}
+}
+
+// endUDPSession removes s from u and closes its upstream socket
+func (f *Forwarder) endUDPSession(u *udpForwarder, key string, s *udpSession) {
+	u.mu.Lock()
+	if u.sessions[key] == s {
+		delete(u.sessions, key)
+	}
+	f.metrics.set("gatelan_udp_sessions", float64(len(u.sessions)), "forwarder", u.name)
+	u.mu.Unlock()
+	s.upstream.Close()
+}
+
+// close stops u from relaying, ending every session
+func (u *udpForwarder) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	u.conn.Close()
+	for _, s := range u.sessions {
+		s.upstream.Close()
+	}
+}
+
+// udpAddrIP returns the IP address of addr, or nil
+func udpAddrIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a.IP
+	}
+	return nil
+}
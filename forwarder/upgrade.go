@@ -0,0 +1,99 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Environment of a new instance started by Upgrade
+const (
+	upgradeFDsEnv   = "GATELAN_UPGRADE_FDS"   // Keys of the inherited sockets, from fd 3 on
+	upgradeReadyEnv = "GATELAN_UPGRADE_READY" // Descriptor written to once serving
+)
+
+// upgradeTimeout bounds the start of the new instance during an upgrade
+const upgradeTimeout = time.Minute
+
+// socketFile is a bound socket that can be duplicated for a new instance
+type socketFile interface {
+	File() (*os.File, error)
+}
+
+// HandedOver is closed once Upgrade handed the sockets to a new instance,
+// whichever caller asked for it, telling the owner to shut this one down
+func (f *Forwarder) HandedOver() <-chan struct{} {
+	return f.handedOver
+}
+
+// registerSocket records a bound socket under the key a new instance looks
+// it up by, such as "tcp/:8080" or "unix//run/gatelan.sock"
+func (f *Forwarder) registerSocket(key string, socket any) {
+	if file, ok := socket.(socketFile); ok {
+		if f.sockets == nil {
+			f.sockets = make(map[string]socketFile)
+		}
+		f.sockets[key] = file
+	}
+}
+
+// inheritedListener returns the listener for key handed over by the instance
+// being upgraded, or nil when there is none
+func (f *Forwarder) inheritedListener(key string) (net.Listener, error) {
+	file, ok := f.inherited[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(f.inherited, key)
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("inherited socket %s: %w", key, err)
+	}
+	return listener, nil
+}
+
+// listenTCP binds addr, or takes the socket inherited for it
+func (f *Forwarder) listenTCP(addr string) (net.Listener, error) {
+	key := "tcp/" + addr
+	listener, err := f.inheritedListener(key)
+	if err == nil && listener == nil {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.registerSocket(key, listener)
+	return listener, nil
+}
+
+// listenUDP binds addr, or takes the socket inherited for it
+func (f *Forwarder) listenUDP(addr string) (net.PacketConn, error) {
+	key := "udp/" + addr
+	if file, ok := f.inherited[key]; ok {
+		delete(f.inherited, key)
+		defer file.Close()
+		conn, err := net.FilePacketConn(file)
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %s: %w", key, err)
+		}
+		f.registerSocket(key, conn)
+		return conn, nil
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f.registerSocket(key, conn)
+	return conn, nil
+}
+
+// closeInherited releases inherited sockets the configuration no longer uses
+func (f *Forwarder) closeInherited() {
+	for key, file := range f.inherited {
+		f.logger.Printf("Closing inherited socket %s, which is no longer configured", key)
+		file.Close()
+	}
+	f.inherited = nil
+}
@@ -0,0 +1,159 @@
+//go:build !windows
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// Upgrade starts the executable anew with the same arguments, handing it all
+// bound sockets, and returns once the new instance is serving. The caller
+// then shuts this instance down: clients keep connecting to the same sockets
+// meanwhile, and its open tunnels run on until the shutdown context ends.
+// When the new instance fails, for instance over invalid config, this one
+// announces it and keeps serving. HandedOver is closed on success.
+func (f *Forwarder) Upgrade(ctx context.Context) error {
+	f.lifecycleMu.Lock()
+	defer f.lifecycleMu.Unlock()
+	if f.state != stateRunning {
+		return ErrNotRunning
+	}
+	if f.upgraded {
+		return errors.New("already handed over to a new instance")
+	}
+	err := f.upgrade(ctx)
+	if err != nil {
+		f.emit(Event{Type: config.EventReloadFailed, Message: "New instance failed to take over, still serving", Error: err.Error()})
+		return err
+	}
+	close(f.handedOver)
+	return nil
+}
+
+// upgrade hands over to the new instance for Upgrade
+func (f *Forwarder) upgrade(ctx context.Context) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	keys := make([]string, 0, len(f.sockets))
+	for key := range f.sockets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	files := make([]*os.File, 0, len(keys)+1)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, key := range keys {
+		file, err := f.sockets[key].File()
+		if err != nil {
+			return fmt.Errorf("failed to hand over socket %s: %w", key, err)
+		}
+		files = append(files, file)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+
+	var env []string
+	for _, entry := range os.Environ() {
+		if !strings.HasPrefix(entry, upgradeFDsEnv+"=") && !strings.HasPrefix(entry, upgradeReadyEnv+"=") {
+			env = append(env, entry)
+		}
+	}
+	env = append(env,
+		upgradeFDsEnv+"="+strings.Join(keys, ","),
+		upgradeReadyEnv+"="+strconv.Itoa(systemdListenFdsStart+len(keys)))
+
+	cmd := exec.Command(exePath, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start new instance: %w", err)
+	}
+	readyWriter.Close()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// The new instance writes once it serves, or the pipe closes when it exits
+	started := make(chan bool, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		started <- err == nil
+	}()
+	ctx, cancel := context.WithTimeout(ctx, upgradeTimeout)
+	defer cancel()
+	select {
+	case ok := <-started:
+		if !ok {
+			return fmt.Errorf("new instance exited before serving: %v", <-exited)
+		}
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return fmt.Errorf("new instance did not start serving: %w", ctx.Err())
+	}
+
+	// The socket files now belong to the new instance
+	for _, socket := range f.sockets {
+		if unix, ok := socket.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	f.upgraded = true
+	f.logger.Printf("Handed %d sockets over to new instance with pid %d", len(keys), cmd.Process.Pid)
+	return nil
+}
+
+// inheritedSockets returns the sockets handed over by Upgrade, by key
+func inheritedSockets() map[string]*os.File {
+	keys := os.Getenv(upgradeFDsEnv)
+	os.Unsetenv(upgradeFDsEnv)
+	if keys == "" {
+		return nil
+	}
+	sockets := make(map[string]*os.File)
+	for i, key := range strings.Split(keys, ",") {
+		sockets[key] = os.NewFile(uintptr(systemdListenFdsStart+i), key)
+	}
+	return sockets
+}
+
+// notifyUpgraded tells the instance that started this one that it is
+// serving, once: a later Start after Stop has nobody to tell
+func notifyUpgraded() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	os.Unsetenv(upgradeReadyEnv)
+	if err != nil {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "upgrade-ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// IsUpgrade reports whether this process was started by Upgrade
+func IsUpgrade() bool {
+	return os.Getenv(upgradeReadyEnv) != ""
+}
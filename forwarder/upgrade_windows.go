@@ -0,0 +1,21 @@
+//go:build windows
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// Upgrade is not supported on Windows, which cannot pass sockets to a child
+func (f *Forwarder) Upgrade(ctx context.Context) error {
+	return errors.New("upgrades are not supported on Windows")
+}
+
+func inheritedSockets() map[string]*os.File { return nil }
+
+func notifyUpgraded() {}
+
+// IsUpgrade reports whether this process was started by Upgrade
+func IsUpgrade() bool { return false }
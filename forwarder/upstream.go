@@ -0,0 +1,223 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// upstream is a single upstream proxy with its own connection pool
+type upstream struct {
+	addr      string // As configured, for lookups
+	name      string // addr without credentials, for logs and metrics
+	route     tunnel.Dialer
+	transport *http.Transport
+	client    *http.Client
+	breaker   *circuitBreaker
+	latency   *latencyTracker
+	pool      *poolStats
+	direct    bool          // Connects to destinations itself rather than via a proxy
+	host      string        // Host name of the proxy, empty when addressed by IP
+	idle      time.Duration // Longest wait for response body data, none when 0
+	header    time.Duration // The transport's response header timeout, none when 0
+	takesAuth bool          // An HTTP proxy without credentials, taking those of clients
+	warm      *warmDialer   // Connections opened ahead of requests, none when nil
+	dialAddr  string        // Address of the proxy that prewarming connects to, empty when none
+
+	relaxedOnce sync.Once
+	relaxed     atomic.Pointer[http.Client] // Without a response header timeout, for requests allowed longer
+}
+
+// newUpstream creates an HTTP client that forwards all requests through the
+// upstream at addr (see config.ParseUpstream), reached via the configured
+// chain of hops, address family, pool sizes and timeouts. No timeout bounds
+// an exchange as a whole, so large downloads and long polls run to
+// completion. Plain HTTP requests go to HTTP proxies in absolute form;
+// everything else, including the transport's own tunnels, is dialed along
+// the upstream's route.
+func newUpstream(addr string, cfg *config.Config) (*upstream, error) {
+	proxyURL, err := config.ParseUpstream(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	up := &upstream{addr: addr, name: addr, pool: &poolStats{}, idle: cfg.Timeouts.UpstreamIdle.Timeout(), header: cfg.Timeouts.ResponseHeader.Timeout()}
+	var base tunnel.ContextDialer
+	var proxyAddr string
+	var proxyTLS *tls.Config
+	if proxyURL == nil {
+		// Direct connections skip the chain and race the destination's
+		// addresses, each checked as it is dialed
+		dialer := newFamilyDialer(cfg, time.Duration(cfg.FallbackDelay))
+		dialer.dialer.ControlContext = checkDestination
+		base = up.prewarmed(cfg, dialer)
+		up.route = &tunnel.Direct{Dialer: base}
+		up.direct = true
+	} else {
+		base = &tunnel.ChainDialer{
+			Hops:   cfg.ProxyChain,
+			Dialer: newFamilyDialer(cfg, 0),
+		}
+		if proxyURL.Scheme == "ssh" {
+			// The SSH connection is kept open anyway
+			up.route, err = newSSHRoute(proxyURL, cfg, base)
+		} else {
+			base = up.prewarmed(cfg, base)
+			up.dialAddr = proxyURL.Host
+			up.route, err = tunnel.NewDialer(proxyURL, base)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL.Scheme == "https" {
+			if proxyTLS, err = newProxyTLS(cfg.UpstreamTLS, proxyURL.Hostname()); err != nil {
+				return nil, err
+			}
+			up.route.(*tunnel.HTTPProxy).TLS = proxyTLS
+			proxyAddr = proxyURL.Host
+		}
+		if proxyURL.User != nil {
+			up.name = proxyURL.Redacted()
+		}
+		if proxyURL.Scheme == "ss" {
+			// SIP002 URLs carry the password encoded in the username
+			up.name = "ss://" + proxyURL.Host
+		}
+		if net.ParseIP(proxyURL.Hostname()) == nil {
+			up.host = proxyURL.Hostname()
+		}
+	}
+
+	// Create a custom transport that ignores proxy environment variables
+	// and only uses our configured proxy
+	up.transport = newTransport(cfg, up.pool.countDials(func(ctx context.Context, network, target string) (net.Conn, error) {
+		if proxyURL != nil && target == proxyURL.Host {
+			return base.DialContext(ctx, network, target)
+		}
+		return up.route.Dial(ctx, target)
+	}), proxyAddr, proxyTLS)
+	if proxyURL != nil && (proxyURL.Scheme == "http" || proxyURL.Scheme == "https") {
+		up.takesAuth = proxyURL.User == nil
+		up.transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if req.URL.Scheme == "http" {
+				return proxyURL, nil
+			}
+			return nil, nil
+		}
+	}
+
+	up.client = &http.Client{Transport: up.transport}
+	return up, nil
+}
+
+// newTransport creates a transport with the configured pool sizes and
+// timeouts. proxyTLS secures the connections to the HTTPS proxy at proxyAddr
+// that it sends plain HTTP requests to.
+func newTransport(cfg *config.Config, dial func(ctx context.Context, network, addr string) (net.Conn, error), proxyAddr string, proxyTLS *tls.Config) *http.Transport {
+	pool := cfg.Pool
+	return &http.Transport{
+		DialContext:           dial,
+		DialTLSContext:        tlsDialer(cfg, dial, proxyAddr, proxyTLS),
+		MaxIdleConns:          pool.MaxIdleConns,
+		MaxIdleConnsPerHost:   pool.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       pool.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(pool.IdleConnTimeout),
+		DisableKeepAlives:     pool.DisableKeepAlives,
+		TLSHandshakeTimeout:   cfg.Timeouts.TLSHandshake.Timeout(),
+		ResponseHeaderTimeout: cfg.Timeouts.ResponseHeader.Timeout(),
+		ExpectContinueTimeout: cfg.Timeouts.ExpectContinue.Timeout(),
+	}
+}
+
+// dialTunnel opens a tunnel to target along this upstream's route, recording
+// the time until it is usable
+func (u *upstream) dialTunnel(ctx context.Context, target string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := u.route.Dial(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	u.latency.observeTTFB(time.Since(start))
+	return conn, nil
+}
+
+// upstreamContextKey carries a preferred upstream through a request context
+type upstreamContextKey struct{}
+
+// withUpstream makes up the first choice for requests using ctx
+func withUpstream(ctx context.Context, up *upstream) context.Context {
+	if up == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, upstreamContextKey{}, up)
+}
+
+// selectUpstream returns the upstream for an attempt: the context's preferred
+// upstream first (for every attempt when it is the direct upstream), then
+// the one the client is pinned to, otherwise the first pool member from index
+// start whose circuit breaker admits a request. With the fastest strategy,
+// first attempts try members by recent latency instead. When no breaker
+// admits one, fallback_direct connects directly.
+func (f *Forwarder) selectUpstream(ctx context.Context, start int) (*upstream, error) {
+	if preferred, ok := ctx.Value(upstreamContextKey{}).(*upstream); ok && (start == 0 || preferred.direct) {
+		if preferred.breaker.allow() {
+			return preferred, nil
+		}
+	}
+
+	key, _ := ctx.Value(affinityContextKey{}).(string)
+	if key != "" && start == 0 {
+		if pinned := f.affinity.lookup(key); pinned != nil && pinned.breaker.allow() {
+			f.affinity.pin(key, pinned)
+			return pinned, nil
+		}
+	}
+
+	p := f.profileFor(ctx)
+	for _, up := range f.candidates(p.upstreams, start) {
+		if up.breaker.allow() {
+			if key != "" {
+				f.affinity.pin(key, up)
+			}
+			return up, nil
+		}
+	}
+
+	if f.config.CircuitBreaker.FallbackDirect && p.direct != nil {
+		if !f.fallback.Swap(true) {
+			f.logger.Printf("All upstream proxies are down, connecting directly")
+			f.metrics.inc("gatelan_direct_fallbacks_total")
+		}
+		return p.direct, nil
+	}
+	return nil, ErrUpstreamUnavailable
+}
+
+// candidates orders the pool for an attempt: rotated to start, or for a first
+// attempt under the fastest strategy by moving average time to first byte.
+// Members without samples yet sort first so that each gets measured.
+func (f *Forwarder) candidates(upstreams []*upstream, start int) []*upstream {
+	ordered := make([]*upstream, 0, len(upstreams))
+	for i := range upstreams {
+		ordered = append(ordered, upstreams[(start+i)%len(upstreams)])
+	}
+	if f.config.Balance == config.BalanceFastest && start == 0 && len(ordered) > 1 {
+		latency := make(map[*upstream]time.Duration, len(ordered))
+		for _, up := range ordered {
+			_, latency[up] = up.latency.averages()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return latency[ordered[i]] < latency[ordered[j]]
+		})
+	}
+	return ordered
+}
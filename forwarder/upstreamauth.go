@@ -0,0 +1,57 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/n0z0/GateLAN/acl"
+	"github.com/n0z0/GateLAN/config"
+	"github.com/n0z0/GateLAN/tunnel"
+)
+
+// upstreamAuth selects the clients authenticating with upstream proxies
+// themselves. A nil one selects none.
+type upstreamAuth struct {
+	clients []*net.IPNet
+}
+
+// newUpstreamAuth returns nil unless pass-through is enabled
+func newUpstreamAuth(cfg config.UpstreamAuthConfig) (*upstreamAuth, error) {
+	if !cfg.PassThrough {
+		return nil, nil
+	}
+	clients, err := acl.ParseNetworks(cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream_auth clients: %w", err)
+	}
+	return &upstreamAuth{clients: clients}, nil
+}
+
+// passAuth reports whether the client of req answers the 407 challenges of
+// upstream proxies itself, returning req carrying its Proxy-Authorization
+// for them. Users the listener authenticated answered the proxy's own.
+func (f *Forwarder) passAuth(req *http.Request) (*http.Request, bool) {
+	a := f.proxyAuth
+	if a == nil || requestUser(req) != "" {
+		return req, false
+	}
+	if len(a.clients) > 0 && !acl.ContainsIP(a.clients, net.ParseIP(remoteIP(req))) {
+		return req, false
+	}
+	if auth := req.Header.Get("Proxy-Authorization"); auth != "" {
+		req = req.WithContext(tunnel.WithProxyAuthorization(req.Context(), auth))
+	}
+	return req, true
+}
+
+// upstreamChallenge returns the Proxy-Authenticate challenges of an upstream
+// refusing a tunnel with 407, or nil
+func upstreamChallenge(err error) []string {
+	var refused *tunnel.ConnectError
+	if !errors.As(err, &refused) || refused.StatusCode != http.StatusProxyAuthRequired {
+		return nil
+	}
+	return refused.Header.Values("Proxy-Authenticate")
+}
@@ -0,0 +1,237 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n0z0/GateLAN/config"
+)
+
+// Usage is the traffic attributed to one destination domain or client IP
+type Usage struct {
+	Key           string `json:"key"`
+	Requests      int64  `json:"requests"`
+	BytesSent     int64  `json:"bytes_sent"`     // Client to upstream
+	BytesReceived int64  `json:"bytes_received"` // Upstream to client
+}
+
+// usageBucket holds the usage recorded during one slice of the window
+type usageBucket struct {
+	Start   time.Time         `json:"start"`
+	Domains map[string]*Usage `json:"domains"`
+	Clients map[string]*Usage `json:"clients"`
+	Blocked map[string]*Usage `json:"blocked,omitempty"` // Refused requests by destination domain
+}
+
+// usageStats aggregates usage over a rolling window made of fixed buckets
+type usageStats struct {
+	config     config.StatsConfig
+	bucketSize time.Duration
+
+	mu      sync.Mutex
+	buckets []*usageBucket // Oldest first
+
+	saveMu sync.Mutex // Serialises writes of the file
+}
+
+// newUsageStats creates the aggregator, restoring persisted buckets if any
+func newUsageStats(cfg config.StatsConfig) (*usageStats, error) {
+	s := &usageStats{
+		config:     cfg,
+		bucketSize: time.Duration(cfg.Window) / time.Duration(cfg.Buckets),
+	}
+	if cfg.File == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stats file: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.buckets); err != nil {
+		return nil, fmt.Errorf("failed to parse stats file: %w", err)
+	}
+	return s, nil
+}
+
+// expire drops buckets that fell out of the window; callers hold s.mu
+func (s *usageStats) expire(now time.Time) {
+	cutoff := now.Add(-time.Duration(s.config.Window))
+	i := 0
+	for i < len(s.buckets) && !s.buckets[i].Start.After(cutoff) {
+		i++
+	}
+	s.buckets = s.buckets[i:]
+}
+
+// current returns the bucket for now, starting a new one when needed
+func (s *usageStats) current(now time.Time) *usageBucket {
+	s.expire(now)
+	if n := len(s.buckets); n > 0 && now.Before(s.buckets[n-1].Start.Add(s.bucketSize)) {
+		return s.buckets[n-1]
+	}
+	bucket := &usageBucket{
+		Start:   now.Truncate(s.bucketSize),
+		Domains: make(map[string]*Usage),
+		Clients: make(map[string]*Usage),
+	}
+	s.buckets = append(s.buckets, bucket)
+	return bucket
+}
+
+// record attributes one request or tunnel to domain and client
+func (s *usageStats) record(domain, client string, sent, received int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.current(time.Now())
+	for _, entry := range []struct {
+		table map[string]*Usage
+		key   string
+	}{{bucket.Domains, domain}, {bucket.Clients, client}} {
+		if entry.key == "" {
+			continue
+		}
+		u, ok := entry.table[entry.key]
+		if !ok {
+			u = &Usage{Key: entry.key}
+			entry.table[entry.key] = u
+		}
+		u.Requests++
+		u.BytesSent += sent
+		u.BytesReceived += received
+	}
+}
+
+// block counts a refused request to domain
+func (s *usageStats) block(domain string) {
+	if s == nil || domain == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.current(time.Now())
+	if bucket.Blocked == nil {
+		bucket.Blocked = make(map[string]*Usage)
+	}
+	u, ok := bucket.Blocked[domain]
+	if !ok {
+		u = &Usage{Key: domain}
+		bucket.Blocked[domain] = u
+	}
+	u.Requests++
+}
+
+// top sums the window and returns the n heaviest keys by total bytes
+func (s *usageStats) top(clients bool, n int) []Usage {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.expire(time.Now())
+	totals := sumUsage(s.buckets, func(b *usageBucket) map[string]*Usage {
+		if clients {
+			return b.Clients
+		}
+		return b.Domains
+	})
+	s.mu.Unlock()
+	return rankUsage(totals, n)
+}
+
+// sumUsage adds up the table of each bucket by key
+func sumUsage(buckets []*usageBucket, table func(*usageBucket) map[string]*Usage) map[string]*Usage {
+	totals := make(map[string]*Usage)
+	for _, bucket := range buckets {
+		for key, u := range table(bucket) {
+			t, ok := totals[key]
+			if !ok {
+				t = &Usage{Key: key}
+				totals[key] = t
+			}
+			t.Requests += u.Requests
+			t.BytesSent += u.BytesSent
+			t.BytesReceived += u.BytesReceived
+		}
+	}
+	return totals
+}
+
+// rankUsage returns the n heaviest totals by bytes, then requests, all of
+// them when n is zero
+func rankUsage(totals map[string]*Usage, n int) []Usage {
+	result := make([]Usage, 0, len(totals))
+	for _, u := range totals {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].BytesSent+result[i].BytesReceived, result[j].BytesSent+result[j].BytesReceived
+		if a != b {
+			return a > b
+		}
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Key < result[j].Key
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// save persists the window to the configured file, if any
+func (s *usageStats) save() error {
+	if s == nil || s.config.File == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	data, err := json.Marshal(s.buckets)
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode stats: %w", err)
+	}
+
+	// Write then rename so a crash never leaves a truncated file
+	tmp := s.config.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write stats file: %w", err)
+	}
+	return os.Rename(tmp, s.config.File)
+}
+
+// compact drops the buckets that fell out of the window and saves the rest
+func (s *usageStats) compact() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.expire(time.Now())
+	s.mu.Unlock()
+	return s.save()
+}
+
+// TopDomains returns the n destination domains with the most traffic in the
+// stats window, all of them when n is zero
+func (f *Forwarder) TopDomains(n int) []Usage {
+	return f.stats.top(false, n)
+}
+
+// TopClients returns the n client IPs with the most traffic in the stats window
+func (f *Forwarder) TopClients(n int) []Usage {
+	return f.stats.top(true, n)
+}
@@ -0,0 +1,73 @@
+package forwarder
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Build details, set at link time with for example
+// -ldflags "-X github.com/n0z0/GateLAN/forwarder.version=v1.2.0". Unset ones
+// come from the version control information Go embeds in the binary.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// VersionInfo identifies the running build
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"` // The commit time when not set at link time
+	GoVersion string `json:"go_version"`
+}
+
+// GetVersion returns the version, commit and build date of the binary
+func GetVersion() VersionInfo {
+	return buildVersion()
+}
+
+var buildVersion = sync.OnceValue(func() VersionInfo {
+	info := VersionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && build.Main.Version != "(devel)" {
+			info.Version = build.Main.Version
+		}
+		var modified bool
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+})
+
+// String formats the build for -version output and logs
+func (v VersionInfo) String() string {
+	s := v.Version
+	if v.Commit != "" {
+		s += " (" + v.Commit
+		if v.BuildDate != "" {
+			s += ", built " + v.BuildDate
+		}
+		s += ")"
+	}
+	return s + " " + v.GoVersion
+}
@@ -0,0 +1,233 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/n0z0/GateLAN/acl"
+)
+
+// wpadTTL is how long clients may cache the answer to a wpad lookup
+const wpadTTL = 300
+
+// startWPAD serves the proxy auto-config file and, when configured, answers
+// wpad name lookups with this host's address
+func (f *Forwarder) startWPAD(ctx context.Context) error {
+	cfg := f.config.WPAD
+	if cfg.Addr == "" && cfg.DNSAddr == "" {
+		return nil
+	}
+	proxy, err := f.advertisedProxy(cfg.Proxy)
+	if err != nil {
+		return fmt.Errorf("failed to determine WPAD proxy address: %w", err)
+	}
+	pac := pacScript(proxy, cfg.Direct)
+
+	if cfg.Addr != "" {
+		listener, err := f.listenTCP(cfg.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on WPAD address: %w", err)
+		}
+		mux := http.NewServeMux()
+		servePAC := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+			w.Write([]byte(pac))
+		}
+		mux.HandleFunc("GET /wpad.dat", servePAC)
+		mux.HandleFunc("GET /proxy.pac", servePAC)
+		var handler http.Handler = mux
+		if f.acme != nil && f.config.ACME.HTTPAddr == cfg.Addr {
+			// Answer the HTTP-01 challenges sharing the port
+			handler = f.acme.HTTPHandler(mux)
+		}
+		f.wpad = &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+			BaseContext: func(net.Listener) context.Context {
+				return ctx
+			},
+		}
+		f.logger.Printf("WPAD on %s advertising proxy %s", listener.Addr(), proxy)
+		go func() {
+			if err := f.wpad.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				f.logger.Printf("WPAD server stopped: %v", err)
+			}
+		}()
+	}
+
+	if cfg.DNSAddr != "" {
+		host, _, _ := net.SplitHostPort(proxy)
+		ip := net.ParseIP(host).To4()
+		if ip == nil {
+			return fmt.Errorf("WPAD DNS needs an IPv4 proxy address, have %s", host)
+		}
+		conn, err := f.listenUDP(cfg.DNSAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on WPAD DNS address: %w", err)
+		}
+		f.wpadDNS = conn
+		f.logger.Printf("Answering wpad lookups on %s with %s", conn.LocalAddr(), ip)
+		go f.serveWPADDNS(conn, ip)
+	}
+	return nil
+}
+
+// advertisedProxy returns the proxy address to publish to clients: the
+// configured one, or this host's LAN address with the port of the first TCP
+// listener
+func (f *Forwarder) advertisedProxy(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	for _, l := range f.listeners {
+		addr, ok := l.listener.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		if !addr.IP.IsUnspecified() {
+			return addr.String(), nil
+		}
+		ip, err := lanAddress()
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)), nil
+	}
+	return "", errors.New("no TCP listener to advertise, set the proxy address")
+}
+
+// lanAddress returns the first IPv4 address of an interface that is up and
+// not a loopback
+func lanAddress() (net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok && network.IP.To4() != nil {
+				return network.IP.To4(), nil
+			}
+		}
+	}
+	return nil, errors.New("no LAN IPv4 address found")
+}
+
+// pacScript renders a FindProxyForURL function sending everything through
+// proxy except plain host names and the direct destinations
+func pacScript(proxy string, direct []string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host)) return \"DIRECT\";\n")
+	for _, entry := range direct {
+		if networks, err := acl.ParseNetworks([]string{entry}); err == nil {
+			network := networks[0]
+			if network.IP.To4() == nil {
+				continue
+			}
+			fmt.Fprintf(&b, "\tif (isInNet(host, %q, %q)) return \"DIRECT\";\n", network.IP.String(), net.IP(network.Mask).String())
+			continue
+		}
+		domain := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(entry, "*"), "."))
+		fmt.Fprintf(&b, "\tif (host == %q || dnsDomainIs(host, %q)) return \"DIRECT\";\n", domain, "."+domain)
+	}
+	fmt.Fprintf(&b, "\treturn %q;\n}\n", "PROXY "+proxy)
+	return b.String()
+}
+
+// serveWPADDNS answers A queries for wpad and wpad.<domain> with ip until
+// conn is closed, refusing every other name
+func (f *Forwarder) serveWPADDNS(conn net.PacketConn, ip net.IP) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.logger.Printf("WPAD DNS stopped: %v", err)
+			}
+			return
+		}
+		if reply := wpadReply(buf[:n], ip); reply != nil {
+			conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// DNS message constants used by the wpad and mDNS responders
+const (
+	dnsTypeA       = 1
+	dnsTypePTR     = 12
+	dnsTypeTXT     = 16
+	dnsTypeSRV     = 33
+	dnsTypeANY     = 255
+	dnsClassIN     = 1
+	dnsRcodeRefuse = 5
+)
+
+// wpadReply builds the response to a single-question DNS query, or nil when
+// query is malformed or itself a response
+func wpadReply(query []byte, ip net.IP) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return nil
+	}
+
+	// Walk the question name to find its end and first label
+	offset := 12
+	var labels []string
+	for {
+		if offset >= len(query) {
+			return nil
+		}
+		length := int(query[offset])
+		if length == 0 {
+			offset++
+			break
+		}
+		if length&0xc0 != 0 || offset+1+length > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	if offset+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[offset : offset+2])
+	qclass := binary.BigEndian.Uint16(query[offset+2 : offset+4])
+	question := query[12 : offset+4]
+
+	reply := make([]byte, 12, 12+len(question)+16)
+	copy(reply, query[:2])
+	reply[2] = 0x84 | query[2]&0x01 // Response, authoritative, echoing recursion desired
+	binary.BigEndian.PutUint16(reply[4:6], 1)
+	reply = append(reply, question...)
+
+	if len(labels) == 0 || !strings.EqualFold(labels[0], "wpad") || qclass != dnsClassIN {
+		reply[3] = dnsRcodeRefuse
+		return reply
+	}
+	if qtype != dnsTypeA && qtype != dnsTypeANY {
+		return reply // The name exists without records of this type
+	}
+	binary.BigEndian.PutUint16(reply[6:8], 1)
+	reply = append(reply, 0xc0, 12) // Pointer to the question name
+	reply = binary.BigEndian.AppendUint16(reply, dnsTypeA)
+	reply = binary.BigEndian.AppendUint16(reply, dnsClassIN)
+	reply = binary.BigEndian.AppendUint32(reply, wpadTTL)
+	reply = binary.BigEndian.AppendUint16(reply, net.IPv4len)
+	return append(reply, ip...)
+}
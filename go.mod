@@ -1,3 +1,23 @@
 module github.com/n0z0/GateLAN
 
 go 1.25.3
+
+require github.com/andybalholm/brotli v1.2.5
+
+require golang.org/x/sys v0.40.0
+
+require github.com/yuin/gopher-lua v1.1.1
+
+require (
+	github.com/go-ldap/ldap/v3 v3.4.8
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.22.0
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
@@ -44,7 +44,7 @@ echo.
 
 :: Test 4: Build test
 echo [4/4] Testing build...
-go build -o test-build main_v2.go
+go build -o test-build.exe .\cmd\gatelan
 if %ERRORLEVEL% EQU 0 (
     echo ✅ Build successful!
     echo Generated: test-build.exe
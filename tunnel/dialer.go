@@ -0,0 +1,352 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Dialer opens a connection to a target host:port along one route
+type Dialer interface {
+	Dial(ctx context.Context, target string) (net.Conn, error)
+}
+
+// NewDialer returns the route through the upstream proxy at u, an http,
+// https, socks5, socks4 or socks4a URL with optional credentials or an ss URL
+// with the cipher and password, reached with base
+func NewDialer(u *url.URL, base ContextDialer) (Dialer, error) {
+	switch u.Scheme {
+	case "http", "https":
+		p := &HTTPProxy{Addr: u.Host, Dialer: base}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+			p.Header = http.Header{"Proxy-Authorization": {"Basic " + credentials}}
+		}
+		if u.Scheme == "https" {
+			p.TLS = &tls.Config{ServerName: u.Hostname()}
+		}
+		return p, nil
+	case "socks5", "socks5h":
+		p := &SOCKS5{Addr: u.Host, Dialer: base}
+		if u.User != nil {
+			p.Username = u.User.Username()
+			p.Password, _ = u.User.Password()
+		}
+		return p, nil
+	case "socks4", "socks4a":
+		p := &SOCKS4{Addr: u.Host, Dialer: base, Resolve: u.Scheme == "socks4"}
+		if u.User != nil {
+			p.UserID = u.User.Username()
+		}
+		return p, nil
+	case "ss":
+		method, password, err := shadowsocksCredentials(u.User)
+		if err != nil {
+			return nil, err
+		}
+		return NewShadowsocks(u.Host, method, password, base)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// Direct connects to targets itself
+type Direct struct {
+	Dialer ContextDialer
+}
+
+func (d *Direct) Dial(ctx context.Context, target string) (net.Conn, error) {
+	return d.Dialer.DialContext(ctx, "tcp", target)
+}
+
+// HTTPProxy tunnels with CONNECT through an HTTP proxy, or an HTTPS one when
+// TLS is set
+type HTTPProxy struct {
+	Addr   string
+	Header http.Header // Sent with every CONNECT, such as Proxy-Authorization
+	TLS    *tls.Config
+	Dialer ContextDialer
+}
+
+func (p *HTTPProxy) Dial(ctx context.Context, target string) (net.Conn, error) {
+	conn, err := p.Dialer.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if p.TLS != nil {
+		tlsConn := tls.Client(conn, p.TLS)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	header := p.Header
+	auth := ProxyAuthorization(ctx)
+	if auth != "" && header.Get("Proxy-Authorization") != "" {
+		auth = ""
+	}
+	if extra := ExtraHeader(ctx); auth != "" || len(extra) > 0 {
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		for name, values := range extra {
+			header[name] = append(header[name], values...)
+		}
+		if auth != "" {
+			header.Set("Proxy-Authorization", auth)
+		}
+	}
+	return ConnectHeader(ctx, conn, target, header)
+}
+
+// extraHeaderContextKey carries headers to send with the CONNECTs dialed for
+// a tunnel
+type extraHeaderContextKey struct{}
+
+// WithExtraHeader makes HTTP proxies receive header, on top of their own,
+// with the CONNECTs dialed using ctx
+func WithExtraHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, extraHeaderContextKey{}, header)
+}
+
+// ExtraHeader returns the headers carried by ctx, or nil
+func ExtraHeader(ctx context.Context) http.Header {
+	header, _ := ctx.Value(extraHeaderContextKey{}).(http.Header)
+	return header
+}
+
+// proxyAuthContextKey carries the Proxy-Authorization of the client a
+// tunnel is dialed for
+type proxyAuthContextKey struct{}
+
+// WithProxyAuthorization makes HTTP proxies without credentials of their own
+// receive auth with the CONNECTs dialed using ctx
+func WithProxyAuthorization(ctx context.Context, auth string) context.Context {
+	return context.WithValue(ctx, proxyAuthContextKey{}, auth)
+}
+
+// ProxyAuthorization returns the Proxy-Authorization carried by ctx, or ""
+func ProxyAuthorization(ctx context.Context) string {
+	auth, _ := ctx.Value(proxyAuthContextKey{}).(string)
+	return auth
+}
+
+// SOCKS5 tunnels through a SOCKS5 proxy (RFC 1928), authenticating with a
+// username and password (RFC 1929) when Username is set. Host names are
+// resolved by the proxy.
+type SOCKS5 struct {
+	Addr     string
+	Username string
+	Password string
+	Dialer   ContextDialer
+}
+
+// SOCKS5 protocol values
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksPasswordAuth = 2
+	socksNoAcceptable = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+)
+
+func (p *SOCKS5) Dial(ctx context.Context, target string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+
+	conn, err := p.Dialer.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := p.handshake(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 connect to %s failed: %w", target, err)
+	}
+	return conn, nil
+}
+
+// handshake negotiates authentication and requests a connection to host:port
+func (p *SOCKS5) handshake(conn net.Conn, host string, port uint16) error {
+	method := byte(socksNoAuth)
+	if p.Username != "" {
+		method = socksPasswordAuth
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion || reply[1] == socksNoAcceptable || reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if method == socksPasswordAuth {
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return errors.New("credentials too long")
+		}
+		auth := []byte{1, byte(len(p.Username))}
+		auth = append(auth, p.Username...)
+		auth = append(auth, byte(len(p.Password)))
+		auth = append(auth, p.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("authentication rejected")
+		}
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		request = append(request, socksDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, socksIPv4), ip4...)
+	} else {
+		request = append(append(request, socksIPv6), ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, port)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// The reply carries the bound address, whose length depends on its type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("proxy replied with code %d", header[1])
+	}
+	var skip int
+	switch header[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// SOCKS4 tunnels through a SOCKS4 proxy, identifying with UserID. Host names
+// are passed to the proxy with the SOCKS4a extension unless Resolve is set,
+// in which case they are resolved to an IPv4 address locally.
+type SOCKS4 struct {
+	Addr    string
+	UserID  string
+	Resolve bool
+	Dialer  ContextDialer
+}
+
+// SOCKS4 protocol values
+const (
+	socks4Version = 4
+	socks4Granted = 90
+)
+
+func (p *SOCKS4) Dial(ctx context.Context, target string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil && net.ParseIP(host) != nil {
+		return nil, fmt.Errorf("SOCKS4 cannot reach IPv6 address %s", host)
+	}
+	if ip == nil && p.Resolve {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0].To4()
+	}
+
+	conn, err := p.Dialer.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := p.handshake(conn, ip, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS4 connect to %s failed: %w", target, err)
+	}
+	return conn, nil
+}
+
+// handshake requests a connection to ip:port, or to host:port via SOCKS4a
+// when ip is nil
+func (p *SOCKS4) handshake(conn net.Conn, ip net.IP, host string, port uint16) error {
+	request := binary.BigEndian.AppendUint16([]byte{socks4Version, socksConnect}, port)
+	if ip != nil {
+		request = append(request, ip...)
+	} else {
+		// An address of 0.0.0.x announces a host name after the user ID
+		request = append(request, 0, 0, 0, 1)
+	}
+	request = append(append(request, p.UserID...), 0)
+	if ip == nil {
+		request = append(append(request, host...), 0)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socks4Granted {
+		return fmt.Errorf("proxy replied with code %d", reply[1])
+	}
+	return nil
+}
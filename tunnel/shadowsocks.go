@@ -0,0 +1,260 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Shadowsocks tunnels through a Shadowsocks server over TCP with an AEAD
+// cipher (SIP004). Host names are resolved by the server.
+type Shadowsocks struct {
+	Addr   string
+	Dialer ContextDialer
+
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	key     []byte
+}
+
+// shadowsocksMaxPayload is the largest payload of one chunk
+const shadowsocksMaxPayload = 0x3fff
+
+// NewShadowsocks creates the route through the server at addr using method,
+// one of aes-128-gcm, aes-256-gcm or chacha20-ietf-poly1305, and password
+func NewShadowsocks(addr, method, password string, dialer ContextDialer) (*Shadowsocks, error) {
+	p := &Shadowsocks{Addr: addr, Dialer: dialer}
+	var keySize int
+	switch method {
+	case "aes-128-gcm", "aes-256-gcm":
+		keySize = 16
+		if method == "aes-256-gcm" {
+			keySize = 32
+		}
+		p.newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	case "chacha20-ietf-poly1305":
+		keySize = chacha20poly1305.KeySize
+		p.newAEAD = chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("unsupported Shadowsocks cipher %q", method)
+	}
+	p.key = shadowsocksKey(password, keySize)
+	return p, nil
+}
+
+// shadowsocksCredentials returns the cipher and password of an ss URL, given
+// as "method:password" or base64 encoded as in SIP002
+func shadowsocksCredentials(user *url.Userinfo) (string, string, error) {
+	if password, ok := user.Password(); ok {
+		return user.Username(), password, nil
+	}
+	encoded := strings.TrimRight(user.Username(), "=")
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		decoded, err = base64.RawStdEncoding.DecodeString(encoded)
+	}
+	method, password, ok := strings.Cut(string(decoded), ":")
+	if err != nil || !ok {
+		return "", "", errors.New("Shadowsocks upstream needs a method and password")
+	}
+	return method, password, nil
+}
+
+// shadowsocksKey derives the master key from password like OpenSSL's
+// EVP_BytesToKey with MD5, as Shadowsocks does
+func shadowsocksKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-md5.Size:]
+	}
+	return key[:size]
+}
+
+func (p *Shadowsocks) Dial(ctx context.Context, target string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+
+	// The first chunk names the target in SOCKS5 address form
+	var request []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("host name too long")
+		}
+		request = append([]byte{socksDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append([]byte{socksIPv4}, ip4...)
+	} else {
+		request = append([]byte{socksIPv6}, ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	conn, err := p.Dialer.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	ss := &shadowsocksConn{Conn: conn, proxy: p}
+	if _, err := ss.Write(request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Shadowsocks connect to %s failed: %w", target, err)
+	}
+	return ss, nil
+}
+
+// shadowsocksConn encrypts writes into and decrypts reads from chunks, each
+// direction with its own salt, subkey and nonce counter
+type shadowsocksConn struct {
+	net.Conn
+	proxy *Shadowsocks
+
+	writer      cipher.AEAD
+	writeNonce  []byte
+	reader      cipher.AEAD
+	readNonce   []byte
+	readPending []byte // Decrypted bytes not yet returned
+}
+
+// subkey derives the session key for salt (SIP004)
+func (c *shadowsocksConn) subkey(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha1.New, c.proxy.key, salt, "ss-subkey", len(c.proxy.key))
+	if err != nil {
+		return nil, err
+	}
+	return c.proxy.newAEAD(key)
+}
+
+func (c *shadowsocksConn) Write(p []byte) (int, error) {
+	var out []byte
+	if c.writer == nil {
+		salt := make([]byte, len(c.proxy.key))
+		rand.Read(salt)
+		aead, err := c.subkey(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.writer, c.writeNonce = aead, make([]byte, aead.NonceSize())
+		out = salt
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), shadowsocksMaxPayload)
+		out = c.seal(out, binary.BigEndian.AppendUint16(nil, uint16(n)))
+		out = c.seal(out, p[:n])
+		if _, err := c.Conn.Write(out); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		out = out[:0]
+	}
+	return written, nil
+}
+
+// seal appends plaintext encrypted with the next write nonce to dst
+func (c *shadowsocksConn) seal(dst, plaintext []byte) []byte {
+	dst = c.writer.Seal(dst, c.writeNonce, plaintext, nil)
+	increment(c.writeNonce)
+	return dst
+}
+
+func (c *shadowsocksConn) Read(p []byte) (int, error) {
+	for len(c.readPending) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.readPending)
+	c.readPending = c.readPending[n:]
+	return n, nil
+}
+
+// readChunk reads and decrypts the next chunk, after the server's salt first
+func (c *shadowsocksConn) readChunk() error {
+	if c.reader == nil {
+		salt := make([]byte, len(c.proxy.key))
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := c.subkey(salt)
+		if err != nil {
+			return err
+		}
+		c.reader, c.readNonce = aead, make([]byte, aead.NonceSize())
+	}
+
+	overhead := c.reader.Overhead()
+	header, err := c.open(2 + overhead)
+	if err != nil {
+		return err
+	}
+	length := int(binary.BigEndian.Uint16(header)) & shadowsocksMaxPayload
+	if c.readPending, err = c.open(length + overhead); err != nil {
+		return err
+	}
+	return nil
+}
+
+// open reads size encrypted bytes and decrypts them with the next read nonce
+func (c *shadowsocksConn) open(size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.reader.Open(buf[:0], c.readNonce, buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Shadowsocks decryption failed: %w", err)
+	}
+	increment(c.readNonce)
+	return plaintext, nil
+}
+
+// CloseWrite shuts down the sending side of the underlying connection
+func (c *shadowsocksConn) CloseWrite() error {
+	CloseWrite(c.Conn)
+	return nil
+}
+
+// increment adds one to the little-endian counter nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
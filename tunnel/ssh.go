@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH tunnels through direct-tcpip channels of one SSH connection to a jump
+// host, opened on first use and again after it breaks. With KeepAlive set,
+// a connection that stops answering keepalive requests is closed.
+type SSH struct {
+	Addr      string
+	Config    *ssh.ClientConfig
+	KeepAlive time.Duration
+	Dialer    ContextDialer
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func (p *SSH) Dial(ctx context.Context, target string) (net.Conn, error) {
+	client, err := p.connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SSH connection to %s failed: %w", p.Addr, err)
+	}
+	conn, err := client.DialContext(ctx, "tcp", target)
+	if err != nil {
+		// Anything but the jump host refusing the channel means the
+		// connection itself is broken
+		var refused *ssh.OpenChannelError
+		if !errors.As(err, &refused) && ctx.Err() == nil {
+			p.drop(client)
+		}
+		return nil, fmt.Errorf("SSH connect to %s failed: %w", target, err)
+	}
+	return conn, nil
+}
+
+// connect returns the open connection to the jump host, establishing it if needed
+func (p *SSH) connect(ctx context.Context) (*ssh.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	conn, err := p.Dialer.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, p.Addr, p.Config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	p.client = client
+	go func() {
+		client.Wait()
+		p.drop(client)
+	}()
+	if p.KeepAlive > 0 {
+		go p.keepAlive(client)
+	}
+	return client, nil
+}
+
+// keepAlive sends keepalive requests until client closes, closing it when
+// one goes unanswered for an interval
+func (p *SSH) keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(p.KeepAlive)
+	defer ticker.Stop()
+	for range ticker.C {
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+		select {
+		case err := <-answered:
+			if err != nil {
+				client.Close()
+				return
+			}
+		case <-time.After(p.KeepAlive):
+			client.Close()
+			return
+		}
+	}
+}
+
+// drop closes client and forgets it if it is still the open connection
+func (p *SSH) drop(client *ssh.Client) {
+	p.mu.Lock()
+	if p.client == client {
+		p.client = nil
+	}
+	p.mu.Unlock()
+	client.Close()
+}
@@ -0,0 +1,205 @@
+// Package tunnel dials CONNECT tunnels through HTTP proxies and relays their bytes
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ContextDialer opens network connections, as *net.Dialer does
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// ChainDialer reaches an upstream proxy by nesting CONNECTs through an ordered list of hops
+type ChainDialer struct {
+	Hops   []string
+	Dialer ContextDialer
+}
+
+// DialContext dials the first hop and tunnels through the others to addr
+func (d *ChainDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(d.Hops) == 0 {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+
+	conn, err := d.Dialer.DialContext(ctx, network, d.Hops[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial chain hop %s: %w", d.Hops[0], err)
+	}
+
+	targets := append(append([]string{}, d.Hops[1:]...), addr)
+	for _, target := range targets {
+		if conn, err = Connect(ctx, conn, target); err != nil {
+			return nil, fmt.Errorf("failed to tunnel to chain hop %s: %w", target, err)
+		}
+	}
+	return conn, nil
+}
+
+// ConnectError reports a CONNECT the proxy answered without success
+type ConnectError struct {
+	Target     string
+	StatusCode int
+	Status     string
+	Header     http.Header // Of the proxy's response, such as Proxy-Authenticate challenges
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("CONNECT %s rejected: %s", e.Target, e.Status)
+}
+
+// Connect issues a CONNECT for target over conn and returns the tunnel.
+// conn is closed on failure.
+func Connect(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+	return ConnectHeader(ctx, conn, target, nil)
+}
+
+// ConnectHeader is Connect sending the given extra request headers
+func ConnectHeader(ctx context.Context, conn net.Conn, target string, header http.Header) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		conn.Close()
+		return nil, &ConnectError{Target: target, StatusCode: resp.StatusCode, Status: resp.Status, Header: resp.Header}
+	}
+
+	// Bytes read past the response header already belong to the tunnel
+	if br.Buffered() > 0 {
+		return &BufferedConn{Conn: conn, Reader: br}, nil
+	}
+	return conn, nil
+}
+
+// BufferedConn drains a bufio.Reader before reading from the connection
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// WriteTo drains the buffer, then copies straight from the connection so the
+// copy can take the kernel's fast path
+func (c *BufferedConn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	if buffered := c.Reader.Buffered(); buffered > 0 {
+		p, _ := c.Reader.Peek(buffered)
+		written, err := w.Write(p)
+		c.Reader.Discard(written)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	copied, err := io.Copy(w, c.Conn)
+	return n + copied, err
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *BufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// copyChunk bounds the bytes CopyCounted copies between progress reports
+const copyChunk = 1 << 20
+
+// CopyCounted copies src to dst as io.Copy does, keeping its fast paths such
+// as splice(2) between sockets on Linux, and reports the bytes copied to count
+// at least every copyChunk bytes. Connection wrappers that count traffic use
+// it to implement io.ReaderFrom and io.WriterTo.
+func CopyCounted(dst io.Writer, src io.Reader, count func(int64)) (int64, error) {
+	var total int64
+	for {
+		n, err := io.Copy(dst, &io.LimitedReader{R: src, N: copyChunk})
+		total += n
+		count(n)
+		if err != nil || n < copyChunk {
+			return total, err
+		}
+	}
+}
+
+// relayBuffers holds copy buffers for directions that cannot be relayed in
+// the kernel
+var relayBuffers sync.Pool
+
+// Relay copies bytes both ways between a and b until each side is done,
+// half-closing the destination of a finished direction, then closes both.
+// Directions between plain sockets are copied in the kernel where the
+// platform allows, others through a pooled buffer of bufferSize bytes. It
+// returns the first copy error other than a closed connection.
+func Relay(a, b net.Conn, bufferSize int) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	relay := func(dst, src net.Conn) {
+		defer wg.Done()
+		buf, ok := relayBuffers.Get().(*[]byte)
+		if !ok || len(*buf) != bufferSize {
+			fresh := make([]byte, bufferSize)
+			buf = &fresh
+		}
+		defer relayBuffers.Put(buf)
+		if _, err := io.CopyBuffer(dst, src, *buf); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs <- err
+		}
+		CloseWrite(dst)
+	}
+
+	wg.Add(2)
+	go relay(b, a)
+	go relay(a, b)
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+
+	close(errs)
+	return <-errs
+}
+
+// CloseWrite half-closes conn when supported so the peer sees EOF
+func CloseWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}